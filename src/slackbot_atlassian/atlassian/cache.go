@@ -0,0 +1,72 @@
+package atlassian
+
+import (
+	"sync"
+	"time"
+)
+
+// An Atlassian client that remembers the issues it has looked up for a while,
+// for when the same issues are asked about again and again (e.g. unfurling
+// links in Slack)
+type cached struct {
+	Atlassian
+	expiry time.Duration
+	now    func() time.Time
+
+	mu     sync.Mutex
+	issues map[string]cached_issue
+}
+
+type cached_issue struct {
+	issue   *Issue
+	fetched time.Time
+}
+
+// Wrap a client so issues are cached for the expiry time
+func NewCached(atl Atlassian, expiry time.Duration) Atlassian {
+	return &cached{
+		Atlassian: atl,
+		expiry:    expiry,
+		now:       time.Now,
+		issues:    make(map[string]cached_issue),
+	}
+}
+
+func (c *cached) GetIssue(id string) (*Issue, error) {
+	now := c.now()
+
+	c.mu.Lock()
+	ci, ok := c.issues[id]
+	c.mu.Unlock()
+	if ok && now.Sub(ci.fetched) < c.expiry {
+		return ci.issue, nil
+	}
+
+	issue, err := c.Atlassian.GetIssue(id)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Drop anything that has expired, so the cache doesn't grow forever
+	for k, v := range c.issues {
+		if now.Sub(v.fetched) >= c.expiry {
+			delete(c.issues, k)
+		}
+	}
+	c.issues[id] = cached_issue{issue, now}
+	return issue, nil
+}
+
+// Drop an issue from a cached client, e.g. after changing it. Does nothing
+// for other clients.
+func Forget(atl Atlassian, id string) {
+	c, ok := atl.(*cached)
+	if !ok {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.issues, id)
+}
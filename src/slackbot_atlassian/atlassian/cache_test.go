@@ -0,0 +1,53 @@
+package atlassian
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+type counting_atlassian struct {
+	Atlassian
+	lookups map[string]int
+}
+
+func (a *counting_atlassian) GetIssue(id string) (*Issue, error) {
+	a.lookups[id]++
+	if id == "LRN-404" {
+		return nil, fmt.Errorf("Bad status code looking up issue %s: 404", id)
+	}
+	return &Issue{Id: id}, nil
+}
+
+func TestCachedGetIssue(t *testing.T) {
+	atl := &counting_atlassian{lookups: make(map[string]int)}
+	now := time.Date(2016, 5, 10, 9, 0, 0, 0, time.UTC)
+	c := NewCached(atl, time.Minute).(*cached)
+	c.now = func() time.Time { return now }
+
+	get := func(id string) {
+		if _, err := c.GetIssue(id); err != nil && id != "LRN-404" {
+			t.Fatal(err)
+		}
+	}
+
+	get("LRN-1")
+	get("LRN-1")
+	get("LRN-2")
+	get("LRN-404")
+	get("LRN-404")
+	now = now.Add(59 * time.Second)
+	get("LRN-1")
+	now = now.Add(time.Second)
+	get("LRN-1")
+
+	expected := map[string]int{"LRN-1": 2, "LRN-2": 1, "LRN-404": 2}
+	for id, n := range expected {
+		if atl.lookups[id] != n {
+			t.Errorf("Expected %d lookups of %s, got %d", n, id, atl.lookups[id])
+		}
+	}
+	if _, ok := c.issues["LRN-2"]; ok {
+		t.Errorf("Expected expired issues to be dropped")
+	}
+}
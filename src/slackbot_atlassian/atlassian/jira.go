@@ -8,6 +8,9 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -84,12 +87,44 @@ type ActivityItem struct {
 	Updated        time.Time               `xml:"updated"json:"updated"`
 	Author         Person                  `xml:"author"json:"author"`
 	Summary        Text                    `xml:"summary"json:"summary"`
+	Content        Text                    `xml:"content" json:"content"`
 	Category       Category                `xml:"category"json:"category"`
 	ActivityTarget *ActivityTargetOrObject `xml:"target"`
 	ActivityObject *ActivityTargetOrObject `xml:"object"`
 }
 
-func (ai ActivityItem) user_image_url() (string, bool) {
+// The HTML body of the activity (e.g. a comment), if it has one
+func (ai ActivityItem) Body() string {
+	if ai.Content.Body != "" {
+		return ai.Content.Body
+	}
+	return ai.Summary.Body
+}
+
+var focused_comment_re = regexp.MustCompile(`focusedCommentId=(\d+)`)
+
+// The ID of the comment the activity is about, if it's about one
+func (ai ActivityItem) CommentID() (string, bool) {
+	for _, l := range ai.Link {
+		if m := focused_comment_re.FindStringSubmatch(l.Href); m != nil {
+			return m[1], true
+		}
+	}
+	return "", false
+}
+
+// The link to the activity itself, e.g. to a comment
+func (ai ActivityItem) AlternateLink() string {
+	for _, l := range ai.Link {
+		if l.Rel == "alternate" {
+			return l.Href
+		}
+	}
+	return ""
+}
+
+// The URL of the author's photo in Jira
+func (ai ActivityItem) UserImageURL() (string, bool) {
 	for _, l := range ai.Author.Link {
 		if l.Rel == "photo" {
 			return l.Href, true
@@ -123,6 +158,91 @@ type Issue struct {
 	Fields map[string]interface{}
 }
 
+// A Jira user, as found in issue fields like the assignee
+type User struct {
+	Name         string `json:"name"`
+	Key          string `json:"key"`
+	EmailAddress string `json:"emailAddress"`
+	DisplayName  string `json:"displayName"`
+}
+
+// Get the user in a user field of the issue (e.g. "assignee")
+func (i Issue) User(field string) (User, bool) {
+	m, ok := i.Fields[field].(map[string]interface{})
+	if !ok {
+		return User{}, false
+	}
+
+	var u User
+	u.Name, _ = m["name"].(string)
+	u.Key, _ = m["key"].(string)
+	u.EmailAddress, _ = m["emailAddress"].(string)
+	u.DisplayName, _ = m["displayName"].(string)
+	return u, u.Name != ""
+}
+
+// A comment on an issue. The body is in wiki markup.
+type Comment struct {
+	Id      string `json:"id"`
+	Author  User   `json:"author"`
+	Body    string `json:"body"`
+	Created string `json:"created"`
+}
+
+// A file attached to an issue
+type Attachment struct {
+	Id        string `json:"id"`
+	Filename  string `json:"filename"`
+	Author    User   `json:"author"`
+	Created   string `json:"created"`
+	Size      int64  `json:"size"`
+	MimeType  string `json:"mimeType"`
+	Content   string `json:"content"`
+	Thumbnail string `json:"thumbnail"`
+}
+
+// The comments included in the issue's fields (the most recent ones, if the
+// issue has a lot)
+func (i Issue) Comments() []Comment {
+	var comments struct {
+		Comments []Comment `json:"comments"`
+	}
+	if err := i.decode_field("comment", &comments); err != nil {
+		log.LogF("Could not read comments of %s: %s", i.Id, err)
+	}
+	return comments.Comments
+}
+
+func (i Issue) Attachments() []Attachment {
+	var attachments []Attachment
+	if err := i.decode_field("attachment", &attachments); err != nil {
+		log.LogF("Could not read attachments of %s: %s", i.Id, err)
+	}
+	return attachments
+}
+
+// Decode a structured field into a struct
+func (i Issue) decode_field(field string, into interface{}) error {
+	v, ok := i.Fields[field]
+	if !ok || v == nil {
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, into)
+}
+
+// The activity author as a Jira user
+func (p Person) User() User {
+	return User{
+		Name:         p.Username,
+		EmailAddress: p.Email,
+		DisplayName:  p.Name,
+	}
+}
+
 type ActivityIssue struct {
 	Activity *ActivityItem
 	Issue    *Issue
@@ -131,6 +251,17 @@ type ActivityIssue struct {
 type Atlassian interface {
 	GetNewJiraActivities(last_id_seen string) ([]*ActivityItem, error)
 	GetIssue(id string) (*Issue, error)
+	GetWatchers(issue_id string) ([]User, error)
+	Search(jql string, max int) ([]*Issue, error)
+	FindUserByEmail(email string) (User, bool, error)
+	GetUser(username string) (User, bool, error)
+
+	// Acting on issues, as the bot's Jira user
+	Assign(issue_id, username string) error
+	GetTransitions(issue_id string) ([]Transition, error)
+	Transition(issue_id, transition_id string) error
+	AddComment(issue_id, body string) error
+	CreateIssue(NewIssue) (string, error)
 
 	UserImage(ActivityItem) (io.Reader, bool, error)
 }
@@ -148,11 +279,9 @@ const (
 )
 
 func (a *atlassian) GetNewJiraActivities(last_id_seen string) ([]*ActivityItem, error) {
-	urlTemplate := "https://%s:%s@%s/activity?maxResults=%d&providers=%s"
-
-	url := fmt.Sprintf(urlTemplate,
-		a.cfg.Auth.Username, a.cfg.Auth.Password, a.cfg.Host, a.cfg.MaxActivityLookup, atlassian_provider)
-	resp, err := http.Get(url)
+	url := fmt.Sprintf("%s/activity?maxResults=%d&providers=%s",
+		a.cfg.BaseURL(), a.cfg.MaxActivityLookup, atlassian_provider)
+	resp, err := a.get(url)
 	if err != nil {
 		return nil, err
 	}
@@ -172,6 +301,64 @@ func (a *atlassian) GetNewJiraActivities(last_id_seen string) ([]*ActivityItem,
 	return reverseActivities(entries), nil
 }
 
+// Make an authenticated GET request to Jira
+func (a *atlassian) get(url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(a.cfg.Auth.Username, a.cfg.Auth.Password)
+	return http.DefaultClient.Do(req)
+}
+
+// Send some JSON to Jira, checking that it succeeded, and decode the response
+// into result if it isn't nil
+func (a *atlassian) send(method, url string, body, result interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(a.cfg.Auth.Username, a.cfg.Auth.Password)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		if msg := error_messages(resp.Body); msg != "" {
+			return fmt.Errorf("Jira refused %s %s: %s", method, req.URL.Path, msg)
+		}
+		return fmt.Errorf("Bad status code for %s %s: %d", method, req.URL.Path, resp.StatusCode)
+	}
+	if result != nil {
+		return decodeJson(resp.Body, result)
+	}
+	return nil
+}
+
+// The explanation in a Jira error response, if there is one
+func error_messages(r io.Reader) string {
+	var errors struct {
+		ErrorMessages []string          `json:"errorMessages"`
+		Errors        map[string]string `json:"errors"`
+	}
+	if decodeJson(r, &errors) != nil {
+		return ""
+	}
+	messages := errors.ErrorMessages
+	for field, msg := range errors.Errors {
+		messages = append(messages, field+": "+msg)
+	}
+	return strings.Join(messages, " ")
+}
+
 func reverseActivities(a []*ActivityItem) []*ActivityItem {
 	//https://github.com/golang/go/wiki/SliceTricks#reversing
 	for left, right := 0, len(a)-1; left < right; left, right = left+1, right-1 {
@@ -193,11 +380,9 @@ func filterActivities(a []*ActivityItem, last_id_seen string) []*ActivityItem {
 }
 
 func (a *atlassian) GetIssue(issue_id string) (*Issue, error) {
-	url := fmt.Sprintf(
-		"https://%s:%s@%s/rest/api/latest/issue/%s",
-		a.cfg.Auth.Username, a.cfg.Auth.Password, a.cfg.Host, issue_id)
+	url := fmt.Sprintf("%s/rest/api/latest/issue/%s", a.cfg.BaseURL(), issue_id)
 
-	resp, err := http.Get(url)
+	resp, err := a.get(url)
 	if err != nil {
 		return nil, err
 	}
@@ -211,17 +396,183 @@ func (a *atlassian) GetIssue(issue_id string) (*Issue, error) {
 	return &issue, decodeJson(resp.Body, &issue)
 }
 
+func (a *atlassian) GetWatchers(issue_id string) ([]User, error) {
+	url := fmt.Sprintf("%s/rest/api/latest/issue/%s/watchers", a.cfg.BaseURL(), issue_id)
+
+	resp, err := a.get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Bad status code looking up watchers of %s: %d", issue_id, resp.StatusCode)
+	}
+
+	var watchers struct {
+		Watchers []User `json:"watchers"`
+	}
+	return watchers.Watchers, decodeJson(resp.Body, &watchers)
+}
+
+// Find issues with a JQL query, returning up to max of them
+func (a *atlassian) Search(jql string, max int) ([]*Issue, error) {
+	q := url.Values{}
+	q.Set("jql", jql)
+	q.Set("maxResults", strconv.Itoa(max))
+	q.Set("fields", "summary,status,assignee,priority,issuetype")
+
+	resp, err := a.get(fmt.Sprintf("%s/rest/api/latest/search?%s", a.cfg.BaseURL(), q.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		// Jira explains what is wrong with the query
+		if msg := error_messages(resp.Body); msg != "" {
+			return nil, fmt.Errorf("Bad search %q: %s", jql, msg)
+		}
+		return nil, fmt.Errorf("Bad status code searching for %q: %d", jql, resp.StatusCode)
+	}
+
+	var results struct {
+		Issues []*Issue `json:"issues"`
+	}
+	return results.Issues, decodeJson(resp.Body, &results)
+}
+
+func (a *atlassian) FindUserByEmail(email string) (User, bool, error) {
+	q := url.Values{"username": {email}}
+	resp, err := a.get(fmt.Sprintf("%s/rest/api/latest/user/search?%s", a.cfg.BaseURL(), q.Encode()))
+	if err != nil {
+		return User{}, false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return User{}, false, fmt.Errorf("Bad status code looking up user %s: %d", email, resp.StatusCode)
+	}
+
+	var users []User
+	if err := decodeJson(resp.Body, &users); err != nil {
+		return User{}, false, err
+	}
+	// The search matches prefixes of names too, so check it's really them
+	for _, u := range users {
+		if strings.EqualFold(u.EmailAddress, email) {
+			return u, true, nil
+		}
+	}
+	return User{}, false, nil
+}
+
+// Look up a user by name, e.g. to find the email address of someone
+// mentioned in a comment
+func (a *atlassian) GetUser(username string) (User, bool, error) {
+	q := url.Values{"username": {username}}
+	resp, err := a.get(fmt.Sprintf("%s/rest/api/latest/user?%s", a.cfg.BaseURL(), q.Encode()))
+	if err != nil {
+		return User{}, false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return User{}, false, nil
+	}
+	if resp.StatusCode != 200 {
+		return User{}, false, fmt.Errorf("Bad status code looking up user %s: %d", username, resp.StatusCode)
+	}
+
+	var user User
+	return user, true, decodeJson(resp.Body, &user)
+}
+
+func (a *atlassian) Assign(issue_id, username string) error {
+	url := fmt.Sprintf("%s/rest/api/latest/issue/%s/assignee", a.cfg.BaseURL(), issue_id)
+	return a.send("PUT", url, map[string]string{"name": username}, nil)
+}
+
+// A change of status that can be made to an issue
+type Transition struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	To   struct {
+		Name string `json:"name"`
+	} `json:"to"`
+}
+
+// The transitions that can be made to an issue in its current status
+func (a *atlassian) GetTransitions(issue_id string) ([]Transition, error) {
+	resp, err := a.get(fmt.Sprintf("%s/rest/api/latest/issue/%s/transitions", a.cfg.BaseURL(), issue_id))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Bad status code looking up transitions of %s: %d", issue_id, resp.StatusCode)
+	}
+
+	var transitions struct {
+		Transitions []Transition `json:"transitions"`
+	}
+	return transitions.Transitions, decodeJson(resp.Body, &transitions)
+}
+
+func (a *atlassian) Transition(issue_id, transition_id string) error {
+	url := fmt.Sprintf("%s/rest/api/latest/issue/%s/transitions", a.cfg.BaseURL(), issue_id)
+	return a.send("POST", url, map[string]interface{}{
+		"transition": map[string]string{"id": transition_id},
+	}, nil)
+}
+
+// Add a comment (in wiki markup) to an issue
+func (a *atlassian) AddComment(issue_id, body string) error {
+	url := fmt.Sprintf("%s/rest/api/latest/issue/%s/comment", a.cfg.BaseURL(), issue_id)
+	return a.send("POST", url, map[string]string{"body": body}, nil)
+}
+
+// The fields of an issue to create. The description is in wiki markup, and
+// the priority is optional.
+type NewIssue struct {
+	Project     string
+	IssueType   string
+	Priority    string
+	Summary     string
+	Description string
+}
+
+// Create an issue, returning its key
+func (a *atlassian) CreateIssue(issue NewIssue) (string, error) {
+	fields := map[string]interface{}{
+		"project":     map[string]string{"key": issue.Project},
+		"issuetype":   map[string]string{"name": issue.IssueType},
+		"summary":     issue.Summary,
+		"description": issue.Description,
+	}
+	if issue.Priority != "" {
+		fields["priority"] = map[string]string{"name": issue.Priority}
+	}
+
+	var created struct {
+		Key string `json:"key"`
+	}
+	url := fmt.Sprintf("%s/rest/api/2/issue", a.cfg.BaseURL())
+	if err := a.send("POST", url, map[string]interface{}{"fields": fields}, &created); err != nil {
+		return "", err
+	}
+	return created.Key, nil
+}
+
 func (a *atlassian) UserImage(ai ActivityItem) (io.Reader, bool, error) {
 	log.LogF("Retrieving image for user %s", ai.Author.Username)
-	url, ok := ai.user_image_url()
+	url, ok := ai.UserImageURL()
 	if !ok {
 		return nil, false, nil
 	}
 
-	// Splice our basic auth into the URL
-	url = strings.Replace(url, "https://", fmt.Sprintf("https://%s:%s@", a.cfg.Auth.Username, a.cfg.Auth.Password), 1)
-
-	resp, err := http.Get(url)
+	resp, err := a.get(url)
 	if err != nil {
 		return nil, false, err
 	}
@@ -0,0 +1,126 @@
+// Package avatar turns user images into the square PNGs Slack shows as
+// message icons, or makes them from people's initials.
+package avatar
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"math"
+	"net/http"
+)
+
+// The width and height of avatars, the largest Slack shows icons at
+const Size = 192
+
+// The type of the avatars made here
+const ContentType = "image/png"
+
+// The most pixels an image may have, so huge ones aren't decoded
+const max_pixels = 4096 * 4096
+
+// Decode a PNG, JPEG or GIF image, and scale its middle square to an avatar
+func Normalize(data []byte) ([]byte, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("Unsupported image type %s", http.DetectContentType(data))
+	}
+	if cfg.Width*cfg.Height > max_pixels {
+		return nil, fmt.Errorf("Image is too large (%dx%d)", cfg.Width, cfg.Height)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if b := img.Bounds(); b.Empty() {
+		return nil, fmt.Errorf("Image is empty")
+	}
+	return encode(square(img, Size))
+}
+
+func encode(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Scale the middle square of an image to size by size, averaging the pixels
+// each new one covers when shrinking, and blending the nearest ones when
+// growing
+func square(src image.Image, size int) *image.RGBA {
+	b := src.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	origin := image.Pt(b.Min.X+(b.Dx()-side)/2, b.Min.Y+(b.Dy()-side)/2)
+
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			var c color.RGBA64
+			if side >= size {
+				c = average(src, origin, x*side/size, (x+1)*side/size, y*side/size, (y+1)*side/size)
+			} else {
+				c = blend(src, origin, side, float64(x)*float64(side)/float64(size), float64(y)*float64(side)/float64(size), float64(side)/float64(size))
+			}
+			dst.Set(x, y, c)
+		}
+	}
+	return dst
+}
+
+// The average of the pixels from x0 to x1 and y0 to y1 (exclusive)
+func average(src image.Image, origin image.Point, x0, x1, y0, y1 int) color.RGBA64 {
+	var r, g, b, a, n uint64
+	for y := y0; y < y1; y++ {
+		for x := x0; x < x1; x++ {
+			pr, pg, pb, pa := src.At(origin.X+x, origin.Y+y).RGBA()
+			r, g, b, a, n = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa), n+1
+		}
+	}
+	return color.RGBA64{uint16(r / n), uint16(g / n), uint16(b / n), uint16(a / n)}
+}
+
+// Bilinear interpolation of the pixels around the middle of a new pixel at x,
+// y of the given width, in a square of side pixels
+func blend(src image.Image, origin image.Point, side int, x, y, width float64) color.RGBA64 {
+	clamp := func(v float64) float64 {
+		return math.Max(0, math.Min(float64(side-1), v))
+	}
+	fx, fy := clamp(x+width/2-0.5), clamp(y+width/2-0.5)
+	x0, y0 := int(fx), int(fy)
+	x1, y1 := x0+1, y0+1
+	if x1 >= side {
+		x1 = x0
+	}
+	if y1 >= side {
+		y1 = y0
+	}
+	wx, wy := fx-float64(x0), fy-float64(y0)
+
+	var sum [4]float64
+	for _, p := range []struct {
+		x, y int
+		w    float64
+	}{
+		{x0, y0, (1 - wx) * (1 - wy)},
+		{x1, y0, wx * (1 - wy)},
+		{x0, y1, (1 - wx) * wy},
+		{x1, y1, wx * wy},
+	} {
+		r, g, b, a := src.At(origin.X+p.x, origin.Y+p.y).RGBA()
+		sum[0] += float64(r) * p.w
+		sum[1] += float64(g) * p.w
+		sum[2] += float64(b) * p.w
+		sum[3] += float64(a) * p.w
+	}
+	return color.RGBA64{uint16(sum[0] + 0.5), uint16(sum[1] + 0.5), uint16(sum[2] + 0.5), uint16(sum[3] + 0.5)}
+}
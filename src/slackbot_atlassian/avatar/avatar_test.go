@@ -0,0 +1,145 @@
+package avatar
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+var (
+	red   = color.RGBA{0xff, 0, 0, 0xff}
+	green = color.RGBA{0, 0xff, 0, 0xff}
+	blue  = color.RGBA{0, 0, 0xff, 0xff}
+)
+
+// A wide image, with red and blue halves in its middle square and green
+// either side of it
+func test_image() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	draw.Draw(img, img.Bounds(), &image.Uniform{green}, image.ZP, draw.Src)
+	draw.Draw(img, image.Rect(100, 0, 200, 200), &image.Uniform{red}, image.ZP, draw.Src)
+	draw.Draw(img, image.Rect(200, 0, 300, 200), &image.Uniform{blue}, image.ZP, draw.Src)
+	return img
+}
+
+func decode(t *testing.T, data []byte) image.Image {
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "png" {
+		t.Errorf("Expected a PNG, got %s", format)
+	}
+	if b := img.Bounds(); b.Dx() != Size || b.Dy() != Size {
+		t.Errorf("Expected a %dx%d image, got %v", Size, Size, b)
+	}
+	return img
+}
+
+// Whether two colours are within a little of each other, as JPEG is lossy
+func near(a, b color.Color) bool {
+	ar, ag, ab, _ := a.RGBA()
+	br, bg, bb, _ := b.RGBA()
+	close := func(x, y uint32) bool {
+		return x-y < 0x2000 || y-x < 0x2000
+	}
+	return close(ar, br) && close(ag, bg) && close(ab, bb)
+}
+
+func TestNormalize(t *testing.T) {
+	var png_data, jpeg_data bytes.Buffer
+	if err := png.Encode(&png_data, test_image()); err != nil {
+		t.Fatal(err)
+	}
+	if err := jpeg.Encode(&jpeg_data, test_image(), &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, data := range map[string][]byte{"png": png_data.Bytes(), "jpeg": jpeg_data.Bytes()} {
+		avatar, err := Normalize(data)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		img := decode(t, avatar)
+		for _, p := range []struct {
+			x, y     int
+			expected color.Color
+		}{
+			{4, 4, red},
+			{80, 180, red},
+			{110, 10, blue},
+			{187, 187, blue},
+		} {
+			if c := img.At(p.x, p.y); !near(c, p.expected) {
+				t.Errorf("%s: expected %v at %d,%d, got %v", name, p.expected, p.x, p.y, c)
+			}
+		}
+	}
+}
+
+func TestNormalizeSmall(t *testing.T) {
+	small := image.NewPaletted(image.Rect(0, 0, 16, 16), color.Palette{red, blue})
+	draw.Draw(small, image.Rect(8, 0, 16, 16), &image.Uniform{blue}, image.ZP, draw.Src)
+	var data bytes.Buffer
+	if err := gif.Encode(&data, small, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	avatar, err := Normalize(data.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := decode(t, avatar)
+	if !near(img.At(0, 0), red) || !near(img.At(Size-1, Size-1), blue) {
+		t.Errorf("Expected the image to be scaled up, got %v and %v in the corners", img.At(0, 0), img.At(Size-1, Size-1))
+	}
+}
+
+func TestNormalizeUnsupported(t *testing.T) {
+	for _, data := range []string{`<svg xmlns="http://www.w3.org/2000/svg"/>`, "", "\x89PNG\r\n\x1a\n"} {
+		if _, err := Normalize([]byte(data)); err == nil {
+			t.Errorf("%q: expected an error", data)
+		}
+	}
+}
+
+func TestInitials(t *testing.T) {
+	for name, expected := range map[string]string{
+		"Jane Doe":               "JD",
+		"Mary-Jane van der Berg": "MB",
+		"jane":                   "J",
+		"Ōsaka 2nd":              "S2",
+		"":                       "?",
+		"...":                    "?",
+	} {
+		if got := string(initials(name)); got != expected {
+			t.Errorf("%q: expected %s, got %s", name, expected, got)
+		}
+	}
+
+	jane, err := Initials("Jane Doe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := Initials("Jane Doe")
+	if !bytes.Equal(jane, again) {
+		t.Errorf("Expected the same avatar for the same name")
+	}
+	img := decode(t, jane)
+	var white int
+	for y := 0; y < Size; y++ {
+		for x := 0; x < Size; x++ {
+			if near(img.At(x, y), color.White) {
+				white++
+			}
+		}
+	}
+	if white == 0 || white > Size*Size/4 {
+		t.Errorf("Expected the initials to be drawn, got %d white pixels", white)
+	}
+}
@@ -0,0 +1,383 @@
+package bot
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"slackbot_atlassian/atlassian"
+	"slackbot_atlassian/config"
+	"slackbot_atlassian/log"
+	"slackbot_atlassian/message"
+	"slackbot_atlassian/slack"
+	"slackbot_atlassian/state"
+)
+
+const usage = "I understand:\n" +
+	"• `watch LRN-123` / `unwatch LRN-123`: get (or stop getting) direct messages about an issue\n" +
+	"• `watching`: list the issues you're watching\n" +
+	"• `dm off` / `dm on`: stop (or start again) getting direct messages from triggers\n" +
+	"• `mute #channel 2h` / `unmute #channel`: stop (or start again) posting to a channel, this one if you leave it out\n" +
+	"• `subscribe project=LRN priority=Blocker [for 72h]`: post activity on matching issues to this channel\n" +
+	"• `subscriptions` / `unsubscribe 1`: list this channel's subscriptions, or remove one of yours"
+
+// Answers commands people give by mentioning the bot or sending it a direct
+// message, which adjust what is posted where without editing the config
+type Bot struct {
+	state        state.State
+	atl          atlassian.Atlassian
+	slack_client slack.Slack
+	now          func() time.Time
+}
+
+func New(state_client state.State, atl atlassian.Atlassian, slack_client slack.Slack) *Bot {
+	return &Bot{state_client, atl, slack_client, time.Now}
+}
+
+// Answer a message to the bot in its thread (or directly, for direct
+// messages)
+func (b *Bot) Answer(channel, user, text, thread string) {
+	if is_direct(channel) {
+		thread = ""
+	}
+	m := message.Message{
+		SlackChannel:    channel,
+		Text:            b.Reply(channel, user, text),
+		Format:          config.FormatText,
+		ThreadTimestamp: thread,
+	}
+	if _, _, err := b.slack_client.PostMessage(m); err != nil {
+		log.LogF("Could not answer %s in %s: %s", user, channel, err)
+	}
+}
+
+// Direct message channel IDs start with a D
+func is_direct(channel string) bool {
+	return strings.HasPrefix(channel, "D")
+}
+
+// Messages start with a mention of the bot, unless they are direct messages
+var bot_mention_re = regexp.MustCompile(`^\s*<@[A-Z0-9]+(?:\|[^>]*)?>:?`)
+
+// Carry out a command from a user in a channel, returning what to say back
+func (b *Bot) Reply(channel, user, text string) string {
+	fields := strings.Fields(bot_mention_re.ReplaceAllString(text, ""))
+	if len(fields) == 0 {
+		return usage
+	}
+	log.LogF("%s asked %q in %s", user, strings.Join(fields, " "), channel)
+
+	command, args := strings.ToLower(fields[0]), fields[1:]
+	switch command {
+	case "help":
+		return usage
+	case "watch", "unwatch":
+		return b.watch(user, args, command == "watch")
+	case "watching":
+		return b.watching(user)
+	case "dm":
+		return b.direct_messages(user, args)
+	case "mute":
+		return b.mute(channel, args)
+	case "unmute":
+		return b.unmute(channel, args)
+	case "subscribe":
+		return b.subscribe(channel, user, args)
+	case "subscriptions":
+		return b.subscriptions(channel)
+	case "unsubscribe":
+		return b.unsubscribe(channel, user, args)
+	default:
+		return fmt.Sprintf("Sorry, I don't know how to %q. %s", command, usage)
+	}
+}
+
+var issue_key_re = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*-[0-9]+$`)
+
+func (b *Bot) watch(user string, args []string, watch bool) string {
+	if len(args) != 1 || !issue_key_re.MatchString(args[0]) {
+		return "Which issue? Say e.g. `watch LRN-123`."
+	}
+	key := strings.ToUpper(args[0])
+
+	if !watch {
+		if err := b.state.RemoveWatch(key, user); err != nil {
+			log.LogF("Could not stop %s watching %s: %s", user, key, err)
+			return "Sorry, something went wrong."
+		}
+		return fmt.Sprintf("OK, you've stopped watching %s.", key)
+	}
+
+	if _, err := b.atl.GetIssue(key); err != nil {
+		log.LogF("Could not look up %s to watch: %s", key, err)
+		return fmt.Sprintf("Sorry, I couldn't find %s.", key)
+	}
+	if err := b.state.AddWatch(key, user); err != nil {
+		log.LogF("Could not record %s watching %s: %s", user, key, err)
+		return "Sorry, something went wrong."
+	}
+	return fmt.Sprintf("OK, I'll send you a message when anything happens to %s.", key)
+}
+
+func (b *Bot) watching(user string) string {
+	issues, err := b.state.GetWatchedIssues(user)
+	if err != nil {
+		log.LogF("Could not look up what %s is watching: %s", user, err)
+		return "Sorry, something went wrong."
+	}
+	if len(issues) == 0 {
+		return "You aren't watching any issues."
+	}
+	sort.Strings(issues)
+	return "You're watching " + strings.Join(issues, ", ") + "."
+}
+
+// Opt out of (or back in to) the direct messages sent for triggers with a
+// target. Watching an issue still sends direct messages about it.
+func (b *Bot) direct_messages(user string, args []string) string {
+	if len(args) != 1 || (args[0] != "off" && args[0] != "on") {
+		return "Say `dm off` to stop getting direct messages, or `dm on` to start again."
+	}
+	opt_out := args[0] == "off"
+	if err := b.state.SetDirectMessageOptOut(user, opt_out); err != nil {
+		log.LogF("Could not set %s's direct message opt out: %s", user, err)
+		return "Sorry, something went wrong."
+	}
+	if opt_out {
+		return "OK, I won't send you direct messages, except about issues you're watching."
+	}
+	return "OK, I'll send you direct messages again."
+}
+
+// Slack formats channel links as <#C123|name>
+var channel_re = regexp.MustCompile(`^<#([A-Z0-9]+)(?:\|([^>]*))?>$`)
+
+// The channel a command is about, as its ID and its name if known, and the
+// rest of the arguments. Without a channel it is the one the command was
+// given in.
+func command_channel(channel string, args []string) ([]string, []string) {
+	if len(args) != 0 {
+		if m := channel_re.FindStringSubmatch(args[0]); m != nil {
+			channels := []string{m[1]}
+			if m[2] != "" {
+				channels = append(channels, m[2])
+			}
+			return channels, args[1:]
+		}
+	}
+	return []string{channel}, args
+}
+
+func (b *Bot) mute(channel string, args []string) string {
+	channels, args := command_channel(channel, args)
+	if len(args) != 1 {
+		return "For how long? Say e.g. `mute #channel 2h`."
+	}
+	if is_direct(channels[0]) {
+		return "Which channel? Say e.g. `mute #channel 2h`."
+	}
+	duration, err := time.ParseDuration(args[0])
+	if err != nil || duration <= 0 {
+		return fmt.Sprintf("Sorry, I don't understand %q as a length of time. Try e.g. `30m` or `2h`.", args[0])
+	}
+
+	// Triggers name their channel, but subscriptions use its ID
+	until := b.now().Add(duration)
+	for _, c := range channels {
+		if err := b.state.MuteChannel(c, until); err != nil {
+			log.LogF("Could not mute %s: %s", c, err)
+			return "Sorry, something went wrong."
+		}
+	}
+	return fmt.Sprintf("OK, I won't post to <#%s> for %s.", channels[0], duration)
+}
+
+func (b *Bot) unmute(channel string, args []string) string {
+	channels, _ := command_channel(channel, args)
+	for _, c := range channels {
+		if err := b.state.UnmuteChannel(c); err != nil {
+			log.LogF("Could not unmute %s: %s", c, err)
+			return "Sorry, something went wrong."
+		}
+	}
+	return fmt.Sprintf("OK, I'll post to <#%s> again.", channels[0])
+}
+
+func (b *Bot) subscribe(channel, user string, args []string) string {
+	// An optional expiry comes last: "for 72h"
+	var expires time.Time
+	if n := len(args); n >= 2 && args[n-2] == "for" {
+		duration, err := time.ParseDuration(args[n-1])
+		if err != nil || duration <= 0 {
+			return fmt.Sprintf("Sorry, I don't understand %q as a length of time. Try e.g. `72h`.", args[n-1])
+		}
+		expires = b.now().Add(duration)
+		args = args[:n-2]
+	}
+
+	if len(args) == 0 {
+		return "Subscribe to what? Say e.g. `subscribe project=LRN priority=Blocker`."
+	}
+	fields := make(map[string]string)
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Sprintf("Sorry, I don't understand %q. Say e.g. `subscribe project=LRN priority=Blocker`.", arg)
+		}
+		fields[parts[0]] = parts[1]
+	}
+
+	subscription := state.Subscription{
+		Trigger: FieldsTrigger(channel, fields),
+		Fields:  fields,
+		Owner:   user,
+		Created: b.now(),
+		Expires: expires,
+	}
+	if _, err := config.NewTrigger(subscription.Trigger); err != nil {
+		return fmt.Sprintf("Sorry, that subscription won't work: %s", message.SlackEscape(err.Error()))
+	}
+
+	id, err := b.state.AddSubscription(subscription)
+	if err != nil {
+		log.LogF("Could not record subscription for %s: %s", channel, err)
+		return "Sorry, something went wrong."
+	}
+	reply := fmt.Sprintf("OK, I'll post activity on issues with %s here", describe_fields(fields))
+	if !expires.IsZero() {
+		reply += " until " + format_time(expires)
+	}
+	return fmt.Sprintf("%s (subscription %s).", reply, id)
+}
+
+// The subscriptions posting to a channel
+func (b *Bot) channel_subscriptions(channel string) ([]state.Subscription, error) {
+	all, err := b.state.GetSubscriptions()
+	if err != nil {
+		return nil, err
+	}
+	var subscriptions []state.Subscription
+	for _, s := range all {
+		if s.Trigger.SlackChannel == channel {
+			subscriptions = append(subscriptions, s)
+		}
+	}
+	return subscriptions, nil
+}
+
+func (b *Bot) subscriptions(channel string) string {
+	subscriptions, err := b.channel_subscriptions(channel)
+	if err != nil {
+		log.LogF("Could not look up subscriptions for %s: %s", channel, err)
+		return "Sorry, something went wrong."
+	}
+	if len(subscriptions) == 0 {
+		return "There are no subscriptions in this channel."
+	}
+
+	lines := []string{"This channel's subscriptions:"}
+	for _, s := range subscriptions {
+		line := fmt.Sprintf("%s. %s (from %s", s.ID, describe_subscription(s), describe_owner(s.Owner))
+		if !s.Expires.IsZero() {
+			line += ", until " + format_time(s.Expires)
+		}
+		lines = append(lines, line+")")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// People can only remove their own subscriptions
+func (b *Bot) unsubscribe(channel, user string, args []string) string {
+	if len(args) != 1 {
+		return "Which one? Say e.g. `unsubscribe 1` (see `subscriptions`), or `unsubscribe all`."
+	}
+	subscriptions, err := b.channel_subscriptions(channel)
+	if err != nil {
+		log.LogF("Could not look up subscriptions for %s: %s", channel, err)
+		return "Sorry, something went wrong."
+	}
+
+	var remove []state.Subscription
+	for _, s := range subscriptions {
+		if args[0] == "all" && s.Owner == user {
+			remove = append(remove, s)
+		} else if s.ID == args[0] {
+			if s.Owner != user {
+				return fmt.Sprintf("Sorry, only %s can remove subscription %s.", describe_owner(s.Owner), s.ID)
+			}
+			remove = append(remove, s)
+		}
+	}
+	if len(remove) == 0 && args[0] != "all" {
+		return fmt.Sprintf("There's no subscription %q in this channel.", args[0])
+	}
+
+	for _, s := range remove {
+		if _, err := b.state.RemoveSubscription(s.ID); err != nil {
+			log.LogF("Could not remove subscription %s: %s", s.ID, err)
+			return "Sorry, something went wrong."
+		}
+	}
+	if args[0] == "all" {
+		return "OK, I've removed all your subscriptions in this channel."
+	}
+	return fmt.Sprintf("OK, I've removed subscription %s.", args[0])
+}
+
+// e.g. "`priority=Blocker` `project=LRN`"
+func describe_fields(fields map[string]string) string {
+	var terms []string
+	for k, v := range fields {
+		terms = append(terms, fmt.Sprintf("`%s=%s`", message.SlackEscape(k), message.SlackEscape(v)))
+	}
+	sort.Strings(terms)
+	return strings.Join(terms, " ")
+}
+
+// What a subscription matches. Those made through the admin API can have
+// any trigger.
+func describe_subscription(s state.Subscription) string {
+	if len(s.Fields) != 0 {
+		return describe_fields(s.Fields)
+	}
+	if len(s.Trigger.Match) == 0 {
+		return "all activity"
+	}
+	var terms []string
+	for k, v := range s.Trigger.Match {
+		terms = append(terms, fmt.Sprintf("`%s~%s`", message.SlackEscape(k), message.SlackEscape(v)))
+	}
+	sort.Strings(terms)
+	return strings.Join(terms, " ")
+}
+
+// Slack users are mentioned, and other owners named
+func describe_owner(owner string) string {
+	if slack_user_id_re.MatchString(owner) {
+		return "<@" + owner + ">"
+	}
+	return message.SlackEscape(owner)
+}
+
+var slack_user_id_re = regexp.MustCompile(`^[UW][A-Z0-9]+$`)
+
+func format_time(t time.Time) string {
+	return t.UTC().Format("2 Jan 15:04 MST")
+}
+
+// The trigger for a subscription to a channel made from Slack, which matches
+// the fields' values exactly (ignoring case). A project is matched by the
+// issue key.
+func FieldsTrigger(channel string, fields map[string]string) config.MessageTrigger {
+	match := make(map[string]string)
+	for field, value := range fields {
+		if field == "project" {
+			match["key"] = "^" + regexp.QuoteMeta(strings.ToUpper(value)) + "-"
+		} else {
+			match[field] = "(?i)^" + regexp.QuoteMeta(value) + "$"
+		}
+	}
+	return config.MessageTrigger{SlackChannel: channel, Match: match}
+}
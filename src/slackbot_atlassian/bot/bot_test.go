@@ -0,0 +1,252 @@
+package bot
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"slackbot_atlassian/atlassian"
+	"slackbot_atlassian/config"
+	"slackbot_atlassian/state"
+)
+
+// Keeps what the bot records in memory
+type fake_state struct {
+	state.State
+	watches       map[string]map[string]bool
+	mutes         map[string]time.Time
+	subscriptions []state.Subscription
+	next_id       int
+	opted_out     map[string]bool
+}
+
+func new_fake_state() *fake_state {
+	return &fake_state{
+		watches:   make(map[string]map[string]bool),
+		mutes:     make(map[string]time.Time),
+		opted_out: make(map[string]bool),
+	}
+}
+
+func (f *fake_state) AddWatch(issue, slack_id string) error {
+	if f.watches[slack_id] == nil {
+		f.watches[slack_id] = make(map[string]bool)
+	}
+	f.watches[slack_id][issue] = true
+	return nil
+}
+
+func (f *fake_state) RemoveWatch(issue, slack_id string) error {
+	delete(f.watches[slack_id], issue)
+	return nil
+}
+
+func (f *fake_state) GetWatchedIssues(slack_id string) ([]string, error) {
+	var issues []string
+	for issue := range f.watches[slack_id] {
+		issues = append(issues, issue)
+	}
+	return issues, nil
+}
+
+func (f *fake_state) SetDirectMessageOptOut(slack_id string, opt_out bool) error {
+	f.opted_out[slack_id] = opt_out
+	return nil
+}
+
+func (f *fake_state) MuteChannel(channel string, until time.Time) error {
+	f.mutes[channel] = until
+	return nil
+}
+
+func (f *fake_state) UnmuteChannel(channel string) error {
+	delete(f.mutes, channel)
+	return nil
+}
+
+func (f *fake_state) AddSubscription(subscription state.Subscription) (string, error) {
+	f.next_id++
+	subscription.ID = fmt.Sprint(f.next_id)
+	f.subscriptions = append(f.subscriptions, subscription)
+	return subscription.ID, nil
+}
+
+func (f *fake_state) RemoveSubscription(id string) (bool, error) {
+	for i, s := range f.subscriptions {
+		if s.ID == id {
+			f.subscriptions = append(f.subscriptions[:i], f.subscriptions[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (f *fake_state) GetSubscriptions() ([]state.Subscription, error) {
+	return f.subscriptions, nil
+}
+
+// Knows about the issues in the LRN project
+type fake_atlassian struct {
+	atlassian.Atlassian
+}
+
+func (f fake_atlassian) GetIssue(id string) (*atlassian.Issue, error) {
+	if !strings.HasPrefix(id, "LRN-") {
+		return nil, fmt.Errorf("Bad status code: 404")
+	}
+	return &atlassian.Issue{Id: id}, nil
+}
+
+func test_bot() (*Bot, *fake_state) {
+	s := new_fake_state()
+	b := New(s, fake_atlassian{}, nil)
+	b.now = func() time.Time { return time.Unix(1500000000, 0) }
+	return b, s
+}
+
+func TestWatchCommands(t *testing.T) {
+	b, s := test_bot()
+
+	if reply := b.Reply("C1", "U1", "<@UBOT> watch lrn-123"); !strings.Contains(reply, "LRN-123") || !s.watches["U1"]["LRN-123"] {
+		t.Errorf("Expected LRN-123 to be watched, got %q", reply)
+	}
+	if reply := b.Reply("C1", "U1", "<@UBOT> watch OPS-1"); reply != "Sorry, I couldn't find OPS-1." || s.watches["U1"]["OPS-1"] {
+		t.Errorf("Expected a missing issue not to be watched, got %q", reply)
+	}
+	if reply := b.Reply("D1", "U1", "watching"); reply != "You're watching LRN-123." {
+		t.Errorf("Unexpected reply %q", reply)
+	}
+	b.Reply("C1", "U1", "<@UBOT> unwatch LRN-123")
+	if s.watches["U1"]["LRN-123"] {
+		t.Errorf("Expected LRN-123 not to be watched")
+	}
+}
+
+func TestDirectMessageCommands(t *testing.T) {
+	b, s := test_bot()
+
+	if reply := b.Reply("D1", "U1", "dm off"); !strings.HasPrefix(reply, "OK") || !s.opted_out["U1"] {
+		t.Errorf("Expected U1 to opt out, got %q", reply)
+	}
+	if reply := b.Reply("D1", "U1", "dm on"); !strings.HasPrefix(reply, "OK") || s.opted_out["U1"] {
+		t.Errorf("Expected U1 to opt back in, got %q", reply)
+	}
+	if reply := b.Reply("D1", "U1", "dm maybe"); !strings.HasPrefix(reply, "Say `dm off`") {
+		t.Errorf("Unexpected reply %q", reply)
+	}
+}
+
+func TestMuteCommands(t *testing.T) {
+	b, s := test_bot()
+
+	reply := b.Reply("C1", "U1", "<@UBOT> mute <#C2|team-yoda-jira> 2h")
+	if reply != "OK, I won't post to <#C2> for 2h0m0s." {
+		t.Errorf("Unexpected reply %q", reply)
+	}
+	until := time.Unix(1500000000, 0).Add(2 * time.Hour)
+	if !s.mutes["C2"].Equal(until) || !s.mutes["team-yoda-jira"].Equal(until) {
+		t.Errorf("Expected the channel to be muted by ID and name, got %v", s.mutes)
+	}
+
+	b.Reply("C1", "U1", "<@UBOT> mute 30m")
+	if _, ok := s.mutes["C1"]; !ok {
+		t.Errorf("Expected the current channel to be muted")
+	}
+	if reply := b.Reply("C1", "U1", "<@UBOT> mute C1 for a while"); !strings.HasPrefix(reply, "For how long?") {
+		t.Errorf("Unexpected reply %q", reply)
+	}
+
+	b.Reply("C1", "U1", "<@UBOT> unmute <#C2|team-yoda-jira>")
+	if _, ok := s.mutes["team-yoda-jira"]; ok {
+		t.Errorf("Expected the channel to be unmuted")
+	}
+}
+
+func TestSubscriptionCommands(t *testing.T) {
+	b, s := test_bot()
+
+	reply := b.Reply("C1", "U1", "<@UBOT> subscribe project=LRN priority=Blocker")
+	if reply != "OK, I'll post activity on issues with `priority=Blocker` `project=LRN` here (subscription 1)." {
+		t.Errorf("Unexpected reply %q", reply)
+	}
+	reply = b.Reply("C1", "U2", "<@UBOT> subscribe team=Yoda for 72h")
+	if reply != "OK, I'll post activity on issues with `team=Yoda` here until 17 Jul 02:40 UTC (subscription 2)." {
+		t.Errorf("Unexpected reply %q", reply)
+	}
+	b.Reply("C2", "U1", "<@UBOT> subscribe team=Ewok")
+	if len(s.subscriptions) != 3 {
+		t.Fatalf("Expected 3 subscriptions, got %+v", s.subscriptions)
+	}
+	if s.subscriptions[0].Owner != "U1" || !s.subscriptions[0].Created.Equal(b.now()) || !s.subscriptions[0].Expires.IsZero() {
+		t.Errorf("Unexpected subscription %+v", s.subscriptions[0])
+	}
+	if reply := b.Reply("C1", "U1", "<@UBOT> subscribe priority"); !strings.Contains(reply, "don't understand") {
+		t.Errorf("Unexpected reply %q", reply)
+	}
+	if reply := b.Reply("C1", "U1", "<@UBOT> subscribe team=Yoda for ever"); !strings.Contains(reply, "length of time") {
+		t.Errorf("Unexpected reply %q", reply)
+	}
+
+	expected := "This channel's subscriptions:\n" +
+		"1. `priority=Blocker` `project=LRN` (from <@U1>)\n" +
+		"2. `team=Yoda` (from <@U2>, until 17 Jul 02:40 UTC)"
+	if reply := b.Reply("C1", "U1", "<@UBOT> subscriptions"); reply != expected {
+		t.Errorf("Expected %q, got %q", expected, reply)
+	}
+
+	if reply := b.Reply("C1", "U1", "<@UBOT> unsubscribe 2"); reply != "Sorry, only <@U2> can remove subscription 2." {
+		t.Errorf("Unexpected reply %q", reply)
+	}
+	if reply := b.Reply("C1", "U1", "<@UBOT> unsubscribe 3"); !strings.HasPrefix(reply, "There's no subscription") {
+		t.Errorf("Expected another channel's subscription not to be removed, got %q", reply)
+	}
+	b.Reply("C1", "U1", "<@UBOT> unsubscribe all")
+	if len(s.subscriptions) != 2 || s.subscriptions[0].Owner != "U2" {
+		t.Errorf("Expected only U1's subscription in C1 to be removed, got %+v", s.subscriptions)
+	}
+	b.Reply("C1", "U2", "<@UBOT> unsubscribe 2")
+	if reply := b.Reply("C1", "U1", "<@UBOT> subscriptions"); reply != "There are no subscriptions in this channel." {
+		t.Errorf("Unexpected reply %q", reply)
+	}
+}
+
+func TestAdminSubscriptions(t *testing.T) {
+	b, s := test_bot()
+	s.AddSubscription(state.Subscription{
+		Trigger: config.MessageTrigger{SlackChannel: "C1", Match: map[string]string{"team": "Yoda"}},
+		Owner:   "ops@example.com",
+	})
+
+	expected := "This channel's subscriptions:\n1. `team~Yoda` (from ops@example.com)"
+	if reply := b.Reply("C1", "U1", "<@UBOT> subscriptions"); reply != expected {
+		t.Errorf("Expected %q, got %q", expected, reply)
+	}
+}
+
+func TestFieldsTrigger(t *testing.T) {
+	trigger, err := config.NewTrigger(FieldsTrigger("C1", map[string]string{"project": "lrn", "priority": "Blocker"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trigger.SlackChannel != "C1" {
+		t.Errorf("Unexpected channel %q", trigger.SlackChannel)
+	}
+	matches := trigger.GetCompiledMatches()
+	if !matches["key"].MatchString("LRN-123") || matches["key"].MatchString("OPS-1") {
+		t.Errorf("Expected the project to match the issue key")
+	}
+	if !matches["priority"].MatchString("blocker") || matches["priority"].MatchString("Blocker or not") {
+		t.Errorf("Expected the priority to match exactly, ignoring case")
+	}
+}
+
+func TestOtherCommands(t *testing.T) {
+	b, _ := test_bot()
+
+	for _, text := range []string{"<@UBOT>", "<@UBOT> help", "<@UBOT|bot>: dance"} {
+		if reply := b.Reply("C1", "U1", text); !strings.Contains(reply, usage) {
+			t.Errorf("%q: expected usage, got %q", text, reply)
+		}
+	}
+}
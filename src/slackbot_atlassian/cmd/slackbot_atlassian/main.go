@@ -1,25 +1,98 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 
 	"slackbot_atlassian"
+	"slackbot_atlassian/atlassian"
+	"slackbot_atlassian/bot"
 	"slackbot_atlassian/config"
+	"slackbot_atlassian/server"
+	"slackbot_atlassian/slack"
+	"slackbot_atlassian/state"
+	"slackbot_atlassian/users"
 )
 
 func failF(msg string, args ...interface{}) {
 	fmt.Fprintf(os.Stderr, msg+"\n", args...)
 }
 
+// Something that handles requests from Slack until it fails
+type listener struct {
+	what string
+	run  func() error
+}
+
 func main() {
+	daemon := flag.Bool("daemon", false, "keep running, polling Jira every poll interval")
+	serve := flag.Bool("serve", false, "serve slash commands and events on the configured address")
+	rtm := flag.Bool("rtm", false, "answer commands given to the bot over Slack's RTM API, for when the Events API can't reach the server")
+	check := flag.Bool("check", false, "check the Slack channels and users in the config, and exit")
+	flag.Parse()
+
 	cfg, err := config.LoadConfigEnv()
 	if err != nil {
 		failF("Failed to load config: %s", err)
 		os.Exit(1)
 	}
 
-	err = slackbot_atlassian.ProcessActivityStream(cfg)
+	if *check {
+		if err := slackbot_atlassian.CheckSlack(cfg); err != nil {
+			failF("Failed to check the config against Slack: %s", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *serve || *rtm {
+		st, err := state.New(cfg.State)
+		if err != nil {
+			failF("Failed to create Redis client: %s", err)
+			os.Exit(1)
+		}
+		atl := atlassian.New(cfg.Atlassian)
+		slack_client := slack.New(cfg.Slack)
+		b := bot.New(st, atl, slack_client)
+
+		var listeners []listener
+		if *serve {
+			if cfg.Server.Listen == "" {
+				failF("Serving needs server.listen in the config")
+				os.Exit(1)
+			}
+			srv := server.New(cfg, atl, slack_client, st, users.New(cfg.Slack, slack_client, st, atl), b)
+			listeners = append(listeners, listener{"serving", srv.ListenAndServe})
+		}
+		if *rtm {
+			listeners = append(listeners, listener{"listening over RTM", func() error {
+				return slack.ListenRTM(cfg.Slack, b.Answer)
+			}})
+		}
+
+		// Without -daemon the last listener runs in the foreground
+		for i, l := range listeners {
+			l := l
+			if !*daemon && i == len(listeners)-1 {
+				if err := l.run(); err != nil {
+					failF("Error while %s: %s", l.what, err)
+					os.Exit(1)
+				}
+				return
+			}
+			go func() {
+				failF("Error while %s: %s", l.what, l.run())
+				os.Exit(1)
+			}()
+		}
+	}
+
+	if *daemon {
+		err = slackbot_atlassian.RunDaemon(cfg)
+	} else {
+		err = slackbot_atlassian.ProcessActivityStream(cfg)
+	}
 	if err != nil {
 		failF("Error while processing activity stream: %s\n", err)
 		os.Exit(1)
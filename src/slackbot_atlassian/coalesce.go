@@ -0,0 +1,121 @@
+package slackbot_atlassian
+
+import (
+	"time"
+
+	"slackbot_atlassian/atlassian"
+)
+
+// Groups activities by the same person on the same issue that happen within
+// a window of each other, so they can be posted as one message
+type coalescer struct {
+	window time.Duration
+	groups []*activity_group
+
+	// Activities already sent that are after the last event recorded, so will
+	// be fetched again
+	sent map[string]bool
+}
+
+type activity_group struct {
+	key             string
+	activity_issues []atlassian.ActivityIssue
+}
+
+func (g *activity_group) last() time.Time {
+	return g.activity_issues[len(g.activity_issues)-1].Activity.Updated
+}
+
+func new_coalescer(window time.Duration) *coalescer {
+	return &coalescer{window: window}
+}
+
+func group_key(ai atlassian.ActivityIssue) string {
+	issue_id, _ := ai.Activity.GetIssueID()
+	return issue_id + "/" + ai.Activity.Author.Username
+}
+
+// Add activities, in the order they happened
+func (c *coalescer) add(activity_issues ...atlassian.ActivityIssue) {
+	for _, ai := range activity_issues {
+		if c.has(ai.Activity.Id) || c.sent[ai.Activity.Id] {
+			// Already waiting or sent, e.g. fetched again after a failed run
+			// or while an earlier activity is waiting
+			continue
+		}
+
+		var open *activity_group
+		if c.window > 0 {
+			key := group_key(ai)
+			for _, g := range c.groups {
+				if g.key == key && ai.Activity.Updated.Sub(g.last()) <= c.window {
+					open = g
+				}
+			}
+		}
+
+		if open == nil {
+			open = &activity_group{key: group_key(ai)}
+			c.groups = append(c.groups, open)
+		}
+		open.activity_issues = append(open.activity_issues, ai)
+	}
+}
+
+// Remove and return the groups that can't grow any more (their last activity
+// was more than a window before now), or all of them
+func (c *coalescer) take(now time.Time, all bool) [][]atlassian.ActivityIssue {
+	var ready [][]atlassian.ActivityIssue
+	var waiting []*activity_group
+
+	for _, g := range c.groups {
+		if all || c.window <= 0 || now.Sub(g.last()) > c.window {
+			ready = append(ready, g.activity_issues)
+		} else {
+			waiting = append(waiting, g)
+		}
+	}
+
+	c.groups = waiting
+	return ready
+}
+
+func (c *coalescer) has(activity_id string) bool {
+	for _, g := range c.groups {
+		for _, ai := range g.activity_issues {
+			if ai.Activity.Id == activity_id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// The activities fetched that can be recorded as seen, once everything taken
+// has been sent: those before the oldest still waiting. Those after it are
+// remembered as sent, so they aren't sent again when fetched with it.
+func (c *coalescer) seen(activities []*atlassian.ActivityItem) []*atlassian.ActivityItem {
+	for i, a := range activities {
+		if !c.has(a.Id) {
+			continue
+		}
+		c.sent = make(map[string]bool)
+		for _, later := range activities[i:] {
+			if !c.has(later.Id) {
+				c.sent[later.Id] = true
+			}
+		}
+		return activities[:i]
+	}
+	c.sent = nil
+	return activities
+}
+
+// The number of activities waiting to be taken
+func (c *coalescer) pending() int {
+	var n int
+	for _, g := range c.groups {
+		n += len(g.activity_issues)
+	}
+	return n
+}
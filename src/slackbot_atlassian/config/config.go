@@ -4,22 +4,153 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
 	"regexp"
+	"strings"
+	"text/template"
+	"time"
 )
 
 const ENV_VAR = "CONFIG"
 
+// Message formats a trigger can post in
+const (
+	FormatText       = "text"
+	FormatAttachment = "attachment"
+	FormatBlocks     = "blocks"
+)
+
+// How a trigger's messages are delivered
+const (
+	// Each message is posted on its own
+	DeliveryPost = "post"
+	// Messages about the same issue are posted in a thread
+	DeliveryThread = "thread"
+	// A single card per issue is updated in place
+	DeliveryCard = "card"
+	// Messages are collected and posted as a digest on a schedule
+	DeliveryDigest = "digest"
+)
+
+// The people related to an issue that a trigger can mention, or send direct
+// messages to instead of posting to a channel (its target)
+const (
+	RoleAssignee  = "assignee"
+	RoleReporter  = "reporter"
+	RoleWatchers  = "watchers"
+	RoleMentioned = "mentioned"
+)
+
+// Where else a trigger can send messages, with a target of
+// "<output>:<destination>" (e.g. "teams:eng"). "slack:#channel" is the same as
+// a slack_channel.
+const (
+	OutputSlack      = "slack"
+	OutputMattermost = "mattermost"
+	OutputTeams      = "teams"
+	OutputWebhook    = "webhook"
+	OutputEmail      = "email"
+)
+
+// The buttons a trigger's rich messages can have, besides transitions
+const (
+	ActionAssign  = "assign"
+	ActionComment = "comment"
+)
+
+// What the sidebar color of a rich message reflects
+const (
+	ColorByStatus   = "status"
+	ColorByPriority = "priority"
+)
+
 type MessageTrigger struct {
-	SlackChannel  string            `json:"slack_channel"`
-	Match         map[string]string `json:"match"`
-	matchCompiled map[string]*regexp.Regexp
+	SlackChannel     string            `json:"slack_channel"`
+	Target           string            `json:"target"`
+	Match            map[string]string `json:"match"`
+	Template         string            `json:"template"`
+	Format           string            `json:"format"`
+	ColorBy          string            `json:"color_by"`
+	Delivery         string            `json:"delivery"`
+	Mention          []string          `json:"mention"`
+	Actions          []string          `json:"actions"`
+	Transitions      []string          `json:"transitions"`
+	Thread           ThreadConfig      `json:"thread"`
+	Digest           DigestConfig      `json:"digest"`
+	matchCompiled    map[string]*regexp.Regexp
+	templateCompiled *template.Template
 }
 
 func (mt MessageTrigger) GetCompiledMatches() map[string]*regexp.Regexp {
 	return mt.matchCompiled
 }
 
+// The compiled message template, or nil if the trigger uses the default text
+func (mt MessageTrigger) GetCompiledTemplate() *template.Template {
+	return mt.templateCompiled
+}
+
+type ThreadConfig struct {
+	// Also post replies to the channel
+	Broadcast bool `json:"broadcast"`
+	// How long after the parent message is posted to start a new thread, as
+	// a Go duration (e.g. "72h")
+	Expiry         string `json:"expiry"`
+	expiryCompiled time.Duration
+}
+
+// Threads are restarted after a week unless configured otherwise
+const default_thread_expiry = 7 * 24 * time.Hour
+
+func (tc ThreadConfig) GetExpiry() time.Duration {
+	return tc.expiryCompiled
+}
+
+type DigestConfig struct {
+	// The time of day to post the digest, as "15:04"
+	At string `json:"at"`
+	// The time zone At is in, e.g. "Australia/Sydney"
+	Timezone         string `json:"timezone"`
+	atCompiled       time.Duration
+	locationCompiled *time.Location
+}
+
+const default_digest_at = "09:00"
+
+// The most recent time the digest was scheduled for, at or before now
+func (dc DigestConfig) LastScheduled(now time.Time) time.Time {
+	location := dc.locationCompiled
+	if location == nil {
+		location = time.UTC
+	}
+	now = now.In(location)
+
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, location)
+	scheduled := midnight.Add(dc.atCompiled)
+	if scheduled.After(now) {
+		scheduled = scheduled.AddDate(0, 0, -1)
+	}
+	return scheduled
+}
+
+func (dc *DigestConfig) compile() error {
+	if dc.At == "" {
+		dc.At = default_digest_at
+	}
+	at, err := time.Parse("15:04", dc.At)
+	if err != nil {
+		return fmt.Errorf("Invalid digest time %q: want HH:MM", dc.At)
+	}
+	dc.atCompiled = time.Duration(at.Hour())*time.Hour + time.Duration(at.Minute())*time.Minute
+
+	dc.locationCompiled, err = time.LoadLocation(dc.Timezone)
+	if err != nil {
+		return fmt.Errorf("Invalid digest timezone %q: %s", dc.Timezone, err)
+	}
+	return nil
+}
+
 type StateConfig struct {
 	Driver string      `json:"redis"`
 	Host   string      `json:"host"`
@@ -28,6 +159,7 @@ type StateConfig struct {
 }
 
 type AtlassianConfig struct {
+	// The Jira host, optionally with a scheme (https is assumed)
 	Host                   string `json:"host"`
 	MaxActivityLookup      int    `json:"max_activity_lookup"`
 	ConcurrentIssueLookups int    `json:"concurrent_issue_lookups"`
@@ -37,15 +169,69 @@ type AtlassianConfig struct {
 	} `json:"auth"`
 }
 
+// The base URL of the Jira instance, e.g. "https://example.atlassian.net"
+func (ac AtlassianConfig) BaseURL() string {
+	host := strings.TrimRight(ac.Host, "/")
+	if strings.Contains(host, "://") {
+		return host
+	}
+	return "https://" + host
+}
+
+// The link to browse an issue in Jira
+func (ac AtlassianConfig) IssueURL(key string) string {
+	return ac.BaseURL() + "/browse/" + key
+}
+
 type SlackConfig struct {
 	TeamDomain string `json:"team_domain"`
 	Auth       struct {
 		Token string `json:"token"`
+		// The app's signing secret, for verifying requests from Slack
+		SigningSecret string `json:"signing_secret"`
 	} `json:"auth"`
 	Users map[string]SlackUser `json:"users"`
+	// Incoming webhook URLs keyed by channel name, for channels to post to
+	// through a webhook instead of with the token
+	Webhooks map[string]string `json:"webhooks"`
+}
+
+// The incoming webhook URL for a channel, if it has one
+func (sc SlackConfig) Webhook(channel string) (string, bool) {
+	u, ok := sc.Webhooks[strings.TrimPrefix(channel, "#")]
+	return u, ok
+}
+
+func (sc SlackConfig) compile(triggers []*MessageTrigger) error {
+	for channel, u := range sc.Webhooks {
+		if !is_http_url(u) {
+			return fmt.Errorf("Invalid webhook URL for %q", channel)
+		}
+	}
+
+	for _, t := range triggers {
+		if err := sc.check_trigger(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Webhooks don't say which message they posted, so it can't be replied to or
+// updated
+func (sc SlackConfig) check_trigger(t *MessageTrigger) error {
+	if _, ok := sc.Webhook(t.SlackChannel); !ok {
+		return nil
+	}
+	if t.Delivery == DeliveryThread || t.Delivery == DeliveryCard {
+		return fmt.Errorf("Trigger %q posts through a webhook, so it can't use %s delivery", t.Name(), t.Delivery)
+	}
+	return nil
 }
 
 type SlackUser struct {
+	// The user's Slack ID, for mentions
+	ID        string `json:"id"`
 	Name      string `json:"name"`
 	IconUrl   string `json:"icon_url"`
 	IconEmoji string `json:"icon_emoji"`
@@ -56,11 +242,410 @@ type CustomJiraFieldConfig struct {
 	JiraField string `json:"jira_field"`
 }
 
+// Where user images are kept, so Slack can show them
+const (
+	StorageS3    = "s3"
+	StorageLocal = "local"
+	// Link to Jira's images directly
+	StorageNone = "none"
+)
+
 type ResourceStorageConfig struct {
-	S3_Bucket             string `json:"s3_bucket"`
-	S3_Region             string `json:"s3_region"`
+	// One of the storage drivers: s3 if there's a bucket, and none otherwise,
+	// by default
+	Driver string `json:"driver"`
+
+	S3_Bucket string `json:"s3_bucket"`
+	S3_Region string `json:"s3_region"`
+	// Without keys, the default AWS credentials (the environment, shared
+	// credentials or the instance's role) are used
 	AWS_Access_Key_ID     string `json:"aws_key"`
 	AWS_Secret_Access_Key string `json:"aws_secret"`
+	// An S3-compatible server (e.g. MinIO or Ceph) to use instead of AWS
+	S3_Endpoint string `json:"s3_endpoint"`
+	// Use URLs with the bucket in the host name rather than the path
+	S3_VirtualHosted bool `json:"s3_virtual_hosted"`
+
+	// The directory to keep images in for the local driver, which the server
+	// serves at /resources/
+	Directory string `json:"directory"`
+
+	// Where stored images are found, e.g. a CDN in front of the bucket, or
+	// the server's /resources/ URL for the local driver
+	BaseURL string `json:"base_url"`
+
+	// How long a user's image is used before checking for a new one, as a
+	// Go duration. A new photo in Jira is noticed straight away.
+	ImageCacheExpiry         string `json:"image_cache_expiry"`
+	imageCacheExpiryCompiled time.Duration
+
+	// Who can fetch stored images: anyone by default, or only those given a
+	// presigned or signed URL
+	Access string `json:"access"`
+	// How long presigned and signed URLs work for, as a Go duration
+	URLExpiry         string `json:"url_expiry"`
+	urlExpiryCompiled time.Duration
+	// The secret signed URLs are signed with
+	SigningKey string `json:"signing_key"`
+}
+
+// Who can fetch stored images
+const (
+	AccessPublic = "public"
+	// The bucket is private, and Slack is given presigned S3 URLs
+	AccessPresigned = "presigned"
+	// Images are only served, by the bot's server at /resources/, to URLs
+	// signed with the signing key
+	AccessSigned = "signed"
+)
+
+const (
+	default_image_cache_expiry = 24 * time.Hour
+	// The longest S3 allows presigned URLs to work for
+	max_presigned_url_expiry = 7 * 24 * time.Hour
+	default_url_expiry       = max_presigned_url_expiry
+)
+
+func (rc ResourceStorageConfig) GetImageCacheExpiry() time.Duration {
+	return rc.imageCacheExpiryCompiled
+}
+
+func (rc ResourceStorageConfig) GetURLExpiry() time.Duration {
+	return rc.urlExpiryCompiled
+}
+
+func (rc *ResourceStorageConfig) compile() error {
+	if rc.Driver == "" {
+		rc.Driver = StorageNone
+		if rc.S3_Bucket != "" {
+			rc.Driver = StorageS3
+		}
+	}
+	var err error
+	if rc.imageCacheExpiryCompiled, err = parse_duration(rc.ImageCacheExpiry, default_image_cache_expiry); err != nil {
+		return fmt.Errorf("Invalid image cache expiry: %s", err)
+	}
+
+	rc.BaseURL = strings.TrimSuffix(rc.BaseURL, "/")
+	if rc.BaseURL != "" && !is_http_url(rc.BaseURL) {
+		return fmt.Errorf("Invalid base_url %q", rc.BaseURL)
+	}
+
+	switch rc.Driver {
+	case StorageS3:
+		if rc.S3_Bucket == "" {
+			return fmt.Errorf("S3 storage needs an s3_bucket")
+		}
+		if rc.S3_Endpoint != "" && !is_http_url(rc.S3_Endpoint) {
+			return fmt.Errorf("Invalid s3_endpoint %q", rc.S3_Endpoint)
+		}
+	case StorageLocal:
+		if rc.Directory == "" || rc.BaseURL == "" {
+			return fmt.Errorf("Local storage needs a directory and the base_url it is served at")
+		}
+	case StorageNone:
+	default:
+		return fmt.Errorf("Invalid driver %q", rc.Driver)
+	}
+
+	return rc.compile_access()
+}
+
+func (rc *ResourceStorageConfig) compile_access() error {
+	if rc.Access == "" {
+		rc.Access = AccessPublic
+	}
+
+	var err error
+	if rc.urlExpiryCompiled, err = parse_duration(rc.URLExpiry, default_url_expiry); err != nil {
+		return fmt.Errorf("Invalid URL expiry: %s", err)
+	} else if rc.urlExpiryCompiled <= 0 {
+		return fmt.Errorf("Invalid URL expiry %q", rc.URLExpiry)
+	}
+
+	switch rc.Access {
+	case AccessPublic:
+	case AccessPresigned:
+		if rc.Driver != StorageS3 {
+			return fmt.Errorf("Only S3 storage can use presigned URLs")
+		}
+		if rc.BaseURL != "" {
+			return fmt.Errorf("Presigned URLs point at the bucket, so can't use a base_url")
+		}
+		if rc.urlExpiryCompiled > max_presigned_url_expiry {
+			return fmt.Errorf("Presigned URLs can work for at most %s", max_presigned_url_expiry)
+		}
+	case AccessSigned:
+		if rc.Driver == StorageNone {
+			return fmt.Errorf("Signed URLs need S3 or local storage")
+		}
+		if rc.SigningKey == "" || rc.BaseURL == "" {
+			return fmt.Errorf("Signed URLs need a signing_key and the base_url of the server's /resources/")
+		}
+	default:
+		return fmt.Errorf("Invalid access %q", rc.Access)
+	}
+	return nil
+}
+
+type CoalesceConfig struct {
+	// Activities by the same person on the same issue within this long of
+	// each other are posted as one message, as a Go duration (e.g. "2m")
+	Window         string `json:"window"`
+	windowCompiled time.Duration
+}
+
+func (cc CoalesceConfig) GetWindow() time.Duration {
+	return cc.windowCompiled
+}
+
+type DaemonConfig struct {
+	// How often to poll Jira for activities, as a Go duration
+	PollInterval         string `json:"poll_interval"`
+	pollIntervalCompiled time.Duration
+}
+
+const default_poll_interval = time.Minute
+
+func (dc DaemonConfig) GetPollInterval() time.Duration {
+	return dc.pollIntervalCompiled
+}
+
+type ServerConfig struct {
+	// The address to serve slash commands etc. on, e.g. ":8080"
+	Listen string `json:"listen"`
+	// How many issues /jira search lists
+	MaxSearchResults int `json:"max_search_results"`
+	// The bearer token for the admin API, which is off without one
+	AdminToken string `json:"admin_token"`
+}
+
+const default_max_search_results = 5
+
+type UnfurlConfig struct {
+	// The Jira projects whose issues are unfurled, e.g. ["LRN"]
+	Projects []string `json:"projects"`
+	// Also reply to messages that mention issue keys (links to issues are
+	// always unfurled)
+	Keys bool `json:"keys"`
+	// The most issues replied about for one message
+	MaxPerMessage int `json:"max_per_message"`
+	// The most issues described or unfurled in one channel within the
+	// cooldown
+	MaxPerChannel int `json:"max_per_channel"`
+	// How long an issue isn't described again in a channel after it has
+	// been, as a Go duration
+	Cooldown string `json:"cooldown"`
+	// How long looked up issues are cached for, as a Go duration
+	CacheExpiry         string `json:"cache_expiry"`
+	keyCompiled         *regexp.Regexp
+	cooldownCompiled    time.Duration
+	cacheExpiryCompiled time.Duration
+}
+
+const (
+	default_unfurl_max_per_message = 3
+	default_unfurl_max_per_channel = 20
+	default_unfurl_cooldown        = 10 * time.Minute
+	default_unfurl_cache_expiry    = 5 * time.Minute
+)
+
+// Find the keys of issues in the configured projects in some text, in the
+// order they first appear
+func (uc UnfurlConfig) IssueKeys(text string) []string {
+	if uc.keyCompiled == nil {
+		return nil
+	}
+	var keys []string
+	seen := make(map[string]bool)
+	for _, k := range uc.keyCompiled.FindAllString(text, -1) {
+		if !seen[k] {
+			seen[k] = true
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func (uc UnfurlConfig) GetCooldown() time.Duration {
+	return uc.cooldownCompiled
+}
+
+func (uc UnfurlConfig) GetCacheExpiry() time.Duration {
+	return uc.cacheExpiryCompiled
+}
+
+func (uc *UnfurlConfig) compile() error {
+	if len(uc.Projects) != 0 {
+		projects := make([]string, len(uc.Projects))
+		for i, p := range uc.Projects {
+			if !project_key_re.MatchString(p) {
+				return fmt.Errorf("Invalid project key %q", p)
+			}
+			projects[i] = regexp.QuoteMeta(p)
+		}
+		uc.keyCompiled = regexp.MustCompile(`\b(?:` + strings.Join(projects, "|") + `)-[0-9]+\b`)
+	}
+
+	if uc.MaxPerMessage == 0 {
+		uc.MaxPerMessage = default_unfurl_max_per_message
+	}
+	if uc.MaxPerChannel == 0 {
+		uc.MaxPerChannel = default_unfurl_max_per_channel
+	}
+
+	var err error
+	if uc.cooldownCompiled, err = parse_duration(uc.Cooldown, default_unfurl_cooldown); err != nil {
+		return fmt.Errorf("Invalid cooldown: %s", err)
+	}
+	if uc.cacheExpiryCompiled, err = parse_duration(uc.CacheExpiry, default_unfurl_cache_expiry); err != nil {
+		return fmt.Errorf("Invalid cache expiry: %s", err)
+	}
+	return nil
+}
+
+type CreateConfig struct {
+	// The Jira projects issues can be created in from Slack (the unfurl
+	// projects if not set), issue types to choose from and priorities
+	Projects   []string `json:"projects"`
+	IssueTypes []string `json:"issue_types"`
+	Priorities []string `json:"priorities"`
+}
+
+var (
+	default_create_issue_types = []string{"Bug", "Task", "Story"}
+	default_create_priorities  = []string{"Highest", "High", "Medium", "Low", "Lowest"}
+)
+
+func (cc *CreateConfig) compile(unfurl UnfurlConfig) error {
+	if len(cc.Projects) == 0 {
+		cc.Projects = unfurl.Projects
+	}
+	for _, p := range cc.Projects {
+		if !project_key_re.MatchString(p) {
+			return fmt.Errorf("Invalid project key %q", p)
+		}
+	}
+	if len(cc.IssueTypes) == 0 {
+		cc.IssueTypes = default_create_issue_types
+	}
+	if len(cc.Priorities) == 0 {
+		cc.Priorities = default_create_priorities
+	}
+	return nil
+}
+
+var project_key_re = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+
+type OutputsConfig struct {
+	Mattermost MattermostConfig `json:"mattermost"`
+	Email      EmailConfig      `json:"email"`
+	// Microsoft Teams incoming webhook (connector) URLs, by destination name
+	Teams map[string]string `json:"teams"`
+	// URLs to post each message to as JSON, by destination name
+	Webhooks map[string]string `json:"webhooks"`
+}
+
+type MattermostConfig struct {
+	// Posts to any Mattermost channel (the destination) through an incoming
+	// webhook
+	Webhook string `json:"webhook"`
+}
+
+type EmailConfig struct {
+	// The SMTP server, and the login for it if it needs one
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	From     string `json:"from"`
+	// Lists of addresses to send to, by destination name. A destination can
+	// also be addresses separated by commas.
+	Recipients map[string][]string `json:"recipients"`
+}
+
+const default_smtp_port = 25
+
+// Who to email for a destination: a list of recipients, or addresses
+func (ec EmailConfig) To(destination string) []string {
+	if to, ok := ec.Recipients[destination]; ok {
+		return to
+	}
+	if !strings.Contains(destination, "@") {
+		return nil
+	}
+	var to []string
+	for _, address := range strings.Split(destination, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			to = append(to, address)
+		}
+	}
+	return to
+}
+
+// Check that every trigger's output is configured
+func (oc *OutputsConfig) compile(triggers []*MessageTrigger) error {
+	urls := map[string]string{}
+	for name, u := range oc.Teams {
+		urls["teams:"+name] = u
+	}
+	for name, u := range oc.Webhooks {
+		urls["webhook:"+name] = u
+	}
+	if oc.Mattermost.Webhook != "" {
+		urls["mattermost"] = oc.Mattermost.Webhook
+	}
+	for name, u := range urls {
+		if !is_http_url(u) {
+			return fmt.Errorf("Invalid URL for %s", name)
+		}
+	}
+	if oc.Email.Port == 0 {
+		oc.Email.Port = default_smtp_port
+	}
+
+	for _, t := range triggers {
+		if err := oc.check_trigger(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check that the output a trigger sends to is configured
+func (oc OutputsConfig) check_trigger(t *MessageTrigger) error {
+	output, destination, ok := t.Output()
+	if !ok {
+		return nil
+	}
+	var configured bool
+	switch output {
+	case OutputMattermost:
+		configured = oc.Mattermost.Webhook != ""
+	case OutputTeams:
+		_, configured = oc.Teams[destination]
+	case OutputWebhook:
+		_, configured = oc.Webhooks[destination]
+	case OutputEmail:
+		configured = oc.Email.Host != "" && oc.Email.From != "" && len(oc.Email.To(destination)) != 0
+	}
+	if !configured {
+		return fmt.Errorf("Invalid target for %q: there's no %s output configured for it", t.Name(), output)
+	}
+	return nil
+}
+
+func is_http_url(u string) bool {
+	parsed, err := url.Parse(u)
+	return err == nil && (parsed.Scheme == "https" || parsed.Scheme == "http") && parsed.Host != ""
+}
+
+// Parse an optional Go duration
+func parse_duration(s string, default_duration time.Duration) (time.Duration, error) {
+	if s == "" {
+		return default_duration, nil
+	}
+	return time.ParseDuration(s)
 }
 
 type Config struct {
@@ -70,6 +655,167 @@ type Config struct {
 	Triggers         []*MessageTrigger       `json:"triggers"`
 	CustomJiraFields []CustomJiraFieldConfig `json:"custom_jira_fields"`
 	ResourceStorage  ResourceStorageConfig   `json:"resource_storage"`
+	Coalesce         CoalesceConfig          `json:"coalesce"`
+	Daemon           DaemonConfig            `json:"daemon"`
+	Server           ServerConfig            `json:"server"`
+	Unfurl           UnfurlConfig            `json:"unfurl"`
+	Create           CreateConfig            `json:"create"`
+	Outputs          OutputsConfig           `json:"outputs"`
+}
+
+// A name for the trigger in messages: where it sends messages to
+func (t MessageTrigger) Name() string {
+	if t.Target != "" {
+		return t.Target
+	}
+	return t.SlackChannel
+}
+
+// Where a trigger sends messages other than Slack, e.g. "teams", "eng" for a
+// target of "teams:eng"
+func (t MessageTrigger) Output() (string, string, bool) {
+	parts := strings.SplitN(t.Target, ":", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// Compile a trigger made outside the config, e.g. for a subscription made in
+// Slack
+func NewTrigger(t MessageTrigger) (*MessageTrigger, error) {
+	if err := t.compile(); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// Check a trigger made at runtime (see NewTrigger) against the Slack and
+// output config, as the configured triggers are checked when it is loaded
+func (c *Config) CheckTrigger(t *MessageTrigger) error {
+	if err := c.Slack.check_trigger(t); err != nil {
+		return err
+	}
+	return c.Outputs.check_trigger(t)
+}
+
+func (t *MessageTrigger) compile() error {
+	if t.SlackChannel == "" && t.Target == "" {
+		return fmt.Errorf("Trigger needs a slack_channel or a target")
+	}
+	switch t.Target {
+	case "", RoleAssignee, RoleReporter, RoleWatchers, RoleMentioned:
+	default:
+		output, destination, ok := t.Output()
+		if !ok || destination == "" {
+			return fmt.Errorf("Invalid target %q", t.Target)
+		}
+		switch output {
+		case OutputSlack:
+			t.SlackChannel, t.Target = destination, ""
+		case OutputMattermost, OutputTeams, OutputWebhook, OutputEmail:
+			if len(t.Mention) != 0 || len(t.Actions) != 0 || len(t.Transitions) != 0 {
+				return fmt.Errorf("Invalid target for %q: mentions and buttons only work in Slack", t.Name())
+			}
+		default:
+			return fmt.Errorf("Invalid target %q", t.Target)
+		}
+	}
+
+	t.matchCompiled = make(map[string]*regexp.Regexp)
+	for k, v := range t.Match {
+		match, err := regexp.Compile(v)
+		if err != nil {
+			return fmt.Errorf("Invalid regexp %q: %s", v, err)
+		}
+		t.matchCompiled[k] = match
+	}
+
+	// Compile the message template, if any
+	if t.Template != "" {
+		tmpl, err := compile_template(t.Name(), t.Template)
+		if err != nil {
+			return fmt.Errorf("Invalid template for %q: %s", t.Name(), err)
+		}
+		t.templateCompiled = tmpl
+	}
+
+	switch t.Format {
+	case "":
+		t.Format = FormatText
+	case FormatText, FormatAttachment, FormatBlocks:
+	default:
+		return fmt.Errorf("Invalid format for %q: %q", t.Name(), t.Format)
+	}
+
+	switch t.ColorBy {
+	case "":
+		t.ColorBy = ColorByStatus
+	case ColorByStatus, ColorByPriority:
+	default:
+		return fmt.Errorf("Invalid color_by for %q: %q", t.Name(), t.ColorBy)
+	}
+
+	switch t.Delivery {
+	case "":
+		t.Delivery = DeliveryPost
+	case DeliveryPost, DeliveryThread, DeliveryCard, DeliveryDigest:
+	default:
+		return fmt.Errorf("Invalid delivery for %q: %q", t.Name(), t.Delivery)
+	}
+
+	// Live cards are always rich
+	if t.Delivery == DeliveryCard && t.Format == FormatText {
+		t.Format = FormatBlocks
+	}
+
+	t.Thread.expiryCompiled = default_thread_expiry
+	if t.Thread.Expiry != "" {
+		expiry, err := time.ParseDuration(t.Thread.Expiry)
+		if err != nil {
+			return fmt.Errorf("Invalid thread expiry for %q: %s", t.Name(), err)
+		}
+		t.Thread.expiryCompiled = expiry
+	}
+
+	for _, role := range t.Mention {
+		switch role {
+		case RoleAssignee, RoleReporter, RoleMentioned:
+		default:
+			return fmt.Errorf("Invalid mention for %q: %q", t.Name(), role)
+		}
+	}
+
+	for _, action := range t.Actions {
+		switch action {
+		case ActionAssign, ActionComment:
+		default:
+			return fmt.Errorf("Invalid action for %q: %q", t.Name(), action)
+		}
+	}
+	if (len(t.Actions) != 0 || len(t.Transitions) != 0) && t.Format == FormatText {
+		return fmt.Errorf("Invalid actions for %q: buttons need an attachment or blocks format", t.Name())
+	}
+
+	if t.Delivery == DeliveryDigest {
+		if err := t.Digest.compile(); err != nil {
+			return fmt.Errorf("Invalid digest for %q: %s", t.Name(), err)
+		}
+	}
+
+	// Direct messages (and messages outside Slack) are always posted on
+	// their own, except that email can be a digest
+	output, _, is_output := t.Output()
+	switch {
+	case t.Target == "" || t.Delivery == DeliveryPost:
+	case is_output && output == OutputEmail && t.Delivery == DeliveryDigest:
+	case is_output:
+		return fmt.Errorf("Invalid delivery for %q: messages outside Slack can only be posted", t.Name())
+	default:
+		return fmt.Errorf("Invalid delivery for %q: direct messages can only be posted", t.Name())
+	}
+
+	return nil
 }
 
 func LoadConfig(input io.Reader) (*Config, error) {
@@ -81,16 +827,55 @@ func LoadConfig(input io.Reader) (*Config, error) {
 		return nil, err
 	}
 
-	// Compile the match regular expression
+	// Compile the match regular expressions, templates etc.
 	for _, t := range cfg.Triggers {
-		t.matchCompiled = make(map[string]*regexp.Regexp)
-		for k, v := range t.Match {
-			match, err := regexp.Compile(v)
-			if err != nil {
-				return nil, fmt.Errorf("Invalid regexp %q: %s", v, err)
-			}
-			t.matchCompiled[k] = match
+		if err := t.compile(); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Coalesce.Window != "" {
+		window, err := time.ParseDuration(cfg.Coalesce.Window)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid coalesce window: %s", err)
+		}
+		cfg.Coalesce.windowCompiled = window
+	}
+
+	cfg.Daemon.pollIntervalCompiled = default_poll_interval
+	if cfg.Daemon.PollInterval != "" {
+		interval, err := time.ParseDuration(cfg.Daemon.PollInterval)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid daemon poll interval: %s", err)
+		} else if interval <= 0 {
+			return nil, fmt.Errorf("Invalid daemon poll interval: must be positive")
 		}
+		cfg.Daemon.pollIntervalCompiled = interval
+	}
+
+	if cfg.Server.MaxSearchResults == 0 {
+		cfg.Server.MaxSearchResults = default_max_search_results
+	}
+	if err := cfg.Unfurl.compile(); err != nil {
+		return nil, fmt.Errorf("Invalid unfurl config: %s", err)
+	}
+	if err := cfg.Create.compile(cfg.Unfurl); err != nil {
+		return nil, fmt.Errorf("Invalid create config: %s", err)
+	}
+
+	if err := cfg.ResourceStorage.compile(); err != nil {
+		return nil, fmt.Errorf("Invalid resource storage config: %s", err)
+	}
+
+	if err := cfg.Slack.compile(cfg.Triggers); err != nil {
+		return nil, err
+	}
+	if err := cfg.Outputs.compile(cfg.Triggers); err != nil {
+		return nil, err
+	}
+
+	if cfg.Server.Listen != "" && cfg.Slack.Auth.SigningSecret == "" {
+		return nil, fmt.Errorf("Serving requests from Slack needs a signing secret")
 	}
 
 	return &cfg, nil
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"strings"
 	"testing"
+	"time"
 
 	"slackbot_atlassian/config"
 )
@@ -58,6 +59,162 @@ func TestLoadConfig(t *testing.T) {
             }
             `, false, "Invalid regexp",
 		},
+		{
+			`{
+                "triggers": [
+                    {
+                       "slack_channel": "team-yoda-jira",
+                       "match": {"team": "Yoda"},
+                       "template": "{{.Key}} {{.Text | truncate 80}} {{link .URL .Summary}}"
+                    }
+                ]
+            }
+            `, true, "",
+		},
+		{
+			`{
+                "triggers": [
+                    {
+                       "slack_channel": "team-yoda-jira",
+                       "template": "{{.Key"
+                    }
+                ]
+            }
+            `, false, "Invalid template",
+		},
+		{
+			`{
+                "triggers": [
+                    {
+                       "slack_channel": "team-yoda-jira",
+                       "template": "{{shout .Key}}"
+                    }
+                ]
+            }
+            `, false, "function \"shout\" not defined",
+		},
+		{
+			`{"triggers": [{"slack_channel": "team-yoda-jira", "format": "blocks", "color_by": "priority"}]}`,
+			true, "",
+		},
+		{
+			`{"triggers": [{"slack_channel": "team-yoda-jira", "format": "html"}]}`,
+			false, "Invalid format",
+		},
+		{
+			`{"triggers": [{"slack_channel": "team-yoda-jira", "color_by": "mood"}]}`,
+			false, "Invalid color_by",
+		},
+		{
+			`{"triggers": [{"slack_channel": "team-yoda-jira", "delivery": "thread", "thread": {"broadcast": true, "expiry": "72h"}}]}`,
+			true, "",
+		},
+		{
+			`{"triggers": [{"slack_channel": "team-yoda-jira", "delivery": "pigeon"}]}`,
+			false, "Invalid delivery",
+		},
+		{
+			`{"triggers": [{"slack_channel": "team-yoda-jira", "delivery": "thread", "thread": {"expiry": "3 days"}}]}`,
+			false, "Invalid thread expiry",
+		},
+		{
+			`{"triggers": [{"slack_channel": "team-yoda-jira", "delivery": "card"}]}`,
+			true, "",
+		},
+		{
+			`{"triggers": [{"slack_channel": "managers", "delivery": "digest", "digest": {"at": "08:30", "timezone": "Australia/Sydney"}}]}`,
+			true, "",
+		},
+		{
+			`{"triggers": [{"slack_channel": "managers", "delivery": "digest", "digest": {"at": "8.30am"}}]}`,
+			false, "Invalid digest time",
+		},
+		{
+			`{"triggers": [{"slack_channel": "managers", "delivery": "digest", "digest": {"timezone": "Middle/Earth"}}]}`,
+			false, "Invalid digest timezone",
+		},
+		{
+			`{"triggers": [{"slack_channel": "team-yoda-jira", "mention": ["assignee", "mentioned"]}]}`,
+			true, "",
+		},
+		{
+			`{"triggers": [{"slack_channel": "team-yoda-jira", "mention": ["everyone"]}]}`,
+			false, "Invalid mention",
+		},
+		{`{"triggers": [{"target": "watchers"}]}`, true, ""},
+		{`{"triggers": [{"target": "everyone"}]}`, false, "Invalid target"},
+		{`{"triggers": [{"match": {"team": "Yoda"}}]}`, false, "needs a slack_channel or a target"},
+		{
+			`{"triggers": [{"target": "assignee", "delivery": "thread"}]}`,
+			false, "direct messages can only be posted",
+		},
+		{`{"coalesce": {"window": "2m"}, "daemon": {"poll_interval": "30s"}}`, true, ""},
+		{`{"coalesce": {"window": "soon"}}`, false, "Invalid coalesce window"},
+		{`{"daemon": {"poll_interval": "0s"}}`, false, "Invalid daemon poll interval"},
+		{`{"server": {"listen": ":8080"}, "slack": {"auth": {"signing_secret": "s3cret"}}}`, true, ""},
+		{`{"server": {"listen": ":8080"}}`, false, "needs a signing secret"},
+		{`{"unfurl": {"projects": ["LRN", "OPS"], "keys": true, "cooldown": "1h"}}`, true, ""},
+		{
+			`{"triggers": [{"slack_channel": "team-yoda-jira", "format": "blocks", "actions": ["assign", "comment"], "transitions": ["In Progress", "Done"]}]}`,
+			true, "",
+		},
+		{`{"triggers": [{"slack_channel": "team-yoda-jira", "format": "blocks", "actions": ["delete"]}]}`, false, "Invalid action"},
+		{`{"triggers": [{"slack_channel": "team-yoda-jira", "transitions": ["Done"]}]}`, false, "buttons need an attachment or blocks format"},
+		{`{"unfurl": {"projects": ["lrn"]}}`, false, "Invalid project key"},
+		{`{"unfurl": {"cooldown": "a while"}}`, false, "Invalid cooldown"},
+		{`{"create": {"projects": ["LRN"], "issue_types": ["Bug"], "priorities": ["High", "Low"]}}`, true, ""},
+		{`{"create": {"projects": ["Learnosity"]}}`, false, "Invalid project key"},
+		{
+			`{"slack": {"webhooks": {"team-yoda-jira": "https://hooks.slack.com/services/T0/B0/x"}}, "triggers": [{"slack_channel": "#team-yoda-jira", "format": "blocks"}]}`,
+			true, "",
+		},
+		{`{"slack": {"webhooks": {"team-yoda-jira": "hooks.slack.com/services/T0/B0/x"}}}`, false, "Invalid webhook URL"},
+		{
+			`{"outputs": {"mattermost": {"webhook": "https://mm.example.com/hooks/x"}, "teams": {"eng": "https://example.webhook.office.com/x"}, "webhooks": {"audit": "http://localhost:8081/jira"}},
+			  "triggers": [{"target": "mattermost:town-square"}, {"target": "teams:eng", "format": "attachment"}, {"target": "webhook:audit"}, {"target": "slack:#team-yoda-jira", "delivery": "card"}]}`,
+			true, "",
+		},
+		{`{"triggers": [{"target": "teams:eng"}]}`, false, "no teams output configured"},
+		{`{"resource_storage": {"s3_bucket": "avatars", "s3_endpoint": "http://minio:9000", "base_url": "https://cdn.example.com/"}}`, true, ""},
+		{`{"resource_storage": {"driver": "local", "directory": "/var/lib/slackbot", "base_url": "https://bot.example.com/resources"}}`, true, ""},
+		{`{"resource_storage": {"driver": "local", "directory": "/var/lib/slackbot"}}`, false, "needs a directory and the base_url"},
+		{`{"resource_storage": {"driver": "s3"}}`, false, "needs an s3_bucket"},
+		{`{"resource_storage": {"driver": "ftp"}}`, false, "Invalid driver"},
+		{`{"resource_storage": {"image_cache_expiry": "a day"}}`, false, "Invalid image cache expiry"},
+		{`{"resource_storage": {"s3_bucket": "avatars", "access": "presigned", "url_expiry": "72h"}}`, true, ""},
+		{`{"resource_storage": {"s3_bucket": "avatars", "access": "presigned", "url_expiry": "720h"}}`, false, "at most 168h0m0s"},
+		{`{"resource_storage": {"s3_bucket": "avatars", "access": "presigned", "base_url": "https://cdn.example.com"}}`, false, "can't use a base_url"},
+		{`{"resource_storage": {"driver": "local", "directory": "/var/lib/slackbot", "base_url": "https://bot.example.com/resources", "access": "presigned"}}`, false, "Only S3 storage"},
+		{`{"resource_storage": {"s3_bucket": "avatars", "access": "signed", "signing_key": "s3cret", "base_url": "https://bot.example.com/resources"}}`, true, ""},
+		{`{"resource_storage": {"s3_bucket": "avatars", "access": "signed", "base_url": "https://bot.example.com/resources"}}`, false, "need a signing_key"},
+		{`{"resource_storage": {"access": "signed", "signing_key": "s3cret", "base_url": "https://bot.example.com/resources"}}`, false, "need S3 or local storage"},
+		{`{"resource_storage": {"s3_bucket": "avatars", "access": "private"}}`, false, "Invalid access"},
+		{`{"resource_storage": {"s3_bucket": "avatars", "url_expiry": "-1h"}}`, false, "Invalid URL expiry"},
+		{
+			`{"outputs": {"email": {"host": "localhost", "from": "jira@example.com", "recipients": {"stakeholders": ["ceo@example.com"]}}},
+			  "triggers": [{"target": "email:stakeholders", "delivery": "digest"}, {"target": "email:pm@example.com, qa@example.com", "format": "attachment"}]}`,
+			true, "",
+		},
+		{`{"outputs": {"email": {"host": "localhost", "from": "jira@example.com"}}, "triggers": [{"target": "email:stakeholders"}]}`, false, "no email output configured"},
+		{`{"triggers": [{"target": "email:pm@example.com"}]}`, false, "no email output configured"},
+		{
+			`{"outputs": {"email": {"host": "localhost", "from": "jira@example.com"}}, "triggers": [{"target": "email:pm@example.com", "delivery": "card"}]}`,
+			false, "messages outside Slack can only be posted",
+		},
+		{`{"triggers": [{"target": "carrier-pigeon:home"}]}`, false, "Invalid target"},
+		{`{"outputs": {"teams": {"eng": "x"}}, "triggers": [{"target": "teams:eng"}]}`, false, "Invalid URL for teams:eng"},
+		{
+			`{"outputs": {"teams": {"eng": "https://example.webhook.office.com/x"}}, "triggers": [{"target": "teams:eng", "delivery": "thread"}]}`,
+			false, "messages outside Slack can only be posted",
+		},
+		{
+			`{"outputs": {"teams": {"eng": "https://example.webhook.office.com/x"}}, "triggers": [{"target": "teams:eng", "mention": ["assignee"]}]}`,
+			false, "only work in Slack",
+		},
+		{
+			`{"slack": {"webhooks": {"team-yoda-jira": "https://hooks.slack.com/services/T0/B0/x"}}, "triggers": [{"slack_channel": "team-yoda-jira", "delivery": "card"}]}`,
+			false, "can't use card delivery",
+		},
 	}
 
 	for _, c := range cases {
@@ -75,3 +232,151 @@ func TestLoadConfig(t *testing.T) {
 		}
 	}
 }
+
+func TestAtlassianURLs(t *testing.T) {
+	cases := []struct {
+		host     string
+		expected string
+	}{
+		{"learnosity.atlassian.net", "https://learnosity.atlassian.net/browse/LRN-1"},
+		{"http://127.0.0.1:8080/", "http://127.0.0.1:8080/browse/LRN-1"},
+	}
+	for _, c := range cases {
+		cfg := config.AtlassianConfig{Host: c.host}
+		if got := cfg.IssueURL("LRN-1"); got != c.expected {
+			t.Errorf("Host %q: expected %q, got %q", c.host, c.expected, got)
+		}
+	}
+}
+
+func TestUnfurlIssueKeys(t *testing.T) {
+	cfg, err := config.LoadConfig(strings.NewReader(`{"unfurl": {"projects": ["LRN", "OPS"]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := cfg.Unfurl.IssueKeys("LRN-1, OPS-22 and XLRN-3, ABC-4 and LRN-1 again (LRN-5)")
+	expected := []string{"LRN-1", "OPS-22", "LRN-5"}
+	if strings.Join(keys, " ") != strings.Join(expected, " ") {
+		t.Errorf("Expected %v, got %v", expected, keys)
+	}
+}
+
+func TestDigestLastScheduled(t *testing.T) {
+	cfg, err := config.LoadConfig(bytes.NewBufferString(`{"triggers": [
+		{"slack_channel": "managers", "delivery": "digest", "digest": {"at": "09:00", "timezone": "Australia/Sydney"}}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := cfg.Triggers[0].Digest
+
+	sydney, _ := time.LoadLocation("Australia/Sydney")
+	cases := []struct {
+		now      time.Time
+		expected time.Time
+	}{
+		{time.Date(2016, 5, 10, 9, 0, 0, 0, sydney), time.Date(2016, 5, 10, 9, 0, 0, 0, sydney)},
+		{time.Date(2016, 5, 10, 15, 0, 0, 0, sydney), time.Date(2016, 5, 10, 9, 0, 0, 0, sydney)},
+		{time.Date(2016, 5, 10, 8, 59, 0, 0, sydney), time.Date(2016, 5, 9, 9, 0, 0, 0, sydney)},
+		// 22:00 UTC is 08:00 the next day in Sydney
+		{time.Date(2016, 5, 10, 22, 0, 0, 0, time.UTC), time.Date(2016, 5, 10, 9, 0, 0, 0, sydney)},
+	}
+
+	for _, c := range cases {
+		if got := digest.LastScheduled(c.now); !got.Equal(c.expected) {
+			t.Errorf("At %s expected last digest at %s, got %s", c.now, c.expected, got)
+		}
+	}
+}
+
+func TestTriggerOutputs(t *testing.T) {
+	cfg, err := config.LoadConfig(strings.NewReader(`{
+		"outputs": {"teams": {"eng": "https://example.webhook.office.com/x"}},
+		"triggers": [{"target": "slack:#team-yoda-jira"}, {"target": "teams:eng"}, {"target": "watchers"}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if slack := cfg.Triggers[0]; slack.SlackChannel != "#team-yoda-jira" || slack.Target != "" {
+		t.Errorf("Expected a Slack target to be a channel, got %+v", slack)
+	}
+	if output, destination, ok := cfg.Triggers[1].Output(); !ok || output != config.OutputTeams || destination != "eng" {
+		t.Errorf("Unexpected output %q %q %v", output, destination, ok)
+	}
+	if _, _, ok := cfg.Triggers[2].Output(); ok {
+		t.Errorf("Expected direct messages not to have an output")
+	}
+}
+
+func TestEmailRecipients(t *testing.T) {
+	cfg, err := config.LoadConfig(strings.NewReader(`{
+		"outputs": {"email": {"host": "localhost", "from": "jira@example.com", "recipients": {"stakeholders": ["ceo@example.com", "cto@example.com"]}}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	email := cfg.Outputs.Email
+	if email.Port != 25 {
+		t.Errorf("Expected the default SMTP port, got %d", email.Port)
+	}
+	if to := email.To("stakeholders"); len(to) != 2 || to[1] != "cto@example.com" {
+		t.Errorf("Unexpected recipients %v", to)
+	}
+	if to := email.To("pm@example.com, qa@example.com"); len(to) != 2 || to[0] != "pm@example.com" || to[1] != "qa@example.com" {
+		t.Errorf("Unexpected recipients %v", to)
+	}
+	if to := email.To("nobody"); len(to) != 0 {
+		t.Errorf("Expected no recipients, got %v", to)
+	}
+}
+
+func TestResourceStorageDriver(t *testing.T) {
+	for input, driver := range map[string]string{
+		`{}`: config.StorageNone,
+		`{"resource_storage": {"s3_bucket": "avatars", "s3_region": "ap-southeast-2"}}`: config.StorageS3,
+	} {
+		cfg, err := config.LoadConfig(strings.NewReader(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.ResourceStorage.Driver != driver {
+			t.Errorf("%s: expected the %s driver, got %q", input, driver, cfg.ResourceStorage.Driver)
+		}
+	}
+}
+
+func TestCheckTrigger(t *testing.T) {
+	cfg, err := config.LoadConfig(strings.NewReader(`{
+		"slack": {"webhooks": {"ops": "https://hooks.slack.com/services/T0/B0/x"}},
+		"outputs": {"teams": {"eng": "https://example.webhook.office.com/hook"}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		trigger config.MessageTrigger
+		err     string
+	}{
+		{config.MessageTrigger{Target: "teams:eng"}, ""},
+		{config.MessageTrigger{SlackChannel: "#dev", Delivery: config.DeliveryThread}, ""},
+		{config.MessageTrigger{Target: "teams:nope"}, "no teams output configured"},
+		{config.MessageTrigger{Target: "mattermost:town-square"}, "no mattermost output configured"},
+		{config.MessageTrigger{SlackChannel: "#ops", Delivery: config.DeliveryCard}, "can't use card delivery"},
+	}
+	for _, c := range cases {
+		trigger, err := config.NewTrigger(c.trigger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = cfg.CheckTrigger(trigger)
+		if c.err == "" && err != nil {
+			t.Errorf("%+v: unexpected error %s", c.trigger, err)
+		} else if c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+			t.Errorf("%+v: expected an error containing %q, got %v", c.trigger, c.err, err)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// The layouts Jira uses for datetime (e.g. when a comment was made) and date
+// fields in the REST API
+const (
+	JiraDatetimeLayout = "2006-01-02T15:04:05.000-0700"
+	jira_date_layout   = "2006-01-02"
+)
+
+// TemplateFuncs are the helper functions available to trigger templates.
+//
+// The message package overrides some of them (e.g. "mention") when rendering
+// so that they can use what it knows about Slack; the versions here are the
+// plain-text fallbacks, and are what the templates are validated against when
+// the config is loaded.
+var TemplateFuncs = template.FuncMap{
+	"link":     TemplateLink,
+	"mention":  TemplateMention,
+	"truncate": TemplateTruncate,
+	"date":     TemplateDate,
+}
+
+// TemplateLink formats a Slack link to url with the given text
+func TemplateLink(url, text string) string {
+	if url == "" {
+		return text
+	}
+	if text == "" {
+		return fmt.Sprintf("<%s>", url)
+	}
+	return fmt.Sprintf("<%s|%s>", url, text)
+}
+
+// TemplateMention renders a user (a name, or a Jira user object from the
+// issue fields) as plain text
+func TemplateMention(user interface{}) string {
+	switch u := user.(type) {
+	case string:
+		return "@" + u
+	case map[string]interface{}:
+		for _, k := range []string{"displayName", "name"} {
+			if v, ok := u[k].(string); ok && v != "" {
+				return "@" + v
+			}
+		}
+	}
+	return ""
+}
+
+// TemplateTruncate cuts s down to at most n characters, adding an ellipsis if
+// anything was removed. The argument order allows `{{.Text | truncate 80}}`.
+func TemplateTruncate(n int, s string) string {
+	r := []rune(strings.TrimSpace(s))
+	if n <= 0 || len(r) <= n {
+		return string(r)
+	}
+	if n == 1 {
+		return "…"
+	}
+	return strings.TrimSpace(string(r[:n-1])) + "…"
+}
+
+// TemplateDate formats a time.Time, or a date string as returned by the Jira
+// REST API, with the given Go time layout
+func TemplateDate(layout string, v interface{}) (string, error) {
+	switch t := v.(type) {
+	case time.Time:
+		return t.Format(layout), nil
+	case *time.Time:
+		if t == nil {
+			return "", nil
+		}
+		return t.Format(layout), nil
+	case string:
+		if t == "" {
+			return "", nil
+		}
+		for _, l := range []string{JiraDatetimeLayout, time.RFC3339, jira_date_layout} {
+			if parsed, err := time.Parse(l, t); err == nil {
+				return parsed.Format(layout), nil
+			}
+		}
+		return "", fmt.Errorf("Cannot parse %q as a date", t)
+	case nil:
+		return "", nil
+	default:
+		return "", fmt.Errorf("Cannot format %T as a date", v)
+	}
+}
+
+func compile_template(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(TemplateFuncs).Parse(text)
+}
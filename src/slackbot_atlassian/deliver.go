@@ -0,0 +1,258 @@
+package slackbot_atlassian
+
+import (
+	"time"
+
+	"slackbot_atlassian/atlassian"
+	"slackbot_atlassian/config"
+	"slackbot_atlassian/log"
+	"slackbot_atlassian/message"
+	"slackbot_atlassian/slack"
+	"slackbot_atlassian/state"
+)
+
+// Deliver a message according to its trigger's target and delivery mode
+func (p *processor) deliver(m message.Message) error {
+	if p.muted(m.SlackChannel) {
+		log.LogF("Not posting to %s, which is muted", m.SlackChannel)
+		return nil
+	}
+
+	if m.Trigger != nil {
+		if _, _, ok := m.Trigger.Output(); ok {
+			if m.Trigger.Delivery == config.DeliveryDigest {
+				return p.add_digest_item(m)
+			}
+			return p.sinks.Send(m)
+		}
+	}
+
+	if m.Trigger == nil || m.IssueKey == "" {
+		_, _, err := p.slack_client.PostMessage(m)
+		return err
+	}
+
+	if m.Trigger.Target != "" {
+		return p.deliver_direct(m)
+	}
+
+	switch m.Trigger.Delivery {
+	case config.DeliveryThread:
+		return p.deliver_threaded(m)
+	case config.DeliveryCard:
+		return p.deliver_card(m)
+	case config.DeliveryDigest:
+		return p.add_digest_item(m)
+	default:
+		_, _, err := p.slack_client.PostMessage(m)
+		return err
+	}
+}
+
+// Post a message as a reply in the issue's thread, starting a new thread if
+// there isn't one yet (or it has expired)
+func (p *processor) deliver_threaded(m message.Message) error {
+	parent, ok, err := p.state.GetThread(m.SlackChannel, m.IssueKey)
+	if err != nil {
+		log.LogF("Could not look up thread for %s in %s: %s", m.IssueKey, m.SlackChannel, err)
+	} else if ok {
+		reply := m
+		reply.ThreadTimestamp = parent.Timestamp
+		reply.Broadcast = m.Trigger.Thread.Broadcast
+
+		_, _, err := p.slack_client.PostMessage(reply)
+		if err == nil || !slack.IsAPIError(err, "thread_not_found", "message_not_found") {
+			return err
+		}
+		log.LogF("Thread for %s in %s has gone, starting a new one", m.IssueKey, m.SlackChannel)
+	}
+
+	channel, ts, err := p.slack_client.PostMessage(m)
+	if err != nil {
+		return err
+	}
+
+	parent = state.SlackMessage{Channel: channel, Timestamp: ts}
+	if err := p.state.RecordThread(m.SlackChannel, m.IssueKey, parent, m.Trigger.Thread.GetExpiry()); err != nil {
+		log.LogF("Failed to record thread for %s in %s: %s", m.IssueKey, m.SlackChannel, err)
+	}
+	return nil
+}
+
+// Update the issue's card in the channel, posting a new one if there isn't
+// one yet (or it was deleted)
+func (p *processor) deliver_card(m message.Message) error {
+	card, ok, err := p.state.GetCard(m.SlackChannel, m.IssueKey)
+	if err != nil {
+		log.LogF("Could not look up card for %s in %s: %s", m.IssueKey, m.SlackChannel, err)
+	} else if ok {
+		err := p.slack_client.UpdateMessage(card.Channel, card.Timestamp, m)
+		if err == nil || !slack.IsAPIError(err, "message_not_found", "cant_update_message") {
+			return err
+		}
+		log.LogF("Card for %s in %s has gone, posting a new one", m.IssueKey, m.SlackChannel)
+	}
+
+	channel, ts, err := p.slack_client.PostMessage(m)
+	if err != nil {
+		return err
+	}
+
+	card = state.SlackMessage{Channel: channel, Timestamp: ts}
+	if err := p.state.RecordCard(m.SlackChannel, m.IssueKey, card); err != nil {
+		log.LogF("Failed to record card for %s in %s: %s", m.IssueKey, m.SlackChannel, err)
+	}
+	return nil
+}
+
+// Send a message directly to each of its recipients who can be found in
+// Slack and haven't opted out
+func (p *processor) deliver_direct(m message.Message) error {
+	slack_ids, err := p.direct_recipients(m)
+	if err != nil {
+		return err
+	}
+	for _, slack_id := range slack_ids {
+		if err := p.send_direct(slack_id, m); err != nil {
+			log.LogF("Failed to send direct message to %s: %s", slack_id, err)
+		}
+	}
+	return nil
+}
+
+// Whether a message is sent directly to people (see deliver_direct)
+func is_direct(m message.Message) bool {
+	if m.Trigger == nil || m.IssueKey == "" || m.Trigger.Target == "" {
+		return false
+	}
+	_, _, ok := m.Trigger.Output()
+	return !ok
+}
+
+// The Slack IDs of the people a direct message is for: its recipients, and
+// for a message to the watchers, the issue's watchers other than its author
+func (p *processor) direct_recipients(m message.Message) ([]string, error) {
+	recipients := m.Recipients
+	if m.Trigger.Target == config.RoleWatchers {
+		watchers, err := p.atl.GetWatchers(m.IssueKey)
+		if err != nil {
+			return nil, err
+		}
+		for _, w := range watchers {
+			if w.Name != m.Author.Name {
+				recipients = append(recipients, w)
+			}
+		}
+	}
+
+	var slack_ids []string
+	for _, u := range recipients {
+		slack_id, ok, err := p.users.SlackUserID(u)
+		if err != nil {
+			log.LogF("Could not find the Slack user for %s: %s", u.Name, err)
+		} else if !ok {
+			log.LogF("No Slack user found for %s", u.Name)
+		} else {
+			slack_ids = append(slack_ids, slack_id)
+		}
+	}
+	return slack_ids, nil
+}
+
+// Send a message to a Slack user's direct message channel, unless they have
+// opted out
+func (p *processor) send_direct(slack_id string, m message.Message) error {
+	opted_out, err := p.state.GetDirectMessageOptOut(slack_id)
+	if err != nil {
+		return err
+	} else if opted_out {
+		return nil
+	}
+
+	channel, err := p.slack_client.OpenDirectMessage(slack_id)
+	if err != nil {
+		return err
+	}
+
+	m.SlackChannel = channel
+	_, _, err = p.slack_client.PostMessage(m)
+	return err
+}
+
+// Whether a channel has been muted from Slack. Mutes are recorded by the
+// channel's ID, and by its name if that was given, while triggers name their
+// channel, so both are checked.
+func (p *processor) muted(channel string) bool {
+	if channel == "" {
+		return false
+	}
+	channels := []string{channel}
+	if id, ok, err := p.slack_client.ChannelID(channel); err != nil {
+		log.LogF("Could not look up the ID of %s: %s", channel, err)
+	} else if ok && id != channel {
+		channels = append(channels, id)
+	}
+
+	for _, c := range channels {
+		until, ok, err := p.state.GetChannelMute(c)
+		if err != nil {
+			log.LogF("Could not look up whether %s is muted: %s", c, err)
+		} else if ok && time.Now().Before(until) {
+			return true
+		}
+	}
+	return false
+}
+
+// Queue direct messages about a group of activities on an issue to the people
+// watching it from Slack, except whoever did them, calling fail for any that
+// can't be sent
+func (p *processor) notify_watchers(matcher message.MessageMatcher, group []atlassian.ActivityIssue, fail func(error)) {
+	latest := group[len(group)-1]
+	issue_id, ok := latest.Activity.GetIssueID()
+	if !ok {
+		return
+	}
+	watchers, err := p.state.GetIssueWatchers(issue_id)
+	if err != nil {
+		log.LogF("Could not look up who is watching %s: %s", issue_id, err)
+		return
+	} else if len(watchers) == 0 {
+		return
+	}
+
+	author, _, err := p.users.SlackUserID(latest.Activity.Author.User())
+	if err != nil {
+		log.LogF("Could not find the Slack user for %s: %s", latest.Activity.Author.Username, err)
+	}
+
+	for _, slack_id := range watchers {
+		if slack_id == author {
+			continue
+		}
+		slack_id := slack_id
+		p.sender.Send(direct_queue(slack_id), func() {
+			if err := p.send_watched(slack_id, matcher, group); err != nil {
+				log.LogF("Failed to tell %s about %s: %s", slack_id, issue_id, err)
+				fail(err)
+			}
+		})
+	}
+}
+
+func (p *processor) send_watched(slack_id string, matcher message.MessageMatcher, group []atlassian.ActivityIssue) error {
+	channel, err := p.slack_client.OpenDirectMessage(slack_id)
+	if err != nil {
+		return err
+	}
+	trigger, err := config.NewTrigger(config.MessageTrigger{SlackChannel: channel})
+	if err != nil {
+		return err
+	}
+	for _, m := range matcher.GetGroupMessages([]*config.MessageTrigger{trigger}, group...) {
+		if _, _, err := p.slack_client.PostMessage(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
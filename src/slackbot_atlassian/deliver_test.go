@@ -0,0 +1,57 @@
+package slackbot_atlassian
+
+import (
+	"strings"
+	"testing"
+
+	"slackbot_atlassian/atlassian"
+	"slackbot_atlassian/bot"
+	"slackbot_atlassian/message"
+)
+
+func TestMutedByID(t *testing.T) {
+	p, st, slack_client := test_processor(t, `{"triggers": [{"slack_channel": "#team-yoda-jira"}]}`)
+	slack_client.channels = map[string]string{"team-yoda-jira": "C1"}
+
+	// Muting a channel from within it only gives its ID
+	if reply := bot.New(st, nil, slack_client).Reply("C1", "U1", "<@UBOT> mute 2h"); !strings.HasPrefix(reply, "OK") {
+		t.Fatalf("Unexpected reply %q", reply)
+	}
+
+	m := message.Message{SlackChannel: "#team-yoda-jira", Trigger: p.config.Triggers[0], Text: "LRN-1 was updated"}
+	if err := p.deliver(m); err != nil {
+		t.Fatal(err)
+	}
+	if len(slack_client.posted) != 0 {
+		t.Errorf("Expected nothing to be posted to the muted channel, got %+v", slack_client.posted)
+	}
+
+	m.SlackChannel = "#team-luke-jira"
+	if err := p.deliver(m); err != nil {
+		t.Fatal(err)
+	}
+	if len(slack_client.posted) != 1 {
+		t.Errorf("Expected other channels to be posted to, got %+v", slack_client.posted)
+	}
+}
+
+func TestDirectMessageOptOut(t *testing.T) {
+	p, st, slack_client := test_processor(t, `{"triggers": [{"target": "assignee"}]}`)
+	p.users = all_users{}
+
+	if reply := bot.New(st, nil, slack_client).Reply("Djane", "jane", "dm off"); !strings.HasPrefix(reply, "OK") {
+		t.Fatalf("Unexpected reply %q", reply)
+	}
+
+	m := message.Message{
+		Trigger:    p.config.Triggers[0],
+		IssueKey:   "LRN-1",
+		Recipients: []atlassian.User{{Name: "jane"}, {Name: "bob"}},
+	}
+	if err := p.deliver(m); err != nil {
+		t.Fatal(err)
+	}
+	if len(slack_client.posted) != 1 || slack_client.posted[0].SlackChannel != "Dbob" {
+		t.Errorf("Expected only bob to get a direct message, got %+v", slack_client.posted)
+	}
+}
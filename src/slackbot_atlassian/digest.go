@@ -0,0 +1,89 @@
+package slackbot_atlassian
+
+import (
+	"time"
+
+	"slackbot_atlassian/config"
+	"slackbot_atlassian/log"
+	"slackbot_atlassian/message"
+)
+
+// Digests are collected for each Slack channel, or for each other output's
+// destination (e.g. "email:stakeholders")
+func digest_key(t *config.MessageTrigger) string {
+	if _, _, ok := t.Output(); ok {
+		return t.Target
+	}
+	return t.SlackChannel
+}
+
+func (p *processor) add_digest_item(m message.Message) error {
+	if m.DigestItem == nil {
+		return nil
+	}
+	return p.state.AddDigestItem(digest_key(m.Trigger), m.DigestItem)
+}
+
+// Post the digest for every channel whose scheduled time has passed since its
+// last digest, including those for subscriptions
+func (p *processor) send_digests(now time.Time) {
+	done := make(map[string]bool)
+	triggers, _ := p.triggers()
+
+	for _, trigger := range triggers {
+		channel := digest_key(trigger)
+		if trigger.Delivery != config.DeliveryDigest || done[channel] {
+			continue
+		}
+		done[channel] = true
+
+		if err := p.send_digest(trigger, channel, trigger.Digest.LastScheduled(now), now); err != nil {
+			log.LogF("Failed to send digest to %s: %s", channel, err)
+		}
+	}
+}
+
+func (p *processor) send_digest(trigger *config.MessageTrigger, channel string, scheduled, now time.Time) error {
+	last, ok, err := p.state.GetLastDigest(channel)
+	if err != nil {
+		return err
+	} else if !ok {
+		// First time round - start collecting for the next digest
+		log.LogF("Starting digest for %s", channel)
+		return p.state.RecordLastDigest(channel, now)
+	} else if !last.Before(scheduled) {
+		// Not due yet
+		return nil
+	}
+
+	var items []message.DigestItem
+	if err := p.state.TakeDigestItems(channel, &items); err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		log.LogF("Nothing to put in the digest for %s", channel)
+		return p.state.RecordLastDigest(channel, now)
+	}
+
+	log.LogF("Posting digest of %d items to %s", len(items), channel)
+	if err := p.post_digest(trigger, channel, items); err != nil {
+		// Put the items back for the next attempt
+		for _, item := range items {
+			if err := p.state.AddDigestItem(channel, item); err != nil {
+				log.LogF("Failed to keep digest item for %s: %s", channel, err)
+			}
+		}
+		return err
+	}
+	return p.state.RecordLastDigest(channel, now)
+}
+
+func (p *processor) post_digest(trigger *config.MessageTrigger, channel string, items []message.DigestItem) error {
+	m := message.NewDigestMessage(channel, items)
+	if _, _, ok := trigger.Output(); ok {
+		m.Trigger = trigger
+		return p.sinks.Send(m)
+	}
+	_, _, err := p.slack_client.PostMessage(m)
+	return err
+}
@@ -0,0 +1,72 @@
+package slackbot_atlassian
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"slackbot_atlassian/config"
+	"slackbot_atlassian/message"
+	"slackbot_atlassian/state"
+)
+
+func test_digest_processor(t *testing.T, subscriptions ...config.MessageTrigger) (*processor, *memory_state, *recording_slack) {
+	cfg, err := config.LoadConfig(strings.NewReader(`{
+		"triggers": [{"slack_channel": "#team-yoda-jira", "delivery": "digest", "digest": {"at": "09:00"}}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := new_memory_state()
+	for i, s := range subscriptions {
+		st.subscriptions = append(st.subscriptions, state.Subscription{ID: fmt.Sprint(i + 1), Trigger: s})
+	}
+	slack_client := &recording_slack{errs: make(map[string]error)}
+	return &processor{config: cfg, state: st, slack_client: slack_client}, st, slack_client
+}
+
+func TestSubscriptionDigests(t *testing.T) {
+	p, st, slack_client := test_digest_processor(t, config.MessageTrigger{SlackChannel: "#team-luke-jira", Delivery: config.DeliveryDigest})
+	now := time.Date(2017, 7, 14, 10, 0, 0, 0, time.UTC)
+	yesterday := now.AddDate(0, 0, -1)
+
+	for _, channel := range []string{"#team-yoda-jira", "#team-luke-jira"} {
+		st.last_digests[channel] = yesterday
+		st.AddDigestItem(channel, message.DigestItem{IssueKey: "LRN-1", Type: message.ActivityCommented, Time: yesterday})
+	}
+
+	p.send_digests(now)
+	if len(slack_client.posted) != 2 {
+		t.Fatalf("Expected a digest for the trigger and the subscription, got %+v", slack_client.posted)
+	}
+	if len(st.digest_items) != 0 || !st.last_digests["#team-luke-jira"].Equal(now) {
+		t.Errorf("Expected the subscription's digest to be taken and recorded, got %v and %v", st.digest_items, st.last_digests)
+	}
+}
+
+func TestFailedDigest(t *testing.T) {
+	p, st, slack_client := test_digest_processor(t)
+	now := time.Date(2017, 7, 14, 10, 0, 0, 0, time.UTC)
+	yesterday := now.AddDate(0, 0, -1)
+	st.last_digests["#team-yoda-jira"] = yesterday
+	st.AddDigestItem("#team-yoda-jira", message.DigestItem{IssueKey: "LRN-1", Type: message.ActivityCommented, Time: yesterday})
+	st.AddDigestItem("#team-yoda-jira", message.DigestItem{IssueKey: "LRN-2", Type: message.ActivityCommented, Time: yesterday})
+
+	slack_client.errs["#team-yoda-jira"] = fmt.Errorf("rate_limited")
+	p.send_digests(now)
+	if len(st.digest_items["#team-yoda-jira"]) != 2 || !st.last_digests["#team-yoda-jira"].Equal(yesterday) {
+		t.Fatalf("Expected the digest to be kept for the next attempt, got %v and %v", st.digest_items, st.last_digests)
+	}
+
+	// The next attempt posts the same items
+	delete(slack_client.errs, "#team-yoda-jira")
+	later := now.Add(time.Minute)
+	p.send_digests(later)
+	if len(slack_client.posted) != 1 || len(st.digest_items) != 0 || !st.last_digests["#team-yoda-jira"].Equal(later) {
+		t.Fatalf("Expected the digest to be posted on retry, got %+v, %v and %v", slack_client.posted, st.digest_items, st.last_digests)
+	}
+	if text := slack_client.posted[0].Text; !strings.Contains(text, "2 updates on 2 issues") || !strings.Contains(text, "*Commented on (2)*") {
+		t.Errorf("Expected both comments in the digest, got %q", text)
+	}
+}
@@ -0,0 +1,181 @@
+package message
+
+import (
+	"regexp"
+	"strings"
+
+	"slackbot_atlassian/atlassian"
+	"slackbot_atlassian/config"
+)
+
+// The longest comment excerpt shown on a card
+const card_excerpt_length = 300
+
+// A rich description of an issue message, independent of how it ends up being
+// laid out. The slack package renders it as attachments or Block Kit blocks.
+type Card struct {
+	// The issue key and summary, and where they link to
+	Title     string
+	TitleLink string
+
+	// The sidebar color, as a hex string
+	Color string
+
+	// What happened (the message text) and an excerpt of any comment
+	Text    string
+	Excerpt string
+
+	Fields []CardField
+
+	// Buttons for acting on the issue
+	Actions []CardAction
+
+	// Plain text for notifications and clients that can't show the card
+	Fallback string
+}
+
+type CardField struct {
+	Title string
+	Value string
+	Short bool
+}
+
+// A button on a card. The ID says what it does (e.g. "assign" or
+// "transition:Done") and the value is the issue key.
+type CardAction struct {
+	ID    string
+	Text  string
+	Value string
+}
+
+const transition_action_prefix = "transition:"
+
+// The buttons for a trigger's actions and transitions on an issue
+func NewCardActions(trigger *config.MessageTrigger, issue_key string) []CardAction {
+	var actions []CardAction
+	for _, a := range trigger.Actions {
+		switch a {
+		case config.ActionAssign:
+			actions = append(actions, CardAction{a, "Assign to me", issue_key})
+		case config.ActionComment:
+			actions = append(actions, CardAction{a, "Add comment", issue_key})
+		}
+	}
+	for _, t := range trigger.Transitions {
+		actions = append(actions, CardAction{transition_action_prefix + t, t, issue_key})
+	}
+	return actions
+}
+
+// The status a transition button moves the issue to, if it is one
+func (a CardAction) Transition() (string, bool) {
+	if !strings.HasPrefix(a.ID, transition_action_prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(a.ID, transition_action_prefix), true
+}
+
+// Colors for Jira's status categories, as used in the Jira UI
+var status_category_colors = map[string]string{
+	"new":           "#4a6785",
+	"indeterminate": "#ffd351",
+	"done":          "#14892c",
+}
+
+// Colors for the default Jira priorities (both old and new naming schemes)
+var priority_colors = map[string]string{
+	"blocker":  "#d04437",
+	"highest":  "#d04437",
+	"critical": "#f15c75",
+	"high":     "#f15c75",
+	"major":    "#f79232",
+	"medium":   "#f79232",
+	"minor":    "#707070",
+	"low":      "#707070",
+	"trivial":  "#999999",
+	"lowest":   "#999999",
+}
+
+const default_card_color = "#cccccc"
+
+// Build a card for an issue. text is the message describing what happened.
+func NewCard(issue *atlassian.Issue, text, url, color_by string) *Card {
+	card := &Card{
+		Text:      text,
+		TitleLink: url,
+		Color:     default_card_color,
+	}
+	if issue == nil {
+		card.Fallback = text
+		return card
+	}
+
+	summary := field_display(issue, "summary")
+	card.Title = issue.Id
+	if summary != "" {
+		card.Title += ": " + summary
+	}
+
+	for _, f := range []struct{ title, field string }{
+		{"Assignee", "assignee"},
+		{"Status", "status"},
+		{"Priority", "priority"},
+	} {
+		if v := field_display(issue, f.field); v != "" {
+			card.Fields = append(card.Fields, CardField{f.title, v, true})
+		}
+	}
+
+	switch color_by {
+	case config.ColorByPriority:
+		if c, ok := priority_colors[strings.ToLower(field_display(issue, "priority"))]; ok {
+			card.Color = c
+		}
+	default:
+		if c, ok := status_category_colors[status_category(issue)]; ok {
+			card.Color = c
+		}
+	}
+
+	card.Fallback = card.Title
+	if text = strings.TrimSpace(text); text != "" {
+		card.Fallback += " - " + text
+	}
+
+	return card
+}
+
+// Get a human readable value for an issue field, preferring display names
+func field_display(issue *atlassian.Issue, name string) string {
+	switch v := issue.Fields[name].(type) {
+	case string:
+		return v
+	case map[string]interface{}:
+		for _, k := range []string{"displayName", "value", "name"} {
+			if s, ok := v[k].(string); ok && s != "" {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+func status_category(issue *atlassian.Issue) string {
+	status, ok := issue.Fields["status"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	category, ok := status["statusCategory"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	key, _ := category["key"].(string)
+	return key
+}
+
+var html_tag_re = regexp.MustCompile(`<[^>]*>`)
+
+// A short excerpt of the activity's body (e.g. a comment)
+func activity_excerpt(activity *atlassian.ActivityItem) string {
+	return TruncateMrkdwn(card_excerpt_length, HTMLToMrkdwn(activity.Body()))
+}
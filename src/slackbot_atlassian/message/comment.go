@@ -0,0 +1,185 @@
+package message
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"slackbot_atlassian/atlassian"
+	"slackbot_atlassian/config"
+)
+
+// The longest comment shown in a message before it is cut off with a "read
+// more" link
+const comment_length = 500
+
+// Attachments added this long before or after an activity are taken to be
+// part of it
+const attachment_window = time.Minute
+
+// A comment made in an activity, as shown in messages
+type Comment struct {
+	Id     string
+	Author string
+
+	// The comment as mrkdwn, cut down to comment_length, and the full text
+	Text     string
+	FullText string
+
+	// Where to read the whole comment, and whether Text was cut short
+	URL       string
+	Truncated bool
+}
+
+// A file attached in an activity
+type Attachment struct {
+	Filename  string
+	URL       string
+	Size      int64
+	MimeType  string
+	Thumbnail string
+}
+
+// The comment an activity adds, from the issue's REST comments if we can find
+// it there (as that has the full body) and otherwise from the activity stream
+func activity_comment(activity_issue atlassian.ActivityIssue) *Comment {
+	activity := activity_issue.Activity
+	id, is_comment := activity.CommentID()
+	if !is_comment && ActivityType(activity) != ActivityCommented {
+		return nil
+	}
+
+	c := &Comment{Id: id, Author: activity.Author.Name, URL: comment_url(activity, id)}
+	if rest := issue_comment(activity_issue.Issue, id); rest != nil {
+		c.FullText = WikiToMrkdwn(rest.Body)
+	} else {
+		c.FullText = HTMLToMrkdwn(activity.Body())
+	}
+	if c.FullText == "" {
+		return nil
+	}
+
+	c.Text = TruncateMrkdwn(comment_length, c.FullText)
+	c.Truncated = c.Text != c.FullText
+	return c
+}
+
+func issue_comment(issue *atlassian.Issue, id string) *atlassian.Comment {
+	if issue == nil || id == "" {
+		return nil
+	}
+	for _, c := range issue.Comments() {
+		if c.Id == id {
+			return &c
+		}
+	}
+	return nil
+}
+
+func comment_url(activity *atlassian.ActivityItem, id string) string {
+	if link := activity.AlternateLink(); link != "" {
+		return link
+	}
+	target := activity_target(activity)
+	if target == nil || target.Link.Href == "" {
+		return ""
+	}
+	if id == "" {
+		return target.Link.Href
+	}
+	return fmt.Sprintf("%s?focusedCommentId=%s#comment-%s", target.Link.Href, id, id)
+}
+
+// Attachments are referred to in wiki markup as !name! (images) or [^name]
+var attachment_ref_re = regexp.MustCompile(`!([^!\s|]+)(?:\|[^!]*)?!|\[\^([^\[\]]+)\]`)
+
+// The files attached in an activity: those referred to in its comment, and
+// those its author attached at the time of the activity
+func activity_attachments(activity_issue atlassian.ActivityIssue) []Attachment {
+	if activity_issue.Issue == nil {
+		return nil
+	}
+	activity := activity_issue.Activity
+
+	referenced := make(map[string]bool)
+	id, _ := activity.CommentID()
+	if c := issue_comment(activity_issue.Issue, id); c != nil {
+		for _, m := range attachment_ref_re.FindAllStringSubmatch(c.Body, -1) {
+			referenced[m[1]+m[2]] = true
+		}
+	}
+
+	var attachments []Attachment
+	for _, a := range activity_issue.Issue.Attachments() {
+		if !referenced[a.Filename] && !attached_during(a, activity) {
+			continue
+		}
+		attachments = append(attachments, Attachment{
+			Filename:  a.Filename,
+			URL:       a.Content,
+			Size:      a.Size,
+			MimeType:  a.MimeType,
+			Thumbnail: a.Thumbnail,
+		})
+	}
+	return attachments
+}
+
+func attached_during(a atlassian.Attachment, activity *atlassian.ActivityItem) bool {
+	if a.Author.Name != activity.Author.Username || activity.Updated.IsZero() {
+		return false
+	}
+	created, err := time.Parse(config.JiraDatetimeLayout, a.Created)
+	if err != nil {
+		return false
+	}
+	d := created.Sub(activity.Updated)
+	return d > -attachment_window && d < attachment_window
+}
+
+// The comment as a block quote, with a link to the rest of it if it was cut
+// short
+func (c *Comment) Quote() string {
+	text := prefix_lines(c.Text, "> ")
+	if c.Truncated && c.URL != "" {
+		text += fmt.Sprintf("\n<%s|Read more>", c.URL)
+	}
+	return text
+}
+
+// The comment cut down to n characters, with a link to the rest of it
+func (c *Comment) excerpt(n int) string {
+	text := TruncateMrkdwn(n, c.FullText)
+	if text != c.FullText && c.URL != "" {
+		text += fmt.Sprintf("\n<%s|Read more>", c.URL)
+	}
+	return text
+}
+
+// One line per attachment, linking to the file
+func attachment_lines(attachments []Attachment) string {
+	var lines []string
+	for _, a := range attachments {
+		line := ":paperclip: " + SlackEscape(a.Filename)
+		if a.URL != "" {
+			line = fmt.Sprintf(":paperclip: <%s|%s>", a.URL, SlackEscape(a.Filename))
+		}
+		if a.Size > 0 {
+			line += " (" + file_size(a.Size) + ")"
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func file_size(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%d KB", n/(1<<10))
+	default:
+		return fmt.Sprintf("%d bytes", n)
+	}
+}
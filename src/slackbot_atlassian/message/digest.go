@@ -0,0 +1,171 @@
+package message
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"slackbot_atlassian/atlassian"
+	"slackbot_atlassian/config"
+)
+
+// The kinds of change a digest groups activities by, in the order they are
+// listed
+const (
+	ActivityCreated   = "created"
+	ActivityResolved  = "resolved"
+	ActivityCommented = "commented"
+	ActivityUpdated   = "updated"
+)
+
+var digest_sections = []struct {
+	activity_type string
+	title         string
+}{
+	{ActivityCreated, "Created"},
+	{ActivityResolved, "Resolved"},
+	{ActivityCommented, "Commented on"},
+	{ActivityUpdated, "Updated"},
+}
+
+// An activity waiting to be posted in a digest
+type DigestItem struct {
+	IssueKey     string    `json:"issue_key"`
+	IssueSummary string    `json:"issue_summary"`
+	IssueURL     string    `json:"issue_url"`
+	Type         string    `json:"type"`
+	Author       string    `json:"author"`
+	Text         string    `json:"text"`
+	Time         time.Time `json:"time"`
+}
+
+var (
+	created_re  = regexp.MustCompile(`^created\b`)
+	resolved_re = regexp.MustCompile(`^(resolved|closed)\b|changed the status to '?(Resolved|Done|Closed)`)
+	comment_re  = regexp.MustCompile(`^commented\b`)
+)
+
+// Work out what kind of change an activity is from its title
+func ActivityType(activity *atlassian.ActivityItem) string {
+	text := strings.TrimSpace(GetTextFromActivityItem(activity))
+	switch {
+	case created_re.MatchString(text):
+		return ActivityCreated
+	case resolved_re.MatchString(text):
+		return ActivityResolved
+	case comment_re.MatchString(text):
+		return ActivityCommented
+	default:
+		return ActivityUpdated
+	}
+}
+
+func new_digest_item(activity_issue atlassian.ActivityIssue, text string) DigestItem {
+	activity := activity_issue.Activity
+	item := DigestItem{
+		Type:   ActivityType(activity),
+		Author: activity.Author.Name,
+		Text:   strings.TrimSpace(text),
+		Time:   activity.Updated,
+	}
+	item.IssueKey, _ = activity.GetIssueID()
+	if target := activity_target(activity); target != nil {
+		item.IssueSummary = target.Summary
+		item.IssueURL = target.Link.Href
+	}
+	if issue := activity_issue.Issue; issue != nil {
+		if summary := field_display(issue, "summary"); summary != "" {
+			item.IssueSummary = summary
+		}
+	}
+	return item
+}
+
+// Build the digest message for a channel from the items collected for it
+func NewDigestMessage(channel string, items []DigestItem) Message {
+	issues := make(map[string]bool)
+	by_type := make(map[string][]DigestItem)
+	for _, item := range items {
+		issues[item.IssueKey] = true
+		by_type[item.Type] = append(by_type[item.Type], item)
+	}
+
+	var counts []string
+	for _, section := range digest_sections {
+		if n := len(by_type[section.activity_type]); n != 0 {
+			counts = append(counts, fmt.Sprintf("%d %s", n, section.activity_type))
+		}
+	}
+
+	lines := []string{fmt.Sprintf("*Jira digest: %s on %s* (%s)",
+		plural(len(items), "update"), plural(len(issues), "issue"), strings.Join(counts, ", "))}
+
+	for _, section := range digest_sections {
+		section_items := by_type[section.activity_type]
+		if len(section_items) == 0 {
+			continue
+		}
+
+		lines = append(lines, "", fmt.Sprintf("*%s (%d)*", section.title, len(section_items)))
+		for _, group := range group_digest_items(section_items) {
+			lines = append(lines, digest_line(group))
+		}
+	}
+
+	return Message{
+		SlackChannel: channel,
+		Text:         strings.Join(lines, "\n"),
+		Format:       config.FormatText,
+	}
+}
+
+// Group items by issue, keeping the order issues first appear in
+func group_digest_items(items []DigestItem) [][]DigestItem {
+	var keys []string
+	groups := make(map[string][]DigestItem)
+	for _, item := range items {
+		if _, ok := groups[item.IssueKey]; !ok {
+			keys = append(keys, item.IssueKey)
+		}
+		groups[item.IssueKey] = append(groups[item.IssueKey], item)
+	}
+
+	grouped := make([][]DigestItem, 0, len(keys))
+	for _, k := range keys {
+		grouped = append(grouped, groups[k])
+	}
+	return grouped
+}
+
+// One line of a digest, for one issue
+func digest_line(items []DigestItem) string {
+	first := items[0]
+
+	issue := config.TemplateLink(first.IssueURL, first.IssueKey)
+	if first.IssueSummary != "" {
+		issue += " " + first.IssueSummary
+	}
+
+	var authors []string
+	seen := make(map[string]bool)
+	for _, item := range items {
+		if !seen[item.Author] {
+			seen[item.Author] = true
+			authors = append(authors, item.Author)
+		}
+	}
+
+	line := fmt.Sprintf("• %s — %s", issue, strings.Join(authors, ", "))
+	if len(items) > 1 {
+		line += fmt.Sprintf(" (%d times)", len(items))
+	}
+	return line
+}
+
+func plural(n int, noun string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, noun)
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
@@ -0,0 +1,62 @@
+package message
+
+import (
+	"fmt"
+	"strings"
+
+	"slackbot_atlassian/atlassian"
+	"slackbot_atlassian/config"
+)
+
+// A message showing an issue's card, as posted when someone looks it up from
+// Slack or acts on it there. text says what happened, if anything. The card's
+// excerpt is the start of the issue's description.
+func NewIssueMessage(issue *atlassian.Issue, url, text string) Message {
+	card := NewCard(issue, text, url, config.ColorByStatus)
+	if description, ok := issue.Fields["description"].(string); ok {
+		card.Excerpt = TruncateMrkdwn(card_excerpt_length, WikiToMrkdwn(description))
+	}
+	return Message{
+		Text:     text,
+		Format:   config.FormatAttachment,
+		Card:     card,
+		IssueKey: issue.Id,
+	}
+}
+
+// A message listing the issues found by a search. issue_url gives the link to
+// each issue.
+func NewSearchMessage(jql string, issues []*atlassian.Issue, issue_url func(key string) string) Message {
+	if len(issues) == 0 {
+		return Message{
+			Text:   fmt.Sprintf("No issues match `%s`", SlackEscape(jql)),
+			Format: config.FormatText,
+		}
+	}
+
+	lines := []string{fmt.Sprintf("Top %s matching `%s`:", plural(len(issues), "issue"), SlackEscape(jql))}
+	for _, issue := range issues {
+		lines = append(lines, "• "+IssueLine(issue, issue_url(issue.Id)))
+	}
+
+	return Message{
+		Text:   strings.Join(lines, "\n"),
+		Format: config.FormatText,
+	}
+}
+
+// A one line summary of an issue: its key (linking to it), summary, status
+// and assignee
+func IssueLine(issue *atlassian.Issue, url string) string {
+	line := fmt.Sprintf("%s %s", config.TemplateLink(url, issue.Id), SlackEscape(field_display(issue, "summary")))
+	var details []string
+	for _, field := range []string{"status", "assignee"} {
+		if v := field_display(issue, field); v != "" {
+			details = append(details, SlackEscape(v))
+		}
+	}
+	if len(details) != 0 {
+		line += " (" + strings.Join(details, ", ") + ")"
+	}
+	return line
+}
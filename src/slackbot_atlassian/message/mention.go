@@ -0,0 +1,122 @@
+package message
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+
+	"slackbot_atlassian/atlassian"
+	"slackbot_atlassian/config"
+	"slackbot_atlassian/log"
+)
+
+// Finds the Slack users for Jira users
+type UserMapper interface {
+	SlackUserID(atlassian.User) (string, bool, error)
+}
+
+var (
+	// Jira renders mentions as links like
+	// <a href="..." class="user-hover" rel="jane">Jane Doe</a>
+	user_hover_re = regexp.MustCompile(`<a\s[^>]*class="user-hover"[^>]*>(.*?)</a>`)
+	rel_re        = regexp.MustCompile(`\srel="([^"]+)"`)
+
+	// and in wiki markup as [~jane]
+	wiki_mention_re = regexp.MustCompile(`\[~([^\]]+)\]`)
+)
+
+// Find the users mentioned in some Jira HTML or wiki markup
+func MentionedUsers(text string) []atlassian.User {
+	var users []atlassian.User
+	seen := make(map[string]bool)
+	add := func(u atlassian.User) {
+		if u.Name != "" && !seen[u.Name] {
+			seen[u.Name] = true
+			users = append(users, u)
+		}
+	}
+
+	for _, m := range user_hover_re.FindAllStringSubmatch(text, -1) {
+		if rel := rel_re.FindStringSubmatch(m[0]); rel != nil {
+			add(atlassian.User{
+				Name:        html.UnescapeString(rel[1]),
+				DisplayName: html.UnescapeString(html_tag_re.ReplaceAllString(m[1], "")),
+			})
+		}
+	}
+	for _, m := range wiki_mention_re.FindAllStringSubmatch(text, -1) {
+		add(atlassian.User{Name: m[1]})
+	}
+
+	return users
+}
+
+// The users related to an activity's issue in a role
+func role_users(role string, activity_issue atlassian.ActivityIssue) []atlassian.User {
+	switch role {
+	case config.RoleAssignee, config.RoleReporter:
+		if activity_issue.Issue == nil {
+			return nil
+		}
+		if u, ok := activity_issue.Issue.User(role); ok {
+			return []atlassian.User{u}
+		}
+	case config.RoleMentioned:
+		return MentionedUsers(activity_issue.Activity.Body())
+	}
+	return nil
+}
+
+// Render a user as a Slack mention if we can find them in Slack, and as their
+// name otherwise. Takes a Jira user, an activity author, a user object from
+// the issue fields or a username.
+func (m matcher) mention(user interface{}) string {
+	var u atlassian.User
+	switch v := user.(type) {
+	case atlassian.User:
+		u = v
+	case atlassian.Person:
+		u = v.User()
+	case map[string]interface{}:
+		u.Name, _ = v["name"].(string)
+		u.EmailAddress, _ = v["emailAddress"].(string)
+		u.DisplayName, _ = v["displayName"].(string)
+	case string:
+		u.Name = v
+	}
+
+	if m.users != nil && u.Name != "" {
+		id, ok, err := m.users.SlackUserID(u)
+		if err != nil {
+			log.LogF("Could not find Slack user for %s: %s", u.Name, err)
+		} else if ok {
+			return fmt.Sprintf("<@%s>", id)
+		}
+	}
+
+	if slack_user, ok := m.cfg.Users[u.Name]; ok && slack_user.Name != "" {
+		return "@" + slack_user.Name
+	} else if u.DisplayName != "" {
+		return "@" + u.DisplayName
+	}
+	return config.TemplateMention(user)
+}
+
+// The mentions a trigger asks for, e.g. "cc <@U1> <@U2>"
+func (m match) get_mentions() string {
+	var mentions []string
+	seen := make(map[string]bool)
+	for _, role := range m.trigger.Mention {
+		for _, u := range role_users(role, m.activity_issue) {
+			if mention := m.matcher.mention(u); mention != "" && !seen[mention] {
+				seen[mention] = true
+				mentions = append(mentions, mention)
+			}
+		}
+	}
+	if len(mentions) == 0 {
+		return ""
+	}
+	return "cc " + strings.Join(mentions, " ")
+}
@@ -2,7 +2,6 @@ package message
 
 import (
 	"fmt"
-	"html"
 	"regexp"
 	"strings"
 
@@ -15,24 +14,49 @@ type Message struct {
 	SlackChannel string
 	AsUser       config.SlackUser
 	Text         string
-}
 
-func (m Message) HtmlUnescapedText() string {
-	return html.UnescapeString(m.Text)
+	// How to lay the message out, and the card to show for the rich formats
+	Format string
+	Card   *Card
+
+	// The trigger that produced the message, the issue it is about and who
+	// did whatever it is about
+	Trigger  *config.MessageTrigger
+	IssueKey string
+	Author   atlassian.User
+
+	// Who to send direct messages to, for triggers with a target (except
+	// watchers, who have to be looked up)
+	Recipients []atlassian.User
+
+	// The thread to post the message in, if any, and whether to also post it
+	// to the channel
+	ThreadTimestamp string
+	Broadcast       bool
+
+	// What to record for the digest, for digest triggers
+	DigestItem *DigestItem
 }
 
 type MessageMatcher interface {
 	GetMatchingMessages([]*config.MessageTrigger, ...atlassian.ActivityIssue) []Message
+
+	// Get the messages for a group of activities by one person on one
+	// issue (in the order they happened), combining the activities each
+	// trigger matches into a single message
+	GetGroupMessages([]*config.MessageTrigger, ...atlassian.ActivityIssue) []Message
 }
 
 type matcher struct {
 	cfg                config.SlackConfig
 	custom_jira_fields []config.CustomJiraFieldConfig
 	user_image_urls    map[string]string
+	users              UserMapper
 }
 
-func NewMessageMatcher(cfg config.SlackConfig, user_image_urls map[string]string, custom_jira_fields ...config.CustomJiraFieldConfig) MessageMatcher {
-	return matcher{cfg, custom_jira_fields, user_image_urls}
+// Create a matcher. users is used to mention people, and may be nil.
+func NewMessageMatcher(cfg config.SlackConfig, user_image_urls map[string]string, users UserMapper, custom_jira_fields ...config.CustomJiraFieldConfig) MessageMatcher {
+	return matcher{cfg, custom_jira_fields, user_image_urls, users}
 }
 
 func (m matcher) GetMatchingMessages(triggers []*config.MessageTrigger, activity_issues ...atlassian.ActivityIssue) []Message {
@@ -51,7 +75,35 @@ func (m matcher) GetMatchingMessages(triggers []*config.MessageTrigger, activity
 	return messages
 }
 
+func (m matcher) GetGroupMessages(triggers []*config.MessageTrigger, group ...atlassian.ActivityIssue) []Message {
+	messages := make([]Message, 0)
+
+	for _, trigger := range triggers {
+		var matches []*match
+		for _, activity_issue := range group {
+			if match, ok, err := m.get_match(trigger, activity_issue); ok && err == nil {
+				matches = append(matches, match)
+			} else if err != nil {
+				log.LogF("Error matching issue %v: %s", activity_issue, err)
+			}
+		}
+		if len(matches) == 0 {
+			continue
+		}
+
+		// The latest activity carries the others along with it
+		latest := matches[len(matches)-1]
+		for _, earlier := range matches[:len(matches)-1] {
+			latest.earlier = append(latest.earlier, earlier.activity_issue)
+		}
+		messages = append(messages, latest.get_messages()...)
+	}
+
+	return messages
+}
+
 func (m matcher) get_match(trigger *config.MessageTrigger, activity_issue atlassian.ActivityIssue) (*match, bool, error) {
+	matched := make(map[string]string)
 	for name, match := range trigger.GetCompiledMatches() {
 		// Look up the value for this field
 		field_val, ok, err := m.get_trigger_field_value(name, activity_issue)
@@ -62,9 +114,10 @@ func (m matcher) get_match(trigger *config.MessageTrigger, activity_issue atlass
 		if !match.MatchString(field_val) {
 			return nil, false, nil
 		}
+		matched[name] = field_val
 	}
 
-	return &match{m.user_image_urls, trigger, activity_issue}, true, nil
+	return &match{m, trigger, activity_issue, matched, nil}, true, nil
 }
 
 func (m matcher) get_trigger_field_value(name string, activity_issue atlassian.ActivityIssue) (string, bool, error) {
@@ -100,6 +153,11 @@ func (m matcher) get_trigger_field_value(name string, activity_issue atlassian.A
 		}
 	}
 
+	// The issue key isn't a field, but is handy for matching projects
+	if name == "key" {
+		return activity_issue.Issue.Id, true, nil
+	}
+
 	// Now try with built-in fields
 	return lookup_field(name)
 }
@@ -137,39 +195,151 @@ func format_field_value_from_slice(s []interface{}) string {
 }
 
 type match struct {
-	user_image_urls map[string]string
-	trigger         *config.MessageTrigger
-	activity_issue  atlassian.ActivityIssue
+	matcher        matcher
+	trigger        *config.MessageTrigger
+	activity_issue atlassian.ActivityIssue
+	matched        map[string]string
+
+	// Earlier activities coalesced into this one
+	earlier []atlassian.ActivityIssue
 }
 
 func (m match) get_messages() []Message {
 	message := Message{
-		m.trigger.SlackChannel,
-		config.SlackUser{
+		SlackChannel: m.trigger.SlackChannel,
+		AsUser: config.SlackUser{
 			Name:    m.activity_issue.Activity.Author.Name,
-			IconUrl: m.user_image_urls[m.activity_issue.Activity.Author.Username],
+			IconUrl: m.matcher.user_image_urls[m.activity_issue.Activity.Author.Username],
 		},
-		GetTextFromActivityItem(m.activity_issue.Activity),
+		Text:    m.get_text(),
+		Format:  m.trigger.Format,
+		Trigger: m.trigger,
+		Author:  m.activity_issue.Activity.Author.User(),
+	}
+	if mentions := m.get_mentions(); mentions != "" {
+		message.Text = strings.TrimRight(message.Text, " \n") + "\n" + mentions
+	}
+	if issue_id, ok := m.activity_issue.Activity.GetIssueID(); ok {
+		message.IssueKey = issue_id
+	}
+	if !m.is_text_format() {
+		message.Card = m.get_card(message.Text)
+	}
+	if m.trigger.Delivery == config.DeliveryDigest {
+		item := new_digest_item(m.activity_issue, message.Text)
+		message.DigestItem = &item
+	}
+	if m.trigger.Target != "" {
+		for _, u := range role_users(m.trigger.Target, m.activity_issue) {
+			// Don't tell people about what they did themselves
+			if u.Name != message.Author.Name {
+				message.Recipients = append(message.Recipients, u)
+			}
+		}
 	}
 	return []Message{message}
 }
 
-func GetTextFromActivityItem(activity *atlassian.ActivityItem) string {
-	// Strip name from start of title
-	re := regexp.MustCompile("^<a.+?</a>")
-	text := re.ReplaceAllString(activity.Title, "")
+func (m match) get_card(text string) *Card {
+	var url string
+	if target := activity_target(m.activity_issue.Activity); target != nil {
+		url = target.Link.Href
+	}
+	text = strings.TrimSpace(text)
+	if m.trigger.Delivery == config.DeliveryCard {
+		// Updated cards keep the name of whoever posted them first, so say
+		// who did the latest thing
+		text = fmt.Sprintf("*%s* %s", m.activity_issue.Activity.Author.Name, text)
+	}
+	card := NewCard(m.activity_issue.Issue, text, url, m.trigger.ColorBy)
+	if c := activity_comment(m.activity_issue); c != nil {
+		card.Excerpt = c.excerpt(card_excerpt_length)
+	} else {
+		card.Excerpt = activity_excerpt(m.activity_issue.Activity)
+	}
+	if attachments := activity_attachments(m.activity_issue); len(attachments) != 0 {
+		card.Fields = append(card.Fields, CardField{Title: "Attachments", Value: attachment_lines(attachments)})
+	}
+	if issue_id, ok := m.activity_issue.Activity.GetIssueID(); ok {
+		card.Actions = NewCardActions(m.trigger, issue_id)
+	}
+	return card
+}
 
-	// Convert resolved links
-	re = regexp.MustCompile(`<span class='resolved-link'>(.+?)</span>`)
-	text = re.ReplaceAllString(text, "~$1~")
+// Render the message text with the trigger's template, falling back to the
+// default text for the activity
+func (m match) get_text() string {
+	tmpl := m.trigger.GetCompiledTemplate()
+	if tmpl == nil {
+		return m.get_default_text()
+	}
 
-	// Convert HTML links
-	re = regexp.MustCompile(`<a .*?href="(.+?)".*?>(.+?)</a>`)
-	text = re.ReplaceAllString(text, "<$1|$2>")
+	data := m.matcher.template_data(m.activity_issue, m.matched)
+	if len(m.earlier) != 0 {
+		for _, ai := range m.all_activity_issues() {
+			data.Changes = append(data.Changes, strings.TrimSpace(GetTextFromActivityItem(ai.Activity)))
+		}
+	}
 
-	// Strip duplicate whitespace
-	re = regexp.MustCompile("\\s+")
-	text = re.ReplaceAllString(text, " ")
+	text, err := m.matcher.execute_template(tmpl, data)
+	if err != nil {
+		log.LogF("Error rendering template for %s: %s", m.trigger.Name(), err)
+		return m.get_default_text()
+	}
+	return text
+}
+
+func (m match) get_default_text() string {
+	if len(m.earlier) != 0 {
+		return GetCombinedText(m.all_activity_issues())
+	}
 
+	text := GetTextFromActivityItem(m.activity_issue.Activity)
+	if !m.is_text_format() {
+		// Cards show the comment and attachments themselves
+		return text
+	}
+	if c := activity_comment(m.activity_issue); c != nil {
+		text += "\n" + c.Quote()
+	}
+	if attachments := activity_attachments(m.activity_issue); len(attachments) != 0 {
+		text += "\n" + attachment_lines(attachments)
+	}
 	return text
 }
+
+func (m match) is_text_format() bool {
+	return m.trigger.Format == config.FormatText || m.trigger.Format == ""
+}
+
+func (m match) all_activity_issues() []atlassian.ActivityIssue {
+	return append(append([]atlassian.ActivityIssue(nil), m.earlier...), m.activity_issue)
+}
+
+// Describe several activities on one issue as a single list of changes
+func GetCombinedText(activity_issues []atlassian.ActivityIssue) string {
+	latest := activity_issues[len(activity_issues)-1]
+
+	issue, _ := latest.Activity.GetIssueID()
+	if target := activity_target(latest.Activity); target != nil && target.Link.Href != "" {
+		issue = fmt.Sprintf("<%s|%s>", target.Link.Href, issue)
+	}
+
+	lines := []string{fmt.Sprintf("made %d changes to %s:", len(activity_issues), issue)}
+	for _, ai := range activity_issues {
+		lines = append(lines, "• "+strings.TrimSpace(GetTextFromActivityItem(ai.Activity)))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Convert an activity's title to mrkdwn, without the name of the person who
+// did it (which is shown as the message's user name instead)
+func GetTextFromActivityItem(activity *atlassian.ActivityItem) string {
+	// Strip name from start of title
+	text := strings.TrimSpace(activity.Title)
+	text = author_link_re.ReplaceAllString(text, "")
+
+	return collapse_whitespace(HTMLToMrkdwn(text))
+}
+
+var author_link_re = regexp.MustCompile("^<a.+?</a>")
@@ -0,0 +1,393 @@
+package message
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"slackbot_atlassian/atlassian"
+	"slackbot_atlassian/config"
+)
+
+func load_triggers(t *testing.T, triggers ...map[string]interface{}) []*config.MessageTrigger {
+	b, err := json.Marshal(map[string]interface{}{"triggers": triggers})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.LoadConfig(bytes.NewBuffer(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg.Triggers
+}
+
+func test_activity_issue() atlassian.ActivityIssue {
+	return atlassian.ActivityIssue{
+		Activity: &atlassian.ActivityItem{
+			Title: `<a href="https://learnosity.atlassian.net/secure/ViewProfile.jspa?name=bob">Bob Smith</a> resolved <a href="https://learnosity.atlassian.net/browse/LRN-115">LRN-115</a>`,
+			Author: atlassian.Person{
+				Name:     "Bob Smith",
+				Username: "bob",
+			},
+			ActivityObject: &atlassian.ActivityTargetOrObject{
+				Title:   "LRN-115",
+				Summary: "Author API v1.0.0",
+				Link:    atlassian.Link{Href: "https://learnosity.atlassian.net/browse/LRN-115"},
+			},
+		},
+		Issue: &atlassian.Issue{
+			Id: "LRN-115",
+			Fields: map[string]interface{}{
+				"summary":           "Author API v1.0.0",
+				"priority":          map[string]interface{}{"name": "Blocker"},
+				"customfield_10500": map[string]interface{}{"value": "Yoda"},
+				"updated":           "2016-05-10T10:20:30.000+1000",
+			},
+		},
+	}
+}
+
+func TestTemplateMessages(t *testing.T) {
+	cases := []struct {
+		template string
+		expected string
+	}{
+		{"", "resolved <https://learnosity.atlassian.net/browse/LRN-115|LRN-115>"},
+		{"{{link .URL .Key}}: {{.Summary}}", "<https://learnosity.atlassian.net/browse/LRN-115|LRN-115>: Author API v1.0.0"},
+		{"{{.Fields.team}} / {{.Fields.priority}} / {{.Matched.team}}", "Yoda / Blocker / Yoda"},
+		{"{{mention .Author}} {{.Text}}", "@Bobby resolved <https://learnosity.atlassian.net/browse/LRN-115|LRN-115>"},
+		{"{{.Summary | truncate 10}}", "Author AP…"},
+		{`{{date "2 Jan 2006" .Issue.Fields.updated}}`, "10 May 2016"},
+		// Rendering errors fall back to the default text
+		{`{{date "2 Jan 2006" .Fields.team}}`, "resolved <https://learnosity.atlassian.net/browse/LRN-115|LRN-115>"},
+	}
+
+	slack_cfg := config.SlackConfig{
+		Users: map[string]config.SlackUser{"bob": {Name: "Bobby"}},
+	}
+	custom_fields := config.CustomJiraFieldConfig{Name: "team", JiraField: "customfield_10500"}
+	m := NewMessageMatcher(slack_cfg, nil, nil, custom_fields)
+
+	for _, c := range cases {
+		triggers := load_triggers(t, map[string]interface{}{
+			"slack_channel": "team-yoda-jira",
+			"match":         map[string]string{"team": "Yoda"},
+			"template":      c.template,
+		})
+
+		messages := m.GetMatchingMessages(triggers, test_activity_issue())
+		if len(messages) != 1 {
+			t.Fatalf("Expected 1 message, got %d", len(messages))
+		}
+		if messages[0].Text != c.expected {
+			t.Errorf("Template %q: expected %q, got %q", c.template, c.expected, messages[0].Text)
+		}
+	}
+}
+
+func TestMatchIssueKey(t *testing.T) {
+	m := NewMessageMatcher(config.SlackConfig{}, nil, nil)
+
+	for pattern, expected := range map[string]int{"^LRN-": 1, "^OPS-": 0} {
+		triggers := load_triggers(t, map[string]interface{}{
+			"slack_channel": "team-yoda-jira",
+			"match":         map[string]string{"key": pattern},
+		})
+		if messages := m.GetMatchingMessages(triggers, test_activity_issue()); len(messages) != expected {
+			t.Errorf("%q: expected %d messages, got %d", pattern, expected, len(messages))
+		}
+	}
+}
+
+func TestCardMessages(t *testing.T) {
+	cases := []struct {
+		format   string
+		color_by string
+		card     bool
+		color    string
+	}{
+		{"", "", false, ""},
+		{"attachment", "", true, "#14892c"},
+		{"blocks", "priority", true, "#d04437"},
+	}
+
+	ai := test_activity_issue()
+	ai.Issue.Fields["assignee"] = map[string]interface{}{"name": "jane", "displayName": "Jane Doe"}
+	ai.Issue.Fields["status"] = map[string]interface{}{
+		"name":           "Resolved",
+		"statusCategory": map[string]interface{}{"key": "done"},
+	}
+	m := NewMessageMatcher(config.SlackConfig{}, nil, nil)
+
+	for _, c := range cases {
+		triggers := load_triggers(t, map[string]interface{}{
+			"slack_channel": "team-yoda-jira",
+			"format":        c.format,
+			"color_by":      c.color_by,
+		})
+
+		messages := m.GetMatchingMessages(triggers, ai)
+		if len(messages) != 1 {
+			t.Fatalf("Expected 1 message, got %d", len(messages))
+		}
+		card := messages[0].Card
+		if !c.card {
+			if card != nil {
+				t.Errorf("Format %q: expected no card", c.format)
+			}
+			continue
+		} else if card == nil {
+			t.Fatalf("Format %q: expected a card", c.format)
+		}
+
+		if card.Title != "LRN-115: Author API v1.0.0" {
+			t.Errorf("Unexpected card title %q", card.Title)
+		}
+		if card.Color != c.color {
+			t.Errorf("Format %q: expected color %s, got %s", c.format, c.color, card.Color)
+		}
+		expected_fields := []CardField{
+			{"Assignee", "Jane Doe", true},
+			{"Status", "Resolved", true},
+			{"Priority", "Blocker", true},
+		}
+		if len(card.Fields) != len(expected_fields) {
+			t.Fatalf("Expected fields %v, got %v", expected_fields, card.Fields)
+		}
+		for i, f := range expected_fields {
+			if card.Fields[i] != f {
+				t.Errorf("Expected field %v, got %v", f, card.Fields[i])
+			}
+		}
+	}
+}
+
+func TestGroupMessages(t *testing.T) {
+	first := test_activity_issue()
+	first.Activity.Title = `<a href="https://learnosity.atlassian.net/secure/ViewProfile.jspa?name=bob">Bob Smith</a> changed the Assignee to 'Jane Doe' on <a href="https://learnosity.atlassian.net/browse/LRN-115">LRN-115</a>`
+	second := test_activity_issue()
+
+	m := NewMessageMatcher(config.SlackConfig{}, nil, nil)
+
+	triggers := load_triggers(t, map[string]interface{}{"slack_channel": "team-yoda-jira"})
+	messages := m.GetGroupMessages(triggers, first, second)
+	if len(messages) != 1 {
+		t.Fatalf("Expected 1 message, got %d", len(messages))
+	}
+	expected := "made 2 changes to <https://learnosity.atlassian.net/browse/LRN-115|LRN-115>:\n" +
+		"• changed the Assignee to 'Jane Doe' on <https://learnosity.atlassian.net/browse/LRN-115|LRN-115>\n" +
+		"• resolved <https://learnosity.atlassian.net/browse/LRN-115|LRN-115>"
+	if messages[0].Text != expected {
+		t.Errorf("Expected %q, got %q", expected, messages[0].Text)
+	}
+
+	// A single activity is posted as normal
+	messages = m.GetGroupMessages(triggers, second)
+	if len(messages) != 1 || messages[0].Text != "resolved <https://learnosity.atlassian.net/browse/LRN-115|LRN-115>" {
+		t.Errorf("Unexpected messages %v", messages)
+	}
+
+	// Templates get the list of changes
+	triggers = load_triggers(t, map[string]interface{}{
+		"slack_channel": "team-yoda-jira",
+		"template":      "{{.Key}}: {{len .Changes}} changes",
+	})
+	messages = m.GetGroupMessages(triggers, first, second)
+	if len(messages) != 1 || messages[0].Text != "LRN-115: 2 changes" {
+		t.Errorf("Unexpected messages %v", messages)
+	}
+}
+
+func TestDigestMessage(t *testing.T) {
+	m := NewMessageMatcher(config.SlackConfig{}, nil, nil)
+	triggers := load_triggers(t, map[string]interface{}{
+		"slack_channel": "managers",
+		"delivery":      "digest",
+	})
+
+	titles := []string{
+		`created <a href="https://learnosity.atlassian.net/browse/LRN-115">LRN-115</a>`,
+		`commented on <a href="https://learnosity.atlassian.net/browse/LRN-115">LRN-115</a>`,
+		`commented on <a href="https://learnosity.atlassian.net/browse/LRN-115">LRN-115</a>`,
+		`changed the status to 'Done' on <a href="https://learnosity.atlassian.net/browse/LRN-115">LRN-115</a>`,
+		`updated 2 fields of <a href="https://learnosity.atlassian.net/browse/LRN-115">LRN-115</a>`,
+	}
+	expected_types := []string{ActivityCreated, ActivityCommented, ActivityCommented, ActivityResolved, ActivityUpdated}
+
+	var items []DigestItem
+	for i, title := range titles {
+		ai := test_activity_issue()
+		ai.Activity.Title = `<a href="https://learnosity.atlassian.net/secure/ViewProfile.jspa?name=bob">Bob Smith</a> ` + title
+
+		messages := m.GetMatchingMessages(triggers, ai)
+		if len(messages) != 1 || messages[0].DigestItem == nil {
+			t.Fatalf("Expected 1 message with a digest item, got %v", messages)
+		}
+		item := *messages[0].DigestItem
+		if item.Type != expected_types[i] {
+			t.Errorf("Expected %q to be %s, got %s", title, expected_types[i], item.Type)
+		}
+		items = append(items, item)
+	}
+
+	digest := NewDigestMessage("managers", items)
+	expected := "*Jira digest: 5 updates on 1 issue* (1 created, 1 resolved, 2 commented, 1 updated)\n" +
+		"\n*Created (1)*\n• <https://learnosity.atlassian.net/browse/LRN-115|LRN-115> Author API v1.0.0 — Bob Smith\n" +
+		"\n*Resolved (1)*\n• <https://learnosity.atlassian.net/browse/LRN-115|LRN-115> Author API v1.0.0 — Bob Smith\n" +
+		"\n*Commented on (2)*\n• <https://learnosity.atlassian.net/browse/LRN-115|LRN-115> Author API v1.0.0 — Bob Smith (2 times)\n" +
+		"\n*Updated (1)*\n• <https://learnosity.atlassian.net/browse/LRN-115|LRN-115> Author API v1.0.0 — Bob Smith"
+	if digest.Text != expected {
+		t.Errorf("Expected digest:\n%s\ngot:\n%s", expected, digest.Text)
+	}
+}
+
+type test_users map[string]string
+
+func (tu test_users) SlackUserID(u atlassian.User) (string, bool, error) {
+	id, ok := tu[u.Name]
+	return id, ok, nil
+}
+
+func TestMentions(t *testing.T) {
+	ai := test_activity_issue()
+	ai.Activity.Summary.Body = `<p>Thanks <a href="https://learnosity.atlassian.net/secure/ViewProfile.jspa?name=sam" class="user-hover" rel="sam">Sam Jones</a>, ` +
+		`and <a href="https://learnosity.atlassian.net/secure/ViewProfile.jspa?name=jane" class="user-hover" rel="jane">Jane Doe</a></p>`
+	ai.Issue.Fields["assignee"] = map[string]interface{}{"name": "jane", "displayName": "Jane Doe"}
+	ai.Issue.Fields["reporter"] = map[string]interface{}{"name": "bob", "displayName": "Bob Smith"}
+
+	m := NewMessageMatcher(config.SlackConfig{}, nil, test_users{"jane": "U1", "bob": "U2"})
+
+	cases := []struct {
+		trigger  map[string]interface{}
+		expected string
+	}{
+		{
+			map[string]interface{}{"mention": []string{"assignee", "reporter"}},
+			"resolved <https://learnosity.atlassian.net/browse/LRN-115|LRN-115>\ncc <@U1> <@U2>",
+		},
+		{
+			// Sam isn't in Slack, and Jane is only mentioned once
+			map[string]interface{}{"mention": []string{"mentioned", "assignee"}},
+			"resolved <https://learnosity.atlassian.net/browse/LRN-115|LRN-115>\ncc @Sam Jones <@U1>",
+		},
+		{
+			map[string]interface{}{"template": "{{mention .Assignee}}: {{mention .Author}} {{.Text}}"},
+			"<@U1>: <@U2> resolved <https://learnosity.atlassian.net/browse/LRN-115|LRN-115>",
+		},
+	}
+
+	for _, c := range cases {
+		c.trigger["slack_channel"] = "team-yoda-jira"
+		messages := m.GetMatchingMessages(load_triggers(t, c.trigger), ai)
+		if len(messages) != 1 {
+			t.Fatalf("Expected 1 message, got %d", len(messages))
+		}
+		if messages[0].Text != c.expected {
+			t.Errorf("Expected %q, got %q", c.expected, messages[0].Text)
+		}
+	}
+}
+
+func test_comment_activity_issue(body string) atlassian.ActivityIssue {
+	ai := test_activity_issue()
+	ai.Activity.Title = `<a href="https://learnosity.atlassian.net/secure/ViewProfile.jspa?name=bob">Bob Smith</a> commented on <a href="https://learnosity.atlassian.net/browse/LRN-115">LRN-115</a>`
+	ai.Activity.Content = atlassian.Text{Type: "html", Body: "<p>From the <b>stream</b></p>"}
+	ai.Activity.Link = []atlassian.Link{{
+		Rel:  "alternate",
+		Href: "https://learnosity.atlassian.net/browse/LRN-115?focusedCommentId=10200#comment-10200",
+	}}
+	ai.Activity.Updated = time.Date(2016, 5, 10, 0, 20, 30, 0, time.UTC)
+	ai.Issue.Fields["comment"] = map[string]interface{}{
+		"comments": []interface{}{
+			map[string]interface{}{"id": "10100", "body": "An older comment"},
+			map[string]interface{}{"id": "10200", "body": body},
+		},
+	}
+	ai.Issue.Fields["attachment"] = []interface{}{
+		map[string]interface{}{
+			"filename": "shot.png",
+			"content":  "https://learnosity.atlassian.net/secure/attachment/1/shot.png",
+			"size":     2048,
+			"author":   map[string]interface{}{"name": "jane"},
+			"created":  "2016-05-01T10:20:30.000+1000",
+		},
+		map[string]interface{}{
+			"filename": "log.txt",
+			"content":  "https://learnosity.atlassian.net/secure/attachment/2/log.txt",
+			"size":     10,
+			"author":   map[string]interface{}{"name": "bob"},
+			"created":  "2016-05-10T10:20:50.000+1000",
+		},
+		map[string]interface{}{
+			"filename": "old.txt",
+			"author":   map[string]interface{}{"name": "bob"},
+			"created":  "2016-05-09T10:20:50.000+1000",
+		},
+	}
+	return ai
+}
+
+func TestCommentMessages(t *testing.T) {
+	comment_link := "https://learnosity.atlassian.net/browse/LRN-115?focusedCommentId=10200#comment-10200"
+	long := strings.Repeat("word ", 150)
+	cases := []struct {
+		body     string
+		template string
+		expected string
+	}{
+		{
+			"See *this* !shot.png|thumbnail!", "",
+			"commented on <https://learnosity.atlassian.net/browse/LRN-115|LRN-115>\n" +
+				"> See *this* shot.png\n" +
+				":paperclip: <https://learnosity.atlassian.net/secure/attachment/1/shot.png|shot.png> (2 KB)\n" +
+				":paperclip: <https://learnosity.atlassian.net/secure/attachment/2/log.txt|log.txt> (10 bytes)",
+		},
+		{
+			long, "",
+			"commented on <https://learnosity.atlassian.net/browse/LRN-115|LRN-115>\n" +
+				"> " + strings.TrimSpace(long[:comment_length-1]) + "…\n" +
+				"<" + comment_link + "|Read more>\n" +
+				":paperclip: <https://learnosity.atlassian.net/secure/attachment/2/log.txt|log.txt> (10 bytes)",
+		},
+		{
+			"Hello", "{{.Comment.Author}}: {{.Comment.Text}} ({{len .Attachments}})",
+			"Bob Smith: Hello (1)",
+		},
+	}
+
+	m := NewMessageMatcher(config.SlackConfig{}, nil, nil)
+	for _, c := range cases {
+		triggers := load_triggers(t, map[string]interface{}{
+			"slack_channel": "team-yoda-jira",
+			"template":      c.template,
+		})
+		messages := m.GetMatchingMessages(triggers, test_comment_activity_issue(c.body))
+		if len(messages) != 1 {
+			t.Fatalf("Expected 1 message, got %d", len(messages))
+		}
+		if messages[0].Text != c.expected {
+			t.Errorf("Expected %q, got %q", c.expected, messages[0].Text)
+		}
+	}
+
+	// Without the REST comment, the body comes from the activity stream, and
+	// cards show it as the excerpt rather than in the text
+	ai := test_comment_activity_issue("Hello")
+	delete(ai.Issue.Fields, "comment")
+	triggers := load_triggers(t, map[string]interface{}{
+		"slack_channel": "team-yoda-jira",
+		"format":        "attachment",
+	})
+	messages := m.GetMatchingMessages(triggers, ai)
+	if len(messages) != 1 || messages[0].Card == nil {
+		t.Fatalf("Expected 1 message with a card, got %v", messages)
+	}
+	if messages[0].Text != "commented on <https://learnosity.atlassian.net/browse/LRN-115|LRN-115>" {
+		t.Errorf("Unexpected text %q", messages[0].Text)
+	}
+	if messages[0].Card.Excerpt != "From the *stream*" {
+		t.Errorf("Unexpected excerpt %q", messages[0].Card.Excerpt)
+	}
+}
@@ -0,0 +1,450 @@
+package message
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+
+	"slackbot_atlassian/config"
+)
+
+// Converting Jira's HTML (as found in the activity stream) to Slack's mrkdwn.
+//
+// The HTML is tokenized with encoding/xml in its lenient mode, built into a
+// tree (coping with unclosed and mismatched tags), and rendered back out as
+// mrkdwn. If the HTML can't be tokenized at all we fall back to stripping the
+// tags.
+
+// A node in a parsed HTML document: an element, or text if tag is empty
+type html_node struct {
+	tag      string
+	attrs    map[string]string
+	text     string
+	children []*html_node
+	parent   *html_node
+}
+
+// Elements that never have content
+var void_elements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "hr": true, "img": true,
+	"input": true, "link": true, "meta": true, "param": true, "source": true, "wbr": true,
+}
+
+// Elements that are implicitly closed when another of their kind starts
+var self_closing_siblings = map[string]bool{
+	"li": true, "p": true, "tr": true, "td": true, "th": true,
+}
+
+// Elements whose whitespace between children is only layout
+var structural_elements = map[string]bool{
+	"table": true, "thead": true, "tbody": true, "tr": true, "ul": true, "ol": true,
+}
+
+func parse_html(s string) (*html_node, error) {
+	d := xml.NewDecoder(strings.NewReader(s))
+	d.Strict = false
+	d.Entity = xml.HTMLEntity
+
+	root := &html_node{tag: "#root"}
+	current := root
+
+	for {
+		// RawToken doesn't insist that end tags match start tags
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			name := strings.ToLower(t.Name.Local)
+			if self_closing_siblings[name] && current.tag == name {
+				current = current.parent
+			}
+
+			node := &html_node{tag: name, attrs: make(map[string]string), parent: current}
+			for _, a := range t.Attr {
+				node.attrs[strings.ToLower(a.Name.Local)] = a.Value
+			}
+			current.children = append(current.children, node)
+			if !void_elements[name] {
+				current = node
+			}
+		case xml.EndElement:
+			// Close the nearest open element with this name, if any
+			name := strings.ToLower(t.Name.Local)
+			for n := current; n != root; n = n.parent {
+				if n.tag == name {
+					current = n.parent
+					break
+				}
+			}
+		case xml.CharData:
+			current.children = append(current.children, &html_node{text: string(t), parent: current})
+		}
+	}
+
+	return root, nil
+}
+
+// Convert Jira HTML to Slack mrkdwn
+func HTMLToMrkdwn(s string) string {
+	root, err := parse_html(s)
+	if err != nil {
+		// Not even lenient XML - fall back to plain text
+		text := html_tag_re.ReplaceAllString(s, " ")
+		return tidy_mrkdwn(SlackEscape(collapse_whitespace(text)))
+	}
+
+	r := &mrkdwn_renderer{}
+	return tidy_mrkdwn(r.children(root))
+}
+
+type mrkdwn_renderer struct {
+	// Whether we are in a <pre>, and in a link (where nested links and
+	// formatting are not possible)
+	pre     int
+	in_link int
+}
+
+func (r *mrkdwn_renderer) children(n *html_node) string {
+	var buf bytes.Buffer
+	for _, c := range n.children {
+		buf.WriteString(r.node(c))
+	}
+	return buf.String()
+}
+
+func (r *mrkdwn_renderer) node(n *html_node) string {
+	if n.tag == "" {
+		if structural_elements[n.parent.tag] && strings.TrimSpace(n.text) == "" {
+			return ""
+		}
+		if r.pre > 0 {
+			return SlackEscape(n.text)
+		}
+		return SlackEscape(collapse_whitespace(n.text))
+	}
+
+	class := " " + n.attrs["class"] + " "
+
+	switch n.tag {
+	case "script", "style", "head":
+		return ""
+	case "br":
+		return "\n"
+	case "hr":
+		return "\n\n———\n\n"
+	case "b", "strong":
+		return r.wrap(n, "*")
+	case "i", "em", "cite":
+		return r.wrap(n, "_")
+	case "del", "s", "strike":
+		return r.wrap(n, "~")
+	case "code", "tt", "kbd", "samp":
+		if r.pre > 0 {
+			return r.children(n)
+		}
+		return r.wrap(n, "`")
+	case "span":
+		if strings.Contains(class, " resolved-link ") {
+			return r.wrap(n, "~")
+		}
+		return r.children(n)
+	case "a":
+		return r.link(n)
+	case "img":
+		return r.image(n)
+	case "pre":
+		r.pre++
+		inner := strings.Trim(r.children(n), "\n")
+		r.pre--
+		return "\n```\n" + inner + "\n```\n"
+	case "blockquote":
+		return "\n" + prefix_lines(tidy_mrkdwn(r.children(n)), "> ") + "\n"
+	case "ul", "ol":
+		return "\n" + r.list(n) + "\n"
+	case "h1", "h2", "h3", "h4", "h5", "h6":
+		return "\n" + r.wrap(n, "*") + "\n"
+	case "tr":
+		var cells []string
+		for _, c := range n.children {
+			if c.tag == "td" || c.tag == "th" {
+				cells = append(cells, strings.TrimSpace(r.node(c)))
+			}
+		}
+		return strings.Join(cells, " | ") + "\n"
+	case "th":
+		return r.wrap(n, "*")
+	case "p", "div", "table", "tbody", "thead", "li":
+		return "\n" + r.children(n) + "\n"
+	default:
+		return r.children(n)
+	}
+}
+
+// Wrap the content of an element in a formatting mark, keeping the
+// surrounding whitespace outside the mark so Slack recognises it
+func (r *mrkdwn_renderer) wrap(n *html_node, mark string) string {
+	inner := r.children(n)
+	trimmed := strings.TrimSpace(inner)
+	if trimmed == "" {
+		return inner
+	}
+	if r.in_link > 0 || strings.Contains(trimmed, "\n") && mark != "`" {
+		// Formatting can't span lines, or be applied inside links
+		return inner
+	}
+
+	start := inner[:strings.Index(inner, trimmed)]
+	end := inner[len(start)+len(trimmed):]
+	return start + mark + trimmed + mark + end
+}
+
+func (r *mrkdwn_renderer) link(n *html_node) string {
+	href := n.attrs["href"]
+
+	r.in_link++
+	text := strings.TrimSpace(collapse_whitespace(r.children(n)))
+	r.in_link--
+
+	// Jira user mentions
+	if strings.Contains(" "+n.attrs["class"]+" ", " user-hover ") && text != "" {
+		return "@" + text
+	}
+
+	if href == "" || strings.HasPrefix(href, "#") || strings.HasPrefix(href, "javascript:") || r.in_link > 0 {
+		return text
+	}
+	if text == "" || text == href {
+		return fmt.Sprintf("<%s>", href)
+	}
+	return fmt.Sprintf("<%s|%s>", href, text)
+}
+
+// Common Jira emoticons, by image file name
+var jira_emoticons = map[string]string{
+	"smile.png":         ":slightly_smiling_face:",
+	"sad.png":           ":slightly_frowning_face:",
+	"tongue.png":        ":stuck_out_tongue:",
+	"biggrin.png":       ":grin:",
+	"wink.png":          ":wink:",
+	"thumbs_up.png":     ":+1:",
+	"thumbs_down.png":   ":-1:",
+	"information.png":   ":information_source:",
+	"check.png":         ":white_check_mark:",
+	"error.png":         ":x:",
+	"warning.png":       ":warning:",
+	"forbidden.png":     ":no_entry:",
+	"help_16.png":       ":question:",
+	"lightbulb_on.png":  ":bulb:",
+	"lightbulb.png":     ":bulb:",
+	"star_yellow.png":   ":star:",
+	"add.png":           ":heavy_plus_sign:",
+	"flag.png":          ":triangular_flag_on_post:",
+	"flag_grey.png":     ":flag-white:",
+	"star_red.png":      ":star:",
+	"star_green.png":    ":star:",
+	"star_blue.png":     ":star:",
+	"lightbulb_off.png": ":bulb:",
+}
+
+func (r *mrkdwn_renderer) image(n *html_node) string {
+	src := n.attrs["src"]
+	name := path.Base(strings.SplitN(src, "?", 2)[0])
+
+	if strings.Contains(" "+n.attrs["class"]+" ", " emoticon ") {
+		if emoji, ok := jira_emoticons[name]; ok {
+			return emoji
+		}
+	}
+
+	text := n.attrs["alt"]
+	if text == "" {
+		text = name
+	}
+	if src == "" || r.in_link > 0 {
+		return SlackEscape(text)
+	}
+	return fmt.Sprintf("<%s|%s>", src, SlackEscape(text))
+}
+
+func (r *mrkdwn_renderer) list(n *html_node) string {
+	var lines []string
+	var number int
+	for _, c := range n.children {
+		if c.tag != "li" {
+			continue
+		}
+		number++
+
+		bullet := "• "
+		if n.tag == "ol" {
+			bullet = fmt.Sprintf("%d. ", number)
+		}
+
+		item := tidy_mrkdwn(r.children(c))
+		// Indent the lines after the first (e.g. nested lists) under the
+		// bullet
+		item = strings.Replace(item, "\n", "\n"+strings.Repeat(" ", 4), -1)
+		lines = append(lines, bullet+item)
+	}
+	return strings.Join(lines, "\n")
+}
+
+var (
+	whitespace_re  = regexp.MustCompile(`[ \t\r\n\f\x{00a0}]+`)
+	blank_lines_re = regexp.MustCompile(`\n{3,}`)
+	line_space_re  = regexp.MustCompile(`[ \t]+\n`)
+)
+
+func collapse_whitespace(s string) string {
+	return whitespace_re.ReplaceAllString(s, " ")
+}
+
+// Tidy up rendered mrkdwn: no stray indentation or trailing spaces, at most
+// one blank line in a row, and no blank lines at the start or end. Code blocks
+// are left alone.
+func tidy_mrkdwn(s string) string {
+	parts := strings.Split(s, "```")
+	for i := 0; i < len(parts); i += 2 {
+		part := line_space_re.ReplaceAllString(parts[i], "\n")
+		lines := strings.Split(part, "\n")
+		for j, l := range lines {
+			// Keep the indentation of nested list items
+			if !strings.HasPrefix(l, "    ") {
+				lines[j] = strings.TrimLeft(l, " ")
+			}
+		}
+		parts[i] = blank_lines_re.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")
+	}
+	return strings.TrimSpace(strings.Join(parts, "```"))
+}
+
+func prefix_lines(s, prefix string) string {
+	return prefix + strings.Replace(s, "\n", "\n"+prefix, -1)
+}
+
+// Cut mrkdwn down to at most n characters like TemplateTruncate, but without
+// breaking links or escaped characters
+func TruncateMrkdwn(n int, s string) string {
+	truncated := config.TemplateTruncate(n, s)
+	if truncated == strings.TrimSpace(s) {
+		return truncated
+	}
+
+	body := strings.TrimSuffix(truncated, "…")
+	if open := strings.LastIndex(body, "<"); open > strings.LastIndex(body, ">") {
+		body = body[:open]
+	}
+	if amp := strings.LastIndex(body, "&"); amp >= 0 && !strings.Contains(body[amp:], ";") {
+		body = body[:amp]
+	}
+	return strings.TrimSpace(body) + "…"
+}
+
+// Escape the characters Slack treats as control characters in message text
+func SlackEscape(s string) string {
+	return slack_escaper.Replace(s)
+}
+
+var slack_escaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// Slack's formatting of links, mentions etc: <url>, <url|text>, <@U123>,
+// <#C123|general>
+var slack_control_re = regexp.MustCompile(`<([^<>|]*)(?:\|([^<>]*))?>`)
+
+// Turn Slack message text into plain text, e.g. for copying into Jira. Links
+// with text keep their URL in brackets.
+func MrkdwnToText(s string) string {
+	s = replace_controls(s, func(url, text string) string {
+		if text != "" && text != url {
+			return fmt.Sprintf("%s (%s)", text, url)
+		}
+		return url
+	})
+	return slack_unescaper.Replace(s)
+}
+
+// Turn Slack message text into Markdown, for Mattermost and Teams
+func MrkdwnToMarkdown(s string) string {
+	s = replace_controls(s, func(url, text string) string {
+		if text == "" {
+			text = url
+		}
+		return fmt.Sprintf("[%s](%s)", text, url)
+	})
+	s = mrkdwn_bold_re.ReplaceAllString(s, "$1**$2**")
+	s = mrkdwn_strike_re.ReplaceAllString(s, "$1~~$2~~")
+	return slack_unescaper.Replace(s)
+}
+
+// Turn Slack message text into HTML, for email. Slack escapes &, < and > the
+// same way HTML does, so only its formatting needs changing. Only web and
+// email links are kept as links; others (e.g. javascript:) are left as text.
+func MrkdwnToHTML(s string) string {
+	s = replace_controls(s, func(url, text string) string {
+		if text == "" {
+			text = url
+		}
+		if !html_link_re.MatchString(url) {
+			return text
+		}
+		return fmt.Sprintf(`<a href="%s">%s</a>`, strings.Replace(url, `"`, "&quot;", -1), text)
+	})
+	s = mrkdwn_bold_re.ReplaceAllString(s, "$1<strong>$2</strong>")
+	s = mrkdwn_strike_re.ReplaceAllString(s, "$1<del>$2</del>")
+	s = mrkdwn_italic_re.ReplaceAllString(s, "$1<em>$2</em>")
+
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		for _, quote := range []string{"> ", "&gt; "} {
+			if strings.HasPrefix(line, quote) {
+				lines[i] = "<blockquote>" + strings.TrimPrefix(line, quote) + "</blockquote>"
+			}
+		}
+	}
+	return strings.Replace(strings.Join(lines, "<br>\n"), "</blockquote><br>\n", "</blockquote>\n", -1)
+}
+
+// The schemes of the links kept in HTML
+var html_link_re = regexp.MustCompile(`(?i)^(https?|mailto):`)
+
+var mrkdwn_italic_re = regexp.MustCompile(`(^|[^\w_])_([^_\n]+)_`)
+
+// Slack's *bold* and ~strikethrough~, which are doubled up in Markdown
+var (
+	mrkdwn_bold_re   = regexp.MustCompile(`(^|[^\w*])\*([^*\n]+)\*`)
+	mrkdwn_strike_re = regexp.MustCompile(`(^|[^\w~])~([^~\n]+)~`)
+)
+
+// Replace Slack's links, mentions etc. Mentions become @name and #channel, and
+// links are rendered by link.
+func replace_controls(s string, link func(url, text string) string) string {
+	return slack_control_re.ReplaceAllStringFunc(s, func(control string) string {
+		m := slack_control_re.FindStringSubmatch(control)
+		target, text := m[1], m[2]
+		switch {
+		case strings.HasPrefix(target, "@") || strings.HasPrefix(target, "!"):
+			if text != "" {
+				return "@" + text
+			}
+			return "@" + strings.TrimLeft(target, "@!")
+		case strings.HasPrefix(target, "#"):
+			if text != "" {
+				return "#" + text
+			}
+			return target
+		default:
+			return link(target, text)
+		}
+	})
+}
+
+var slack_unescaper = strings.NewReplacer("&amp;", "&", "&lt;", "<", "&gt;", ">")
@@ -0,0 +1,162 @@
+package message
+
+import (
+	"bytes"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"slackbot_atlassian/atlassian"
+)
+
+// Run with -update to rewrite the golden files from the current output
+var update_golden = flag.Bool("update", false, "update golden files")
+
+func check_golden(t *testing.T, name string, got []byte) {
+	path := filepath.Join("testdata", name)
+	if *update_golden {
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	expected, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, expected) {
+		t.Errorf("Output doesn't match %s:\n%s", path, got)
+	}
+}
+
+func TestActivityStreamToMrkdwn(t *testing.T) {
+	b, err := ioutil.ReadFile(filepath.Join("testdata", "activity_stream.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var feed atlassian.ActivityFeed
+	if err := xml.Unmarshal(b, &feed); err != nil {
+		t.Fatal(err)
+	}
+	if len(feed.Entries) == 0 {
+		t.Fatal("No entries in activity stream")
+	}
+
+	var out bytes.Buffer
+	for _, entry := range feed.Entries {
+		fmt.Fprintf(&out, "== %s\n%s\n\n%s\n\n", entry.Id, GetTextFromActivityItem(entry), HTMLToMrkdwn(entry.Body()))
+	}
+	check_golden(t, "activity_stream.golden", out.Bytes())
+}
+
+func TestWikiToMrkdwn(t *testing.T) {
+	b, err := ioutil.ReadFile(filepath.Join("testdata", "comment.wiki"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check_golden(t, "comment.golden", []byte(WikiToMrkdwn(string(b))+"\n"))
+}
+
+func TestHTMLToMrkdwn(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"", ""},
+		{"plain &amp; simple", "plain &amp; simple"},
+		{"<b>bold</b> <i> italic </i>", "*bold*  _italic_"},
+		{"<b>multi<br/>line</b>", "multi\nline"},
+		{`<a href="https://example.com">https://example.com</a>`, "<https://example.com>"},
+		{`<a href="https://example.com"><b>x</b></a>`, "<https://example.com|x>"},
+		{"<p>one</p><p>two", "one\n\ntwo"},
+		{"<ul><li>a<li>b</ul>", "• a\n• b"},
+		{"<pre>a  &lt;b&gt;\n  c</pre>", "```\na  &lt;b&gt;\n  c\n```"},
+		{"<b>unclosed <i>tags", "*unclosed _tags_*"},
+		{"a <b>b</b> <x y=a.b>c", "a b c"},
+	}
+
+	for _, test := range tests {
+		if got := HTMLToMrkdwn(test.input); got != test.expected {
+			t.Errorf("HTMLToMrkdwn(%q): expected %q, got %q", test.input, test.expected, got)
+		}
+	}
+}
+
+func TestTruncateMrkdwn(t *testing.T) {
+	tests := []struct {
+		n        int
+		input    string
+		expected string
+	}{
+		{20, "short", "short"},
+		{10, "see <https://example.com|here>", "see…"},
+		{7, "a &amp; b &amp; c", "a…"},
+		{11, "a &amp; b &amp; c", "a &amp; b…"},
+	}
+
+	for _, test := range tests {
+		if got := TruncateMrkdwn(test.n, test.input); got != test.expected {
+			t.Errorf("TruncateMrkdwn(%d, %q): expected %q, got %q", test.n, test.input, test.expected, got)
+		}
+	}
+}
+
+func TestMrkdwnToText(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"a &amp; b &lt;c&gt;", "a & b <c>"},
+		{"see <https://example.com|the docs> or <https://example.com>", "see the docs (https://example.com) or https://example.com"},
+		{"<!here> <@U123|jane> in <#C123|general>", "@here @jane in #general"},
+	}
+
+	for _, test := range tests {
+		if got := MrkdwnToText(test.input); got != test.expected {
+			t.Errorf("MrkdwnToText(%q): expected %q, got %q", test.input, test.expected, got)
+		}
+	}
+}
+
+func TestMrkdwnToMarkdown(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"a &amp; b &lt;c&gt;", "a & b <c>"},
+		{"see <https://example.com|the docs> or <https://example.com>", "see [the docs](https://example.com) or [https://example.com](https://example.com)"},
+		{"<@U123|jane> moved *LRN-1* to ~Done~ in <#C123|general>", "@jane moved **LRN-1** to ~~Done~~ in #general"},
+		{"2*3*4 and snake_case*", "2*3*4 and snake_case*"},
+	}
+
+	for _, test := range tests {
+		if got := MrkdwnToMarkdown(test.input); got != test.expected {
+			t.Errorf("MrkdwnToMarkdown(%q): expected %q, got %q", test.input, test.expected, got)
+		}
+	}
+}
+
+func TestMrkdwnToHTML(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"a &amp; b &lt;c&gt;", "a &amp; b &lt;c&gt;"},
+		{"see <https://example.com/?a=1&amp;b=2|the docs>", `see <a href="https://example.com/?a=1&amp;b=2">the docs</a>`},
+		{"<@U123|jane> moved *LRN-1* to ~Done~ _today_", "@jane moved <strong>LRN-1</strong> to <del>Done</del> <em>today</em>"},
+		{"Jane commented\n&gt; Looks good\nThanks", "Jane commented<br>\n<blockquote>Looks good</blockquote>\nThanks"},
+		{"&gt; Quoted\n> Also quoted", "<blockquote>Quoted</blockquote>\n<blockquote>Also quoted</blockquote>"},
+		{"<mailto:jane@example.com|Jane> and <HTTP://example.com>", `<a href="mailto:jane@example.com">Jane</a> and <a href="HTTP://example.com">HTTP://example.com</a>`},
+		{"<javascript:alert(document.cookie)|click> <data:text/html,x> <//example.com|here>", "click data:text/html,x here"},
+	}
+
+	for _, test := range tests {
+		if got := MrkdwnToHTML(test.input); got != test.expected {
+			t.Errorf("MrkdwnToHTML(%q): expected %q, got %q", test.input, test.expected, got)
+		}
+	}
+}
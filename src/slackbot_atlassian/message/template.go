@@ -0,0 +1,121 @@
+package message
+
+import (
+	"bytes"
+	"strings"
+	"text/template"
+
+	"slackbot_atlassian/atlassian"
+)
+
+// The data a trigger template is executed with
+type TemplateData struct {
+	Activity *atlassian.ActivityItem
+	Issue    *atlassian.Issue
+	Author   atlassian.Person
+
+	// The issue key, summary and browse link
+	Key     string
+	Summary string
+	URL     string
+
+	// Every issue field as a string (as used for matching), including the
+	// custom field aliases from the config
+	Fields map[string]string
+
+	// The people involved with the issue
+	Assignee  atlassian.User
+	Reporter  atlassian.User
+	Mentioned []atlassian.User
+
+	// The values of the fields that the trigger matched on
+	Matched map[string]string
+
+	// The default message text for the activity
+	Text string
+
+	// The comment the activity added (nil if it didn't) and any files
+	// attached with it
+	Comment     *Comment
+	Attachments []Attachment
+
+	// The default text of each activity, when several activities have been
+	// coalesced into one message
+	Changes []string
+}
+
+func (m matcher) template_data(activity_issue atlassian.ActivityIssue, matched map[string]string) TemplateData {
+	activity := activity_issue.Activity
+	issue := activity_issue.Issue
+
+	data := TemplateData{
+		Activity: activity,
+		Issue:    issue,
+		Author:   activity.Author,
+		Fields:   make(map[string]string),
+		Matched:  matched,
+		Text:     strings.TrimSpace(GetTextFromActivityItem(activity)),
+	}
+
+	data.Mentioned = MentionedUsers(activity.Body())
+	data.Comment = activity_comment(activity_issue)
+	data.Attachments = activity_attachments(activity_issue)
+
+	if issue != nil {
+		data.Assignee, _ = issue.User("assignee")
+		data.Reporter, _ = issue.User("reporter")
+		data.Key = issue.Id
+		for name := range issue.Fields {
+			if v, ok, err := m.get_trigger_field_value(name, activity_issue); ok && err == nil {
+				data.Fields[name] = v
+			}
+		}
+		for _, cf := range m.custom_jira_fields {
+			if v, ok, err := m.get_trigger_field_value(cf.Name, activity_issue); ok && err == nil {
+				data.Fields[cf.Name] = v
+			}
+		}
+		data.Summary = data.Fields["summary"]
+	}
+
+	if target := activity_target(activity); target != nil {
+		if data.Key == "" {
+			data.Key = target.Title
+		}
+		if data.Summary == "" {
+			data.Summary = target.Summary
+		}
+		data.URL = target.Link.Href
+	}
+
+	return data
+}
+
+// The issue an activity is about, as described in the activity stream
+func activity_target(activity *atlassian.ActivityItem) *atlassian.ActivityTargetOrObject {
+	if activity.ActivityTarget != nil {
+		return activity.ActivityTarget
+	}
+	return activity.ActivityObject
+}
+
+func (m matcher) template_funcs() template.FuncMap {
+	return template.FuncMap{
+		"mention": m.mention,
+	}
+}
+
+func (m matcher) execute_template(tmpl *template.Template, data TemplateData) (string, error) {
+	// Clone so that overriding the helpers can't race with other renders
+	t, err := tmpl.Clone()
+	if err != nil {
+		return "", err
+	}
+	t.Funcs(m.template_funcs())
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
@@ -0,0 +1,212 @@
+package message
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Converting Jira wiki markup (as returned by the REST API, e.g. for comment
+// bodies) to Slack's mrkdwn.
+//
+// Block structure (code and quote blocks, headings, lists, tables) is handled
+// line by line, and inline markup with regular expressions.
+
+var (
+	wiki_code_start_re = regexp.MustCompile(`^\s*\{(code|noformat)(:[^}]*)?\}(.*)$`)
+	wiki_quote_re      = regexp.MustCompile(`^\s*\{quote\}(.*)$`)
+	wiki_heading_re    = regexp.MustCompile(`^\s*h[1-6]\.\s+(.*)$`)
+	wiki_bq_re         = regexp.MustCompile(`^\s*bq\.\s+(.*)$`)
+	wiki_list_re       = regexp.MustCompile(`^\s*([*#-]+)\s+(.*)$`)
+	wiki_rule_re       = regexp.MustCompile(`^\s*-{4,}\s*$`)
+	wiki_table_re      = regexp.MustCompile(`^\s*\|\|?(.*?)\|*\s*$`)
+	wiki_panel_re      = regexp.MustCompile(`\{(panel|color)(:[^}]*)?\}`)
+
+	wiki_link_re      = regexp.MustCompile(`\[([^\[\]|]*)\|([^\[\]]+)\]`)
+	wiki_bare_link_re = regexp.MustCompile(`\[((?:https?|mailto|ftp):[^\[\]|]+)\]`)
+	wiki_attach_re    = regexp.MustCompile(`\[\^([^\[\]]+)\]`)
+	wiki_image_re     = regexp.MustCompile(`!([^!\s|]+)(\|[^!]*)?!`)
+	wiki_mono_re      = regexp.MustCompile(`\{\{(.+?)\}\}`)
+	wiki_cite_re      = regexp.MustCompile(`\?\?(.+?)\?\?`)
+	wiki_strike_re    = regexp.MustCompile(`(^|[\s(])-(\S(?:.*?\S)?)-($|[\s).,;:!?])`)
+	wiki_under_re     = regexp.MustCompile(`(^|[\s(])\+(\S(?:.*?\S)?)\+($|[\s).,;:!?])`)
+	wiki_supsub_re    = regexp.MustCompile(`(^|[\s(])[\^~](\S(?:.*?\S)?)[\^~]($|[\s).,;:!?])`)
+	wiki_emoticon_re  = regexp.MustCompile(`(^|\s)(:\)|:\(|:P|:D|;\)|\(y\)|\(n\)|\(i\)|\(/\)|\(x\)|\(!\)|\(\?\)|\(on\)|\(\*\))`)
+)
+
+var wiki_emoticons = map[string]string{
+	":)":   ":slightly_smiling_face:",
+	":(":   ":slightly_frowning_face:",
+	":P":   ":stuck_out_tongue:",
+	":D":   ":grin:",
+	";)":   ":wink:",
+	"(y)":  ":+1:",
+	"(n)":  ":-1:",
+	"(i)":  ":information_source:",
+	"(/)":  ":white_check_mark:",
+	"(x)":  ":x:",
+	"(!)":  ":warning:",
+	"(?)":  ":question:",
+	"(on)": ":bulb:",
+	"(*)":  ":star:",
+}
+
+// Convert Jira wiki markup to Slack mrkdwn
+func WikiToMrkdwn(s string) string {
+	var out []string
+	var list_counters []int
+
+	lines := strings.Split(strings.Replace(s, "\r\n", "\n", -1), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+
+		// Code blocks are copied as they are, up to the closing tag
+		if m := wiki_code_start_re.FindStringSubmatch(line); m != nil {
+			end := "{" + m[1] + "}"
+			var code []string
+			rest := m[3]
+			for {
+				if idx := strings.Index(rest, end); idx >= 0 {
+					code = append(code, rest[:idx])
+					break
+				}
+				code = append(code, rest)
+				i++
+				if i >= len(lines) {
+					break
+				}
+				rest = lines[i]
+			}
+			out = append(out, "```\n"+SlackEscape(strings.Trim(strings.Join(code, "\n"), "\n"))+"\n```")
+			list_counters = nil
+			continue
+		}
+
+		// So are quote blocks, but with their content converted
+		if m := wiki_quote_re.FindStringSubmatch(line); m != nil {
+			var quote []string
+			rest := m[1]
+			for {
+				if idx := strings.Index(rest, "{quote}"); idx >= 0 {
+					quote = append(quote, rest[:idx])
+					break
+				}
+				quote = append(quote, rest)
+				i++
+				if i >= len(lines) {
+					break
+				}
+				rest = lines[i]
+			}
+			inner := WikiToMrkdwn(strings.Join(quote, "\n"))
+			out = append(out, prefix_lines(inner, "> "))
+			list_counters = nil
+			continue
+		}
+
+		if m := wiki_list_re.FindStringSubmatch(line); m != nil && !wiki_rule_re.MatchString(line) {
+			marker := m[1]
+			depth := len(marker)
+			for len(list_counters) < depth {
+				list_counters = append(list_counters, 0)
+			}
+			list_counters = list_counters[:depth]
+			list_counters[depth-1]++
+
+			bullet := "• "
+			if strings.HasSuffix(marker, "#") {
+				bullet = fmt.Sprintf("%d. ", list_counters[depth-1])
+			}
+			out = append(out, strings.Repeat(" ", 4*(depth-1))+bullet+wiki_inline(m[2]))
+			continue
+		}
+		list_counters = nil
+
+		switch {
+		case wiki_rule_re.MatchString(line):
+			out = append(out, "———")
+		case wiki_heading_re.MatchString(line):
+			out = append(out, "*"+wiki_inline(wiki_heading_re.FindStringSubmatch(line)[1])+"*")
+		case wiki_bq_re.MatchString(line):
+			out = append(out, "> "+wiki_inline(wiki_bq_re.FindStringSubmatch(line)[1]))
+		case strings.HasPrefix(strings.TrimSpace(line), "|"):
+			out = append(out, wiki_table_row(line))
+		default:
+			out = append(out, wiki_inline(line))
+		}
+	}
+
+	return tidy_mrkdwn(strings.Join(out, "\n"))
+}
+
+func wiki_table_row(line string) string {
+	header := strings.HasPrefix(strings.TrimSpace(line), "||")
+	inner := wiki_table_re.FindStringSubmatch(line)[1]
+
+	var cells []string
+	for _, c := range strings.Split(strings.Replace(inner, "||", "|", -1), "|") {
+		c = strings.TrimSpace(wiki_inline(c))
+		if header && c != "" {
+			c = "*" + c + "*"
+		}
+		cells = append(cells, c)
+	}
+	return strings.Join(cells, " | ")
+}
+
+// Convert the inline markup in a line of wiki markup
+func wiki_inline(s string) string {
+	s = SlackEscape(s)
+
+	// Forced line breaks
+	s = strings.Replace(s, `\\`, "\n", -1)
+
+	s = wiki_panel_re.ReplaceAllString(s, "")
+	s = wiki_mono_re.ReplaceAllString(s, "`$1`")
+	s = wiki_cite_re.ReplaceAllString(s, "_${1}_")
+
+	// Slack has no underline, superscript or subscript; Jira's subscript
+	// would otherwise turn into strikethrough
+	s = replace_all_repeatedly(wiki_under_re, s, "$1$2$3")
+	s = replace_all_repeatedly(wiki_supsub_re, s, "$1$2$3")
+	s = replace_all_repeatedly(wiki_strike_re, s, "$1~$2~$3")
+
+	s = wiki_emoticon_re.ReplaceAllStringFunc(s, func(m string) string {
+		trimmed := strings.TrimLeft(m, " \t")
+		return m[:len(m)-len(trimmed)] + wiki_emoticons[trimmed]
+	})
+
+	s = wiki_image_re.ReplaceAllStringFunc(s, func(m string) string {
+		src := wiki_image_re.FindStringSubmatch(m)[1]
+		if strings.Contains(src, "://") {
+			return fmt.Sprintf("<%s|%s>", src, path.Base(src))
+		}
+		return src
+	})
+	s = wiki_attach_re.ReplaceAllString(s, "$1")
+	s = wiki_mention_re.ReplaceAllString(s, "@$1")
+	s = wiki_link_re.ReplaceAllStringFunc(s, func(m string) string {
+		parts := wiki_link_re.FindStringSubmatch(m)
+		text, target := parts[1], parts[2]
+		if text == "" {
+			return fmt.Sprintf("<%s>", target)
+		}
+		return fmt.Sprintf("<%s|%s>", target, text)
+	})
+	s = wiki_bare_link_re.ReplaceAllString(s, "<$1>")
+
+	return s
+}
+
+// Keep replacing until nothing changes, for patterns whose matches can share
+// the surrounding characters (e.g. "-a- -b-")
+func replace_all_repeatedly(re *regexp.Regexp, s, repl string) string {
+	for {
+		replaced := re.ReplaceAllString(s, repl)
+		if replaced == s {
+			return s
+		}
+		s = replaced
+	}
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"slackbot_atlassian/config"
+	"slackbot_atlassian/log"
+	"slackbot_atlassian/state"
+)
+
+// A request to the admin API to add a subscription
+type subscription_request struct {
+	Trigger config.MessageTrigger `json:"trigger"`
+	Owner   string                `json:"owner"`
+	// How long until it expires, as a Go duration, if ever
+	ExpiresIn string `json:"expires_in"`
+}
+
+// Wrap a handler so it is only called with the admin token. Without a token
+// in the config there is no admin API.
+func (s *Server) admin(h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := s.cfg.Server.AdminToken
+		if token == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		h(w, r)
+	})
+}
+
+// List (GET) or add (POST) subscriptions
+func (s *Server) handle_subscriptions(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		subscriptions, err := s.state.GetSubscriptions()
+		if err != nil {
+			log.LogF("Could not look up subscriptions: %s", err)
+			http.Error(w, "Could not look up subscriptions", http.StatusInternalServerError)
+			return
+		}
+		if subscriptions == nil {
+			subscriptions = []state.Subscription{}
+		}
+		respond(w, subscriptions)
+	case "POST":
+		var req subscription_request
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, max_body_size)).Decode(&req); err != nil {
+			http.Error(w, "Invalid subscription: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		subscription, err := s.new_subscription(req)
+		if err != nil {
+			http.Error(w, "Invalid subscription: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		id, err := s.state.AddSubscription(subscription)
+		if err != nil {
+			log.LogF("Could not record subscription: %s", err)
+			http.Error(w, "Could not record subscription", http.StatusInternalServerError)
+			return
+		}
+		subscription.ID = id
+		log.LogF("%s subscribed %s through the admin API", subscription.Owner, subscription.Trigger.Name())
+
+		// respond can't set the content type once the status is written
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		respond(w, subscription)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Check a request for a subscription, against the config as well, and make
+// it
+func (s *Server) new_subscription(req subscription_request) (state.Subscription, error) {
+	if req.Owner == "" {
+		return state.Subscription{}, fmt.Errorf("it needs an owner")
+	}
+	trigger, err := config.NewTrigger(req.Trigger)
+	if err != nil {
+		return state.Subscription{}, err
+	}
+	if err := s.cfg.CheckTrigger(trigger); err != nil {
+		return state.Subscription{}, err
+	}
+
+	now := s.now()
+	subscription := state.Subscription{Trigger: req.Trigger, Owner: req.Owner, Created: now}
+	if req.ExpiresIn != "" {
+		expires_in, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || expires_in <= 0 {
+			return state.Subscription{}, fmt.Errorf("bad expires_in %q", req.ExpiresIn)
+		}
+		subscription.Expires = now.Add(expires_in)
+	}
+	return subscription, nil
+}
+
+// Remove (DELETE) a subscription by ID
+func (s *Server) handle_subscription(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/admin/subscriptions/")
+	removed, err := s.state.RemoveSubscription(id)
+	if err != nil {
+		log.LogF("Could not remove subscription %s: %s", id, err)
+		http.Error(w, "Could not remove subscription", http.StatusInternalServerError)
+		return
+	} else if !removed {
+		http.NotFound(w, r)
+		return
+	}
+	log.LogF("Removed subscription %s through the admin API", id)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"slackbot_atlassian/bot"
+	"slackbot_atlassian/state"
+)
+
+// Keeps subscriptions in memory
+type fake_state struct {
+	state.State
+	subscriptions []state.Subscription
+}
+
+func (f *fake_state) AddSubscription(subscription state.Subscription) (string, error) {
+	subscription.ID = fmt.Sprint(len(f.subscriptions) + 1)
+	f.subscriptions = append(f.subscriptions, subscription)
+	return subscription.ID, nil
+}
+
+func (f *fake_state) RemoveSubscription(id string) (bool, error) {
+	for i, s := range f.subscriptions {
+		if s.ID == id {
+			f.subscriptions = append(f.subscriptions[:i], f.subscriptions[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (f *fake_state) GetSubscriptions() ([]state.Subscription, error) {
+	return f.subscriptions, nil
+}
+
+const test_admin_token = "t0ken"
+
+func test_admin_server(t *testing.T) (*Server, *fake_state) {
+	s := test_server(t, "http://127.0.0.1:0")
+	st := &fake_state{}
+	s.cfg.Server.AdminToken = test_admin_token
+	s.state = st
+	s.bot = bot.New(st, nil, s.slack)
+	return s, st
+}
+
+func admin_request(s *Server, method, path, body, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, r)
+	return w
+}
+
+func TestAdminSubscriptions(t *testing.T) {
+	s, st := test_admin_server(t)
+
+	w := admin_request(s, "POST", "/admin/subscriptions",
+		`{"trigger": {"slack_channel": "team-yoda-jira", "match": {"team": "Yoda"}}, "owner": "ops@example.com", "expires_in": "24h"}`,
+		test_admin_token)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body)
+	}
+	var created state.Subscription
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1500000000, 0)
+	if created.ID != "1" || created.Owner != "ops@example.com" || !created.Created.Equal(now) || !created.Expires.Equal(now.Add(24*time.Hour)) {
+		t.Errorf("Unexpected subscription %+v", created)
+	}
+	if len(st.subscriptions) != 1 || st.subscriptions[0].Trigger.Match["team"] != "Yoda" {
+		t.Errorf("Expected the subscription to be recorded, got %+v", st.subscriptions)
+	}
+
+	w = admin_request(s, "GET", "/admin/subscriptions", "", test_admin_token)
+	var listed []state.Subscription
+	if err := json.NewDecoder(w.Body).Decode(&listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 1 || listed[0].ID != "1" {
+		t.Errorf("Unexpected subscriptions %+v", listed)
+	}
+
+	if w := admin_request(s, "DELETE", "/admin/subscriptions/1", "", test_admin_token); w.Code != http.StatusNoContent {
+		t.Errorf("Expected status 204, got %d: %s", w.Code, w.Body)
+	}
+	if w := admin_request(s, "DELETE", "/admin/subscriptions/1", "", test_admin_token); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for a missing subscription, got %d", w.Code)
+	}
+	if len(st.subscriptions) != 0 {
+		t.Errorf("Expected no subscriptions, got %+v", st.subscriptions)
+	}
+}
+
+func TestInvalidAdminSubscriptions(t *testing.T) {
+	s, st := test_admin_server(t)
+	s.cfg.Slack.Webhooks = map[string]string{"ops": "https://hooks.slack.com/services/T0/B0/x"}
+
+	for _, body := range []string{
+		`{"trigger": {"slack_channel": "team-yoda-jira"}}`,
+		`{"trigger": {"target": "teams:nope"}, "owner": "ops@example.com"}`,
+		`{"trigger": {"slack_channel": "#ops", "delivery": "thread"}, "owner": "ops@example.com"}`,
+		`{"trigger": {"match": {"team": "Yoda"}}, "owner": "ops@example.com"}`,
+		`{"trigger": {"slack_channel": "team-yoda-jira", "match": {"team": "("}}, "owner": "ops@example.com"}`,
+		`{"trigger": {"slack_channel": "team-yoda-jira"}, "owner": "ops@example.com", "expires_in": "a day"}`,
+		`not json`,
+	} {
+		if w := admin_request(s, "POST", "/admin/subscriptions", body, test_admin_token); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", body, w.Code)
+		}
+	}
+	if len(st.subscriptions) != 0 {
+		t.Errorf("Expected no subscriptions, got %+v", st.subscriptions)
+	}
+}
+
+func TestAdminToken(t *testing.T) {
+	s, _ := test_admin_server(t)
+
+	for _, token := range []string{"", "wrong"} {
+		if w := admin_request(s, "GET", "/admin/subscriptions", "", token); w.Code != http.StatusUnauthorized {
+			t.Errorf("%q: expected status 401, got %d", token, w.Code)
+		}
+	}
+
+	// No admin API without a token configured
+	s.cfg.Server.AdminToken = ""
+	if w := admin_request(s, "GET", "/admin/subscriptions", "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", w.Code)
+	}
+}
+
+func TestSubscribeCommand(t *testing.T) {
+	s, st := test_admin_server(t)
+
+	payload := run_command(t, s, "subscribe team=Yoda for 24h")
+	if payload.ResponseType != "ephemeral" || !strings.Contains(payload.Text, "(subscription 1)") {
+		t.Errorf("Unexpected response %+v", payload)
+	}
+	if len(st.subscriptions) != 1 || st.subscriptions[0].Owner != "U1" || st.subscriptions[0].Trigger.SlackChannel != "C1" {
+		t.Errorf("Expected a subscription for U1 in C1, got %+v", st.subscriptions)
+	}
+
+	payload = run_command(t, s, "unsubscribe 1")
+	if len(st.subscriptions) != 0 {
+		t.Errorf("Expected the subscription to be removed, got %+v (%q)", st.subscriptions, payload.Text)
+	}
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"slackbot_atlassian/log"
+	"slackbot_atlassian/message"
+	"slackbot_atlassian/slack"
+)
+
+const command_usage = "Use `/jira LRN-1234` to show an issue, `/jira search <JQL>` to find issues, or " +
+	"`/jira subscribe project=LRN priority=Blocker` to have activity on matching issues posted here " +
+	"(and `/jira subscriptions` and `/jira unsubscribe 1` to see and remove them). " +
+	"`/jira dm off` and `/jira dm on` stop and start direct messages to you."
+
+var issue_key_re = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*-[0-9]+$`)
+
+// Handle a /jira slash command. Slack only waits a few seconds for a
+// response, so it is acknowledged straight away and the answer is sent to the
+// command's response URL in the background.
+func (s *Server) handle_command(w http.ResponseWriter, r *http.Request, body []byte) {
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+
+	channel, user, text, response_url := form.Get("channel_id"), form.Get("user_id"), form.Get("text"), form.Get("response_url")
+	log.LogF("%s used %s %s", form.Get("user_name"), form.Get("command"), text)
+	s.background(func() {
+		if err := slack.Respond(response_url, s.command(channel, user, text)); err != nil {
+			log.LogF("Could not respond to %s %s: %s", form.Get("command"), text, err)
+		}
+	})
+}
+
+// The response to a slash command's text, from a user in a channel
+func (s *Server) command(channel, user, text string) slack.Payload {
+	text = strings.TrimSpace(text)
+	fields := strings.Fields(text)
+
+	switch {
+	case len(fields) == 0 || fields[0] == "help":
+		return ephemeral(command_usage)
+	case fields[0] == "search":
+		jql := strings.TrimSpace(strings.TrimPrefix(text, "search"))
+		if jql == "" {
+			return ephemeral("What should I search for? " + command_usage)
+		}
+		return s.search(jql)
+	case fields[0] == "subscribe" || fields[0] == "subscriptions" || fields[0] == "unsubscribe" || fields[0] == "dm":
+		// The same as asking the bot
+		return ephemeral(s.bot.Reply(channel, user, text))
+	case len(fields) == 1 && issue_key_re.MatchString(text):
+		return s.lookup(strings.ToUpper(text))
+	default:
+		return ephemeral(fmt.Sprintf("Sorry, I don't understand %q. %s", text, command_usage))
+	}
+}
+
+// Show an issue's card to the channel
+func (s *Server) lookup(key string) slack.Payload {
+	issue, err := s.atl.GetIssue(key)
+	if err != nil {
+		log.LogF("Could not look up %s: %s", key, err)
+		return ephemeral(fmt.Sprintf("Sorry, I couldn't find %s.", key))
+	}
+
+	payload := slack.NewPayload(message.NewIssueMessage(issue, s.cfg.Atlassian.IssueURL(issue.Id), ""))
+	payload.ResponseType = "in_channel"
+	return payload
+}
+
+// List the top issues matching a JQL query, just to the user who asked
+func (s *Server) search(jql string) slack.Payload {
+	issues, err := s.atl.Search(jql, s.cfg.Server.MaxSearchResults)
+	if err != nil {
+		log.LogF("Could not search for %q: %s", jql, err)
+		return ephemeral(fmt.Sprintf("Sorry, that search didn't work: %s", message.SlackEscape(err.Error())))
+	}
+
+	payload := slack.NewPayload(message.NewSearchMessage(jql, issues, s.cfg.Atlassian.IssueURL))
+	payload.ResponseType = "ephemeral"
+	return payload
+}
+
+func ephemeral(text string) slack.Payload {
+	return slack.Payload{ResponseType: "ephemeral", Text: text}
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// Keeps track of when each issue was last described in each channel, so the
+// same issue isn't described over and over, and of how many issues each
+// channel has had described, so a busy channel isn't flooded
+type cooldown struct {
+	period      time.Duration
+	per_channel int
+
+	mu   sync.Mutex
+	last map[string]time.Time
+	// When issues were described in each channel, within the period
+	described map[string][]time.Time
+}
+
+func new_cooldown(period time.Duration, per_channel int) *cooldown {
+	return &cooldown{
+		period:      period,
+		per_channel: per_channel,
+		last:        make(map[string]time.Time),
+		described:   make(map[string][]time.Time),
+	}
+}
+
+// Check whether an issue can be described in a channel, and if so record that
+// it has been
+func (c *cooldown) allow(channel, key string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.expire(now)
+	k := channel + " " + key
+	if _, ok := c.last[k]; ok || len(c.described[channel]) >= c.per_channel {
+		return false
+	}
+	c.last[k] = now
+	c.described[channel] = append(c.described[channel], now)
+	return true
+}
+
+// Check whether another issue can be unfurled in a channel, and if so record
+// that it has been. Links are unfurled however recently the issue was
+// described, but count towards the channel's limit.
+func (c *cooldown) allow_unfurl(channel string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.expire(now)
+	if len(c.described[channel]) >= c.per_channel {
+		return false
+	}
+	c.described[channel] = append(c.described[channel], now)
+	return true
+}
+
+// Forget descriptions from before the period
+func (c *cooldown) expire(now time.Time) {
+	for k, last := range c.last {
+		if now.Sub(last) >= c.period {
+			delete(c.last, k)
+		}
+	}
+	for channel, times := range c.described {
+		for len(times) != 0 && now.Sub(times[0]) >= c.period {
+			times = times[1:]
+		}
+		if len(times) == 0 {
+			delete(c.described, channel)
+		} else {
+			c.described[channel] = times
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCooldown(t *testing.T) {
+	c := new_cooldown(10*time.Minute, 3)
+	start := time.Unix(1500000000, 0)
+
+	if !c.allow("C1", "LRN-1", start) || c.allow("C1", "LRN-1", start.Add(time.Minute)) {
+		t.Errorf("Expected LRN-1 to be described once in C1")
+	}
+	if !c.allow("C2", "LRN-1", start) {
+		t.Errorf("Expected LRN-1 to be described in another channel")
+	}
+
+	// Each channel only gets so many, whichever issues they are
+	if !c.allow("C1", "LRN-2", start.Add(2*time.Minute)) || !c.allow_unfurl("C1", start.Add(3*time.Minute)) {
+		t.Errorf("Expected C1 to have room for two more")
+	}
+	if c.allow("C1", "LRN-3", start.Add(4*time.Minute)) || c.allow_unfurl("C1", start.Add(4*time.Minute)) {
+		t.Errorf("Expected C1 to have had its fill")
+	}
+
+	// Until the first ones are older than the period
+	if !c.allow("C1", "LRN-1", start.Add(10*time.Minute)) {
+		t.Errorf("Expected LRN-1 to be described again after the cooldown")
+	}
+	if c.allow("C1", "LRN-3", start.Add(10*time.Minute)) {
+		t.Errorf("Expected C1 to have had its fill again")
+	}
+}
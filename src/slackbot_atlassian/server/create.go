@@ -0,0 +1,123 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"slackbot_atlassian/atlassian"
+	"slackbot_atlassian/config"
+	"slackbot_atlassian/log"
+	"slackbot_atlassian/message"
+	"slackbot_atlassian/slack"
+)
+
+const (
+	// The callback ID of the message shortcut for creating an issue, as set
+	// up in the Slack app
+	create_shortcut_id = "create_jira_issue"
+	// The callback ID of the modal it opens
+	create_view_id = "jira_create_issue"
+)
+
+// Jira's limit on the length of a summary
+const max_summary_length = 255
+
+// Where to reply once an issue has been created, kept in the modal's private
+// metadata
+type create_origin struct {
+	Channel         string `json:"channel"`
+	ThreadTimestamp string `json:"thread_ts"`
+}
+
+// Open a modal for creating an issue from a message, filled in with the
+// message's text and a link back to it
+func (s *Server) open_create_view(i slack.Interaction) {
+	if len(s.cfg.Create.Projects) == 0 {
+		s.tell(i, "Sorry, there are no projects set up for creating issues from Slack.")
+		return
+	}
+
+	text := strings.TrimSpace(message.MrkdwnToText(i.MessageText))
+	summary := text
+	if n := strings.Index(summary, "\n"); n >= 0 {
+		summary = summary[:n]
+	}
+	summary = config.TemplateTruncate(max_summary_length, summary)
+
+	description := text
+	if link, err := s.slack.GetPermalink(i.ChannelID, i.MessageTimestamp); err != nil {
+		log.LogF("Could not get a link to %s in %s: %s", i.MessageTimestamp, i.ChannelID, err)
+	} else {
+		description += "\n\nFrom Slack: " + link
+	}
+
+	// Reply in the message's thread, or start one
+	thread := i.ThreadTimestamp
+	if thread == "" {
+		thread = i.MessageTimestamp
+	}
+	origin, err := json.Marshal(create_origin{i.ChannelID, thread})
+	if err != nil {
+		log.LogF("Could not encode modal metadata: %s", err)
+		return
+	}
+
+	priority := slack.SelectInput("priority", "Priority", s.cfg.Create.Priorities, "")
+	priority["optional"] = true
+	view := slack.View{
+		CallbackID:      create_view_id,
+		Title:           "Create Jira issue",
+		Submit:          "Create",
+		PrivateMetadata: string(origin),
+		Blocks: []slack.Block{
+			slack.SelectInput("project", "Project", s.cfg.Create.Projects, s.cfg.Create.Projects[0]),
+			slack.SelectInput("issue_type", "Issue type", s.cfg.Create.IssueTypes, s.cfg.Create.IssueTypes[0]),
+			priority,
+			slack.TextInput("summary", "Summary", summary, false),
+			slack.TextInput("description", "Description", description, true),
+		},
+	}
+	if err := s.slack.OpenView(i.TriggerID, view); err != nil {
+		log.LogF("Could not open the create issue modal: %s", err)
+	}
+}
+
+// Create an issue from the modal, and reply about it in the thread it came
+// from
+func (s *Server) create_issue(i slack.Interaction, origin create_origin) {
+	// Modals aren't in a channel, so any problem is told where it came from
+	i.ChannelID = origin.Channel
+
+	description := i.Submission["description"]
+	if username, ok, err := s.users.JiraUsername(i.UserID); err != nil {
+		log.LogF("Could not find the Jira user for %s: %s", i.UserID, err)
+	} else if ok {
+		description += fmt.Sprintf("\n\n_(reported by [~%s] from Slack)_", username)
+	}
+
+	issue := atlassian.NewIssue{
+		Project:     i.Submission["project"],
+		IssueType:   i.Submission["issue_type"],
+		Priority:    i.Submission["priority"],
+		Summary:     strings.TrimSpace(i.Submission["summary"]),
+		Description: strings.TrimSpace(description),
+	}
+	key, err := s.atl.CreateIssue(issue)
+	if err != nil {
+		log.LogF("Could not create an issue in %s for %s: %s", issue.Project, i.UserName, err)
+		s.tell(i, fmt.Sprintf("Sorry, I couldn't create the issue: %s", message.SlackEscape(err.Error())))
+		return
+	}
+	log.LogF("%s created %s from Slack", i.UserName, key)
+
+	m := message.Message{
+		SlackChannel:    origin.Channel,
+		Text:            fmt.Sprintf("<@%s> created %s %s", i.UserID, config.TemplateLink(s.cfg.Atlassian.IssueURL(key), key), message.SlackEscape(issue.Summary)),
+		Format:          config.FormatText,
+		ThreadTimestamp: origin.ThreadTimestamp,
+	}
+	if _, _, err := s.slack.PostMessage(m); err != nil {
+		log.LogF("Could not reply about %s in %s: %s", key, origin.Channel, err)
+	}
+}
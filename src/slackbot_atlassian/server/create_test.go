@@ -0,0 +1,58 @@
+package server
+
+import (
+	"testing"
+
+	"slackbot_atlassian/slack"
+)
+
+func TestCreateIssueShortcut(t *testing.T) {
+	jira := test_jira(t)
+	defer jira.Close()
+	s := test_server(t, jira.URL)
+	fake := s.slack.(*fake_slack)
+
+	send_interaction(t, s, `{
+		"type": "message_action", "callback_id": "create_jira_issue", "trigger_id": "T1",
+		"user": {"id": "U1", "name": "jane"}, "channel": {"id": "C1"},
+		"message": {"text": "Login is broken\nIt says &lt;error&gt;", "ts": "1500000000.000200", "thread_ts": "1500000000.000100"}
+	}`)
+	if len(fake.views) != 1 {
+		t.Fatalf("Expected a modal, got %+v", fake.views)
+	}
+	view := fake.views[0]
+	inputs := make(map[string]slack.Block)
+	for _, b := range view.Blocks {
+		inputs[b["block_id"].(string)] = b
+	}
+	summary := inputs["summary"]["element"].(map[string]interface{})["initial_value"]
+	if summary != "Login is broken" {
+		t.Errorf("Unexpected summary %q", summary)
+	}
+	description := inputs["description"]["element"].(map[string]interface{})["initial_value"]
+	if description != "Login is broken\nIt says <error>\n\nFrom Slack: https://example.slack.com/archives/C1/p1500000000000200" {
+		t.Errorf("Unexpected description %q", description)
+	}
+
+	send_interaction(t, s, `{
+		"type": "view_submission", "user": {"id": "U1", "name": "jane"},
+		"view": {"callback_id": "jira_create_issue", "private_metadata": `+json_string(view.PrivateMetadata)+`, "state": {"values": {
+			"project": {"project": {"type": "static_select", "selected_option": {"value": "LRN"}}},
+			"issue_type": {"issue_type": {"type": "static_select", "selected_option": {"value": "Bug"}}},
+			"priority": {"priority": {"type": "static_select", "selected_option": null}},
+			"summary": {"summary": {"type": "plain_text_input", "value": "Login is broken"}},
+			"description": {"description": {"type": "plain_text_input", "value": "It says <error>"}}
+		}}}
+	}`)
+	if len(fake.ephemeral) != 0 {
+		t.Fatalf("Unexpected errors %v", fake.ephemeral)
+	}
+	if len(fake.posted) != 1 {
+		t.Fatalf("Expected a reply, got %+v", fake.posted)
+	}
+	reply := fake.posted[0]
+	expected := "<@U1> created <" + jira.URL + "/browse/LRN-1235|LRN-1235> Login is broken"
+	if reply.Text != expected || reply.SlackChannel != "C1" || reply.ThreadTimestamp != "1500000000.000100" {
+		t.Errorf("Unexpected reply %+v", reply)
+	}
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"slackbot_atlassian/config"
+	"slackbot_atlassian/log"
+	"slackbot_atlassian/message"
+	"slackbot_atlassian/slack"
+)
+
+// An Events API request
+type event_request struct {
+	Type      string          `json:"type"`
+	Challenge string          `json:"challenge"`
+	Event     json.RawMessage `json:"event"`
+}
+
+// The parts of the events we handle that we care about
+type event struct {
+	Type        string `json:"type"`
+	Subtype     string `json:"subtype"`
+	Channel     string `json:"channel"`
+	ChannelType string `json:"channel_type"`
+	User        string `json:"user"`
+	BotID       string `json:"bot_id"`
+
+	// Messages
+	Text            string `json:"text"`
+	Timestamp       string `json:"ts"`
+	ThreadTimestamp string `json:"thread_ts"`
+
+	// Shared links
+	MessageTimestamp string `json:"message_ts"`
+	Links            []struct {
+		Domain string `json:"domain"`
+		URL    string `json:"url"`
+	} `json:"links"`
+}
+
+// Handle a request from the Events API. Slack wants a response within three
+// seconds, so events are handled in the background.
+func (s *Server) handle_event(w http.ResponseWriter, r *http.Request, body []byte) {
+	var req event_request
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+
+	switch req.Type {
+	case "url_verification":
+		respond(w, map[string]string{"challenge": req.Challenge})
+		return
+	case "event_callback":
+	default:
+		return
+	}
+
+	// Slack retries events it thinks we didn't get. We always reply straight
+	// away, so a retry means we were too slow and have probably handled it.
+	if r.Header.Get("X-Slack-Retry-Num") != "" {
+		return
+	}
+
+	var e event
+	if err := json.Unmarshal(req.Event, &e); err != nil {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+	s.background(func() { s.dispatch_event(e) })
+}
+
+func (s *Server) dispatch_event(e event) {
+	switch e.Type {
+	case "link_shared":
+		s.unfurl_links(e)
+	case "app_mention":
+		s.answer(e)
+	case "message":
+		if e.ChannelType == "im" {
+			s.answer(e)
+		} else {
+			s.describe_issue_keys(e)
+		}
+	}
+}
+
+// Answer a command given by mentioning the bot or in a direct message to it
+func (s *Server) answer(e event) {
+	// Skip edits, bot messages (including our own) etc.
+	if e.Subtype != "" || e.BotID != "" {
+		return
+	}
+
+	thread := e.ThreadTimestamp
+	if thread == "" {
+		thread = e.Timestamp
+	}
+	s.bot.Answer(e.Channel, e.User, e.Text, thread)
+}
+
+// Unfurl links to issues as issue cards
+func (s *Server) unfurl_links(e event) {
+	browse := s.cfg.Atlassian.BaseURL() + "/browse/"
+
+	unfurls := make(map[string]slack.Attachment)
+	now := s.now()
+	for _, l := range e.Links {
+		if !strings.HasPrefix(l.URL, browse) {
+			continue
+		}
+		key := strings.TrimPrefix(l.URL, browse)
+		if i := strings.IndexAny(key, "/?#"); i >= 0 {
+			key = key[:i]
+		}
+		if keys := s.cfg.Unfurl.IssueKeys(key); len(keys) != 1 || keys[0] != key {
+			continue
+		}
+
+		if !s.cooldown.allow_unfurl(e.Channel, now) {
+			log.LogF("Not unfurling %s, as %s has had enough issues unfurled for now", key, e.Channel)
+			break
+		}
+
+		issue, err := s.atl.GetIssue(key)
+		if err != nil {
+			log.LogF("Could not look up %s to unfurl: %s", key, err)
+			continue
+		}
+		payload := slack.NewPayload(message.NewIssueMessage(issue, s.cfg.Atlassian.IssueURL(issue.Id), ""))
+		unfurls[l.URL] = payload.Attachments[0]
+	}
+
+	if len(unfurls) == 0 {
+		return
+	}
+	if err := s.slack.Unfurl(e.Channel, e.MessageTimestamp, unfurls); err != nil {
+		log.LogF("Could not unfurl links in %s: %s", e.Channel, err)
+	}
+}
+
+// Slack formats links as <url> or <url|text>
+var slack_link_re = regexp.MustCompile(`<[^<>]*>`)
+
+// Reply to a message that mentions issue keys with a line about each issue,
+// unless they have been described in the channel recently (or the channel has
+// had its fill of descriptions)
+func (s *Server) describe_issue_keys(e event) {
+	// Skip edits, bot messages (including our own) etc.
+	if !s.cfg.Unfurl.Keys || e.Subtype != "" || e.BotID != "" {
+		return
+	}
+
+	// Keys in links are left for unfurling
+	keys := s.cfg.Unfurl.IssueKeys(slack_link_re.ReplaceAllString(e.Text, ""))
+
+	var lines []string
+	now := s.now()
+	for _, key := range keys {
+		if len(lines) == s.cfg.Unfurl.MaxPerMessage {
+			break
+		}
+		if !s.cooldown.allow(e.Channel, key, now) {
+			continue
+		}
+
+		issue, err := s.atl.GetIssue(key)
+		if err != nil {
+			log.LogF("Could not look up %s to describe: %s", key, err)
+			continue
+		}
+		lines = append(lines, message.IssueLine(issue, s.cfg.Atlassian.IssueURL(issue.Id)))
+	}
+	if len(lines) == 0 {
+		return
+	}
+
+	// Reply in a thread, so a conversation about issues isn't drowned out
+	thread := e.ThreadTimestamp
+	if thread == "" {
+		thread = e.Timestamp
+	}
+	m := message.Message{
+		SlackChannel:    e.Channel,
+		Text:            strings.Join(lines, "\n"),
+		Format:          config.FormatText,
+		ThreadTimestamp: thread,
+	}
+	if _, _, err := s.slack.PostMessage(m); err != nil {
+		log.LogF("Could not describe issues in %s: %s", e.Channel, err)
+	}
+}
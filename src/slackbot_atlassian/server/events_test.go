@@ -0,0 +1,142 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func send_event(t *testing.T, s *Server, body string) *httptest.ResponseRecorder {
+	r := sign(httptest.NewRequest("POST", "/slack/events", strings.NewReader(body)), body, test_signing_secret, s.now())
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body)
+	}
+	return w
+}
+
+func TestURLVerification(t *testing.T) {
+	s := test_server(t, "http://127.0.0.1:0")
+	w := send_event(t, s, `{"type": "url_verification", "challenge": "3eZbrw1aBm2rZgRNFdxV2595E9CY3gmdALWMmHkvFXO7tYXAYM8P"}`)
+	if strings.TrimSpace(w.Body.String()) != `{"challenge":"3eZbrw1aBm2rZgRNFdxV2595E9CY3gmdALWMmHkvFXO7tYXAYM8P"}` {
+		t.Errorf("Unexpected response %s", w.Body)
+	}
+}
+
+func TestLinkSharedEvent(t *testing.T) {
+	jira := test_jira(t)
+	defer jira.Close()
+	s := test_server(t, jira.URL)
+	fake := s.slack.(*fake_slack)
+
+	send_event(t, s, `{"type": "event_callback", "event": {
+		"type": "link_shared", "channel": "C1", "message_ts": "1499999999.000200",
+		"links": [
+			{"url": "`+jira.URL+`/browse/LRN-1234?focusedCommentId=1"},
+			{"url": "`+jira.URL+`/browse/OPS-1"},
+			{"url": "`+jira.URL+`/secure/Dashboard.jspa"}
+		]
+	}}`)
+
+	if len(fake.unfurled) != 1 || len(fake.unfurled[0]) != 1 {
+		t.Fatalf("Expected one unfurl, got %v", fake.unfurled)
+	}
+	a, ok := fake.unfurled[0][jira.URL+"/browse/LRN-1234?focusedCommentId=1"]
+	if !ok || a.Title != "LRN-1234: Author API v1.0.0" {
+		t.Errorf("Unexpected unfurl %+v", fake.unfurled[0])
+	}
+
+	// Unfurls count towards the channel's limit
+	s.cooldown = new_cooldown(time.Hour, 1)
+	unfurl := `{"type": "event_callback", "event": {
+		"type": "link_shared", "channel": "C1", "message_ts": "1499999999.000300",
+		"links": [{"url": "` + jira.URL + `/browse/LRN-1234"}]
+	}}`
+	send_event(t, s, unfurl)
+	send_event(t, s, unfurl)
+	if len(fake.unfurled) != 2 {
+		t.Errorf("Expected only one more unfurl, got %v", fake.unfurled)
+	}
+}
+
+func TestMessageEvent(t *testing.T) {
+	jira := test_jira(t)
+	defer jira.Close()
+	s := test_server(t, jira.URL)
+	fake := s.slack.(*fake_slack)
+
+	message_event := func(text string, extra string) {
+		send_event(t, s, `{"type": "event_callback", "event": {
+			"type": "message", "channel": "C1", "user": "U1", "ts": "1500000000.000100",
+			"text": "`+text+`"`+extra+`
+		}}`)
+	}
+
+	message_event("Is LRN-1234 done? See also <"+jira.URL+"/browse/LRN-1|LRN-1>", "")
+	if len(fake.posted) != 1 {
+		t.Fatalf("Expected a reply, got %v", fake.posted)
+	}
+	reply := fake.posted[0]
+	expected := "<" + jira.URL + "/browse/LRN-1234|LRN-1234> Author API v1.0.0 (In Progress, Jane Doe)"
+	if reply.Text != expected || reply.SlackChannel != "C1" || reply.ThreadTimestamp != "1500000000.000100" {
+		t.Errorf("Unexpected reply %+v", reply)
+	}
+
+	// Not again straight away, or for bots' messages and edits
+	message_event("LRN-1234 again", "")
+	message_event("LRN-1234", `, "bot_id": "B1"`)
+	message_event("LRN-1234", `, "subtype": "message_changed"`)
+	if len(fake.posted) != 1 {
+		t.Errorf("Expected no more replies, got %v", fake.posted[1:])
+	}
+
+	// But again after the cooldown
+	s.now = func() time.Time { return time.Unix(1500000000, 0).Add(time.Hour) }
+	message_event("LRN-1234 again", "")
+	if len(fake.posted) != 2 {
+		t.Errorf("Expected a reply after the cooldown")
+	}
+}
+
+func TestEventRetries(t *testing.T) {
+	s := test_server(t, "http://127.0.0.1:0")
+	fake := s.slack.(*fake_slack)
+
+	body := `{"type": "event_callback", "event": {"type": "message", "channel": "C1", "text": "LRN-1"}}`
+	r := sign(httptest.NewRequest("POST", "/slack/events", strings.NewReader(body)), body, test_signing_secret, s.now())
+	r.Header.Set("X-Slack-Retry-Num", "1")
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, r)
+	if w.Code != http.StatusOK || len(fake.posted) != 0 {
+		t.Errorf("Expected retries to be acknowledged and ignored")
+	}
+}
+
+func TestAppMentionEvent(t *testing.T) {
+	s := test_server(t, "http://127.0.0.1:0")
+	fake := s.slack.(*fake_slack)
+
+	send_event(t, s, `{"type": "event_callback", "event": {
+		"type": "app_mention", "channel": "C1", "user": "U1", "ts": "1500000000.000100",
+		"text": "<@UBOT> help"
+	}}`)
+	if len(fake.posted) != 1 {
+		t.Fatalf("Expected an answer, got %v", fake.posted)
+	}
+	answer := fake.posted[0]
+	if !strings.HasPrefix(answer.Text, "I understand:") || answer.SlackChannel != "C1" || answer.ThreadTimestamp != "1500000000.000100" {
+		t.Errorf("Unexpected answer %+v", answer)
+	}
+
+	// Direct messages are answered outside of a thread
+	send_event(t, s, `{"type": "event_callback", "event": {
+		"type": "message", "channel_type": "im", "channel": "D1", "user": "U1", "ts": "1500000000.000200",
+		"text": "help"
+	}}`)
+	if len(fake.posted) != 2 || fake.posted[1].SlackChannel != "D1" || fake.posted[1].ThreadTimestamp != "" {
+		t.Errorf("Unexpected answers %+v", fake.posted)
+	}
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"slackbot_atlassian/atlassian"
+	"slackbot_atlassian/config"
+	"slackbot_atlassian/log"
+	"slackbot_atlassian/message"
+	"slackbot_atlassian/slack"
+)
+
+// The callback ID of the dialog for commenting on an issue
+const comment_dialog_id = "jira_comment"
+
+// The message an action was taken on, kept in the comment dialog's state so
+// it can be updated once the comment is added
+type action_message struct {
+	IssueKey  string               `json:"issue"`
+	Channel   string               `json:"channel"`
+	Timestamp string               `json:"ts"`
+	Format    string               `json:"format"`
+	Actions   []message.CardAction `json:"actions"`
+}
+
+// Handle a button being clicked, a shortcut being used or a dialog or modal
+// being submitted. Slack wants a response within three seconds, so the work
+// is done in the background.
+func (s *Server) handle_interaction(w http.ResponseWriter, r *http.Request, body []byte) {
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+	i, err := slack.ParseInteraction([]byte(form.Get("payload")))
+	if err != nil {
+		http.Error(w, "Invalid interaction", http.StatusBadRequest)
+		return
+	}
+
+	switch i.Type {
+	case slack.InteractionMessage, slack.InteractionBlockActions:
+		log.LogF("%s clicked %q on %s", i.UserName, i.Action.ID, i.Action.Value)
+		if i.Action.ID == config.ActionComment {
+			// The trigger ID is only good for a few seconds
+			s.open_comment_dialog(i)
+			return
+		}
+		s.background(func() { s.act(i) })
+	case slack.InteractionDialogSubmission:
+		if i.CallbackID != comment_dialog_id {
+			return
+		}
+		var m action_message
+		if err := json.Unmarshal([]byte(i.State), &m); err != nil {
+			http.Error(w, "Invalid dialog state", http.StatusBadRequest)
+			return
+		}
+		log.LogF("%s commented on %s", i.UserName, m.IssueKey)
+		s.background(func() { s.comment(i, m) })
+	case slack.InteractionMessageAction:
+		if i.CallbackID != create_shortcut_id {
+			return
+		}
+		// The trigger ID is only good for a few seconds
+		s.open_create_view(i)
+	case slack.InteractionViewSubmission:
+		if i.CallbackID != create_view_id {
+			return
+		}
+		var origin create_origin
+		if err := json.Unmarshal([]byte(i.State), &origin); err != nil {
+			http.Error(w, "Invalid modal metadata", http.StatusBadRequest)
+			return
+		}
+		s.background(func() { s.create_issue(i, origin) })
+	}
+}
+
+// Ask for the text of a comment on an issue
+func (s *Server) open_comment_dialog(i slack.Interaction) {
+	state, err := json.Marshal(action_message{i.Action.Value, i.ChannelID, i.MessageTimestamp, i.Format, i.Actions})
+	if err != nil {
+		log.LogF("Could not encode dialog state: %s", err)
+		return
+	}
+	dialog := slack.Dialog{
+		CallbackID:  comment_dialog_id,
+		Title:       "Comment on " + i.Action.Value,
+		SubmitLabel: "Comment",
+		State:       string(state),
+		Elements: []slack.DialogElement{{
+			Type:      "textarea",
+			Label:     "Comment",
+			Name:      "comment",
+			MaxLength: 3000,
+		}},
+	}
+	if err := s.slack.OpenDialog(i.TriggerID, dialog); err != nil {
+		log.LogF("Could not open comment dialog for %s: %s", i.Action.Value, err)
+	}
+}
+
+// Assign or transition the issue a button is for, as the user who clicked it
+func (s *Server) act(i slack.Interaction) {
+	key := i.Action.Value
+	m := action_message{key, i.ChannelID, i.MessageTimestamp, i.Format, i.Actions}
+
+	username, ok := s.jira_username(i)
+	if !ok {
+		return
+	}
+
+	var err error
+	var text string
+	if status, ok := i.Action.Transition(); ok {
+		err = s.transition(key, status)
+		text = fmt.Sprintf("<@%s> moved %s to %s", i.UserID, key, message.SlackEscape(status))
+	} else if i.Action.ID == config.ActionAssign {
+		err = s.atl.Assign(key, username)
+		text = fmt.Sprintf("<@%s> assigned %s to themselves", i.UserID, key)
+	} else {
+		log.LogF("Unknown action %q on %s", i.Action.ID, key)
+		return
+	}
+	if err != nil {
+		log.LogF("Could not do %q on %s for %s: %s", i.Action.ID, key, username, err)
+		s.tell(i, fmt.Sprintf("Sorry, I couldn't do that to %s: %s", key, message.SlackEscape(err.Error())))
+		return
+	}
+
+	s.update_action_message(m, text)
+}
+
+// Add a comment from the comment dialog, crediting the user who wrote it
+func (s *Server) comment(i slack.Interaction, m action_message) {
+	username, ok := s.jira_username(i)
+	if !ok {
+		return
+	}
+
+	text := strings.TrimSpace(i.Submission["comment"])
+	if text == "" {
+		return
+	}
+	if err := s.atl.AddComment(m.IssueKey, fmt.Sprintf("%s\n\n_(from [~%s] in Slack)_", text, username)); err != nil {
+		log.LogF("Could not comment on %s for %s: %s", m.IssueKey, username, err)
+		s.tell(i, fmt.Sprintf("Sorry, I couldn't comment on %s: %s", m.IssueKey, message.SlackEscape(err.Error())))
+		return
+	}
+
+	s.update_action_message(m, fmt.Sprintf("<@%s> commented on %s", i.UserID, m.IssueKey))
+}
+
+// Move an issue to a status (or through a transition with that name)
+func (s *Server) transition(key, status string) error {
+	transitions, err := s.atl.GetTransitions(key)
+	if err != nil {
+		return err
+	}
+	for _, t := range transitions {
+		if strings.EqualFold(t.To.Name, status) || strings.EqualFold(t.Name, status) {
+			return s.atl.Transition(key, t.Id)
+		}
+	}
+	return fmt.Errorf("it can't be moved to %s from where it is", status)
+}
+
+// The Jira user for whoever interacted, telling them if there isn't one
+func (s *Server) jira_username(i slack.Interaction) (string, bool) {
+	username, ok, err := s.users.JiraUsername(i.UserID)
+	if err != nil {
+		log.LogF("Could not find the Jira user for %s: %s", i.UserID, err)
+	}
+	if !ok {
+		s.tell(i, "Sorry, I couldn't find your Jira account. Ask for your Jira username to be added to the Slack users in my config.")
+	}
+	return username, ok
+}
+
+// Replace the card on the message an action was taken on with the issue as it
+// is now, saying what was done
+func (s *Server) update_action_message(m action_message, text string) {
+	if m.Channel == "" || m.Timestamp == "" {
+		return
+	}
+
+	atlassian.Forget(s.atl, m.IssueKey)
+	issue, err := s.atl.GetIssue(m.IssueKey)
+	if err != nil {
+		log.LogF("Could not look up %s to update its message: %s", m.IssueKey, err)
+		return
+	}
+
+	updated := message.NewIssueMessage(issue, s.cfg.Atlassian.IssueURL(issue.Id), text)
+	if m.Format != "" {
+		updated.Format = m.Format
+	}
+	updated.Card.Actions = m.Actions
+	if err := s.slack.UpdateMessage(m.Channel, m.Timestamp, updated); err != nil {
+		log.LogF("Could not update the message for %s in %s: %s", m.IssueKey, m.Channel, err)
+	}
+}
+
+// Tell the user who interacted something only they can see
+func (s *Server) tell(i slack.Interaction, text string) {
+	if i.ChannelID == "" {
+		return
+	}
+	if err := s.slack.PostEphemeral(i.ChannelID, i.UserID, text); err != nil {
+		log.LogF("Could not tell %s in %s: %s", i.UserID, i.ChannelID, err)
+	}
+}
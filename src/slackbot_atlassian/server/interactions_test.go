@@ -0,0 +1,107 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"slackbot_atlassian/config"
+	"slackbot_atlassian/message"
+)
+
+func send_interaction(t *testing.T, s *Server, payload string) {
+	body := url.Values{"payload": {payload}}.Encode()
+	r := httptest.NewRequest("POST", "/slack/interactions", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, sign(r, body, test_signing_secret, s.now()))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func json_string(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// A click on one of the buttons of a Block Kit issue card
+func block_action(user, action_id string) string {
+	return `{
+		"type": "block_actions", "trigger_id": "T1", "user": {"id": "` + user + `", "name": "jane"},
+		"container": {"channel_id": "C1", "message_ts": "1500000000.000100"},
+		"actions": [{"action_id": "` + action_id + `", "value": "LRN-1234", "text": {"text": "Done"}}],
+		"message": {"attachments": [{"blocks": [{"type": "actions", "block_id": "jira_issue", "elements": [
+			{"type": "button", "action_id": "assign", "value": "LRN-1234", "text": {"type": "plain_text", "text": "Assign to me"}},
+			{"type": "button", "action_id": "comment", "value": "LRN-1234", "text": {"type": "plain_text", "text": "Add comment"}},
+			{"type": "button", "action_id": "transition:Done", "value": "LRN-1234", "text": {"type": "plain_text", "text": "Done"}}
+		]}]}]}
+	}`
+}
+
+func TestTransitionButton(t *testing.T) {
+	jira := test_jira(t)
+	defer jira.Close()
+	s := test_server(t, jira.URL)
+	fake := s.slack.(*fake_slack)
+
+	send_interaction(t, s, block_action("U1", "transition:Done"))
+	if len(fake.ephemeral) != 0 {
+		t.Fatalf("Unexpected errors %v", fake.ephemeral)
+	}
+	if len(fake.updated) != 1 {
+		t.Fatalf("Expected the message to be updated, got %v", fake.updated)
+	}
+	m := fake.updated[0]
+	if m.SlackChannel != "C1" || m.Format != config.FormatBlocks || m.Text != "<@U1> moved LRN-1234 to Done" {
+		t.Errorf("Unexpected update %+v", m)
+	}
+	if len(m.Card.Actions) != 3 || m.Card.Actions[2] != (message.CardAction{ID: "transition:Done", Text: "Done", Value: "LRN-1234"}) {
+		t.Errorf("Expected the buttons to be kept, got %+v", m.Card.Actions)
+	}
+}
+
+func TestAssignButton(t *testing.T) {
+	jira := test_jira(t)
+	defer jira.Close()
+	s := test_server(t, jira.URL)
+	fake := s.slack.(*fake_slack)
+
+	send_interaction(t, s, block_action("U1", "assign"))
+	if len(fake.updated) != 1 || fake.updated[0].Text != "<@U1> assigned LRN-1234 to themselves" {
+		t.Errorf("Unexpected updates %+v", fake.updated)
+	}
+
+	// Someone without a Jira account is told so
+	send_interaction(t, s, block_action("U2", "assign"))
+	if len(fake.updated) != 1 || len(fake.ephemeral) != 1 || !strings.Contains(fake.ephemeral[0], "couldn't find your Jira account") {
+		t.Errorf("Expected an unknown user to be told, got %v", fake.ephemeral)
+	}
+}
+
+func TestCommentDialog(t *testing.T) {
+	jira := test_jira(t)
+	defer jira.Close()
+	s := test_server(t, jira.URL)
+	fake := s.slack.(*fake_slack)
+
+	send_interaction(t, s, block_action("U1", "comment"))
+	if len(fake.dialogs) != 1 || fake.dialogs[0].CallbackID != comment_dialog_id {
+		t.Fatalf("Expected a comment dialog, got %+v", fake.dialogs)
+	}
+
+	send_interaction(t, s, `{
+		"type": "dialog_submission", "callback_id": "jira_comment", "user": {"id": "U1", "name": "jane"},
+		"channel": {"id": "C1"}, "submission": {"comment": "Looks good"},
+		"state": `+json_string(fake.dialogs[0].State)+`
+	}`)
+	if len(fake.ephemeral) != 0 {
+		t.Fatalf("Unexpected errors %v", fake.ephemeral)
+	}
+	if len(fake.updated) != 1 || fake.updated[0].Text != "<@U1> commented on LRN-1234" || len(fake.updated[0].Card.Actions) != 3 {
+		t.Errorf("Unexpected updates %+v", fake.updated)
+	}
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"slackbot_atlassian/atlassian"
+	"slackbot_atlassian/bot"
+	"slackbot_atlassian/config"
+	"slackbot_atlassian/log"
+	"slackbot_atlassian/slack"
+	"slackbot_atlassian/state"
+	"slackbot_atlassian/storage"
+	"slackbot_atlassian/users"
+)
+
+// The largest request body we accept from Slack
+const max_body_size = 1 << 20
+
+// Serves requests from Slack (slash commands, events and interactions), and
+// the admin API, over HTTP
+type Server struct {
+	cfg      *config.Config
+	atl      atlassian.Atlassian
+	slack    slack.Slack
+	state    state.State
+	users    users.Mapper
+	bot      *bot.Bot
+	cooldown *cooldown
+
+	// The current time, for checking request timestamps
+	now func() time.Time
+	// Run work that shouldn't hold up the response to Slack
+	background func(func())
+}
+
+// Issues are looked up through a cache, as the same ones tend to come up
+// again and again. users finds the Jira user to act as for people using
+// buttons, and b answers people who mention the bot.
+func New(cfg *config.Config, atl atlassian.Atlassian, slack_client slack.Slack, state_client state.State, user_mapper users.Mapper, b *bot.Bot) *Server {
+	return &Server{
+		cfg:        cfg,
+		atl:        atlassian.NewCached(atl, cfg.Unfurl.GetCacheExpiry()),
+		slack:      slack_client,
+		state:      state_client,
+		users:      user_mapper,
+		bot:        b,
+		cooldown:   new_cooldown(cfg.Unfurl.GetCooldown(), cfg.Unfurl.MaxPerChannel),
+		now:        time.Now,
+		background: func(f func()) { go f() },
+	}
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/slack/commands", s.verified(s.handle_command))
+	mux.Handle("/slack/events", s.verified(s.handle_event))
+	mux.Handle("/slack/interactions", s.verified(s.handle_interaction))
+	mux.Handle("/admin/subscriptions", s.admin(s.handle_subscriptions))
+	mux.Handle("/admin/subscriptions/", s.admin(s.handle_subscription))
+	if resources, err := storage.Handler(s.cfg.ResourceStorage); err != nil {
+		log.LogF("Could not serve resources: %s", err)
+	} else if resources != nil {
+		mux.Handle("/resources/", http.StripPrefix("/resources/", resources))
+	}
+	return mux
+}
+
+// Serve requests on the configured address until something goes wrong
+func (s *Server) ListenAndServe() error {
+	log.LogF("Serving Slack requests on %s", s.cfg.Server.Listen)
+	return http.ListenAndServe(s.cfg.Server.Listen, s.Handler())
+}
+
+// Wrap a handler so it is only called for POST requests signed by Slack,
+// with the request body
+func (s *Server) verified(h func(http.ResponseWriter, *http.Request, []byte)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, max_body_size))
+		if err != nil {
+			http.Error(w, "Could not read request", http.StatusBadRequest)
+			return
+		}
+
+		if err := slack.VerifyRequest(s.cfg.Slack.Auth.SigningSecret, r.Header, body, s.now()); err != nil {
+			log.LogF("Rejected request to %s: %s", r.URL.Path, err)
+			http.Error(w, "Invalid signature", http.StatusUnauthorized)
+			return
+		}
+
+		h(w, r, body)
+	})
+}
+
+func respond(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.LogF("Could not write response: %s", err)
+	}
+}
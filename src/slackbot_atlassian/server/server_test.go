@@ -0,0 +1,353 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"slackbot_atlassian/atlassian"
+	"slackbot_atlassian/bot"
+	"slackbot_atlassian/config"
+	"slackbot_atlassian/message"
+	"slackbot_atlassian/slack"
+	"slackbot_atlassian/storage"
+)
+
+const test_signing_secret = "s3cret"
+
+// A stand-in for the Jira REST API
+func test_jira(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "bot" || pass != "pw" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/rest/api/latest/issue/LRN-1234":
+			fmt.Fprint(w, `{"key": "LRN-1234", "fields": {
+				"summary": "Author API v1.0.0",
+				"description": "Needs *bold* work",
+				"status": {"name": "In Progress", "statusCategory": {"key": "indeterminate"}},
+				"assignee": {"name": "jane", "displayName": "Jane Doe"}
+			}}`)
+		case "/rest/api/latest/issue/LRN-1234/transitions":
+			if r.Method == "POST" {
+				body, _ := ioutil.ReadAll(r.Body)
+				if string(body) != `{"transition":{"id":"31"}}` {
+					t.Errorf("Unexpected transition %s", body)
+				}
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			fmt.Fprint(w, `{"transitions": [
+				{"id": "21", "name": "Start", "to": {"name": "In Progress"}},
+				{"id": "31", "name": "Finish", "to": {"name": "Done"}}
+			]}`)
+		case "/rest/api/latest/issue/LRN-1234/assignee":
+			body, _ := ioutil.ReadAll(r.Body)
+			if r.Method != "PUT" || string(body) != `{"name":"jane"}` {
+				t.Errorf("Unexpected assignment %s %s", r.Method, body)
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case "/rest/api/latest/issue/LRN-1234/comment":
+			var comment struct {
+				Body string `json:"body"`
+			}
+			json.NewDecoder(r.Body).Decode(&comment)
+			if comment.Body != "Looks good\n\n_(from [~jane] in Slack)_" {
+				t.Errorf("Unexpected comment %q", comment.Body)
+			}
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{"id": "10000"}`)
+		case "/rest/api/2/issue":
+			var issue struct {
+				Fields map[string]interface{} `json:"fields"`
+			}
+			json.NewDecoder(r.Body).Decode(&issue)
+			if issue.Fields["summary"] != "Login is broken" || issue.Fields["priority"] != nil {
+				t.Errorf("Unexpected issue %v", issue.Fields)
+			}
+			if project, _ := issue.Fields["project"].(map[string]interface{}); project["key"] != "LRN" {
+				t.Errorf("Unexpected project %v", issue.Fields["project"])
+			}
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{"id": "10002", "key": "LRN-1235"}`)
+		case "/rest/api/latest/search":
+			jql := r.URL.Query().Get("jql")
+			if jql == "bad" {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"errorMessages": ["Error in the JQL Query"]}`)
+				return
+			}
+			if r.URL.Query().Get("maxResults") != "5" {
+				t.Errorf("Unexpected maxResults %q", r.URL.Query().Get("maxResults"))
+			}
+			fmt.Fprint(w, `{"issues": [
+				{"key": "LRN-1", "fields": {"summary": "First", "status": {"name": "Done"}}},
+				{"key": "LRN-2", "fields": {"summary": "Second & <last>"}}
+			]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func test_server(t *testing.T, jira_url string) *Server {
+	cfg, err := config.LoadConfig(strings.NewReader(fmt.Sprintf(`{
+		"atlassian": {"host": %q, "auth": {"username": "bot", "password": "pw"}},
+		"slack": {"auth": {"signing_secret": %q}},
+		"server": {"listen": ":0"},
+		"unfurl": {"projects": ["LRN"], "keys": true, "max_per_message": 2},
+		"create": {"issue_types": ["Bug", "Task"]}
+	}`, jira_url, test_signing_secret)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fake_slack{}
+	s := New(cfg, atlassian.New(cfg.Atlassian), fake, nil, fake_users{"U1": "jane"}, bot.New(nil, nil, fake))
+	s.now = func() time.Time { return time.Unix(1500000000, 0) }
+	s.background = func(f func()) { f() }
+	return s
+}
+
+// Records what would have been sent to Slack
+type fake_slack struct {
+	slack.Slack
+	posted    []message.Message
+	updated   []message.Message
+	unfurled  []map[string]slack.Attachment
+	ephemeral []string
+	dialogs   []slack.Dialog
+	views     []slack.View
+}
+
+func (f *fake_slack) PostMessage(m message.Message) (string, string, error) {
+	f.posted = append(f.posted, m)
+	return m.SlackChannel, "1500000000.000100", nil
+}
+
+func (f *fake_slack) UpdateMessage(channel, timestamp string, m message.Message) error {
+	m.SlackChannel = channel
+	f.updated = append(f.updated, m)
+	return nil
+}
+
+func (f *fake_slack) Unfurl(channel, timestamp string, unfurls map[string]slack.Attachment) error {
+	f.unfurled = append(f.unfurled, unfurls)
+	return nil
+}
+
+func (f *fake_slack) PostEphemeral(channel, user_id, text string) error {
+	f.ephemeral = append(f.ephemeral, text)
+	return nil
+}
+
+func (f *fake_slack) OpenDialog(trigger_id string, dialog slack.Dialog) error {
+	f.dialogs = append(f.dialogs, dialog)
+	return nil
+}
+
+func (f *fake_slack) OpenView(trigger_id string, view slack.View) error {
+	f.views = append(f.views, view)
+	return nil
+}
+
+func (f *fake_slack) GetPermalink(channel, timestamp string) (string, error) {
+	return "https://example.slack.com/archives/" + channel + "/p" + strings.Replace(timestamp, ".", "", 1), nil
+}
+
+// Jira usernames keyed by Slack user ID
+type fake_users map[string]string
+
+func (f fake_users) SlackUserID(user atlassian.User) (string, bool, error) {
+	return "", false, nil
+}
+
+func (f fake_users) JiraUsername(slack_id string) (string, bool, error) {
+	name, ok := f[slack_id]
+	return name, ok, nil
+}
+
+// Sign a request as Slack would at a time
+func sign(r *http.Request, body, secret string, at time.Time) *http.Request {
+	ts := strconv.FormatInt(at.Unix(), 10)
+	r.Header.Set("X-Slack-Request-Timestamp", ts)
+	r.Header.Set("X-Slack-Signature", slack.SignRequest(secret, ts, []byte(body)))
+	return r
+}
+
+func command_request(text, secret, response_url string) *http.Request {
+	body := url.Values{
+		"command": {"/jira"}, "text": {text}, "channel_id": {"C1"}, "user_id": {"U1"}, "user_name": {"bob"},
+		"response_url": {response_url},
+	}.Encode()
+	r := httptest.NewRequest("POST", "/slack/commands", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return sign(r, body, secret, time.Unix(1500000000, 0))
+}
+
+// Run a command, returning the response sent to its response URL
+func run_command(t *testing.T, s *Server, text string) slack.Payload {
+	var responses []slack.Payload
+	response_url := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload slack.Payload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Error(err)
+		}
+		responses = append(responses, payload)
+		fmt.Fprint(w, "ok")
+	}))
+	defer response_url.Close()
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, command_request(text, test_signing_secret, response_url.URL))
+	if w.Code != http.StatusOK {
+		t.Fatalf("%q: expected status 200, got %d: %s", text, w.Code, w.Body)
+	}
+	if len(responses) != 1 {
+		t.Fatalf("%q: expected a response, got %+v", text, responses)
+	}
+	return responses[0]
+}
+
+func TestLookupCommand(t *testing.T) {
+	jira := test_jira(t)
+	defer jira.Close()
+	s := test_server(t, jira.URL)
+
+	payload := run_command(t, s, "lrn-1234")
+	if payload.ResponseType != "in_channel" {
+		t.Errorf("Expected response in channel, got %q", payload.ResponseType)
+	}
+	if len(payload.Attachments) != 1 {
+		t.Fatalf("Expected a card, got %+v", payload)
+	}
+	card := payload.Attachments[0]
+	if card.Title != "LRN-1234: Author API v1.0.0" || card.TitleLink != jira.URL+"/browse/LRN-1234" {
+		t.Errorf("Unexpected card title %q linking to %q", card.Title, card.TitleLink)
+	}
+	if card.Color != "#ffd351" {
+		t.Errorf("Unexpected card color %q", card.Color)
+	}
+	if card.Text != "> Needs *bold* work" {
+		t.Errorf("Unexpected card text %q", card.Text)
+	}
+
+	payload = run_command(t, s, "LRN-404")
+	if payload.ResponseType != "ephemeral" || payload.Text != "Sorry, I couldn't find LRN-404." {
+		t.Errorf("Unexpected response for a missing issue: %+v", payload)
+	}
+}
+
+func TestSearchCommand(t *testing.T) {
+	jira := test_jira(t)
+	defer jira.Close()
+	s := test_server(t, jira.URL)
+
+	payload := run_command(t, s, "search project = LRN ORDER BY updated")
+	expected := "Top 2 issues matching `project = LRN ORDER BY updated`:\n" +
+		"• <" + jira.URL + "/browse/LRN-1|LRN-1> First (Done)\n" +
+		"• <" + jira.URL + "/browse/LRN-2|LRN-2> Second &amp; &lt;last&gt;"
+	if payload.Text != expected {
+		t.Errorf("Expected %q, got %q", expected, payload.Text)
+	}
+	if payload.ResponseType != "ephemeral" {
+		t.Errorf("Expected search results to be ephemeral")
+	}
+
+	payload = run_command(t, s, "search bad")
+	if !strings.Contains(payload.Text, "Error in the JQL Query") {
+		t.Errorf("Expected Jira's error, got %q", payload.Text)
+	}
+}
+
+func TestOtherCommands(t *testing.T) {
+	s := test_server(t, "http://127.0.0.1:0")
+
+	for _, text := range []string{"", "help", "search", "what is LRN-1"} {
+		payload := run_command(t, s, text)
+		if payload.ResponseType != "ephemeral" || !strings.Contains(payload.Text, command_usage) {
+			t.Errorf("%q: expected usage, got %+v", text, payload)
+		}
+	}
+}
+
+func TestCommandsInBackground(t *testing.T) {
+	s := test_server(t, "http://127.0.0.1:0")
+	var background []func()
+	s.background = func(f func()) { background = append(background, f) }
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, command_request("LRN-1234", test_signing_secret, "http://127.0.0.1:0"))
+	if w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Errorf("Expected the command to be acknowledged, got %d: %s", w.Code, w.Body)
+	}
+	if len(background) != 1 {
+		t.Errorf("Expected the command to be answered in the background, got %d", len(background))
+	}
+}
+
+func TestUnsignedCommands(t *testing.T) {
+	s := test_server(t, "http://127.0.0.1:0")
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, command_request("LRN-1234", "wrong", ""))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 for a bad signature, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/slack/commands", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405 for a GET, got %d", w.Code)
+	}
+}
+
+func TestResources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resources")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "users", "images"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "users", "images", "jane.png"), []byte("image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := test_server(t, "http://127.0.0.1:0")
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	if w := get("/resources/users/images/jane.png"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected no resources without local storage, got %d", w.Code)
+	}
+
+	s.cfg.ResourceStorage = config.ResourceStorageConfig{Driver: config.StorageLocal, Directory: dir, BaseURL: "https://bot.example.com/resources"}
+	w := get("/resources/users/images/jane.png")
+	if w.Code != http.StatusOK || w.Body.String() != "image" {
+		t.Errorf("Expected the image, got %d %q", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Content-Type") != "image/png" || w.Header().Get("Cache-Control") != storage.CacheControl {
+		t.Errorf("Unexpected headers %v", w.Header())
+	}
+	for _, path := range []string{"/resources/", "/resources/users/images/", "/resources/users/images/bob"} {
+		if w := get(path); w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected status 404, got %d", path, w.Code)
+		}
+	}
+}
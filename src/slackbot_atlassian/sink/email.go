@@ -0,0 +1,176 @@
+package sink
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"slackbot_atlassian/config"
+	"slackbot_atlassian/message"
+)
+
+// The longest subject line, which is the first line of the message
+const max_subject_length = 120
+
+// Sends messages (and digests) as emails with an HTML and a plain text part
+type email struct {
+	cfg config.EmailConfig
+	now func() time.Time
+}
+
+// The parts of a message for the email templates: plain text, or HTML from
+// the message package's Slack formatting
+type email_content struct {
+	Text  template.HTML
+	Card  *email_card
+	Color string
+}
+
+type email_card struct {
+	Title     string
+	TitleLink string
+	Text      template.HTML
+	Fields    []email_field
+}
+
+type email_field struct {
+	Title string
+	Value template.HTML
+}
+
+var email_html_template = template.Must(template.New("html").Parse(`<html>
+<body style="font-family: sans-serif">
+{{if .Card}}<div style="border-left: 4px solid {{.Color}}; padding-left: 8px">
+<p><a href="{{.Card.TitleLink}}"><strong>{{.Card.Title}}</strong></a></p>
+<p>{{.Card.Text}}</p>
+{{if .Card.Fields}}<table>
+{{range .Card.Fields}}<tr><th align="left">{{.Title}}</th><td>{{.Value}}</td></tr>
+{{end}}</table>
+{{end}}</div>
+{{else}}<p>{{.Text}}</p>
+{{end}}</body>
+</html>
+`))
+
+func (e email) Send(destination string, m message.Message) error {
+	to := e.cfg.To(destination)
+	if len(to) == 0 {
+		return fmt.Errorf("No email recipients for %q", destination)
+	}
+
+	body, err := e.render(to, m)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if e.cfg.Username != "" {
+		auth = smtp.PlainAuth("", e.cfg.Username, e.cfg.Password, e.cfg.Host)
+	}
+	addr := fmt.Sprintf("%s:%d", e.cfg.Host, e.cfg.Port)
+	return smtp.SendMail(addr, auth, e.cfg.From, to, body)
+}
+
+// The whole email, headers and all
+func (e email) render(to []string, m message.Message) ([]byte, error) {
+	var buf bytes.Buffer
+	parts := multipart.NewWriter(&buf)
+
+	headers := []string{
+		"From: " + e.cfg.From,
+		"To: " + strings.Join(to, ", "),
+		"Subject: " + mime.QEncoding.Encode("utf-8", email_subject(m)),
+		"Date: " + e.now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: multipart/alternative; boundary=" + parts.Boundary(),
+	}
+	var out bytes.Buffer
+	out.WriteString(strings.Join(headers, "\r\n") + "\r\n\r\n")
+
+	if err := write_part(parts, "text/plain", []byte(email_text(m))); err != nil {
+		return nil, err
+	}
+	var html bytes.Buffer
+	if err := email_html_template.Execute(&html, html_content(m)); err != nil {
+		return nil, err
+	}
+	if err := write_part(parts, "text/html", html.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+
+	out.Write(buf.Bytes())
+	return out.Bytes(), nil
+}
+
+func write_part(parts *multipart.Writer, content_type string, body []byte) error {
+	w, err := parts.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {content_type + "; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return err
+	}
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write(body); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// The first line of the message (or card), as plain text
+func email_subject(m message.Message) string {
+	text := m.Text
+	if m.Card != nil && m.Card.Fallback != "" {
+		text = m.Card.Fallback
+	}
+	subject := strings.TrimSpace(strings.SplitN(message.MrkdwnToText(text), "\n", 2)[0])
+	subject = strings.Trim(subject, "*")
+	if runes := []rune(subject); len(runes) > max_subject_length {
+		subject = string(runes[:max_subject_length]) + "…"
+	}
+	return subject
+}
+
+func email_text(m message.Message) string {
+	if m.Card == nil {
+		return message.MrkdwnToText(m.Text)
+	}
+	lines := []string{message.MrkdwnToText(m.Card.Title)}
+	if m.Card.TitleLink != "" {
+		lines = append(lines, m.Card.TitleLink)
+	}
+	lines = append(lines, "", message.MrkdwnToText(card_text(m.Card)))
+	if len(m.Card.Fields) != 0 {
+		lines = append(lines, "")
+		for _, f := range m.Card.Fields {
+			lines = append(lines, f.Title+": "+message.MrkdwnToText(f.Value))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func html_content(m message.Message) email_content {
+	if m.Card == nil {
+		return email_content{Text: template.HTML(message.MrkdwnToHTML(m.Text))}
+	}
+
+	card := &email_card{
+		Title:     message.MrkdwnToText(m.Card.Title),
+		TitleLink: m.Card.TitleLink,
+		Text:      template.HTML(message.MrkdwnToHTML(card_text(m.Card))),
+	}
+	for _, f := range m.Card.Fields {
+		card.Fields = append(card.Fields, email_field{f.Title, template.HTML(message.MrkdwnToHTML(f.Value))})
+	}
+	return email_content{Card: card, Color: m.Card.Color}
+}
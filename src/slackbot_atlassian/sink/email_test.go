@@ -0,0 +1,209 @@
+package sink
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"slackbot_atlassian/config"
+	"slackbot_atlassian/message"
+)
+
+// An email received by the SMTP stand-in
+type test_email struct {
+	from string
+	to   []string
+	data []byte
+}
+
+// A stand-in for an SMTP server, which accepts every email and sends it on
+// the channel
+func test_smtp(t *testing.T) (net.Listener, chan test_email) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	emails := make(chan test_email, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serve_smtp(textproto.NewConn(conn), emails)
+		}
+	}()
+	return l, emails
+}
+
+func serve_smtp(c *textproto.Conn, emails chan test_email) {
+	defer c.Close()
+	c.PrintfLine("220 localhost ESMTP")
+
+	var e test_email
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch command {
+		case "EHLO", "HELO":
+			c.PrintfLine("250-localhost")
+			c.PrintfLine("250 8BITMIME")
+		case "MAIL":
+			e = test_email{from: smtp_address(line)}
+			c.PrintfLine("250 OK")
+		case "RCPT":
+			e.to = append(e.to, smtp_address(line))
+			c.PrintfLine("250 OK")
+		case "DATA":
+			c.PrintfLine("354 Go ahead")
+			data, err := c.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			e.data = data
+			emails <- e
+			c.PrintfLine("250 OK")
+		case "QUIT":
+			c.PrintfLine("221 Bye")
+			return
+		default:
+			c.PrintfLine("250 OK")
+		}
+	}
+}
+
+// The address in e.g. "MAIL FROM:<jira@example.com> BODY=8BITMIME"
+func smtp_address(line string) string {
+	start, end := strings.Index(line, "<"), strings.Index(line, ">")
+	if start < 0 || end < start {
+		return ""
+	}
+	return line[start+1 : end]
+}
+
+// Read the plain text and HTML parts of an email
+func read_email(t *testing.T, e test_email) (*mail.Message, string, string) {
+	msg, err := mail.ReadMessage(bytes.NewReader(e.data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	media_type, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || media_type != "multipart/alternative" {
+		t.Fatalf("Unexpected content type %q (%v)", msg.Header.Get("Content-Type"), err)
+	}
+
+	parts := make(map[string]string)
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := r.NextPart()
+		if err != nil {
+			break
+		}
+		// The reader decodes quoted-printable parts
+		b, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts[strings.SplitN(part.Header.Get("Content-Type"), ";", 2)[0]] = string(b)
+	}
+	return msg, parts["text/plain"], parts["text/html"]
+}
+
+func test_email_sinks(t *testing.T, l net.Listener) Sinks {
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	n, _ := strconv.Atoi(port)
+	sinks := New(config.OutputsConfig{Email: config.EmailConfig{
+		Host:       host,
+		Port:       n,
+		From:       "jira@example.com",
+		Recipients: map[string][]string{"stakeholders": {"ceo@example.com", "cto@example.com"}},
+	}})
+	e := sinks[config.OutputEmail].(email)
+	e.now = func() time.Time { return time.Unix(1500000000, 0).UTC() }
+	sinks[config.OutputEmail] = e
+	return sinks
+}
+
+func TestEmail(t *testing.T) {
+	l, emails := test_smtp(t)
+	defer l.Close()
+	sinks := test_email_sinks(t, l)
+
+	m := message.Message{Trigger: test_trigger(t, "email:stakeholders"), Text: "LRN-1 was *created*", Card: test_card}
+	if err := sinks.Send(m); err != nil {
+		t.Fatal(err)
+	}
+
+	e := <-emails
+	if e.from != "jira@example.com" || len(e.to) != 2 || e.to[0] != "ceo@example.com" {
+		t.Errorf("Unexpected sender %q and recipients %v", e.from, e.to)
+	}
+	msg, text, html := read_email(t, e)
+	if subject := msg.Header.Get("Subject"); subject != "Jane changed the status of LRN-1 to Done" {
+		t.Errorf("Unexpected subject %q", subject)
+	}
+	if date := msg.Header.Get("Date"); date != "Fri, 14 Jul 2017 02:40:00 +0000" {
+		t.Errorf("Unexpected date %q", date)
+	}
+
+	expected_text := "LRN-1: Author API\n" +
+		"https://jira.example.com/browse/LRN-1\n\n" +
+		"Jane (https://jira.example.com/people/jane) changed the status to *Done*\n> Looks good\n\n" +
+		"Assignee: Jane & Bob"
+	if text != expected_text {
+		t.Errorf("Expected text %q, got %q", expected_text, text)
+	}
+	for _, expected := range []string{
+		`<div style="border-left: 4px solid #ffd351; padding-left: 8px">`,
+		`<a href="https://jira.example.com/browse/LRN-1"><strong>LRN-1: Author API</strong></a>`,
+		`<a href="https://jira.example.com/people/jane">Jane</a> changed the status to <strong>Done</strong><br>`,
+		`<blockquote>Looks good</blockquote>`,
+		`<tr><th align="left">Assignee</th><td>Jane &amp; Bob</td></tr>`,
+	} {
+		if !strings.Contains(html, expected) {
+			t.Errorf("Expected %q in the HTML:\n%s", expected, html)
+		}
+	}
+}
+
+func TestEmailDigest(t *testing.T) {
+	l, emails := test_smtp(t)
+	defer l.Close()
+	sinks := test_email_sinks(t, l)
+
+	m := message.NewDigestMessage("email:pm@example.com", []message.DigestItem{
+		{IssueKey: "LRN-1", IssueSummary: "Author API", IssueURL: "https://jira.example.com/browse/LRN-1", Type: "created", Author: "Jane"},
+	})
+	m.Trigger = test_trigger(t, "email:pm@example.com")
+	if err := sinks.Send(m); err != nil {
+		t.Fatal(err)
+	}
+
+	e := <-emails
+	if len(e.to) != 1 || e.to[0] != "pm@example.com" {
+		t.Errorf("Unexpected recipients %v", e.to)
+	}
+	msg, text, html := read_email(t, e)
+	if subject := msg.Header.Get("Subject"); !strings.HasPrefix(subject, "Jira digest: 1 update on 1 issue") {
+		t.Errorf("Unexpected subject %q", subject)
+	}
+	if !strings.Contains(text, "LRN-1") || !strings.Contains(html, `<a href="https://jira.example.com/browse/LRN-1">`) {
+		t.Errorf("Expected the issue in the digest, got %q and %q", text, html)
+	}
+
+	m.Trigger = test_trigger(t, "email:nobody")
+	if err := sinks.Send(m); err == nil {
+		t.Errorf("Expected an error without recipients")
+	}
+}
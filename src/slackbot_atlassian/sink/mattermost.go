@@ -0,0 +1,67 @@
+package sink
+
+import (
+	"slackbot_atlassian/message"
+)
+
+// Posts to Mattermost channels through an incoming webhook, which takes
+// Slack-like attachments but Markdown rather than Slack's formatting
+type mattermost struct {
+	url string
+}
+
+type mattermost_payload struct {
+	Channel     string                  `json:"channel"`
+	Text        string                  `json:"text,omitempty"`
+	Username    string                  `json:"username,omitempty"`
+	IconURL     string                  `json:"icon_url,omitempty"`
+	Attachments []mattermost_attachment `json:"attachments,omitempty"`
+}
+
+type mattermost_attachment struct {
+	Fallback  string             `json:"fallback"`
+	Color     string             `json:"color,omitempty"`
+	Title     string             `json:"title"`
+	TitleLink string             `json:"title_link,omitempty"`
+	Text      string             `json:"text,omitempty"`
+	Fields    []mattermost_field `json:"fields,omitempty"`
+}
+
+type mattermost_field struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+func (mm mattermost) Send(channel string, m message.Message) error {
+	payload := mattermost_payload{
+		Channel:  channel,
+		Username: m.AsUser.Name,
+		IconURL:  m.AsUser.IconUrl,
+	}
+	if m.Card == nil {
+		payload.Text = message.MrkdwnToMarkdown(m.Text)
+		return post_json(mm.url, payload)
+	}
+
+	a := mattermost_attachment{
+		Fallback:  message.MrkdwnToText(m.Card.Fallback),
+		Color:     m.Card.Color,
+		Title:     m.Card.Title,
+		TitleLink: m.Card.TitleLink,
+		Text:      message.MrkdwnToMarkdown(card_text(m.Card)),
+	}
+	for _, f := range m.Card.Fields {
+		a.Fields = append(a.Fields, mattermost_field{f.Title, message.MrkdwnToMarkdown(f.Value), f.Short})
+	}
+	payload.Attachments = []mattermost_attachment{a}
+	return post_json(mm.url, payload)
+}
+
+// What happened, followed by any comment excerpt
+func card_text(card *message.Card) string {
+	if card.Excerpt == "" {
+		return card.Text
+	}
+	return card.Text + "\n" + card.Excerpt
+}
@@ -0,0 +1,73 @@
+// Package sink sends messages to places other than Slack: Mattermost,
+// Microsoft Teams, plain JSON webhooks and email. A trigger picks one with a target
+// of "<output>:<destination>".
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"slackbot_atlassian/config"
+	"slackbot_atlassian/message"
+)
+
+// Somewhere messages can be sent, rendering them in its own format
+type Sink interface {
+	Send(destination string, m message.Message) error
+}
+
+// The configured sinks, by output
+type Sinks map[string]Sink
+
+func New(cfg config.OutputsConfig) Sinks {
+	sinks := Sinks{
+		config.OutputTeams:   teams{cfg.Teams},
+		config.OutputWebhook: webhook{cfg.Webhooks},
+	}
+	if cfg.Mattermost.Webhook != "" {
+		sinks[config.OutputMattermost] = mattermost{cfg.Mattermost.Webhook}
+	}
+	if cfg.Email.Host != "" {
+		sinks[config.OutputEmail] = email{cfg.Email, time.Now}
+	}
+	return sinks
+}
+
+// Send a message to its trigger's target
+func (s Sinks) Send(m message.Message) error {
+	output, destination, ok := m.Trigger.Output()
+	if !ok {
+		return fmt.Errorf("Trigger %q doesn't send to a sink", m.Trigger.Name())
+	}
+	sink, ok := s[output]
+	if !ok {
+		return fmt.Errorf("No %s output configured", output)
+	}
+	return sink.Send(destination, m)
+}
+
+// Post a payload as JSON, returning an error with the response body if it
+// isn't accepted
+func post_json(url string, payload interface{}) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Bad status code %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
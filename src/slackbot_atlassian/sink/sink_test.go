@@ -0,0 +1,194 @@
+package sink
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"slackbot_atlassian/config"
+	"slackbot_atlassian/message"
+)
+
+// A stand-in for a webhook, recording the JSON posted to it
+type test_hook struct {
+	*httptest.Server
+	posted []map[string]interface{}
+}
+
+func new_test_hook(t *testing.T) *test_hook {
+	h := &test_hook{}
+	h.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Error(err)
+		}
+		if payload["fail"] != nil {
+			http.Error(w, "nope", http.StatusBadRequest)
+			return
+		}
+		h.posted = append(h.posted, payload)
+	}))
+	return h
+}
+
+// Compact JSON for comparing parts of payloads
+func to_json(t *testing.T, v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// Whether part of a payload is the same as some JSON, once both are encoded
+// the same way
+func same_json(t *testing.T, v interface{}, expected string) bool {
+	var e interface{}
+	if err := json.Unmarshal([]byte(expected), &e); err != nil {
+		t.Fatal(err)
+	}
+	return to_json(t, v) == to_json(t, e)
+}
+
+func test_trigger(t *testing.T, target string) *config.MessageTrigger {
+	trigger := &config.MessageTrigger{Target: target}
+	// Trigger outputs are parsed from the target, so it doesn't need
+	// compiling
+	if _, _, ok := trigger.Output(); !ok {
+		t.Fatalf("Bad target %q", target)
+	}
+	return trigger
+}
+
+var test_card = &message.Card{
+	Title:     "LRN-1: Author API",
+	TitleLink: "https://jira.example.com/browse/LRN-1",
+	Color:     "#ffd351",
+	Text:      "<https://jira.example.com/people/jane|Jane> changed the status to *Done*",
+	Excerpt:   "> Looks good",
+	Fields:    []message.CardField{{Title: "Assignee", Value: "Jane &amp; Bob", Short: true}},
+	Fallback:  "Jane changed the status of LRN-1 to Done",
+}
+
+func TestMattermost(t *testing.T) {
+	hook := new_test_hook(t)
+	defer hook.Close()
+	sinks := New(config.OutputsConfig{Mattermost: config.MattermostConfig{Webhook: hook.URL}})
+
+	m := message.Message{
+		Trigger: test_trigger(t, "mattermost:town-square"),
+		AsUser:  config.SlackUser{Name: "Jira", IconUrl: "https://example.com/jira.png"},
+		Text:    "<https://jira.example.com/browse/LRN-1|LRN-1> was created",
+	}
+	if err := sinks.Send(m); err != nil {
+		t.Fatal(err)
+	}
+	m.Card = test_card
+	if err := sinks.Send(m); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(hook.posted) != 2 {
+		t.Fatalf("Expected 2 posts, got %v", hook.posted)
+	}
+	text := hook.posted[0]
+	if text["channel"] != "town-square" || text["username"] != "Jira" || text["icon_url"] != "https://example.com/jira.png" {
+		t.Errorf("Unexpected payload %v", text)
+	}
+	if text["text"] != "[LRN-1](https://jira.example.com/browse/LRN-1) was created" {
+		t.Errorf("Unexpected text %q", text["text"])
+	}
+
+	expected := `[{"color":"#ffd351",` +
+		`"fallback":"Jane changed the status of LRN-1 to Done",` +
+		`"fields":[{"short":true,"title":"Assignee","value":"Jane & Bob"}],` +
+		`"text":"[Jane](https://jira.example.com/people/jane) changed the status to **Done**\n> Looks good",` +
+		`"title":"LRN-1: Author API",` +
+		`"title_link":"https://jira.example.com/browse/LRN-1"}]`
+	if got := hook.posted[1]["attachments"]; !same_json(t, got, expected) {
+		t.Errorf("Expected attachments %s, got %v", expected, got)
+	}
+}
+
+func TestTeams(t *testing.T) {
+	hook := new_test_hook(t)
+	defer hook.Close()
+	sinks := New(config.OutputsConfig{Teams: map[string]string{"eng": hook.URL}})
+
+	m := message.Message{Trigger: test_trigger(t, "teams:eng"), Text: "LRN-1 was *created*", Card: test_card}
+	if err := sinks.Send(m); err != nil {
+		t.Fatal(err)
+	}
+	if len(hook.posted) != 1 {
+		t.Fatalf("Expected a post, got %v", hook.posted)
+	}
+	card := hook.posted[0]
+	if card["@type"] != "MessageCard" || card["themeColor"] != "ffd351" || card["title"] != "LRN-1: Author API" {
+		t.Errorf("Unexpected card %v", card)
+	}
+	if card["summary"] != "Jane changed the status of LRN-1 to Done" {
+		t.Errorf("Unexpected summary %q", card["summary"])
+	}
+	if got := card["sections"]; !same_json(t, got, `[{"facts":[{"name":"Assignee","value":"Jane & Bob"}]}]`) {
+		t.Errorf("Unexpected sections %v", got)
+	}
+	if got := card["potentialAction"]; !same_json(t, got, `[{"@type":"OpenUri","name":"Open in Jira","targets":[{"os":"default","uri":"https://jira.example.com/browse/LRN-1"}]}]`) {
+		t.Errorf("Unexpected actions %v", got)
+	}
+
+	m.Trigger = test_trigger(t, "teams:ops")
+	if err := sinks.Send(m); err == nil {
+		t.Errorf("Expected an error for a missing connector")
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	hook := new_test_hook(t)
+	defer hook.Close()
+	sinks := New(config.OutputsConfig{Webhooks: map[string]string{"audit": hook.URL}})
+
+	m := message.Message{
+		Trigger:  test_trigger(t, "webhook:audit"),
+		IssueKey: "LRN-1",
+		Text:     "<https://jira.example.com/browse/LRN-1|LRN-1> was *created*",
+		Card:     test_card,
+	}
+	m.Author.Name = "jane"
+	if err := sinks.Send(m); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"author":"jane",` +
+		`"color":"#ffd351",` +
+		`"destination":"audit",` +
+		`"fields":{"Assignee":"Jane & Bob"},` +
+		`"issue_key":"LRN-1",` +
+		`"markdown":"[LRN-1](https://jira.example.com/browse/LRN-1) was **created**",` +
+		`"text":"LRN-1 (https://jira.example.com/browse/LRN-1) was *created*",` +
+		`"title":"LRN-1: Author API",` +
+		`"url":"https://jira.example.com/browse/LRN-1"}`
+	if len(hook.posted) != 1 {
+		t.Fatalf("Expected a post, got %v", hook.posted)
+	} else if got := hook.posted[0]; !same_json(t, got, expected) {
+		t.Errorf("Expected %s, got %v", expected, got)
+	}
+}
+
+func TestSinkErrors(t *testing.T) {
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Invalid webhook", http.StatusNotFound)
+	}))
+	defer hook.Close()
+	sinks := New(config.OutputsConfig{Webhooks: map[string]string{"audit": hook.URL}})
+
+	err := sinks.Send(message.Message{Trigger: test_trigger(t, "webhook:audit"), Text: "hello"})
+	if err == nil || err.Error() != "Bad status code 404: Invalid webhook" {
+		t.Errorf("Expected the webhook's error, got %v", err)
+	}
+
+	// Mattermost isn't configured
+	if err := sinks.Send(message.Message{Trigger: test_trigger(t, "mattermost:town-square")}); err == nil {
+		t.Errorf("Expected an error")
+	}
+}
@@ -0,0 +1,82 @@
+package sink
+
+import (
+	"fmt"
+	"strings"
+
+	"slackbot_atlassian/message"
+)
+
+// Posts to Microsoft Teams channels through their incoming webhook
+// connectors, as message cards
+type teams struct {
+	connectors map[string]string
+}
+
+// A legacy actionable message card, which every Teams connector accepts
+type teams_card struct {
+	Type            string          `json:"@type"`
+	Context         string          `json:"@context"`
+	Summary         string          `json:"summary"`
+	ThemeColor      string          `json:"themeColor,omitempty"`
+	Title           string          `json:"title,omitempty"`
+	Text            string          `json:"text"`
+	Sections        []teams_section `json:"sections,omitempty"`
+	PotentialAction []teams_action  `json:"potentialAction,omitempty"`
+}
+
+type teams_section struct {
+	Facts []teams_fact `json:"facts"`
+}
+
+type teams_fact struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type teams_action struct {
+	Type    string         `json:"@type"`
+	Name    string         `json:"name"`
+	Targets []teams_target `json:"targets"`
+}
+
+type teams_target struct {
+	OS  string `json:"os"`
+	URI string `json:"uri"`
+}
+
+func (t teams) Send(connector string, m message.Message) error {
+	url, ok := t.connectors[connector]
+	if !ok {
+		return fmt.Errorf("No Teams connector %q", connector)
+	}
+
+	card := teams_card{
+		Type:    "MessageCard",
+		Context: "https://schema.org/extensions",
+		Summary: message.MrkdwnToText(m.Text),
+		Text:    message.MrkdwnToMarkdown(m.Text),
+	}
+	if m.Card != nil {
+		card.Summary = message.MrkdwnToText(m.Card.Fallback)
+		card.ThemeColor = strings.TrimPrefix(m.Card.Color, "#")
+		card.Title = m.Card.Title
+		card.Text = message.MrkdwnToMarkdown(card_text(m.Card))
+
+		var facts []teams_fact
+		for _, f := range m.Card.Fields {
+			facts = append(facts, teams_fact{f.Title, message.MrkdwnToMarkdown(f.Value)})
+		}
+		if len(facts) != 0 {
+			card.Sections = []teams_section{{facts}}
+		}
+		if m.Card.TitleLink != "" {
+			card.PotentialAction = []teams_action{{
+				Type:    "OpenUri",
+				Name:    "Open in Jira",
+				Targets: []teams_target{{"default", m.Card.TitleLink}},
+			}}
+		}
+	}
+	return post_json(url, card)
+}
@@ -0,0 +1,52 @@
+package sink
+
+import (
+	"fmt"
+
+	"slackbot_atlassian/message"
+)
+
+// Posts a description of each message as JSON, for anything else that wants
+// to hear about Jira activity
+type webhook struct {
+	urls map[string]string
+}
+
+type webhook_payload struct {
+	Destination string `json:"destination"`
+	IssueKey    string `json:"issue_key,omitempty"`
+	Author      string `json:"author,omitempty"`
+	// The message as plain text and as Markdown
+	Text     string `json:"text"`
+	Markdown string `json:"markdown"`
+	// From the card, for rich formats
+	Title  string            `json:"title,omitempty"`
+	URL    string            `json:"url,omitempty"`
+	Color  string            `json:"color,omitempty"`
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+func (w webhook) Send(destination string, m message.Message) error {
+	url, ok := w.urls[destination]
+	if !ok {
+		return fmt.Errorf("No webhook %q", destination)
+	}
+
+	payload := webhook_payload{
+		Destination: destination,
+		IssueKey:    m.IssueKey,
+		Author:      m.Author.Name,
+		Text:        message.MrkdwnToText(m.Text),
+		Markdown:    message.MrkdwnToMarkdown(m.Text),
+	}
+	if m.Card != nil {
+		payload.Title = m.Card.Title
+		payload.URL = m.Card.TitleLink
+		payload.Color = m.Card.Color
+		payload.Fields = make(map[string]string)
+		for _, f := range m.Card.Fields {
+			payload.Fields[f.Title] = message.MrkdwnToText(f.Value)
+		}
+	}
+	return post_json(url, payload)
+}
@@ -0,0 +1,128 @@
+package slack
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"slackbot_atlassian/log"
+
+	"github.com/nlopes/slack"
+)
+
+// The parts of a Web API response we care about. The vendored client doesn't
+// know about newer API features (threads, blocks, conversations), so those
+// methods are called directly.
+type api_response struct {
+	Ok        bool   `json:"ok"`
+	Error     string `json:"error"`
+	Channel   string `json:"channel"`
+	Timestamp string `json:"ts"`
+}
+
+func (r *api_response) api_error() error {
+	if !r.Ok {
+		return APIError{r.Error}
+	}
+	return nil
+}
+
+// An error returned by the Slack API, e.g. "channel_not_found"
+type APIError struct {
+	Code string
+}
+
+func (e APIError) Error() string {
+	return "Slack API error: " + e.Code
+}
+
+// Check whether err is a Slack API error with one of the given codes
+func IsAPIError(err error, codes ...string) bool {
+	api_err, ok := err.(APIError)
+	if !ok {
+		return false
+	}
+	for _, c := range codes {
+		if api_err.Code == c {
+			return true
+		}
+	}
+	return false
+}
+
+// Slack said to slow down, and when to try again
+type RateLimitedError struct {
+	RetryAfter time.Duration
+}
+
+func (e RateLimitedError) Error() string {
+	return fmt.Sprintf("Slack API rate limited, retry after %s", e.RetryAfter)
+}
+
+// How many times to make a call that Slack keeps rate limiting
+const max_rate_limited_attempts = 3
+
+type api_result interface {
+	api_error() error
+}
+
+// Call a Slack Web API method with form encoded arguments, decoding the
+// response into result. Calls that are rate limited are retried when Slack
+// says to.
+func (s impl) call(method string, values url.Values, result api_result) error {
+	values.Set("token", s.cfg.Auth.Token)
+
+	return retry_rate_limited(method, func() error {
+		return call_once(method, values, result)
+	})
+}
+
+// Make a request, again when Slack says to if it is rate limited
+func retry_rate_limited(what string, request func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := request()
+		limited, ok := err.(RateLimitedError)
+		if !ok || attempt == max_rate_limited_attempts {
+			return err
+		}
+		log.LogF("Slack rate limited %s, retrying after %s", what, limited.RetryAfter)
+		time.Sleep(limited.RetryAfter)
+	}
+}
+
+func call_once(method string, values url.Values, result api_result) error {
+	resp, err := http.PostForm(slack.SLACK_API+method, values)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return RateLimitedError{retry_after(resp)}
+	}
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("Bad status code calling Slack %s: %d", method, resp.StatusCode)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return err
+	}
+	err = result.api_error()
+	if IsAPIError(err, "ratelimited", "rate_limited") {
+		return RateLimitedError{retry_after(resp)}
+	}
+	return err
+}
+
+// How long Slack's Retry-After header (in seconds) says to wait, or a second
+// if it doesn't say
+func retry_after(resp *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return time.Second
+	}
+	return time.Duration(seconds) * time.Second
+}
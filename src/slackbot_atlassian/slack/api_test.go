@@ -0,0 +1,64 @@
+package slack
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"slackbot_atlassian/config"
+	"slackbot_atlassian/message"
+
+	"github.com/nlopes/slack"
+)
+
+// Point the client at a stand-in for the Slack Web API, returning a function
+// to put it back
+func fake_slack_api(h http.HandlerFunc) func() {
+	server := httptest.NewServer(h)
+	api := slack.SLACK_API
+	slack.SLACK_API = server.URL + "/"
+	return func() {
+		slack.SLACK_API = api
+		server.Close()
+	}
+}
+
+func TestRateLimitedRetry(t *testing.T) {
+	var calls int
+	defer fake_slack_api(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		switch calls {
+		case 1:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, `{"ok": false, "error": "ratelimited"}`)
+		case 2:
+			w.Header().Set("Retry-After", "0")
+			fmt.Fprint(w, `{"ok": false, "error": "rate_limited"}`)
+		default:
+			fmt.Fprint(w, `{"ok": true, "channel": "C1", "ts": "1500000000.000100"}`)
+		}
+	})()
+
+	s := New(config.SlackConfig{})
+	if _, ts, err := s.PostMessage(message.Message{SlackChannel: "C1", Text: "hello"}); err != nil || ts != "1500000000.000100" {
+		t.Errorf("Expected the message to be posted after retrying, got %q (%v)", ts, err)
+	}
+	if calls != 3 {
+		t.Errorf("Expected 3 calls, got %d", calls)
+	}
+
+	// Eventually it gives up
+	calls = 0
+	defer fake_slack_api(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})()
+	if _, _, err := s.PostMessage(message.Message{SlackChannel: "C1", Text: "hello"}); err == nil {
+		t.Errorf("Expected an error")
+	} else if _, ok := err.(RateLimitedError); !ok || calls != max_rate_limited_attempts {
+		t.Errorf("Expected to be rate limited after %d calls, got %v after %d", max_rate_limited_attempts, err, calls)
+	}
+}
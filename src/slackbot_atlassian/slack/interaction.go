@@ -0,0 +1,211 @@
+package slack
+
+import (
+	"encoding/json"
+
+	"slackbot_atlassian/config"
+	"slackbot_atlassian/message"
+)
+
+// Kinds of interaction payload
+const (
+	// A button on a legacy attachment
+	InteractionMessage = "interactive_message"
+	// A button in a Block Kit layout
+	InteractionBlockActions = "block_actions"
+	// A dialog being submitted
+	InteractionDialogSubmission = "dialog_submission"
+	// A message shortcut being used on a message
+	InteractionMessageAction = "message_action"
+	// A modal being submitted
+	InteractionViewSubmission = "view_submission"
+)
+
+// Something a user did with one of our messages or dialogs, from the
+// interactivity endpoint. Legacy attachment buttons and Block Kit buttons
+// send differently shaped payloads, which are both decoded into this.
+type Interaction struct {
+	Type        string
+	UserID      string
+	UserName    string
+	ChannelID   string
+	TriggerID   string
+	ResponseURL string
+
+	// For buttons: the button clicked, the message it was on (and its
+	// format), and all the issue buttons on that message
+	Action           message.CardAction
+	MessageTimestamp string
+	Format           string
+	Actions          []message.CardAction
+
+	// For message shortcuts: the message it was used on
+	MessageText     string
+	ThreadTimestamp string
+
+	// For dialogs and modals (whose private metadata is the state, and
+	// whose inputs are submitted by action ID). Shortcuts have a callback
+	// ID too.
+	CallbackID string
+	State      string
+	Submission map[string]string
+}
+
+// An interaction payload as Slack sends it
+type interaction_payload struct {
+	Type        string `json:"type"`
+	TriggerID   string `json:"trigger_id"`
+	ResponseURL string `json:"response_url"`
+	CallbackID  string `json:"callback_id"`
+	State       string `json:"state"`
+	User        struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"user"`
+	Channel struct {
+		ID string `json:"id"`
+	} `json:"channel"`
+	Submission map[string]string `json:"submission"`
+
+	Actions []struct {
+		// Legacy
+		Name string `json:"name"`
+		// Block Kit
+		ActionID string `json:"action_id"`
+		Text     struct {
+			Text string `json:"text"`
+		} `json:"text"`
+		Value string `json:"value"`
+	} `json:"actions"`
+
+	// Legacy
+	MessageTimestamp string               `json:"message_ts"`
+	OriginalMessage  *interaction_message `json:"original_message"`
+
+	// Block Kit
+	Container struct {
+		MessageTimestamp string `json:"message_ts"`
+		ChannelID        string `json:"channel_id"`
+	} `json:"container"`
+	Message *interaction_message `json:"message"`
+
+	// Modals
+	View struct {
+		CallbackID      string `json:"callback_id"`
+		PrivateMetadata string `json:"private_metadata"`
+		State           struct {
+			Values map[string]map[string]struct {
+				Value          string `json:"value"`
+				SelectedOption struct {
+					Value string `json:"value"`
+				} `json:"selected_option"`
+			} `json:"values"`
+		} `json:"state"`
+	} `json:"view"`
+}
+
+type interaction_message struct {
+	Text            string       `json:"text"`
+	Timestamp       string       `json:"ts"`
+	ThreadTimestamp string       `json:"thread_ts"`
+	Attachments     []Attachment `json:"attachments"`
+	Blocks          []Block      `json:"blocks"`
+}
+
+// Decode the payload field of an interactivity request
+func ParseInteraction(payload []byte) (Interaction, error) {
+	var p interaction_payload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return Interaction{}, err
+	}
+
+	i := Interaction{
+		Type:             p.Type,
+		UserID:           p.User.ID,
+		UserName:         p.User.Name,
+		ChannelID:        p.Channel.ID,
+		TriggerID:        p.TriggerID,
+		ResponseURL:      p.ResponseURL,
+		CallbackID:       p.CallbackID,
+		State:            p.State,
+		Submission:       p.Submission,
+		MessageTimestamp: p.MessageTimestamp,
+	}
+
+	if len(p.Actions) != 0 {
+		a := p.Actions[0]
+		i.Action = message.CardAction{ID: a.Name, Text: a.Text.Text, Value: a.Value}
+	}
+
+	switch p.Type {
+	case InteractionMessage:
+		i.Format = config.FormatAttachment
+		if p.OriginalMessage != nil {
+			for _, a := range p.OriginalMessage.Attachments {
+				for _, action := range a.Actions {
+					i.Actions = append(i.Actions, message.CardAction{ID: action.Name, Text: action.Text, Value: action.Value})
+				}
+			}
+		}
+	case InteractionBlockActions:
+		i.Format = config.FormatBlocks
+		i.Action.ID = p.Actions[0].ActionID
+		if p.Container.ChannelID != "" {
+			i.ChannelID = p.Container.ChannelID
+		}
+		i.MessageTimestamp = p.Container.MessageTimestamp
+		if p.Message != nil {
+			blocks := p.Message.Blocks
+			for _, a := range p.Message.Attachments {
+				blocks = append(blocks, a.Blocks...)
+			}
+			i.Actions = block_actions(blocks)
+		}
+	case InteractionMessageAction:
+		if p.Message != nil {
+			i.MessageText = p.Message.Text
+			i.MessageTimestamp = p.Message.Timestamp
+			i.ThreadTimestamp = p.Message.ThreadTimestamp
+		}
+	case InteractionViewSubmission:
+		i.CallbackID = p.View.CallbackID
+		i.State = p.View.PrivateMetadata
+		i.Submission = make(map[string]string)
+		for _, block := range p.View.State.Values {
+			for id, input := range block {
+				if input.SelectedOption.Value != "" {
+					i.Submission[id] = input.SelectedOption.Value
+				} else {
+					i.Submission[id] = input.Value
+				}
+			}
+		}
+	}
+
+	return i, nil
+}
+
+// The buttons in the issue action blocks of a message
+func block_actions(blocks []Block) []message.CardAction {
+	var actions []message.CardAction
+	for _, b := range blocks {
+		if b["type"] != "actions" || b["block_id"] != IssueActionsID {
+			continue
+		}
+		elements, _ := b["elements"].([]interface{})
+		for _, e := range elements {
+			button, ok := e.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			var action message.CardAction
+			action.ID, _ = button["action_id"].(string)
+			action.Value, _ = button["value"].(string)
+			if text, ok := button["text"].(map[string]interface{}); ok {
+				action.Text, _ = text["text"].(string)
+			}
+			actions = append(actions, action)
+		}
+	}
+	return actions
+}
@@ -0,0 +1,195 @@
+package slack
+
+import (
+	"fmt"
+	"strings"
+
+	"slackbot_atlassian/config"
+	"slackbot_atlassian/message"
+)
+
+// The body of a Slack message, as accepted by chat.postMessage, incoming
+// webhooks and slash command responses
+type Payload struct {
+	// For slash command responses, whether everyone in the channel sees the
+	// response ("in_channel") or only the user who used the command
+	// ("ephemeral", the default)
+	ResponseType string `json:"response_type,omitempty"`
+
+	Text        string       `json:"text"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+	Blocks      []Block      `json:"blocks,omitempty"`
+}
+
+// A (legacy) message attachment. Block Kit layouts are wrapped in one of these
+// to get a colored sidebar.
+type Attachment struct {
+	Color      string            `json:"color,omitempty"`
+	Fallback   string            `json:"fallback,omitempty"`
+	Title      string            `json:"title,omitempty"`
+	TitleLink  string            `json:"title_link,omitempty"`
+	Text       string            `json:"text,omitempty"`
+	Fields     []AttachmentField `json:"fields,omitempty"`
+	MarkdownIn []string          `json:"mrkdwn_in,omitempty"`
+	Blocks     []Block           `json:"blocks,omitempty"`
+
+	// Buttons, which are sent to the interactivity endpoint with the
+	// callback ID
+	CallbackID string             `json:"callback_id,omitempty"`
+	Actions    []AttachmentAction `json:"actions,omitempty"`
+}
+
+type AttachmentAction struct {
+	Name  string `json:"name"`
+	Text  string `json:"text"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// The callback ID of attachments and block ID of action blocks with buttons
+// for acting on an issue
+const IssueActionsID = "jira_issue"
+
+type AttachmentField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+// A Block Kit block. Blocks are loosely structured, so they are built as maps.
+type Block map[string]interface{}
+
+func mrkdwn(text string) map[string]interface{} {
+	return map[string]interface{}{"type": "mrkdwn", "text": text}
+}
+
+func plain_text(text string) map[string]interface{} {
+	return map[string]interface{}{"type": "plain_text", "text": text}
+}
+
+// An input block for some text, whose value is submitted under the ID
+func TextInput(id, label, initial string, multiline bool) Block {
+	element := map[string]interface{}{
+		"type":      "plain_text_input",
+		"action_id": id,
+		"multiline": multiline,
+	}
+	if initial != "" {
+		element["initial_value"] = initial
+	}
+	return Block{"type": "input", "block_id": id, "label": plain_text(label), "element": element}
+}
+
+// An input block for choosing one of some options, whose value is submitted
+// under the ID. The initial option is chosen to start with, if there is one.
+func SelectInput(id, label string, options []string, initial string) Block {
+	element := map[string]interface{}{
+		"type":      "static_select",
+		"action_id": id,
+	}
+	var choices []interface{}
+	for _, o := range options {
+		choice := map[string]interface{}{"text": plain_text(o), "value": o}
+		if o == initial {
+			element["initial_option"] = choice
+		}
+		choices = append(choices, choice)
+	}
+	element["options"] = choices
+	return Block{"type": "input", "block_id": id, "label": plain_text(label), "element": element}
+}
+
+// Build the Slack message body for a message in its format
+func NewPayload(m message.Message) Payload {
+	text := m.Text
+	if m.Card == nil {
+		return Payload{Text: text}
+	}
+
+	switch m.Format {
+	case config.FormatAttachment:
+		return Payload{
+			Text:        text,
+			Attachments: []Attachment{render_attachment(m.Card)},
+		}
+	case config.FormatBlocks:
+		return Payload{
+			Text: m.Card.Fallback,
+			Attachments: []Attachment{{
+				Color:    m.Card.Color,
+				Fallback: m.Card.Fallback,
+				Blocks:   render_blocks(m.Card),
+			}},
+		}
+	default:
+		return Payload{Text: text}
+	}
+}
+
+func render_attachment(card *message.Card) Attachment {
+	a := Attachment{
+		Color:      card.Color,
+		Fallback:   card.Fallback,
+		Title:      card.Title,
+		TitleLink:  card.TitleLink,
+		Text:       quote(card.Excerpt),
+		MarkdownIn: []string{"text"},
+	}
+	for _, f := range card.Fields {
+		a.Fields = append(a.Fields, AttachmentField{f.Title, f.Value, f.Short})
+	}
+	if len(card.Actions) != 0 {
+		a.CallbackID = IssueActionsID
+		for _, action := range card.Actions {
+			a.Actions = append(a.Actions, AttachmentAction{action.ID, action.Text, "button", action.Value})
+		}
+	}
+	return a
+}
+
+func render_blocks(card *message.Card) []Block {
+	title := card.Title
+	if card.TitleLink != "" {
+		title = fmt.Sprintf("<%s|%s>", card.TitleLink, card.Title)
+	}
+
+	blocks := []Block{{
+		"type": "section",
+		"text": mrkdwn(strings.TrimSpace(fmt.Sprintf("*%s*\n%s", title, card.Text))),
+	}}
+
+	if len(card.Fields) != 0 {
+		var fields []interface{}
+		for _, f := range card.Fields {
+			fields = append(fields, mrkdwn(fmt.Sprintf("*%s*\n%s", f.Title, f.Value)))
+		}
+		blocks = append(blocks, Block{"type": "section", "fields": fields})
+	}
+
+	if card.Excerpt != "" {
+		blocks = append(blocks, Block{"type": "section", "text": mrkdwn(quote(card.Excerpt))})
+	}
+
+	if len(card.Actions) != 0 {
+		var buttons []interface{}
+		for _, action := range card.Actions {
+			buttons = append(buttons, map[string]interface{}{
+				"type":      "button",
+				"text":      plain_text(action.Text),
+				"action_id": action.ID,
+				"value":     action.Value,
+			})
+		}
+		blocks = append(blocks, Block{"type": "actions", "block_id": IssueActionsID, "elements": buttons})
+	}
+
+	return blocks
+}
+
+// Format text as a Slack block quote
+func quote(text string) string {
+	if text == "" {
+		return ""
+	}
+	return "> " + strings.Replace(text, "\n", "\n> ", -1)
+}
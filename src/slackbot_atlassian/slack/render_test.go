@@ -0,0 +1,83 @@
+package slack
+
+import (
+	"encoding/json"
+	"testing"
+
+	"slackbot_atlassian/config"
+	"slackbot_atlassian/message"
+)
+
+func test_card() *message.Card {
+	return &message.Card{
+		Title:     "LRN-1: Something",
+		TitleLink: "https://jira.example.com/browse/LRN-1",
+		Color:     "#ffd351",
+		Text:      "Jane commented",
+		Excerpt:   "Looks good\nThanks",
+		Fields:    []message.CardField{{Title: "Status", Value: "In Progress", Short: true}},
+		Actions:   []message.CardAction{{ID: "assign", Text: "Assign to me", Value: "LRN-1"}},
+		Fallback:  "Jane commented on LRN-1",
+	}
+}
+
+func TestNewPayloadText(t *testing.T) {
+	for _, format := range []string{config.FormatText, config.FormatAttachment, config.FormatBlocks} {
+		p := NewPayload(message.Message{Text: "LRN-1 was created", Format: format})
+		if p.Text != "LRN-1 was created" || len(p.Attachments) != 0 {
+			t.Errorf("%s: expected just the text without a card, got %+v", format, p)
+		}
+	}
+
+	p := NewPayload(message.Message{Text: "LRN-1 was created", Format: config.FormatText, Card: test_card()})
+	if p.Text != "LRN-1 was created" || len(p.Attachments) != 0 {
+		t.Errorf("Expected just the text, got %+v", p)
+	}
+}
+
+func TestNewPayloadAttachment(t *testing.T) {
+	p := NewPayload(message.Message{Text: "LRN-1 was updated", Format: config.FormatAttachment, Card: test_card()})
+	if p.Text != "LRN-1 was updated" || len(p.Attachments) != 1 {
+		t.Fatalf("Expected the text and an attachment, got %+v", p)
+	}
+
+	a := p.Attachments[0]
+	if a.Title != "LRN-1: Something" || a.TitleLink != "https://jira.example.com/browse/LRN-1" || a.Color != "#ffd351" {
+		t.Errorf("Unexpected attachment title or color %+v", a)
+	}
+	if a.Text != "> Looks good\n> Thanks" || a.Fallback != "Jane commented on LRN-1" {
+		t.Errorf("Unexpected attachment text %q and fallback %q", a.Text, a.Fallback)
+	}
+	if len(a.Fields) != 1 || a.Fields[0] != (AttachmentField{"Status", "In Progress", true}) {
+		t.Errorf("Unexpected fields %+v", a.Fields)
+	}
+	if a.CallbackID != IssueActionsID || len(a.Actions) != 1 || a.Actions[0] != (AttachmentAction{"assign", "Assign to me", "button", "LRN-1"}) {
+		t.Errorf("Unexpected actions %q %+v", a.CallbackID, a.Actions)
+	}
+}
+
+func TestNewPayloadBlocks(t *testing.T) {
+	p := NewPayload(message.Message{Text: "LRN-1 was updated", Format: config.FormatBlocks, Card: test_card()})
+	if p.Text != "Jane commented on LRN-1" || len(p.Attachments) != 1 {
+		t.Fatalf("Expected the fallback text and an attachment of blocks, got %+v", p)
+	}
+	a := p.Attachments[0]
+	if a.Color != "#ffd351" || a.Title != "" {
+		t.Errorf("Expected just the color outside the blocks, got %+v", a)
+	}
+
+	b, err := json.Marshal(a.Blocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// encoding/json escapes < and >
+	expected := `[` +
+		`{"text":{"text":"*\u003chttps://jira.example.com/browse/LRN-1|LRN-1: Something\u003e*\nJane commented","type":"mrkdwn"},"type":"section"},` +
+		`{"fields":[{"text":"*Status*\nIn Progress","type":"mrkdwn"}],"type":"section"},` +
+		`{"text":{"text":"\u003e Looks good\n\u003e Thanks","type":"mrkdwn"},"type":"section"},` +
+		`{"block_id":"jira_issue","elements":[{"action_id":"assign","text":{"text":"Assign to me","type":"plain_text"},"type":"button","value":"LRN-1"}],"type":"actions"}` +
+		`]`
+	if string(b) != expected {
+		t.Errorf("Expected blocks\n%s\ngot\n%s", expected, b)
+	}
+}
@@ -0,0 +1,68 @@
+package slack
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"slackbot_atlassian/config"
+	"slackbot_atlassian/log"
+
+	"github.com/nlopes/slack"
+)
+
+// Listen for messages to the bot over the Real Time Messaging API, for when
+// Slack's Events API can't reach us. handle is called for messages that
+// mention the bot and direct messages, with the thread to answer in. Runs
+// until the token is rejected.
+func ListenRTM(cfg config.SlackConfig, handle func(channel, user, text, thread string)) error {
+	rtm := slack.New(cfg.Auth.Token).NewRTM()
+	go rtm.ManageConnection()
+	api := impl{cfg: cfg}
+
+	// Our own user ID, to spot mentions (and ignore our own messages)
+	var self string
+	for event := range rtm.IncomingEvents {
+		switch e := event.Data.(type) {
+		case *slack.ConnectedEvent:
+			self = e.Info.User.ID
+			log.LogF("Listening for messages over RTM as %s", e.Info.User.Name)
+		case *slack.MessageEvent:
+			// Skip edits, bot messages (including our own) etc.
+			if self == "" || e.SubType != "" || e.BotID != "" || e.User == self {
+				continue
+			}
+			if strings.HasPrefix(e.Channel, "D") {
+				handle(e.Channel, e.User, e.Text, "")
+			} else if strings.HasPrefix(strings.TrimSpace(e.Text), "<@"+self) {
+				handle(e.Channel, e.User, e.Text, api.message_thread(e.Channel, e.Timestamp))
+			}
+		case *slack.InvalidAuthEvent:
+			return fmt.Errorf("Slack rejected the token for RTM")
+		}
+	}
+	return nil
+}
+
+type replies_response struct {
+	api_response
+	Messages []struct {
+		ThreadTimestamp string `json:"thread_ts"`
+	} `json:"messages"`
+}
+
+// The thread to answer a message in: the one it was given in, or else its
+// own. The vendored client's RTM messages don't say which thread they are in,
+// so it is looked up.
+func (s impl) message_thread(channel, timestamp string) string {
+	var resp replies_response
+	values := url.Values{"channel": {channel}, "ts": {timestamp}, "limit": {"1"}}
+	if err := s.call("conversations.replies", values, &resp); err != nil {
+		log.LogF("Could not find the thread of %s in %s: %s", timestamp, channel, err)
+		return timestamp
+	}
+	if len(resp.Messages) != 0 && resp.Messages[0].ThreadTimestamp != "" {
+		return resp.Messages[0].ThreadTimestamp
+	}
+	return timestamp
+}
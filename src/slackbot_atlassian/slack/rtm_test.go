@@ -0,0 +1,36 @@
+package slack
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestMessageThread(t *testing.T) {
+	defer fake_slack_api(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/conversations.replies" || r.FormValue("channel") != "C1" {
+			t.Errorf("Unexpected call %s for %s", r.URL.Path, r.FormValue("channel"))
+		}
+		switch r.FormValue("ts") {
+		case "1500000000.000200":
+			fmt.Fprint(w, `{"ok": true, "messages": [{"ts": "1500000000.000200", "thread_ts": "1500000000.000100"}]}`)
+		case "1500000000.000300":
+			fmt.Fprint(w, `{"ok": true, "messages": [{"ts": "1500000000.000300"}]}`)
+		default:
+			fmt.Fprint(w, `{"ok": false, "error": "missing_scope"}`)
+		}
+	})()
+
+	s := impl{}
+	for ts, expected := range map[string]string{
+		// A reply in a thread is answered in that thread
+		"1500000000.000200": "1500000000.000100",
+		// Other messages start a thread, as they do if the lookup fails
+		"1500000000.000300": "1500000000.000300",
+		"1500000000.000400": "1500000000.000400",
+	} {
+		if thread := s.message_thread("C1", ts); thread != expected {
+			t.Errorf("%s: expected thread %s, got %s", ts, expected, thread)
+		}
+	}
+}
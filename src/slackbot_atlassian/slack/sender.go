@@ -0,0 +1,111 @@
+package slack
+
+import (
+	"sync"
+	"time"
+
+	"gopkg.in/bsm/ratelimit.v1"
+)
+
+// Slack allows about one message a second to each channel
+const (
+	DefaultSendRate = 1
+	DefaultSendPer  = time.Second
+)
+
+// How long a channel's queue is kept once it has nothing left to send
+const sender_idle = time.Minute
+
+// Runs jobs that send to Slack channels: in the order they were queued for
+// each channel, no faster than the rate per channel, and concurrently for
+// different channels
+type Sender struct {
+	rate int
+	per  time.Duration
+	idle time.Duration
+
+	mu     sync.Mutex
+	queues map[string]*send_queue
+	wg     sync.WaitGroup
+}
+
+// The jobs waiting for a channel, and a signal that more have been added
+type send_queue struct {
+	jobs  []func()
+	added chan struct{}
+}
+
+func NewSender(rate int, per time.Duration) *Sender {
+	return &Sender{rate: rate, per: per, idle: sender_idle, queues: make(map[string]*send_queue)}
+}
+
+// Queue a job sending to a channel
+func (s *Sender) Send(channel string, job func()) {
+	s.wg.Add(1)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q, ok := s.queues[channel]
+	if !ok {
+		q = &send_queue{added: make(chan struct{}, 1)}
+		s.queues[channel] = q
+		go s.run(channel, q)
+	}
+	q.jobs = append(q.jobs, job)
+
+	select {
+	case q.added <- struct{}{}:
+	default:
+	}
+}
+
+// Run a channel's jobs as its token bucket allows, until it has had nothing
+// to send for a while
+func (s *Sender) run(channel string, q *send_queue) {
+	limiter := ratelimit.New(s.rate, s.per)
+	// Check for a token a few times per token
+	wait := s.per / time.Duration(s.rate*4)
+	for {
+		job, ok := s.next(channel, q)
+		if !ok {
+			return
+		}
+		for limiter.Limit() {
+			time.Sleep(wait)
+		}
+		job()
+		s.wg.Done()
+	}
+}
+
+// The next job for a channel, waiting for one to be added if need be. If
+// none is for a while, the queue is dropped.
+func (s *Sender) next(channel string, q *send_queue) (func(), bool) {
+	for {
+		s.mu.Lock()
+		if len(q.jobs) != 0 {
+			job := q.jobs[0]
+			q.jobs = q.jobs[1:]
+			s.mu.Unlock()
+			return job, true
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-q.added:
+		case <-time.After(s.idle):
+			s.mu.Lock()
+			if len(q.jobs) == 0 {
+				delete(s.queues, channel)
+				s.mu.Unlock()
+				return nil, false
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// Wait for all the queued jobs to finish
+func (s *Sender) Wait() {
+	s.wg.Wait()
+}
@@ -0,0 +1,84 @@
+package slack
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSender(t *testing.T) {
+	per := 50 * time.Millisecond
+	s := NewSender(1, per)
+
+	var mu sync.Mutex
+	sent := make(map[string][]int)
+	at := make(map[string][]time.Time)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		for _, channel := range []string{"C1", "C2"} {
+			i, channel := i, channel
+			s.Send(channel, func() {
+				mu.Lock()
+				defer mu.Unlock()
+				sent[channel] = append(sent[channel], i)
+				at[channel] = append(at[channel], time.Now())
+			})
+		}
+	}
+	s.Wait()
+
+	for _, channel := range []string{"C1", "C2"} {
+		if len(sent[channel]) != 3 || sent[channel][0] != 0 || sent[channel][1] != 1 || sent[channel][2] != 2 {
+			t.Errorf("Expected %s's jobs in order, got %v", channel, sent[channel])
+			continue
+		}
+		for i := 1; i < 3; i++ {
+			if gap := at[channel][i].Sub(at[channel][i-1]); gap < per*3/4 {
+				t.Errorf("Expected %s's jobs to be paced, got %s between them", channel, gap)
+			}
+		}
+	}
+
+	// The channels take turns rather than waiting for each other
+	if elapsed := time.Since(start); elapsed > 4*per {
+		t.Errorf("Expected the channels to send concurrently, took %s", elapsed)
+	}
+}
+
+func TestSenderIdle(t *testing.T) {
+	s := NewSender(100, time.Second)
+	s.idle = 20 * time.Millisecond
+
+	var sent []string
+	var mu sync.Mutex
+	send := func(channel string) {
+		s.Send(channel, func() {
+			mu.Lock()
+			defer mu.Unlock()
+			sent = append(sent, channel)
+		})
+	}
+	send("D1")
+	send("D2")
+	s.Wait()
+
+	queues := func() int {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.queues)
+	}
+	if n := queues(); n != 2 {
+		t.Errorf("Expected a queue for each channel, got %d", n)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := queues(); n != 0 {
+		t.Errorf("Expected idle queues to be dropped, got %d", n)
+	}
+
+	// Sending again starts a new queue
+	send("D1")
+	s.Wait()
+	if len(sent) != 3 {
+		t.Errorf("Expected every job to run, got %v", sent)
+	}
+}
@@ -1,32 +1,296 @@
 package slack
 
 import (
-	"slackbot_atlassian/config"
+	"encoding/json"
+	"net/url"
 
-	"github.com/nlopes/slack"
+	"slackbot_atlassian/config"
+	"slackbot_atlassian/message"
 )
 
 type Slack interface {
-	PostMessage(channel string, as_user config.SlackUser, message string) error
+	// Post a message, returning the ID of the channel it was posted to and
+	// its timestamp
+	PostMessage(message.Message) (string, string, error)
+
+	// Replace the content of a posted message. The channel must be an ID.
+	UpdateMessage(channel, timestamp string, m message.Message) error
+
+	// Find the ID of the user with an email address
+	LookupUserByEmail(email string) (string, bool, error)
+
+	// Open a direct message conversation with a user, returning its ID
+	OpenDirectMessage(user_id string) (string, error)
+
+	// Attach previews to the links in a message, keyed by URL
+	Unfurl(channel, timestamp string, unfurls map[string]Attachment) error
+
+	// Find a user's email address
+	GetUserEmail(user_id string) (string, bool, error)
+
+	// Find the URL of a user's avatar, hosted by Slack
+	GetUserImage(user_id string) (string, bool, error)
+
+	// Show a message in a channel that only one user can see
+	PostEphemeral(channel, user_id, text string) error
+
+	// Open a dialog in response to an interaction
+	OpenDialog(trigger_id string, dialog Dialog) error
+
+	// Open a modal in response to an interaction
+	OpenView(trigger_id string, view View) error
+
+	// Find the link to a message
+	GetPermalink(channel, timestamp string) (string, error)
+
+	// Check that the bot can post to the channels, which are resolved to
+	// IDs for posting, and that the configured users exist. Archived
+	// channels and deactivated users are only warned about.
+	Validate(channels []string) error
+
+	// Find the ID of a channel given by name (with or without a #), or by ID
+	ChannelID(channel string) (string, bool, error)
+}
+
+// A dialog for getting input from a user. Its submission is sent to the
+// interactivity endpoint with the callback ID and state.
+type Dialog struct {
+	CallbackID  string          `json:"callback_id"`
+	Title       string          `json:"title"`
+	SubmitLabel string          `json:"submit_label,omitempty"`
+	State       string          `json:"state,omitempty"`
+	Elements    []DialogElement `json:"elements"`
+}
+
+type DialogElement struct {
+	Type        string `json:"type"`
+	Label       string `json:"label"`
+	Name        string `json:"name"`
+	Placeholder string `json:"placeholder,omitempty"`
+	MaxLength   int    `json:"max_length,omitempty"`
+}
+
+// A Block Kit modal. Its submission is sent to the interactivity endpoint
+// with the callback ID and private metadata.
+type View struct {
+	CallbackID      string
+	Title           string
+	Submit          string
+	PrivateMetadata string
+	Blocks          []Block
+}
+
+func (v View) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"type":             "modal",
+		"callback_id":      v.CallbackID,
+		"title":            plain_text(v.Title),
+		"submit":           plain_text(v.Submit),
+		"private_metadata": v.PrivateMetadata,
+		"blocks":           v.Blocks,
+	})
 }
 
 type impl struct {
-	cfg    config.SlackConfig
-	client *slack.Client
+	cfg      config.SlackConfig
+	channels *channel_ids
 }
 
+// A client using the token, or for channels with an incoming webhook, the
+// webhook
 func New(cfg config.SlackConfig) Slack {
-	return impl{cfg, slack.New(cfg.Auth.Token)}
+	token := impl{cfg, new_channel_ids()}
+	if len(cfg.Webhooks) == 0 {
+		return token
+	}
+	return new_router(cfg, token)
 }
 
-func (s impl) PostMessage(channel string, user config.SlackUser, message string) error {
-	params := slack.PostMessageParameters{
-		Username:  user.Name,
-		IconURL:   user.IconUrl,
-		IconEmoji: user.IconEmoji,
+func (s impl) PostMessage(m message.Message) (string, string, error) {
+	values, err := message_values(s.channels.id(m.SlackChannel), m.AsUser, NewPayload(m))
+	if err != nil {
+		return "", "", err
+	}
+	if m.ThreadTimestamp != "" {
+		values.Set("thread_ts", m.ThreadTimestamp)
+		if m.Broadcast {
+			values.Set("reply_broadcast", "true")
+		}
+	}
+
+	var resp api_response
+	if err := s.call("chat.postMessage", values, &resp); err != nil {
+		return "", "", err
 	}
+	return resp.Channel, resp.Timestamp, nil
+}
 
-	_, _, err := s.client.PostMessage(channel, message, params)
+func (s impl) UpdateMessage(channel, timestamp string, m message.Message) error {
+	values, err := message_values(channel, m.AsUser, NewPayload(m))
+	if err != nil {
+		return err
+	}
+	values.Set("ts", timestamp)
 
-	return err
+	var resp api_response
+	return s.call("chat.update", values, &resp)
+}
+
+type user_response struct {
+	api_response
+	User struct {
+		ID string `json:"id"`
+	} `json:"user"`
+}
+
+func (s impl) LookupUserByEmail(email string) (string, bool, error) {
+	var resp user_response
+	err := s.call("users.lookupByEmail", url.Values{"email": {email}}, &resp)
+	if IsAPIError(err, "users_not_found") {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	return resp.User.ID, true, nil
+}
+
+type conversation_response struct {
+	api_response
+	Channel struct {
+		ID string `json:"id"`
+	} `json:"channel"`
+}
+
+func (s impl) OpenDirectMessage(user_id string) (string, error) {
+	var resp conversation_response
+	if err := s.call("conversations.open", url.Values{"users": {user_id}}, &resp); err != nil {
+		return "", err
+	}
+	return resp.Channel.ID, nil
+}
+
+func (s impl) Unfurl(channel, timestamp string, unfurls map[string]Attachment) error {
+	b, err := json.Marshal(unfurls)
+	if err != nil {
+		return err
+	}
+	values := url.Values{
+		"channel": {channel},
+		"ts":      {timestamp},
+		"unfurls": {string(b)},
+	}
+
+	var resp api_response
+	return s.call("chat.unfurl", values, &resp)
+}
+
+type user_info_response struct {
+	api_response
+	User struct {
+		Deleted bool `json:"deleted"`
+		Profile struct {
+			Email    string `json:"email"`
+			Image192 string `json:"image_192"`
+		} `json:"profile"`
+	} `json:"user"`
+}
+
+func (s impl) GetUserEmail(user_id string) (string, bool, error) {
+	var resp user_info_response
+	err := s.call("users.info", url.Values{"user": {user_id}}, &resp)
+	if IsAPIError(err, "user_not_found") {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	email := resp.User.Profile.Email
+	return email, email != "", nil
+}
+
+func (s impl) GetUserImage(user_id string) (string, bool, error) {
+	var resp user_info_response
+	err := s.call("users.info", url.Values{"user": {user_id}}, &resp)
+	if IsAPIError(err, "user_not_found") {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	image := resp.User.Profile.Image192
+	return image, image != "", nil
+}
+
+func (s impl) PostEphemeral(channel, user_id, text string) error {
+	values := url.Values{"channel": {channel}, "user": {user_id}, "text": {text}}
+
+	var resp api_response
+	return s.call("chat.postEphemeral", values, &resp)
+}
+
+func (s impl) OpenDialog(trigger_id string, dialog Dialog) error {
+	b, err := json.Marshal(dialog)
+	if err != nil {
+		return err
+	}
+	values := url.Values{"trigger_id": {trigger_id}, "dialog": {string(b)}}
+
+	var resp api_response
+	return s.call("dialog.open", values, &resp)
+}
+
+func (s impl) OpenView(trigger_id string, view View) error {
+	b, err := json.Marshal(view)
+	if err != nil {
+		return err
+	}
+	values := url.Values{"trigger_id": {trigger_id}, "view": {string(b)}}
+
+	var resp api_response
+	return s.call("views.open", values, &resp)
+}
+
+type permalink_response struct {
+	api_response
+	Permalink string `json:"permalink"`
+}
+
+func (s impl) GetPermalink(channel, timestamp string) (string, error) {
+	var resp permalink_response
+	if err := s.call("chat.getPermalink", url.Values{"channel": {channel}, "message_ts": {timestamp}}, &resp); err != nil {
+		return "", err
+	}
+	return resp.Permalink, nil
+}
+
+// Encode a message payload, and who it is from, as chat.postMessage arguments
+func message_values(channel string, user config.SlackUser, p Payload) (url.Values, error) {
+	values := url.Values{
+		"channel":      {channel},
+		"text":         {p.Text},
+		"unfurl_links": {"false"},
+		"unfurl_media": {"false"},
+	}
+	if user.Name != "" {
+		values.Set("username", user.Name)
+	}
+	if user.IconUrl != "" {
+		values.Set("icon_url", user.IconUrl)
+	}
+	if user.IconEmoji != "" {
+		values.Set("icon_emoji", user.IconEmoji)
+	}
+	if len(p.Attachments) != 0 {
+		b, err := json.Marshal(p.Attachments)
+		if err != nil {
+			return nil, err
+		}
+		values.Set("attachments", string(b))
+	}
+	if len(p.Blocks) != 0 {
+		b, err := json.Marshal(p.Blocks)
+		if err != nil {
+			return nil, err
+		}
+		values.Set("blocks", string(b))
+	}
+	return values, nil
 }
@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"slackbot_atlassian/config"
+	"slackbot_atlassian/message"
 )
 
 func TestSlackPostMessage(t *testing.T) {
@@ -22,13 +23,13 @@ func TestSlackPostMessage(t *testing.T) {
 		IconEmoji: ":skull:",
 	}
 
-	err = slack.PostMessage("@slackbot", user, "hello world")
+	_, _, err = slack.PostMessage(message.Message{SlackChannel: "@slackbot", AsUser: user, Text: "hello world"})
 
 	if err != nil {
 		t.Error(err)
 	}
 
-	err = slack.PostMessage("wrong_channel_name_kjsdfkjsf", user, "hello world")
+	_, _, err = slack.PostMessage(message.Message{SlackChannel: "wrong_channel_name_kjsdfkjsf", AsUser: user, Text: "hello world"})
 
 	if err == nil {
 		t.Error("Expected error for incorrect channel name")
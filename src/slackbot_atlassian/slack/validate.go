@@ -0,0 +1,183 @@
+package slack
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"slackbot_atlassian/log"
+)
+
+// Channel names mapped to their IDs, found when validating the config or
+// looking channels up, so messages can be posted by ID
+type channel_ids struct {
+	sync.RWMutex
+	ids map[string]string
+	// When every channel was last listed
+	listed time.Time
+}
+
+// How long before channels are listed again to look up one that isn't known
+const channel_list_expiry = 10 * time.Minute
+
+// Channel IDs are upper case, while names are lower case
+var channel_id_re = regexp.MustCompile(`^[CGD][A-Z0-9]+$`)
+
+func new_channel_ids() *channel_ids {
+	return &channel_ids{ids: make(map[string]string)}
+}
+
+// The ID of a channel, or the channel as given if it isn't known
+func (c *channel_ids) id(channel string) string {
+	c.RLock()
+	defer c.RUnlock()
+	if id, ok := c.ids[strings.TrimPrefix(channel, "#")]; ok {
+		return id
+	}
+	return channel
+}
+
+func (c *channel_ids) set(name, id string) {
+	c.Lock()
+	defer c.Unlock()
+	c.ids[name] = id
+}
+
+func (c *channel_ids) lookup(name string) (string, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	id, ok := c.ids[name]
+	return id, ok
+}
+
+// Whether the channels should be listed to find one that isn't known, which
+// is then put off for a while
+func (c *channel_ids) relist(now time.Time) bool {
+	c.Lock()
+	defer c.Unlock()
+	if now.Sub(c.listed) < channel_list_expiry {
+		return false
+	}
+	c.listed = now
+	return true
+}
+
+type channel_info struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	IsArchived bool   `json:"is_archived"`
+	IsMember   bool   `json:"is_member"`
+}
+
+type conversation_list_response struct {
+	api_response
+	Channels         []channel_info `json:"channels"`
+	ResponseMetadata struct {
+		NextCursor string `json:"next_cursor"`
+	} `json:"response_metadata"`
+}
+
+// Every channel the bot can see, keyed by both name and ID
+func (s impl) list_channels() (map[string]channel_info, error) {
+	channels := make(map[string]channel_info)
+	cursor := ""
+	for {
+		values := url.Values{
+			"types":            {"public_channel,private_channel"},
+			"exclude_archived": {"false"},
+			"limit":            {"200"},
+		}
+		if cursor != "" {
+			values.Set("cursor", cursor)
+		}
+
+		var resp conversation_list_response
+		if err := s.call("conversations.list", values, &resp); err != nil {
+			return nil, err
+		}
+		for _, c := range resp.Channels {
+			channels[c.Name] = c
+			channels[c.ID] = c
+		}
+
+		cursor = resp.ResponseMetadata.NextCursor
+		if cursor == "" {
+			return channels, nil
+		}
+	}
+}
+
+func (s impl) ChannelID(channel string) (string, bool, error) {
+	if channel_id_re.MatchString(channel) {
+		return channel, true, nil
+	}
+	name := strings.TrimPrefix(channel, "#")
+	if id, ok := s.channels.lookup(name); ok {
+		return id, true, nil
+	}
+	if !s.channels.relist(time.Now()) {
+		return "", false, nil
+	}
+
+	found, err := s.list_channels()
+	if err != nil {
+		return "", false, err
+	}
+	for _, c := range found {
+		s.channels.set(c.Name, c.ID)
+	}
+	c, ok := found[name]
+	return c.ID, ok, nil
+}
+
+func (s impl) Validate(channels []string) error {
+	var problems []string
+
+	found, err := s.list_channels()
+	if err != nil {
+		return fmt.Errorf("Could not list Slack channels: %s", err)
+	}
+	for _, channel := range channels {
+		c, ok := found[strings.TrimPrefix(channel, "#")]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("channel %q doesn't exist, or is private and the bot isn't in it", channel))
+		case c.IsArchived:
+			log.LogF("Warning: channel %q is archived", channel)
+		case !c.IsMember:
+			problems = append(problems, fmt.Sprintf("the bot isn't a member of channel %q", channel))
+		default:
+			s.channels.set(strings.TrimPrefix(channel, "#"), c.ID)
+		}
+	}
+
+	var usernames []string
+	for username := range s.cfg.Users {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+	for _, username := range usernames {
+		id := s.cfg.Users[username].ID
+		if id == "" {
+			continue
+		}
+		var resp user_info_response
+		err := s.call("users.info", url.Values{"user": {id}}, &resp)
+		if IsAPIError(err, "user_not_found") {
+			problems = append(problems, fmt.Sprintf("user %s for %q doesn't exist", id, username))
+		} else if err != nil {
+			return fmt.Errorf("Could not look up Slack user %s: %s", id, err)
+		} else if resp.User.Deleted {
+			log.LogF("Warning: user %s for %q has been deactivated", id, username)
+		}
+	}
+
+	if len(problems) != 0 {
+		return fmt.Errorf("Problems with the Slack config:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
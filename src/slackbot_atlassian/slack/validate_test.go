@@ -0,0 +1,107 @@
+package slack
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"slackbot_atlassian/config"
+	"slackbot_atlassian/message"
+)
+
+// A stand-in for the Slack Web API, with two pages of channels and one user
+func test_slack_api(t *testing.T) func() {
+	return fake_slack_api(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/conversations.list":
+			if r.FormValue("cursor") == "" {
+				fmt.Fprint(w, `{"ok": true, "channels": [
+					{"id": "C1", "name": "team-yoda-jira", "is_member": true},
+					{"id": "C2", "name": "team-ewok-jira", "is_member": false}
+				], "response_metadata": {"next_cursor": "page2"}}`)
+			} else {
+				fmt.Fprint(w, `{"ok": true, "channels": [
+					{"id": "C3", "name": "old-jira", "is_archived": true}
+				], "response_metadata": {"next_cursor": ""}}`)
+			}
+		case "/users.info":
+			if r.FormValue("user") == "U1" {
+				fmt.Fprint(w, `{"ok": true, "user": {"id": "U1"}}`)
+			} else {
+				fmt.Fprint(w, `{"ok": false, "error": "user_not_found"}`)
+			}
+		case "/chat.postMessage":
+			fmt.Fprintf(w, `{"ok": true, "channel": %q, "ts": "1500000000.000100"}`, r.FormValue("channel"))
+		default:
+			t.Errorf("Unexpected call to %s", r.URL.Path)
+			http.NotFound(w, r)
+		}
+	})
+}
+
+func TestValidate(t *testing.T) {
+	defer test_slack_api(t)()
+
+	s := New(config.SlackConfig{Users: map[string]config.SlackUser{
+		"jane": {ID: "U1"},
+		"bob":  {ID: "U404"},
+		"anon": {Name: "Anon"},
+	}})
+
+	err := s.Validate([]string{"#team-yoda-jira", "team-ewok-jira", "old-jira", "team-typo-jira"})
+	if err == nil {
+		t.Fatal("Expected problems")
+	}
+	for _, problem := range []string{
+		`the bot isn't a member of channel "team-ewok-jira"`,
+		`channel "team-typo-jira" doesn't exist`,
+		`user U404 for "bob" doesn't exist`,
+	} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("Expected %q in %q", problem, err)
+		}
+	}
+	if strings.Contains(err.Error(), "yoda") || strings.Contains(err.Error(), "old-jira") {
+		t.Errorf("Expected only problems to be reported, got %q", err)
+	}
+
+	// Messages are posted to the channel's ID from then on
+	if channel, _, err := s.PostMessage(message.Message{SlackChannel: "team-yoda-jira", Text: "hello"}); err != nil || channel != "C1" {
+		t.Errorf("Expected the message to be posted to C1, got %q (%v)", channel, err)
+	}
+
+	if err := s.Validate([]string{"team-yoda-jira"}); err == nil || strings.Count(err.Error(), "\n") != 1 {
+		t.Errorf("Expected just the user problem, got %v", err)
+	}
+}
+
+func TestChannelID(t *testing.T) {
+	var lists int
+	defer fake_slack_api(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/conversations.list" {
+			t.Errorf("Unexpected call to %s", r.URL.Path)
+		}
+		lists++
+		fmt.Fprint(w, `{"ok": true, "channels": [{"id": "C1", "name": "team-yoda-jira"}]}`)
+	})()
+
+	s := New(config.SlackConfig{})
+	for _, c := range []struct {
+		channel, id string
+		ok          bool
+	}{
+		{"#team-yoda-jira", "C1", true},
+		{"team-yoda-jira", "C1", true},
+		{"C2", "C2", true},
+		{"#team-typo-jira", "", false},
+	} {
+		id, ok, err := s.ChannelID(c.channel)
+		if err != nil || id != c.id || ok != c.ok {
+			t.Errorf("%s: expected %q (%t), got %q (%t, %v)", c.channel, c.id, c.ok, id, ok, err)
+		}
+	}
+	if lists != 1 {
+		t.Errorf("Expected the channels to be listed once, got %d", lists)
+	}
+}
@@ -0,0 +1,48 @@
+package slack
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Requests older than this are rejected, so they can't be replayed
+const max_request_age = 5 * time.Minute
+
+// Check that a request (e.g. a slash command) really came from Slack, using
+// the app's signing secret. See
+// https://api.slack.com/authentication/verifying-requests-from-slack
+func VerifyRequest(signing_secret string, header http.Header, body []byte, now time.Time) error {
+	timestamp := header.Get("X-Slack-Request-Timestamp")
+	signature := header.Get("X-Slack-Signature")
+	if timestamp == "" || signature == "" {
+		return fmt.Errorf("Request is not signed")
+	}
+
+	secs, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid request timestamp %q", timestamp)
+	}
+	age := now.Sub(time.Unix(secs, 0))
+	if age > max_request_age || age < -max_request_age {
+		return fmt.Errorf("Request timestamp is too far from now: %s", age)
+	}
+
+	expected := SignRequest(signing_secret, timestamp, body)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return fmt.Errorf("Request signature does not match")
+	}
+	return nil
+}
+
+// The signature Slack sends with a request
+func SignRequest(signing_secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(signing_secret))
+	fmt.Fprintf(mac, "v0:%s:", timestamp)
+	mac.Write(body)
+	return "v0=" + hex.EncodeToString(mac.Sum(nil))
+}
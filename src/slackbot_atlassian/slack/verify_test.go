@@ -0,0 +1,42 @@
+package slack
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVerifyRequest(t *testing.T) {
+	now := time.Unix(1531420618, 0)
+	body := []byte("token=xyzz0WbapA4vBCDEFasx0q6G&team_id=T1DC2JH3J&command=%2Fjira&text=LRN-1234")
+
+	signed := func(secret string, at time.Time, body []byte) http.Header {
+		h := http.Header{}
+		ts := strconv.FormatInt(at.Unix(), 10)
+		h.Set("X-Slack-Request-Timestamp", ts)
+		h.Set("X-Slack-Signature", SignRequest(secret, ts, body))
+		return h
+	}
+
+	cases := []struct {
+		header   http.Header
+		is_valid bool
+	}{
+		{signed("s3cret", now, body), true},
+		{signed("s3cret", now.Add(-time.Minute), body), true},
+		{signed("wrong", now, body), false},
+		{signed("s3cret", now, []byte("text=LRN-1")), false},
+		{signed("s3cret", now.Add(-10*time.Minute), body), false},
+		{http.Header{}, false},
+	}
+
+	for i, c := range cases {
+		err := VerifyRequest("s3cret", c.header, body, now)
+		if c.is_valid && err != nil {
+			t.Errorf("Case %d: expected request to be valid, got %s", i, err)
+		} else if !c.is_valid && err == nil {
+			t.Errorf("Case %d: expected request not to be valid", i)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package slack
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"slackbot_atlassian/config"
+	"slackbot_atlassian/message"
+)
+
+// Returned for anything but posting a message to a channel with a webhook
+var ErrWebhook = fmt.Errorf("Not possible through an incoming webhook")
+
+// Posts to a channel through an incoming webhook, for workspaces where the
+// bot can't have a token. Webhooks can only post messages, and don't say
+// which message they posted.
+type webhook struct {
+	url string
+}
+
+func NewWebhook(url string) Slack {
+	return webhook{url}
+}
+
+// What is posted to a webhook: the message, and who it is from
+type webhook_payload struct {
+	Payload
+	Username    string `json:"username,omitempty"`
+	IconURL     string `json:"icon_url,omitempty"`
+	IconEmoji   string `json:"icon_emoji,omitempty"`
+	UnfurlLinks bool   `json:"unfurl_links"`
+	UnfurlMedia bool   `json:"unfurl_media"`
+}
+
+// Posts the message, returning the channel as given and no timestamp
+func (w webhook) PostMessage(m message.Message) (string, string, error) {
+	b, err := json.Marshal(webhook_payload{
+		Payload:   NewPayload(m),
+		Username:  m.AsUser.Name,
+		IconURL:   m.AsUser.IconUrl,
+		IconEmoji: m.AsUser.IconEmoji,
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	err = retry_rate_limited("webhook for "+m.SlackChannel, func() error {
+		return w.post(b)
+	})
+	return m.SlackChannel, "", err
+}
+
+func (w webhook) post(body []byte) error {
+	resp, err := http.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return RateLimitedError{retry_after(resp)}
+	}
+	if resp.StatusCode != 200 {
+		// Webhooks give the error code as plain text, e.g. "channel_not_found"
+		b, _ := ioutil.ReadAll(resp.Body)
+		if code := strings.TrimSpace(string(b)); code != "" {
+			return APIError{code}
+		}
+		return fmt.Errorf("Bad status code posting to Slack webhook: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Send the response to a slash command to its response URL, which takes
+// messages like an incoming webhook
+func Respond(response_url string, p Payload) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return retry_rate_limited("response", func() error {
+		return webhook{response_url}.post(b)
+	})
+}
+
+func (w webhook) UpdateMessage(channel, timestamp string, m message.Message) error {
+	return ErrWebhook
+}
+
+func (w webhook) LookupUserByEmail(email string) (string, bool, error) {
+	return "", false, ErrWebhook
+}
+
+func (w webhook) OpenDirectMessage(user_id string) (string, error) {
+	return "", ErrWebhook
+}
+
+func (w webhook) Unfurl(channel, timestamp string, unfurls map[string]Attachment) error {
+	return ErrWebhook
+}
+
+func (w webhook) GetUserEmail(user_id string) (string, bool, error) {
+	return "", false, ErrWebhook
+}
+
+func (w webhook) GetUserImage(user_id string) (string, bool, error) {
+	return "", false, ErrWebhook
+}
+
+func (w webhook) PostEphemeral(channel, user_id, text string) error {
+	return ErrWebhook
+}
+
+func (w webhook) OpenDialog(trigger_id string, dialog Dialog) error {
+	return ErrWebhook
+}
+
+func (w webhook) OpenView(trigger_id string, view View) error {
+	return ErrWebhook
+}
+
+func (w webhook) GetPermalink(channel, timestamp string) (string, error) {
+	return "", ErrWebhook
+}
+
+// There's nothing to check without posting
+func (w webhook) Validate(channels []string) error {
+	return nil
+}
+
+func (w webhook) ChannelID(channel string) (string, bool, error) {
+	return "", false, ErrWebhook
+}
+
+// Posts to the channels with a webhook through it, and does everything else
+// with the token
+type router struct {
+	Slack
+	has_token bool
+	webhooks  map[string]Slack
+}
+
+func new_router(cfg config.SlackConfig, token Slack) Slack {
+	webhooks := make(map[string]Slack)
+	for channel, u := range cfg.Webhooks {
+		webhooks[channel] = NewWebhook(u)
+	}
+	return router{token, cfg.Auth.Token != "", webhooks}
+}
+
+func (r router) PostMessage(m message.Message) (string, string, error) {
+	if w, ok := r.webhooks[strings.TrimPrefix(m.SlackChannel, "#")]; ok {
+		return w.PostMessage(m)
+	}
+	return r.Slack.PostMessage(m)
+}
+
+// Only the channels without a webhook need the token
+func (r router) Validate(channels []string) error {
+	var rest, problems []string
+	for _, channel := range channels {
+		if _, ok := r.webhooks[strings.TrimPrefix(channel, "#")]; ok {
+			continue
+		}
+		rest = append(rest, channel)
+		if !r.has_token {
+			problems = append(problems, fmt.Sprintf("channel %q has no webhook, and there's no token to post with", channel))
+		}
+	}
+	if len(problems) != 0 {
+		return fmt.Errorf("Problems with the Slack config:\n  %s", strings.Join(problems, "\n  "))
+	}
+	if !r.has_token {
+		return nil
+	}
+	return r.Slack.Validate(rest)
+}
+
+// Without a token channels can't be looked up
+func (r router) ChannelID(channel string) (string, bool, error) {
+	if !r.has_token {
+		return "", false, nil
+	}
+	return r.Slack.ChannelID(channel)
+}
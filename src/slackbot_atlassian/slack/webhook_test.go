@@ -0,0 +1,88 @@
+package slack
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"slackbot_atlassian/config"
+	"slackbot_atlassian/message"
+)
+
+func TestWebhook(t *testing.T) {
+	var posted []map[string]interface{}
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Error(err)
+		}
+		if payload["text"] == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, "no_text")
+			return
+		}
+		posted = append(posted, payload)
+		fmt.Fprint(w, "ok")
+	}))
+	defer hook.Close()
+
+	var called []string
+	defer fake_slack_api(func(w http.ResponseWriter, r *http.Request) {
+		called = append(called, r.URL.Path+" "+r.FormValue("channel"))
+		fmt.Fprintf(w, `{"ok": true, "channel": "C2", "ts": "1500000000.000100"}`)
+	})()
+
+	cfg := config.SlackConfig{Webhooks: map[string]string{"team-yoda-jira": hook.URL}}
+	cfg.Auth.Token = "xoxb"
+	s := New(cfg)
+
+	m := message.Message{
+		SlackChannel: "#team-yoda-jira",
+		AsUser:       config.SlackUser{Name: "Jira", IconEmoji: ":jira:"},
+		Text:         "LRN-1 was created",
+		Format:       config.FormatBlocks,
+		Card:         &message.Card{Title: "LRN-1: Something", Fallback: "LRN-1 was created"},
+	}
+	channel, ts, err := s.PostMessage(m)
+	if err != nil || channel != "#team-yoda-jira" || ts != "" {
+		t.Errorf("Unexpected result %q %q %v", channel, ts, err)
+	}
+	if len(posted) != 1 {
+		t.Fatalf("Expected a message through the webhook, got %v", posted)
+	}
+	if posted[0]["username"] != "Jira" || posted[0]["icon_emoji"] != ":jira:" || posted[0]["attachments"] == nil {
+		t.Errorf("Unexpected payload %v", posted[0])
+	}
+
+	// Other channels are posted to with the token
+	m.SlackChannel = "team-ewok-jira"
+	if channel, ts, err := s.PostMessage(m); err != nil || channel != "C2" || ts == "" {
+		t.Errorf("Unexpected result %q %q %v", channel, ts, err)
+	}
+	if len(called) != 1 || called[0] != "/chat.postMessage team-ewok-jira" {
+		t.Errorf("Expected a call to chat.postMessage, got %v", called)
+	}
+
+	// Webhooks' errors are their response
+	m.SlackChannel = "team-yoda-jira"
+	m.Card = nil
+	m.Text = ""
+	if _, _, err := s.PostMessage(m); !IsAPIError(err, "no_text") {
+		t.Errorf("Expected a no_text error, got %v", err)
+	}
+}
+
+func TestValidateWebhooks(t *testing.T) {
+	s := New(config.SlackConfig{Webhooks: map[string]string{"team-yoda-jira": "https://hooks.slack.com/services/T0/B0/x"}})
+
+	if err := s.Validate([]string{"team-yoda-jira"}); err != nil {
+		t.Errorf("Expected webhook channels not to need a token, got %s", err)
+	}
+	err := s.Validate([]string{"team-yoda-jira", "team-ewok-jira"})
+	if err == nil || !strings.Contains(err.Error(), `channel "team-ewok-jira" has no webhook`) {
+		t.Errorf("Expected a channel without a webhook to be a problem, got %v", err)
+	}
+}
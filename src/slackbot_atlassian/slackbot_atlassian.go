@@ -1,28 +1,46 @@
 package slackbot_atlassian
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"sync"
+	"time"
 
 	"slackbot_atlassian/atlassian"
+	"slackbot_atlassian/avatar"
 	"slackbot_atlassian/config"
 	"slackbot_atlassian/log"
 	"slackbot_atlassian/message"
+	"slackbot_atlassian/sink"
 	"slackbot_atlassian/slack"
 	"slackbot_atlassian/state"
 	"slackbot_atlassian/storage"
+	"slackbot_atlassian/users"
 )
 
-// This function:
-//
-// * reads the last event from Redis
-// * queries Jira to get new activities
-// * processes each activity and posts it to Slack
-func ProcessActivityStream(config *config.Config) error {
+// The clients used to process the activity stream, and the activities held
+// back between runs in daemon mode
+type processor struct {
+	config         *config.Config
+	state          state.State
+	atl            atlassian.Atlassian
+	slack_client   slack.Slack
+	storage_client storage.Client
+	users          users.Mapper
+	pending        *coalescer
+	sender         *slack.Sender
+	sinks          sink.Sinks
+}
+
+func new_processor(config *config.Config) (*processor, error) {
 	// Get access to our state
 	log.LogF("Creating Redis client")
 	s, err := state.New(config.State)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	log.LogF("Creating jira client")
@@ -33,12 +51,135 @@ func ProcessActivityStream(config *config.Config) error {
 	// Get a Slack client
 	slack_client := slack.New(config.Slack)
 
-	log.LogF("Creating a storage (S3) client")
-	storage_client := storage.New(config.ResourceStorage)
+	log.LogF("Creating a storage (%s) client", config.ResourceStorage.Driver)
+	storage_client, err := storage.New(config.ResourceStorage)
+	if err != nil {
+		return nil, err
+	}
+
+	user_mapper := users.New(config.Slack, slack_client, s, atl)
+
+	return &processor{
+		config:         config,
+		state:          s,
+		atl:            atl,
+		slack_client:   slack_client,
+		storage_client: storage_client,
+		users:          user_mapper,
+		pending:        new_coalescer(config.Coalesce.GetWindow()),
+		sender:         slack.NewSender(slack.DefaultSendRate, slack.DefaultSendPer),
+		sinks:          sink.New(config.Outputs),
+	}, nil
+}
+
+// Check that the bot can post to the configured triggers' Slack channels and
+// that the configured users exist
+func CheckSlack(config *config.Config) error {
+	return check_slack(slack.New(config.Slack), config)
+}
+
+// Checking also finds the channels' IDs, for the client to post by
+func check_slack(slack_client slack.Slack, config *config.Config) error {
+	log.LogF("Checking the Slack channels and users")
+	return slack_client.Validate(trigger_channels(config))
+}
+
+// How long a check of the Slack channels and users is trusted for, so runs
+// from cron don't list every channel each time
+const slack_check_expiry = time.Hour
+
+// Check the Slack channels and users before posting anything, unless the same
+// ones were found to be fine recently
+func (p *processor) check_slack() error {
+	hash := slack_config_hash(p.config)
+	if at, ok, err := p.state.GetSlackCheck(hash); err != nil {
+		log.LogF("Could not look up the last Slack check: %s", err)
+	} else if ok {
+		log.LogF("Slack channels and users were checked at %s", at)
+		return nil
+	}
+
+	if err := check_slack(p.slack_client, p.config); err != nil {
+		return err
+	}
+	if err := p.state.RecordSlackCheck(hash, time.Now(), slack_check_expiry); err != nil {
+		log.LogF("Failed to record the Slack check: %s", err)
+	}
+	return nil
+}
+
+// Identifies the Slack channels and users a config needs, so changing them
+// checks them again
+func slack_config_hash(config *config.Config) string {
+	users := make(map[string]string)
+	for name, u := range config.Slack.Users {
+		users[name] = u.ID
+	}
+	b, _ := json.Marshal(struct {
+		Channels []string          `json:"channels"`
+		Users    map[string]string `json:"users"`
+	}{trigger_channels(config), users})
+	return fmt.Sprintf("%x", sha256.Sum256(b))
+}
+
+// The channels the configured triggers post to, each once
+func trigger_channels(config *config.Config) []string {
+	var channels []string
+	seen := make(map[string]bool)
+	for _, t := range config.Triggers {
+		if t.SlackChannel != "" && !seen[t.SlackChannel] {
+			seen[t.SlackChannel] = true
+			channels = append(channels, t.SlackChannel)
+		}
+	}
+	return channels
+}
+
+// This function:
+//
+// * checks the Slack channels and users in the config (see check_slack)
+// * reads the last event from Redis
+// * queries Jira to get new activities
+// * processes each activity and posts it to Slack
+func ProcessActivityStream(config *config.Config) error {
+	p, err := new_processor(config)
+	if err != nil {
+		return err
+	}
+	if err := p.check_slack(); err != nil {
+		return err
+	}
+	return p.process(true)
+}
+
+// Process the activity stream every poll interval until the process is
+// killed. Activities that could still be coalesced with later ones are held
+// back until the coalesce window has passed.
+func RunDaemon(config *config.Config) error {
+	p, err := new_processor(config)
+	if err != nil {
+		return err
+	}
+	if err := p.check_slack(); err != nil {
+		return err
+	}
+
+	for {
+		if err := p.process(false); err != nil {
+			log.LogF("Error while processing activity stream: %s", err)
+		}
+		time.Sleep(config.Daemon.GetPollInterval())
+	}
+}
+
+// Process new activities. Unless flush is set, groups of activities that are
+// still within the coalesce window are kept for the next run.
+func (p *processor) process(flush bool) error {
+	config := p.config
 
 	log.LogF("Looking for last event")
 	// Get the last event
-	lastEvent, ok, err := s.GetLastEvent()
+	lastEvent, ok, err := p.state.GetLastEvent()
 	if err != nil {
 		return err
 	}
@@ -49,54 +190,174 @@ func ProcessActivityStream(config *config.Config) error {
 	}
 
 	// Get activities since this event
-	activities, err := atl.GetNewJiraActivities(lastEvent.Id)
+	activities, err := p.atl.GetNewJiraActivities(lastEvent.Id)
 	if err != nil {
 		return err
 	}
 
 	log.LogF("Found %d new activities since last event %v", len(activities), lastEvent)
 
-	activity_issues := get_issues(config, atl, activities)
+	p.pending.add(ordered_activity_issues(activities, get_issues(config, p.atl, activities))...)
+	groups := p.pending.take(time.Now(), flush)
 
-	var ai atlassian.ActivityIssue
 	var posted int
-	var seen bool
-
-	for ai = range activity_issues {
-		seen = true
+	triggers, subscribed := p.triggers()
+
+	// Messages are delivered concurrently for each channel, so remember the
+	// first failure. Failures for subscriptions are only logged, so one that
+	// can't be delivered doesn't hold up everything else.
+	var failed struct {
+		sync.Mutex
+		err error
+	}
+	fail := func(err error) {
+		failed.Lock()
+		if failed.err == nil {
+			failed.err = err
+		}
+		failed.Unlock()
+	}
 
-		user_image_urls := get_user_image_urls(storage_client, atl, s, ai)
-		matcher := message.NewMessageMatcher(config.Slack, user_image_urls, config.CustomJiraFields...)
-		messages := matcher.GetMatchingMessages(config.Triggers, ai)
+	for _, group := range groups {
+		user_image_urls := p.get_user_image_urls(group...)
+		matcher := message.NewMessageMatcher(config.Slack, user_image_urls, p.users, config.CustomJiraFields...)
+		messages := matcher.GetGroupMessages(triggers, group...)
 
 		posted += len(messages)
 
 		if len(messages) != 0 {
 			log.LogF("Posting %d messages to Slack", len(messages))
 			for _, m := range messages {
-				if err := slack_client.PostMessage(m.SlackChannel, m.AsUser, m.HtmlUnescapedText()); err != nil {
-					return err
-				}
+				m := m
+				p.queue_delivery(m, func(err error) {
+					if id, ok := subscribed[m.Trigger]; ok && err != nil {
+						log.LogF("Failed to deliver a message for subscription %s: %s", id, err)
+					} else if err != nil {
+						fail(err)
+					}
+				})
 			}
 		}
+
+		p.notify_watchers(matcher, group, fail)
+	}
+
+	p.sender.Wait()
+	if failed.err != nil {
+		return failed.err
 	}
 
 	log.LogF("Posted a total of %d messages to Slack", posted)
+	if n := p.pending.pending(); n != 0 {
+		log.LogF("Holding back %d activities to coalesce with later ones", n)
+	}
 
-	if seen {
-		// Record the last event seen
-		lastEvent = state.Event{ai.Activity.Id}
+	// Record the last event seen, without going past any activities still
+	// waiting, so they are fetched again if they're lost on a restart
+	if seen := p.pending.seen(activities); len(seen) != 0 {
+		lastEvent = state.Event{seen[len(seen)-1].Id}
 	}
 
 	log.LogF("Record last event in state DB: %v", lastEvent)
-	err = s.RecordLastEvent(lastEvent)
+	err = p.state.RecordLastEvent(lastEvent)
 	if err != nil {
 		return err
 	}
 
+	p.send_digests(time.Now())
+
 	return nil
 }
 
+// Messages are sent in order within their channel (or other destination)
+func send_queue(m message.Message) string {
+	if m.Trigger != nil {
+		if _, _, ok := m.Trigger.Output(); ok {
+			return m.Trigger.Target
+		}
+	}
+	return m.SlackChannel
+}
+
+// Queue the delivery of a message, calling done with the outcome. Direct
+// messages are queued for each recipient, as Slack's rate limit is for each
+// channel; failures to send them are only logged.
+func (p *processor) queue_delivery(m message.Message, done func(error)) {
+	if !is_direct(m) {
+		p.sender.Send(send_queue(m), func() {
+			done(p.deliver(m))
+		})
+		return
+	}
+
+	slack_ids, err := p.direct_recipients(m)
+	if err != nil {
+		done(err)
+		return
+	}
+	for _, slack_id := range slack_ids {
+		slack_id := slack_id
+		p.sender.Send(direct_queue(slack_id), func() {
+			if err := p.send_direct(slack_id, m); err != nil {
+				log.LogF("Failed to send direct message to %s: %s", slack_id, err)
+			}
+		})
+	}
+}
+
+// Direct messages to someone are sent in order
+func direct_queue(slack_id string) string {
+	return "direct " + slack_id
+}
+
+// The configured triggers, along with those for subscriptions made at
+// runtime, and the IDs of the subscriptions the latter are for
+func (p *processor) triggers() ([]*config.MessageTrigger, map[*config.MessageTrigger]string) {
+	triggers := append([]*config.MessageTrigger(nil), p.config.Triggers...)
+	subscribed := make(map[*config.MessageTrigger]string)
+
+	subscriptions, err := p.state.GetSubscriptions()
+	if err != nil {
+		log.LogF("Could not look up subscriptions: %s", err)
+		return triggers, subscribed
+	}
+	for _, s := range subscriptions {
+		t, err := config.NewTrigger(s.Trigger)
+		if err == nil {
+			err = p.config.CheckTrigger(t)
+		}
+		if err != nil {
+			log.LogF("Skipping bad subscription %s: %s", s.ID, err)
+			continue
+		}
+		triggers = append(triggers, t)
+		subscribed[t] = s.ID
+	}
+	return triggers, subscribed
+}
+
+// Put the looked up activity issues back in the order of the activities
+func ordered_activity_issues(activities []*atlassian.ActivityItem, activity_issues chan atlassian.ActivityIssue) []atlassian.ActivityIssue {
+	index := make(map[*atlassian.ActivityItem]int)
+	for i, activity := range activities {
+		index[activity] = i
+	}
+
+	found := make([]*atlassian.ActivityIssue, len(activities))
+	for ai := range activity_issues {
+		ai := ai
+		found[index[ai.Activity]] = &ai
+	}
+
+	ordered := make([]atlassian.ActivityIssue, 0, len(activities))
+	for _, ai := range found {
+		if ai != nil {
+			ordered = append(ordered, *ai)
+		}
+	}
+	return ordered
+}
+
 //func get_issues(config *config.Config, atl atlassian.Atlassian, activities []*atlassian.ActivityItem) []atlassian.ActivityIssue {
 func get_issues(config *config.Config, atl atlassian.Atlassian, activities []*atlassian.ActivityItem) chan atlassian.ActivityIssue {
 	// Create a buffered channel with all the work to be done and fill it up
@@ -144,7 +405,12 @@ func get_issues(config *config.Config, atl atlassian.Atlassian, activities []*at
 	return output
 }
 
-func get_user_image_urls(storage_client storage.Client, atlassian_client atlassian.Atlassian, state_client state.State, activity_issues ...atlassian.ActivityIssue) map[string]string {
+// The URLs of the images of the authors of the activities, from the state
+// cache, or else stored (or linked to, without storage) and cached. Cached
+// images are looked up again when they expire, or when the author's photo in
+// Jira changes, and stored ones get new URLs before theirs stop working.
+func (p *processor) get_user_image_urls(activity_issues ...atlassian.ActivityIssue) map[string]string {
+	now := time.Now()
 	urls := make(map[string]string)
 	for _, ai := range activity_issues {
 		name := ai.Activity.Author.Username
@@ -154,41 +420,140 @@ func get_user_image_urls(storage_client storage.Client, atlassian_client atlassi
 			continue
 		}
 
-		url, ok, err := state_client.GetUserImageURL(name)
-		if ok && err == nil {
-			urls[name] = url
+		source, _ := ai.Activity.UserImageURL()
+		image, ok, err := p.state.GetUserImage(name)
+		if err != nil {
+			log.LogF("Could not retrieve image for user %s in Redis: %s", name, err)
+			ok = false
+		} else if ok && image.Source != source {
+			log.LogF("The image for user %s has changed in Jira", name)
+			ok = false
+		}
+
+		renew := ok && p.renew_due(image, now)
+		if ok && !renew {
+			urls[name] = image.URL
 			continue
-		} else if err != nil {
-			log.LogF("Could not retrieve URL for user %s in Redis: %s", name, err)
 		}
 
 		// Retrieve and record it instead
-		rdr, ok, err := atlassian_client.UserImage(*ai.Activity)
-		if err != nil {
-			log.LogF("Could not retrieve image for user %s from Jira: %s", name, err)
-			continue
+		if renew {
+			image, ok = p.renew_user_image_url(name, image)
+		}
+		if !ok && p.storage_client == nil {
+			var url string
+			url, ok = p.linked_user_image_url(*ai.Activity)
+			image = state.UserImage{URL: url}
 		} else if !ok {
-			log.LogF("Could not find any image for user %s in Redis", name)
-			continue
+			image, ok = p.store_user_image(*ai.Activity)
 		}
-
-		path := "users/images/" + name
-		err = storage_client.PutObject(rdr, path)
-		if err != nil {
-			log.LogF("Failed to persist image for user %s: %s", name, err)
+		if !ok {
 			continue
 		}
-
-		full_url := storage_client.GetFullURL(path)
-		urls[name] = full_url
+		image.Source = source
+		urls[name] = image.URL
 
 		// Cache it for next time
-		err = state_client.RecordUserImageURL(name, full_url)
+		err = p.state.RecordUserImage(name, image, p.config.ResourceStorage.GetImageCacheExpiry())
 		if err != nil {
 			log.LogF("Failed to save image URL for user %s: %s", name, err)
 		}
-
 	}
 
 	return urls
 }
+
+// Whether a stored image's URL is close to no longer working, with less than
+// a quarter of the time it was given left
+func (p *processor) renew_due(image state.UserImage, now time.Time) bool {
+	if image.Expires.IsZero() {
+		return false
+	}
+	return now.After(image.Expires.Add(-p.config.ResourceStorage.GetURLExpiry() / 4))
+}
+
+// A new URL for a stored image, without storing it again
+func (p *processor) renew_user_image_url(name string, image state.UserImage) (state.UserImage, bool) {
+	if p.storage_client == nil || image.Path == "" {
+		return image, false
+	}
+	url, expires, err := p.storage_client.GetFullURL(image.Path)
+	if err != nil {
+		log.LogF("Could not renew the image URL for user %s: %s", name, err)
+		return image, false
+	}
+	log.LogF("Renewed the image URL for user %s", name)
+	image.URL, image.Expires = url, expires
+	return image, true
+}
+
+// Copy the author's image from Jira to storage as an avatar, or one with
+// their initials if they don't have a usable one, returning where it's kept.
+// Avatars are kept under a hash of their content, so a new one gets a new
+// URL, which Slack won't have cached.
+func (p *processor) store_user_image(activity atlassian.ActivityItem) (state.UserImage, bool) {
+	name := activity.Author.Username
+
+	rdr, ok, err := p.atl.UserImage(activity)
+	if err != nil {
+		log.LogF("Could not retrieve image for user %s from Jira: %s", name, err)
+		return state.UserImage{}, false
+	}
+
+	var image []byte
+	if ok {
+		if image, err = ioutil.ReadAll(rdr); err != nil {
+			log.LogF("Could not read image for user %s from Jira: %s", name, err)
+			return state.UserImage{}, false
+		}
+		if image, err = avatar.Normalize(image); err != nil {
+			log.LogF("Could not use the image for user %s from Jira: %s", name, err)
+		}
+	} else {
+		log.LogF("Could not find any image for user %s in Jira", name)
+	}
+	if image == nil {
+		display_name := activity.Author.Name
+		if display_name == "" {
+			display_name = name
+		}
+		if image, err = avatar.Initials(display_name); err != nil {
+			log.LogF("Could not make an image for user %s: %s", name, err)
+			return state.UserImage{}, false
+		}
+	}
+
+	path := fmt.Sprintf("users/images/%x.png", sha256.Sum256(image))
+	err = p.storage_client.PutObject(bytes.NewReader(image), path, avatar.ContentType)
+	if err != nil {
+		log.LogF("Failed to persist image for user %s: %s", name, err)
+		return state.UserImage{}, false
+	}
+
+	url, expires, err := p.storage_client.GetFullURL(path)
+	if err != nil {
+		log.LogF("Could not get the image URL for user %s: %s", name, err)
+		return state.UserImage{}, false
+	}
+	return state.UserImage{URL: url, Path: path, Expires: expires}, true
+}
+
+// The author's Slack avatar, if they're known in Slack, or their photo in
+// Jira otherwise
+func (p *processor) linked_user_image_url(activity atlassian.ActivityItem) (string, bool) {
+	name := activity.Author.Username
+
+	slack_id, ok, err := p.users.SlackUserID(activity.Author.User())
+	if err != nil {
+		log.LogF("Could not find the Slack user for %s: %s", name, err)
+	} else if ok {
+		url, ok, err := p.slack_client.GetUserImage(slack_id)
+		if err != nil {
+			log.LogF("Could not look up the Slack avatar of %s: %s", name, err)
+		} else if ok {
+			return url, true
+		}
+	}
+
+	return activity.UserImageURL()
+}
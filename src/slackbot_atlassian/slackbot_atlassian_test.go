@@ -1 +1,585 @@
 package slackbot_atlassian
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"slackbot_atlassian/atlassian"
+	"slackbot_atlassian/avatar"
+	"slackbot_atlassian/config"
+	"slackbot_atlassian/message"
+	"slackbot_atlassian/slack"
+	"slackbot_atlassian/state"
+	"slackbot_atlassian/storage"
+)
+
+func test_activity(id, issue, author string, at time.Time) atlassian.ActivityIssue {
+	return atlassian.ActivityIssue{
+		Activity: &atlassian.ActivityItem{
+			Id:             id,
+			Updated:        at,
+			Author:         atlassian.Person{Username: author},
+			ActivityTarget: &atlassian.ActivityTargetOrObject{Title: issue},
+		},
+		Issue: &atlassian.Issue{Id: issue},
+	}
+}
+
+func group_ids(groups [][]atlassian.ActivityIssue) string {
+	var ids [][]string
+	for _, g := range groups {
+		var group []string
+		for _, ai := range g {
+			group = append(group, ai.Activity.Id)
+		}
+		ids = append(ids, group)
+	}
+	return fmt.Sprint(ids)
+}
+
+func TestCoalescer(t *testing.T) {
+	start := time.Date(2016, 5, 10, 10, 0, 0, 0, time.UTC)
+	at := func(secs int) time.Time {
+		return start.Add(time.Duration(secs) * time.Second)
+	}
+
+	c := new_coalescer(time.Minute)
+	c.add(
+		test_activity("1", "LRN-1", "bob", at(0)),
+		test_activity("2", "LRN-1", "bob", at(30)),
+		test_activity("3", "LRN-1", "jane", at(40)),
+		test_activity("4", "LRN-2", "bob", at(50)),
+		test_activity("5", "LRN-1", "bob", at(200)),
+	)
+	// Re-adding an activity that is already waiting does nothing
+	c.add(test_activity("2", "LRN-1", "bob", at(30)))
+
+	if ready := group_ids(c.take(at(101), false)); ready != "[[1 2] [3]]" {
+		t.Errorf("Unexpected groups ready: %s", ready)
+	}
+	if n := c.pending(); n != 2 {
+		t.Errorf("Expected 2 activities pending, have %d", n)
+	}
+
+	// A later run can add to a waiting group
+	c.add(test_activity("6", "LRN-2", "bob", at(100)))
+	if ready := group_ids(c.take(at(230), false)); ready != "[[4 6]]" {
+		t.Errorf("Unexpected groups ready: %s", ready)
+	}
+	if ready := group_ids(c.take(at(230), true)); ready != "[[5]]" {
+		t.Errorf("Unexpected groups ready: %s", ready)
+	}
+
+	// Without a window nothing is coalesced
+	c = new_coalescer(0)
+	c.add(
+		test_activity("1", "LRN-1", "bob", at(0)),
+		test_activity("2", "LRN-1", "bob", at(0)),
+	)
+	if ready := group_ids(c.take(at(0), false)); ready != "[[1] [2]]" {
+		t.Errorf("Unexpected groups ready: %s", ready)
+	}
+}
+
+// Serves user photos from a map of their URLs
+type photo_atlassian struct {
+	atlassian.Atlassian
+	photos  map[string]string
+	fetched int
+}
+
+func (a *photo_atlassian) UserImage(ai atlassian.ActivityItem) (io.Reader, bool, error) {
+	url, _ := ai.UserImageURL()
+	photo, ok := a.photos[url]
+	a.fetched++
+	return strings.NewReader(photo), ok, nil
+}
+
+type image_state struct {
+	state.State
+	images map[string]state.UserImage
+}
+
+func (s *image_state) RecordUserImage(username string, image state.UserImage, expiry time.Duration) error {
+	s.images[username] = image
+	return nil
+}
+
+func (s *image_state) GetUserImage(username string) (state.UserImage, bool, error) {
+	image, ok := s.images[username]
+	return image, ok, nil
+}
+
+type stored_object struct {
+	data, content_type string
+}
+
+type memory_storage map[string]stored_object
+
+func (m memory_storage) PutObject(rdr io.Reader, path, content_type string) error {
+	b, err := ioutil.ReadAll(rdr)
+	m[path] = stored_object{string(b), content_type}
+	return err
+}
+
+func (m memory_storage) GetFullURL(path string) (string, time.Time, error) {
+	return "https://cdn.example.com/" + path, time.Time{}, nil
+}
+
+func (m memory_storage) GetObject(path string) (io.ReadCloser, string, error) {
+	o, ok := m[path]
+	if !ok {
+		return nil, "", storage.ErrNotFound
+	}
+	return ioutil.NopCloser(strings.NewReader(o.data)), o.content_type, nil
+}
+
+// Hands out URLs that expire, numbered so new ones can be told apart
+type expiring_storage struct {
+	memory_storage
+	expiry time.Duration
+	urls   int
+}
+
+func (e *expiring_storage) GetFullURL(path string) (string, time.Time, error) {
+	e.urls++
+	return fmt.Sprintf("https://bucket.example.com/%s?signature=%d", path, e.urls), time.Now().Add(e.expiry), nil
+}
+
+func with_photo(ai atlassian.ActivityIssue, url string) atlassian.ActivityIssue {
+	ai.Activity.Author.Link = []atlassian.Link{{Rel: "photo", Href: url}}
+	return ai
+}
+
+func solid_png(t *testing.T, c color.Color) string {
+	img := image.NewRGBA(image.Rect(0, 0, 48, 48))
+	draw.Draw(img, img.Bounds(), &image.Uniform{c}, image.ZP, draw.Src)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestUserImages(t *testing.T) {
+	const (
+		old_photo = "https://jira.example.com/secure/useravatar?ownerId=jane&avatarId=1"
+		new_photo = "https://jira.example.com/secure/useravatar?ownerId=jane&avatarId=2"
+		svg_photo = "https://jira.example.com/secure/useravatar?ownerId=bob&avatarId=3"
+	)
+	atl := &photo_atlassian{photos: map[string]string{
+		old_photo: solid_png(t, color.White),
+		new_photo: solid_png(t, color.Black),
+		svg_photo: `<svg xmlns="http://www.w3.org/2000/svg"/>`,
+	}}
+	stored := memory_storage{}
+	p := &processor{
+		config:         &config.Config{},
+		state:          &image_state{images: make(map[string]state.UserImage)},
+		atl:            atl,
+		storage_client: stored,
+	}
+	at := time.Unix(1500000000, 0)
+
+	first := p.get_user_image_urls(with_photo(test_activity("1", "LRN-1", "jane", at), old_photo))
+	again := p.get_user_image_urls(with_photo(test_activity("2", "LRN-1", "jane", at), old_photo))
+	if first["jane"] == "" || again["jane"] != first["jane"] || atl.fetched != 1 {
+		t.Errorf("Expected the image to be fetched once and cached, got %v then %v after %d fetches", first, again, atl.fetched)
+	}
+
+	changed := p.get_user_image_urls(with_photo(test_activity("3", "LRN-1", "jane", at), new_photo))
+	if changed["jane"] == "" || changed["jane"] == first["jane"] || atl.fetched != 2 {
+		t.Errorf("Expected a new image at a new URL, got %v after %d fetches", changed, atl.fetched)
+	}
+
+	// Images that can't be used, and missing ones, are replaced with initials
+	others := p.get_user_image_urls(with_photo(test_activity("4", "LRN-1", "bob", at), svg_photo), test_activity("5", "LRN-1", "amy", at))
+	bob, _ := avatar.Initials("bob")
+	amy, _ := avatar.Initials("amy")
+
+	// Each is kept as an avatar under the hash of its content
+	old_avatar, _ := avatar.Normalize([]byte(atl.photos[old_photo]))
+	new_avatar, _ := avatar.Normalize([]byte(atl.photos[new_photo]))
+	for url, image := range map[string][]byte{first["jane"]: old_avatar, changed["jane"]: new_avatar, others["bob"]: bob, others["amy"]: amy} {
+		path := fmt.Sprintf("users/images/%x.png", sha256.Sum256(image))
+		if url != "https://cdn.example.com/"+path || stored[path] != (stored_object{string(image), "image/png"}) {
+			t.Errorf("Expected the avatar at %s, got %s", path, url)
+		}
+	}
+}
+
+func TestUserImageURLRenewal(t *testing.T) {
+	const photo = "https://jira.example.com/secure/useravatar?ownerId=jane&avatarId=1"
+	cfg, err := config.LoadConfig(strings.NewReader(`{"resource_storage": {"s3_bucket": "avatars", "access": "presigned", "url_expiry": "4h"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	atl := &photo_atlassian{photos: map[string]string{photo: solid_png(t, color.White)}}
+	images := &image_state{images: make(map[string]state.UserImage)}
+	stored := &expiring_storage{memory_storage: memory_storage{}, expiry: 4 * time.Hour}
+	p := &processor{config: cfg, state: images, atl: atl, storage_client: stored}
+	jane := with_photo(test_activity("1", "LRN-1", "jane", time.Unix(1500000000, 0)), photo)
+
+	first := p.get_user_image_urls(jane)["jane"]
+	if again := p.get_user_image_urls(jane)["jane"]; again != first || stored.urls != 1 {
+		t.Errorf("Expected the URL to be reused while it has long left, got %s then %s", first, again)
+	}
+
+	// With less than a quarter of its time left, the stored image gets a new
+	// URL without being fetched again
+	image := images.images["jane"]
+	image.Expires = time.Now().Add(time.Hour - time.Minute)
+	images.images["jane"] = image
+	renewed := p.get_user_image_urls(jane)["jane"]
+	if renewed == first || stored.urls != 2 || atl.fetched != 1 || len(stored.memory_storage) != 1 {
+		t.Errorf("Expected a new URL for the same image, got %s after %d fetches", renewed, atl.fetched)
+	}
+	if got := images.images["jane"]; got.URL != renewed || got.Path != image.Path || got.Source != photo || !got.Expires.After(time.Now().Add(3*time.Hour)) {
+		t.Errorf("Expected the new URL to be cached, got %+v", got)
+	}
+}
+
+// Keeps what the processor records in memory
+type memory_state struct {
+	state.State
+	last_event    *state.Event
+	digest_items  map[string][]string
+	last_digests  map[string]time.Time
+	mutes         map[string]time.Time
+	subscriptions []state.Subscription
+	watchers      map[string][]string
+	opted_out     map[string]bool
+	slack_checks  map[string]time.Time
+}
+
+func new_memory_state() *memory_state {
+	return &memory_state{
+		digest_items: make(map[string][]string),
+		last_digests: make(map[string]time.Time),
+		mutes:        make(map[string]time.Time),
+		opted_out:    make(map[string]bool),
+		slack_checks: make(map[string]time.Time),
+	}
+}
+
+func (s *memory_state) RecordLastEvent(ev state.Event) error {
+	s.last_event = &ev
+	return nil
+}
+
+func (s *memory_state) GetLastEvent() (state.Event, bool, error) {
+	if s.last_event == nil {
+		return state.Event{}, false, nil
+	}
+	return *s.last_event, true, nil
+}
+
+func (s *memory_state) AddDigestItem(channel string, item interface{}) error {
+	b, err := json.Marshal(item)
+	s.digest_items[channel] = append(s.digest_items[channel], string(b))
+	return err
+}
+
+func (s *memory_state) TakeDigestItems(channel string, into interface{}) error {
+	items := s.digest_items[channel]
+	delete(s.digest_items, channel)
+	return json.Unmarshal([]byte("["+strings.Join(items, ",")+"]"), into)
+}
+
+func (s *memory_state) RecordLastDigest(channel string, at time.Time) error {
+	s.last_digests[channel] = at
+	return nil
+}
+
+func (s *memory_state) GetLastDigest(channel string) (time.Time, bool, error) {
+	at, ok := s.last_digests[channel]
+	return at, ok, nil
+}
+
+func (s *memory_state) MuteChannel(channel string, until time.Time) error {
+	s.mutes[strings.TrimPrefix(channel, "#")] = until
+	return nil
+}
+
+func (s *memory_state) GetChannelMute(channel string) (time.Time, bool, error) {
+	until, ok := s.mutes[strings.TrimPrefix(channel, "#")]
+	return until, ok, nil
+}
+
+func (s *memory_state) GetSubscriptions() ([]state.Subscription, error) {
+	return s.subscriptions, nil
+}
+
+func (s *memory_state) GetIssueWatchers(issue string) ([]string, error) {
+	return s.watchers[issue], nil
+}
+
+func (s *memory_state) RecordSlackCheck(config_hash string, at time.Time, expiry time.Duration) error {
+	s.slack_checks[config_hash] = at
+	return nil
+}
+
+func (s *memory_state) GetSlackCheck(config_hash string) (time.Time, bool, error) {
+	at, ok := s.slack_checks[config_hash]
+	return at, ok, nil
+}
+
+func (s *memory_state) SetDirectMessageOptOut(slack_id string, opt_out bool) error {
+	s.opted_out[slack_id] = opt_out
+	return nil
+}
+
+func (s *memory_state) GetDirectMessageOptOut(slack_id string) (bool, error) {
+	return s.opted_out[slack_id], nil
+}
+
+func (s *memory_state) GetUserImage(username string) (state.UserImage, bool, error) {
+	return state.UserImage{}, false, nil
+}
+
+func (s *memory_state) RecordUserImage(username string, image state.UserImage, expiry time.Duration) error {
+	return nil
+}
+
+// Records the messages posted to Slack, failing for the channels in errs
+type recording_slack struct {
+	slack.Slack
+	sync.Mutex
+	posted   []message.Message
+	errs     map[string]error
+	channels map[string]string
+	// The channels checked by each call to Validate
+	validated [][]string
+}
+
+func (s *recording_slack) Validate(channels []string) error {
+	s.validated = append(s.validated, channels)
+	for _, c := range channels {
+		if _, ok := s.channels[strings.TrimPrefix(c, "#")]; !ok {
+			return fmt.Errorf("Can't post to %s", c)
+		}
+	}
+	return nil
+}
+
+func (s *recording_slack) ChannelID(channel string) (string, bool, error) {
+	id, ok := s.channels[strings.TrimPrefix(channel, "#")]
+	return id, ok, nil
+}
+
+func (s *recording_slack) PostMessage(m message.Message) (string, string, error) {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.errs[m.SlackChannel]; err != nil {
+		return "", "", err
+	}
+	s.posted = append(s.posted, m)
+	return m.SlackChannel, fmt.Sprint(len(s.posted)), nil
+}
+
+func (s *recording_slack) OpenDirectMessage(user_id string) (string, error) {
+	return "D" + user_id, nil
+}
+
+// Finds nobody in Slack
+type no_users struct{}
+
+func (no_users) SlackUserID(atlassian.User) (string, bool, error) {
+	return "", false, nil
+}
+
+func (no_users) JiraUsername(slack_id string) (string, bool, error) {
+	return "", false, nil
+}
+
+// Finds everyone in Slack, with their username as their ID
+type all_users struct {
+	no_users
+}
+
+func (all_users) SlackUserID(u atlassian.User) (string, bool, error) {
+	return u.Name, true, nil
+}
+
+// Serves a fixed activity stream and its issues
+type activity_atlassian struct {
+	atlassian.Atlassian
+	activities []atlassian.ActivityIssue
+}
+
+func (a *activity_atlassian) GetNewJiraActivities(last_id_seen string) ([]*atlassian.ActivityItem, error) {
+	var activities []*atlassian.ActivityItem
+	for _, ai := range a.activities {
+		activities = append(activities, ai.Activity)
+	}
+	return activities, nil
+}
+
+func (a *activity_atlassian) GetIssue(issue_id string) (*atlassian.Issue, error) {
+	for _, ai := range a.activities {
+		if ai.Issue.Id == issue_id {
+			return ai.Issue, nil
+		}
+	}
+	return nil, fmt.Errorf("No issue %s", issue_id)
+}
+
+func test_processor(t *testing.T, cfg string, activities ...atlassian.ActivityIssue) (*processor, *memory_state, *recording_slack) {
+	c, err := config.LoadConfig(strings.NewReader(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Atlassian.ConcurrentIssueLookups = 1
+	st := new_memory_state()
+	slack_client := &recording_slack{errs: make(map[string]error)}
+	return &processor{
+		config:       c,
+		state:        st,
+		atl:          &activity_atlassian{activities: activities},
+		slack_client: slack_client,
+		users:        no_users{},
+		pending:      new_coalescer(0),
+		sender:       slack.NewSender(1000, time.Second),
+	}, st, slack_client
+}
+
+func TestFailedSubscriptionDelivery(t *testing.T) {
+	p, st, slack_client := test_processor(t, `{"triggers": [{"slack_channel": "#team-yoda-jira"}]}`,
+		test_activity("1", "LRN-1", "jane", time.Now()))
+	st.subscriptions = []state.Subscription{{ID: "1", Trigger: config.MessageTrigger{SlackChannel: "#archived"}}}
+	slack_client.errs["#archived"] = fmt.Errorf("is_archived")
+
+	if err := p.process(true); err != nil {
+		t.Fatalf("Expected the failed subscription to be skipped, got %s", err)
+	}
+	if len(slack_client.posted) != 1 || slack_client.posted[0].SlackChannel != "#team-yoda-jira" {
+		t.Errorf("Expected a message for the configured trigger, got %+v", slack_client.posted)
+	}
+	if st.last_event == nil || st.last_event.Id != "1" {
+		t.Errorf("Expected the last event to be recorded, got %v", st.last_event)
+	}
+
+	// Failing to post for a configured trigger still holds the last event back
+	p, st, slack_client = test_processor(t, `{"triggers": [{"slack_channel": "#team-yoda-jira"}]}`,
+		test_activity("2", "LRN-1", "jane", time.Now()))
+	slack_client.errs["#team-yoda-jira"] = fmt.Errorf("channel_not_found")
+	if err := p.process(true); err == nil || st.last_event != nil {
+		t.Errorf("Expected the failure to stop the last event being recorded, got %v and %v", err, st.last_event)
+	}
+}
+
+func TestDirectMessageQueues(t *testing.T) {
+	p, _, slack_client := test_processor(t, `{"triggers": [{"target": "assignee"}]}`)
+	p.users = all_users{}
+	trigger := p.config.Triggers[0]
+
+	for _, issue := range []string{"LRN-1", "LRN-2", "LRN-3"} {
+		p.queue_delivery(message.Message{
+			Trigger:    trigger,
+			IssueKey:   issue,
+			Recipients: []atlassian.User{{Name: "jane"}},
+		}, func(err error) {
+			t.Errorf("Expected direct messages to be sent from their recipient's queue, got %v", err)
+		})
+	}
+	p.sender.Wait()
+
+	if len(slack_client.posted) != 3 {
+		t.Fatalf("Expected 3 direct messages, got %+v", slack_client.posted)
+	}
+	for i, m := range slack_client.posted {
+		if m.SlackChannel != "Djane" || m.IssueKey != fmt.Sprintf("LRN-%d", i+1) {
+			t.Errorf("Expected the messages in order in jane's direct channel, got %+v", slack_client.posted)
+			break
+		}
+	}
+}
+
+func TestWatcherNotifications(t *testing.T) {
+	p, st, slack_client := test_processor(t, `{"triggers": []}`,
+		test_activity("1", "LRN-1", "jane", time.Now()))
+	st.watchers = map[string][]string{"LRN-1": {"U1"}}
+
+	if err := p.process(true); err != nil {
+		t.Fatal(err)
+	}
+	if len(slack_client.posted) != 1 || slack_client.posted[0].SlackChannel != "DU1" {
+		t.Errorf("Expected a direct message to the watcher, got %+v", slack_client.posted)
+	}
+
+	// Failing to tell a watcher holds the last event back
+	p, st, slack_client = test_processor(t, `{"triggers": []}`,
+		test_activity("2", "LRN-1", "jane", time.Now()))
+	st.watchers = map[string][]string{"LRN-1": {"U1"}}
+	slack_client.errs["DU1"] = fmt.Errorf("user_not_found")
+	if err := p.process(true); err == nil || st.last_event != nil {
+		t.Errorf("Expected the failure to stop the last event being recorded, got %v and %v", err, st.last_event)
+	}
+}
+
+func TestLastEventWithPendingActivities(t *testing.T) {
+	now := time.Now()
+	p, st, slack_client := test_processor(t, `{"triggers": [{"slack_channel": "#team-yoda-jira"}]}`,
+		test_activity("1", "LRN-1", "bob", now.Add(-90*time.Second)),
+		test_activity("2", "LRN-2", "jane", now.Add(-80*time.Second)),
+		test_activity("3", "LRN-1", "bob", now.Add(-30*time.Second)),
+	)
+	p.pending = new_coalescer(time.Minute)
+
+	if err := p.process(false); err != nil {
+		t.Fatal(err)
+	}
+	if len(slack_client.posted) != 1 || slack_client.posted[0].IssueKey != "LRN-2" {
+		t.Fatalf("Expected only LRN-2 to be posted, got %+v", slack_client.posted)
+	}
+	if st.last_event != nil && st.last_event.Id != "" {
+		t.Errorf("Expected the last event to stay before the waiting activities, got %v", st.last_event)
+	}
+
+	// The activities are fetched again, but only the waiting ones are posted
+	if err := p.process(true); err != nil {
+		t.Fatal(err)
+	}
+	if len(slack_client.posted) != 2 || slack_client.posted[1].IssueKey != "LRN-1" {
+		t.Errorf("Expected LRN-1 to be posted once, got %+v", slack_client.posted)
+	}
+	if st.last_event == nil || st.last_event.Id != "3" {
+		t.Errorf("Expected the last event to be recorded, got %v", st.last_event)
+	}
+}
+
+func TestCheckSlack(t *testing.T) {
+	p, st, slack_client := test_processor(t, `{"triggers": [{"slack_channel": "#team-yoda-jira"}]}`)
+	slack_client.channels = map[string]string{"team-yoda-jira": "C1"}
+
+	// Checked once, and then trusted for a while
+	for i := 0; i < 2; i++ {
+		if err := p.check_slack(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(slack_client.validated) != 1 || len(st.slack_checks) != 1 {
+		t.Errorf("Expected one check to be made and recorded, got %v and %v", slack_client.validated, st.slack_checks)
+	}
+
+	// A config with a typo is checked, and fails
+	p.config.Triggers[0].SlackChannel = "#team-yoda-jria"
+	if err := p.check_slack(); err == nil {
+		t.Errorf("Expected the check to fail")
+	}
+	if len(slack_client.validated) != 2 || len(st.slack_checks) != 1 {
+		t.Errorf("Expected the new config to be checked and not recorded, got %v and %v", slack_client.validated, st.slack_checks)
+	}
+}
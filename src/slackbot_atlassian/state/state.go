@@ -3,10 +3,13 @@ package state
 import (
 	"encoding/json"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"slackbot_atlassian/config"
+	"slackbot_atlassian/log"
 
 	"gopkg.in/redis.v3"
 )
@@ -17,12 +20,103 @@ type Event struct {
 	Id string `json:"id"`
 }
 
+// A message posted to Slack
+type SlackMessage struct {
+	Channel   string `json:"channel"`
+	Timestamp string `json:"ts"`
+}
+
+// Where a user's image is found, and the photo in Jira it came from
+type UserImage struct {
+	URL    string `json:"url"`
+	Source string `json:"source"`
+	// Where the image is stored, if it is, and when its URL stops working,
+	// if it does
+	Path    string    `json:"path,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
 type State interface {
 	RecordLastEvent(Event) error
 	GetLastEvent() (Event, bool, error)
 
-	RecordUserImageURL(username, url string) error
-	GetUserImageURL(username string) (string, bool, error)
+	// Where a user's image is found, which is forgotten after expiry
+	RecordUserImage(username string, image UserImage, expiry time.Duration) error
+	GetUserImage(username string) (UserImage, bool, error)
+
+	// The parent message of the thread for an issue in a channel, which is
+	// forgotten after expiry
+	RecordThread(channel, issue string, parent SlackMessage, expiry time.Duration) error
+	GetThread(channel, issue string) (SlackMessage, bool, error)
+
+	// The live card message for an issue in a channel
+	RecordCard(channel, issue string, card SlackMessage) error
+	GetCard(channel, issue string) (SlackMessage, bool, error)
+
+	// Items waiting to be posted in the digest for a channel. Items are
+	// stored as JSON; TakeDigestItems decodes them all into a slice pointer
+	// and removes them.
+	AddDigestItem(channel string, item interface{}) error
+	TakeDigestItems(channel string, into interface{}) error
+
+	// The Slack user ID found for a Jira user, or "" if there isn't one
+	RecordSlackUserID(jira_username, slack_id string, expiry time.Duration) error
+	GetSlackUserID(jira_username string) (string, bool, error)
+
+	// The Jira username found for a Slack user, or "" if there isn't one
+	RecordJiraUsername(slack_id, jira_username string, expiry time.Duration) error
+	GetJiraUsername(slack_id string) (string, bool, error)
+
+	// Whether a Slack user has opted out of direct messages
+	SetDirectMessageOptOut(slack_id string, opt_out bool) error
+	GetDirectMessageOptOut(slack_id string) (bool, error)
+
+	// When the Slack channels and users in a version of the config (given
+	// by a hash of them) were last checked and found to be fine, which is
+	// forgotten after expiry
+	RecordSlackCheck(config_hash string, at time.Time, expiry time.Duration) error
+	GetSlackCheck(config_hash string) (time.Time, bool, error)
+
+	// When the digest for a channel was last posted
+	RecordLastDigest(channel string, at time.Time) error
+	GetLastDigest(channel string) (time.Time, bool, error)
+
+	// The Slack users watching an issue, who get direct messages about it
+	AddWatch(issue, slack_id string) error
+	RemoveWatch(issue, slack_id string) error
+	GetIssueWatchers(issue string) ([]string, error)
+	GetWatchedIssues(slack_id string) ([]string, error)
+
+	// Channels that nothing is posted to until a time
+	MuteChannel(channel string, until time.Time) error
+	UnmuteChannel(channel string) error
+	GetChannelMute(channel string) (time.Time, bool, error)
+
+	// Triggers made at runtime (from Slack or the admin API), which are used
+	// alongside the configured ones. Adding one gives it an ID, and expired
+	// ones are dropped as they are read.
+	AddSubscription(Subscription) (string, error)
+	RemoveSubscription(id string) (bool, error)
+	GetSubscriptions() ([]Subscription, error)
+}
+
+// A trigger made at runtime
+type Subscription struct {
+	ID string `json:"id"`
+	// The trigger, as it would be written in the config
+	Trigger config.MessageTrigger `json:"trigger"`
+	// The field values the trigger matches exactly, for subscriptions made
+	// from Slack, to describe it by
+	Fields map[string]string `json:"fields,omitempty"`
+	// Who made it: a Slack user ID, or a name given to the admin API
+	Owner   string    `json:"owner"`
+	Created time.Time `json:"created"`
+	// When it stops being used, if ever
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+func (s Subscription) Expired(now time.Time) bool {
+	return !s.Expires.IsZero() && !now.Before(s.Expires)
 }
 
 func New(cfg config.StateConfig) (State, error) {
@@ -81,20 +175,120 @@ func (r *redisState) GetLastEvent() (Event, bool, error) {
 	return ev, true, json.Unmarshal([]byte(val), &ev)
 }
 
-func user_image_url_key(username string) string {
-	return "image-url-" + strings.Replace(username, " ", "_", -1)
+func user_image_key(username string) string {
+	return "user-image-" + strings.Replace(username, " ", "_", -1)
 }
 
-func (r *redisState) RecordUserImageURL(username, url string) error {
-	key := user_image_url_key(username)
-	sc := r.client.Set(key, url, time.Duration(0))
-	return sc.Err()
+func (r *redisState) RecordUserImage(username string, image UserImage, expiry time.Duration) error {
+	return r.set_json(user_image_key(username), image, expiry)
 }
 
-func (r *redisState) GetUserImageURL(username string) (string, bool, error) {
-	key := user_image_url_key(username)
+func (r *redisState) GetUserImage(username string) (UserImage, bool, error) {
+	var image UserImage
+	ok, err := r.get_json(user_image_key(username), &image)
+	return image, ok, err
+}
 
-	sc := r.client.Get(key)
+func thread_key(channel, issue string) string {
+	return "thread-" + strings.TrimPrefix(channel, "#") + "-" + issue
+}
+
+func (r *redisState) RecordThread(channel, issue string, parent SlackMessage, expiry time.Duration) error {
+	return r.set_json(thread_key(channel, issue), parent, expiry)
+}
+
+func (r *redisState) GetThread(channel, issue string) (SlackMessage, bool, error) {
+	var parent SlackMessage
+	ok, err := r.get_json(thread_key(channel, issue), &parent)
+	return parent, ok, err
+}
+
+func card_key(channel, issue string) string {
+	return "card-" + strings.TrimPrefix(channel, "#") + "-" + issue
+}
+
+func (r *redisState) RecordCard(channel, issue string, card SlackMessage) error {
+	return r.set_json(card_key(channel, issue), card, time.Duration(0))
+}
+
+func (r *redisState) GetCard(channel, issue string) (SlackMessage, bool, error) {
+	var card SlackMessage
+	ok, err := r.get_json(card_key(channel, issue), &card)
+	return card, ok, err
+}
+
+func digest_items_key(channel string) string {
+	return "digest-items-" + strings.TrimPrefix(channel, "#")
+}
+
+func (r *redisState) AddDigestItem(channel string, item interface{}) error {
+	b, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	ic := r.client.RPush(digest_items_key(channel), string(b))
+	return ic.Err()
+}
+
+func (r *redisState) TakeDigestItems(channel string, into interface{}) error {
+	key := digest_items_key(channel)
+
+	// Read and remove the items atomically, so none added meanwhile are lost
+	multi := r.client.Multi()
+	defer multi.Close()
+
+	var items *redis.StringSliceCmd
+	_, err := multi.Exec(func() error {
+		items = multi.LRange(key, 0, -1)
+		multi.Del(key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal([]byte("["+strings.Join(items.Val(), ",")+"]"), into)
+}
+
+func last_digest_key(channel string) string {
+	return "digest-last-" + strings.TrimPrefix(channel, "#")
+}
+
+func (r *redisState) RecordLastDigest(channel string, at time.Time) error {
+	return r.set_json(last_digest_key(channel), at, time.Duration(0))
+}
+
+func (r *redisState) GetLastDigest(channel string) (time.Time, bool, error) {
+	var at time.Time
+	ok, err := r.get_json(last_digest_key(channel), &at)
+	return at, ok, err
+}
+
+func slack_check_key(config_hash string) string {
+	return "slack-check-" + config_hash
+}
+
+func (r *redisState) RecordSlackCheck(config_hash string, at time.Time, expiry time.Duration) error {
+	return r.set_json(slack_check_key(config_hash), at, expiry)
+}
+
+func (r *redisState) GetSlackCheck(config_hash string) (time.Time, bool, error) {
+	var at time.Time
+	ok, err := r.get_json(slack_check_key(config_hash), &at)
+	return at, ok, err
+}
+
+func slack_user_id_key(jira_username string) string {
+	return "slack-user-id-" + strings.Replace(jira_username, " ", "_", -1)
+}
+
+func (r *redisState) RecordSlackUserID(jira_username, slack_id string, expiry time.Duration) error {
+	sc := r.client.Set(slack_user_id_key(jira_username), slack_id, expiry)
+	return sc.Err()
+}
+
+func (r *redisState) GetSlackUserID(jira_username string) (string, bool, error) {
+	sc := r.client.Get(slack_user_id_key(jira_username))
 	err := sc.Err()
 	if err != nil && err == redis.Nil {
 		// No key found
@@ -107,3 +301,177 @@ func (r *redisState) GetUserImageURL(username string) (string, bool, error) {
 	val, err := sc.Result()
 	return val, true, err
 }
+
+func jira_username_key(slack_id string) string {
+	return "jira-username-" + slack_id
+}
+
+func (r *redisState) RecordJiraUsername(slack_id, jira_username string, expiry time.Duration) error {
+	return r.set_json(jira_username_key(slack_id), jira_username, expiry)
+}
+
+func (r *redisState) GetJiraUsername(slack_id string) (string, bool, error) {
+	var username string
+	ok, err := r.get_json(jira_username_key(slack_id), &username)
+	return username, ok, err
+}
+
+const dm_opt_out_key = "dm-opt-out"
+
+func (r *redisState) SetDirectMessageOptOut(slack_id string, opt_out bool) error {
+	var ic *redis.IntCmd
+	if opt_out {
+		ic = r.client.SAdd(dm_opt_out_key, slack_id)
+	} else {
+		ic = r.client.SRem(dm_opt_out_key, slack_id)
+	}
+	return ic.Err()
+}
+
+func (r *redisState) GetDirectMessageOptOut(slack_id string) (bool, error) {
+	bc := r.client.SIsMember(dm_opt_out_key, slack_id)
+	return bc.Result()
+}
+
+func watchers_key(issue string) string {
+	return "watchers-" + issue
+}
+
+func watching_key(slack_id string) string {
+	return "watching-" + slack_id
+}
+
+func (r *redisState) AddWatch(issue, slack_id string) error {
+	if ic := r.client.SAdd(watchers_key(issue), slack_id); ic.Err() != nil {
+		return ic.Err()
+	}
+	return r.client.SAdd(watching_key(slack_id), issue).Err()
+}
+
+func (r *redisState) RemoveWatch(issue, slack_id string) error {
+	if ic := r.client.SRem(watchers_key(issue), slack_id); ic.Err() != nil {
+		return ic.Err()
+	}
+	return r.client.SRem(watching_key(slack_id), issue).Err()
+}
+
+func (r *redisState) GetIssueWatchers(issue string) ([]string, error) {
+	return r.client.SMembers(watchers_key(issue)).Result()
+}
+
+func (r *redisState) GetWatchedIssues(slack_id string) ([]string, error) {
+	return r.client.SMembers(watching_key(slack_id)).Result()
+}
+
+func mute_key(channel string) string {
+	return "mute-" + strings.TrimPrefix(channel, "#")
+}
+
+// Mutes expire when they end, so there's nothing to clean up
+func (r *redisState) MuteChannel(channel string, until time.Time) error {
+	expiry := until.Sub(time.Now())
+	if expiry <= 0 {
+		return r.UnmuteChannel(channel)
+	}
+	return r.set_json(mute_key(channel), until, expiry)
+}
+
+func (r *redisState) UnmuteChannel(channel string) error {
+	return r.client.Del(mute_key(channel)).Err()
+}
+
+func (r *redisState) GetChannelMute(channel string) (time.Time, bool, error) {
+	var until time.Time
+	ok, err := r.get_json(mute_key(channel), &until)
+	return until, ok, err
+}
+
+// Subscriptions are kept in a hash of ID to JSON, so they can all be read at
+// once. IDs count up, so they are short enough to type.
+const (
+	subscriptions_key   = "subscriptions"
+	subscription_id_key = "subscription-id"
+)
+
+func (r *redisState) AddSubscription(s Subscription) (string, error) {
+	n, err := r.client.Incr(subscription_id_key).Result()
+	if err != nil {
+		return "", err
+	}
+	s.ID = strconv.FormatInt(n, 10)
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	return s.ID, r.client.HSet(subscriptions_key, s.ID, string(b)).Err()
+}
+
+func (r *redisState) RemoveSubscription(id string) (bool, error) {
+	n, err := r.client.HDel(subscriptions_key, id).Result()
+	return n != 0, err
+}
+
+func (r *redisState) GetSubscriptions() ([]Subscription, error) {
+	all, err := r.client.HGetAllMap(subscriptions_key).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var subscriptions []Subscription
+	for id, val := range all {
+		var s Subscription
+		if err := json.Unmarshal([]byte(val), &s); err != nil {
+			// e.g. a list of subscriptions for a channel, as they were once
+			// kept, which shouldn't stop the others being used
+			log.LogF("Skipping bad subscription %s: %s", id, err)
+			continue
+		}
+		if s.Expired(now) {
+			if err := r.client.HDel(subscriptions_key, id).Err(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		subscriptions = append(subscriptions, s)
+	}
+
+	sort.Sort(by_created(subscriptions))
+	return subscriptions, nil
+}
+
+// Sorts subscriptions in the order they were made
+type by_created []Subscription
+
+func (s by_created) Len() int           { return len(s) }
+func (s by_created) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s by_created) Less(i, j int) bool { return s[i].Created.Before(s[j].Created) }
+
+func (r *redisState) set_json(key string, v interface{}, expiry time.Duration) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	sc := r.client.Set(key, string(b), expiry)
+	return sc.Err()
+}
+
+func (r *redisState) get_json(key string, into interface{}) (bool, error) {
+	sc := r.client.Get(key)
+	err := sc.Err()
+	if err != nil && err == redis.Nil {
+		// No key found
+		return false, nil
+	} else if err != nil {
+		// Error looking up key
+		return false, err
+	}
+
+	val, err := sc.Result()
+	if err != nil {
+		return false, err
+	}
+
+	return true, json.Unmarshal([]byte(val), into)
+}
@@ -26,7 +26,7 @@ func test_state(t *testing.T) State {
 func TestState(t *testing.T) {
 	s := test_state(t)
 
-	ev := Event{time.Now().AddDate(0, -1, 0).Unix(), "blah blah"}
+	ev := Event{"blah blah"}
 
 	err := s.RecordLastEvent(ev)
 	if err != nil {
@@ -39,9 +39,268 @@ func TestState(t *testing.T) {
 	} else if !ok {
 		t.Errorf("No last event found")
 		t.Fatal(err)
-	} else if ev2.TimestampSecs != ev.TimestampSecs {
-		t.Fatal("Timestamps do not match")
 	} else if ev2.Id != ev.Id {
 		t.Fatal("Ids do not match")
 	}
 }
+
+func TestUserImages(t *testing.T) {
+	s := test_state(t)
+
+	image := UserImage{
+		URL:     "https://cdn.example.com/users/images/0a1b.png",
+		Source:  "https://jira.example.com/secure/useravatar?ownerId=jane&avatarId=10500",
+		Path:    "users/images/0a1b.png",
+		Expires: time.Unix(1500000000, 0),
+	}
+	if err := s.RecordUserImage("jane doe", image, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	got, ok, err := s.GetUserImage("jane doe")
+	if err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("No image found")
+	} else if got.URL != image.URL || got.Source != image.Source || got.Path != image.Path || !got.Expires.Equal(image.Expires) {
+		t.Errorf("Expected %+v, got %+v", image, got)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	if _, ok, err := s.GetUserImage("jane doe"); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Errorf("Expected the image to have expired")
+	}
+}
+
+func TestThreads(t *testing.T) {
+	s := test_state(t)
+
+	parent := SlackMessage{"C012AB3CD", "1405894322.002768"}
+	if err := s.RecordThread("#team-yoda-jira", "LRN-115", parent, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	got, ok, err := s.GetThread("team-yoda-jira", "LRN-115")
+	if err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("No thread found")
+	} else if got != parent {
+		t.Fatalf("Expected thread %v, got %v", parent, got)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+
+	if _, ok, err := s.GetThread("team-yoda-jira", "LRN-115"); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("Expected thread to have expired")
+	}
+}
+
+func TestCards(t *testing.T) {
+	s := test_state(t)
+
+	card := SlackMessage{"C012AB3CD", "1405894322.002768"}
+	if err := s.RecordCard("team-yoda-jira", "LRN-115", card); err != nil {
+		t.Fatal(err)
+	}
+
+	got, ok, err := s.GetCard("#team-yoda-jira", "LRN-115")
+	if err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("No card found")
+	} else if got != card {
+		t.Fatalf("Expected card %v, got %v", card, got)
+	}
+}
+
+func TestDigestItems(t *testing.T) {
+	s := test_state(t)
+
+	type item struct {
+		Key string `json:"key"`
+	}
+
+	for _, key := range []string{"LRN-1", "LRN-2"} {
+		if err := s.AddDigestItem("managers", item{key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var items []item
+	if err := s.TakeDigestItems("#managers", &items); err != nil {
+		t.Fatal(err)
+	} else if len(items) != 2 || items[0].Key != "LRN-1" || items[1].Key != "LRN-2" {
+		t.Fatalf("Unexpected digest items %v", items)
+	}
+
+	items = nil
+	if err := s.TakeDigestItems("managers", &items); err != nil {
+		t.Fatal(err)
+	} else if len(items) != 0 {
+		t.Fatalf("Expected digest items to have been taken, got %v", items)
+	}
+
+	at := time.Date(2016, 5, 10, 9, 0, 0, 0, time.UTC)
+	if err := s.RecordLastDigest("managers", at); err != nil {
+		t.Fatal(err)
+	}
+	if last, ok, err := s.GetLastDigest("managers"); err != nil {
+		t.Fatal(err)
+	} else if !ok || !last.Equal(at) {
+		t.Fatalf("Expected last digest at %s, got %s", at, last)
+	}
+}
+
+func TestSlackCheck(t *testing.T) {
+	s := test_state(t)
+
+	if _, ok, err := s.GetSlackCheck("abc123"); err != nil || ok {
+		t.Fatalf("Expected no check yet, got %v, %v", ok, err)
+	}
+	at := time.Date(2016, 5, 10, 9, 0, 0, 0, time.UTC)
+	if err := s.RecordSlackCheck("abc123", at, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if checked, ok, err := s.GetSlackCheck("abc123"); err != nil || !ok || !checked.Equal(at) {
+		t.Fatalf("Expected a check at %s, got %s, %v, %v", at, checked, ok, err)
+	}
+	if _, ok, err := s.GetSlackCheck("def456"); err != nil || ok {
+		t.Fatalf("Expected no check for another config, got %v, %v", ok, err)
+	}
+}
+
+func TestDirectMessageOptOut(t *testing.T) {
+	s := test_state(t)
+
+	for _, opt_out := range []bool{true, false} {
+		if err := s.SetDirectMessageOptOut("U012AB3CD", opt_out); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := s.GetDirectMessageOptOut("U012AB3CD"); err != nil {
+			t.Fatal(err)
+		} else if got != opt_out {
+			t.Fatalf("Expected opt out to be %v, got %v", opt_out, got)
+		}
+	}
+}
+
+func TestJiraUsernames(t *testing.T) {
+	s := test_state(t)
+
+	if err := s.RecordJiraUsername("U012AB3CD", "jane", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if name, ok, err := s.GetJiraUsername("U012AB3CD"); err != nil {
+		t.Fatal(err)
+	} else if !ok || name != "jane" {
+		t.Errorf("Expected jane, got %q (%v)", name, ok)
+	}
+
+	if _, ok, err := s.GetJiraUsername("U_UNKNOWN"); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Errorf("Expected no username for an unknown user")
+	}
+}
+
+func TestWatches(t *testing.T) {
+	s := test_state(t)
+
+	if err := s.AddWatch("LRN-123", "U012AB3CD"); err != nil {
+		t.Fatal(err)
+	}
+	if watchers, err := s.GetIssueWatchers("LRN-123"); err != nil {
+		t.Fatal(err)
+	} else if len(watchers) != 1 || watchers[0] != "U012AB3CD" {
+		t.Errorf("Expected U012AB3CD watching, got %v", watchers)
+	}
+	if issues, err := s.GetWatchedIssues("U012AB3CD"); err != nil {
+		t.Fatal(err)
+	} else if len(issues) != 1 || issues[0] != "LRN-123" {
+		t.Errorf("Expected LRN-123 watched, got %v", issues)
+	}
+
+	if err := s.RemoveWatch("LRN-123", "U012AB3CD"); err != nil {
+		t.Fatal(err)
+	}
+	if watchers, err := s.GetIssueWatchers("LRN-123"); err != nil {
+		t.Fatal(err)
+	} else if len(watchers) != 0 {
+		t.Errorf("Expected no watchers, got %v", watchers)
+	}
+}
+
+func TestChannelMutes(t *testing.T) {
+	s := test_state(t)
+
+	until := time.Now().Add(time.Minute).Truncate(time.Second)
+	if err := s.MuteChannel("#team-yoda-jira", until); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok, err := s.GetChannelMute("team-yoda-jira"); err != nil {
+		t.Fatal(err)
+	} else if !ok || !got.Equal(until) {
+		t.Errorf("Expected muted until %s, got %s (%v)", until, got, ok)
+	}
+
+	if err := s.UnmuteChannel("team-yoda-jira"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := s.GetChannelMute("team-yoda-jira"); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Errorf("Expected the channel to be unmuted")
+	}
+}
+
+func TestSubscriptions(t *testing.T) {
+	s := test_state(t)
+
+	now := time.Now()
+	trigger := config.MessageTrigger{SlackChannel: "C1", Match: map[string]string{"priority": "Blocker"}}
+	id, err := s.AddSubscription(Subscription{Trigger: trigger, Owner: "U012AB3CD", Created: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := s.AddSubscription(Subscription{Trigger: trigger, Owner: "U012AB3CD", Created: now, Expires: now.Add(-time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id == expired {
+		t.Errorf("Expected subscriptions to get different IDs, got %s", id)
+	}
+
+	// Subscriptions kept as lists for each channel are skipped
+	legacy := s.(*redisState).client.HSet(subscriptions_key, "C1", `[{"fields": {"priority": "Blocker"}, "by": "U012AB3CD"}]`)
+	if err := legacy.Err(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.(*redisState).client.HDel(subscriptions_key, "C1")
+
+	if got, err := s.GetSubscriptions(); err != nil {
+		t.Fatal(err)
+	} else if len(got) != 1 || got[0].ID != id || got[0].Trigger.Match["priority"] != "Blocker" || got[0].Owner != "U012AB3CD" {
+		t.Errorf("Expected just the unexpired subscription, got %+v", got)
+	}
+
+	if removed, err := s.RemoveSubscription(id); err != nil {
+		t.Fatal(err)
+	} else if !removed {
+		t.Errorf("Expected subscription %s to be removed", id)
+	}
+	if removed, err := s.RemoveSubscription(id); err != nil {
+		t.Fatal(err)
+	} else if removed {
+		t.Errorf("Expected subscription %s to be gone already", id)
+	}
+	if got, err := s.GetSubscriptions(); err != nil {
+		t.Fatal(err)
+	} else if len(got) != 0 {
+		t.Errorf("Expected no subscriptions, got %+v", got)
+	}
+}
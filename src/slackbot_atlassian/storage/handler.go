@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"slackbot_atlassian/config"
+	"slackbot_atlassian/log"
+)
+
+// Serves stored objects at their paths, for the server to mount at the base
+// URL. There is only something to serve for the local driver, and for
+// signed URLs; otherwise this is nil.
+func Handler(cfg config.ResourceStorageConfig) (http.Handler, error) {
+	var c Client
+	switch {
+	case cfg.Driver == config.StorageLocal:
+		l, err := open_local(cfg)
+		if err != nil {
+			return nil, err
+		}
+		c = l
+	case cfg.Access == config.AccessSigned:
+		c = new_s3(cfg)
+	default:
+		return nil, nil
+	}
+	return &handler{cfg, c, time.Now}, nil
+}
+
+type handler struct {
+	cfg    config.ResourceStorageConfig
+	client Client
+	now    func() time.Time
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// There are no directory listings
+	path := r.URL.Path
+	if path == "" || strings.HasSuffix(path, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	cache_control := CacheControl
+	if h.cfg.Access == config.AccessSigned {
+		now := h.now()
+		expires, ok := check_signature(h.cfg.SigningKey, path, r.URL.Query(), now)
+		if !ok {
+			http.Error(w, "Invalid or expired signature", http.StatusForbidden)
+			return
+		}
+		cache_control = fmt.Sprintf("private, max-age=%d", int(expires.Sub(now).Seconds()))
+	}
+
+	rc, content_type, err := h.client.GetObject(path)
+	if err == ErrNotFound {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.LogF("Could not read object %s: %s", path, err)
+		http.Error(w, "Could not read object", http.StatusInternalServerError)
+		return
+	}
+	defer rc.Close()
+
+	w.Header().Set("Content-Type", content_type)
+	w.Header().Set("Cache-Control", cache_control)
+	if r.Method == "HEAD" {
+		return
+	}
+	if _, err := io.Copy(w, rc); err != nil {
+		log.LogF("Could not serve object %s: %s", path, err)
+	}
+}
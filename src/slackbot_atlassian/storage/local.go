@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"slackbot_atlassian/config"
+	"slackbot_atlassian/log"
+)
+
+// Keeps objects in a directory, which the server serves at the base URL. The
+// server works out content types from the paths' extensions.
+type local struct {
+	dir      string
+	base_url string
+}
+
+func new_local(cfg config.ResourceStorageConfig) (Client, error) {
+	l, err := open_local(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(l.dir, 0755); err != nil {
+		return nil, fmt.Errorf("Could not create storage directory: %s", err)
+	}
+	return l, nil
+}
+
+// The local directory, which may not exist yet
+func open_local(cfg config.ResourceStorageConfig) (*local, error) {
+	dir, err := filepath.Abs(cfg.Directory)
+	if err != nil {
+		return nil, err
+	}
+	return &local{dir, cfg.BaseURL}, nil
+}
+
+// The file an object is kept in, which must be in the directory
+func (l *local) file(path string) (string, error) {
+	file := filepath.Join(l.dir, filepath.FromSlash(path))
+	if !strings.HasPrefix(file, l.dir+string(filepath.Separator)) {
+		return "", fmt.Errorf("Invalid path %q", path)
+	}
+	return file, nil
+}
+
+func (l *local) PutObject(rdr io.Reader, path, content_type string) error {
+	log.LogF("Putting object to %s", path)
+	file, err := l.file(path)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so a half-written object is never
+	// served
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, rdr); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+func (l *local) GetFullURL(path string) (string, time.Time, error) {
+	return l.base_url + "/" + path, time.Time{}, nil
+}
+
+func (l *local) GetObject(path string) (io.ReadCloser, string, error) {
+	file, err := l.file(path)
+	if err != nil {
+		return nil, "", ErrNotFound
+	}
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, "", ErrNotFound
+	} else if err != nil {
+		return nil, "", err
+	}
+	if info, err := f.Stat(); err != nil || info.IsDir() {
+		f.Close()
+		return nil, "", ErrNotFound
+	}
+
+	content_type := mime.TypeByExtension(filepath.Ext(file))
+	if content_type == "" {
+		content_type = "application/octet-stream"
+	}
+	return f, content_type, nil
+}
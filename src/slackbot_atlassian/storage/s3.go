@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"slackbot_atlassian/config"
+	"slackbot_atlassian/log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+func new_s3(cfg config.ResourceStorageConfig) Client {
+	c := aws.NewConfig()
+
+	c.WithRegion(cfg.S3_Region)
+	c.WithCredentialsChainVerboseErrors(true)
+	// Without static keys the session uses the default credential chain
+	if cfg.AWS_Access_Key_ID != "" {
+		c.WithCredentials(credentials.NewStaticCredentials(cfg.AWS_Access_Key_ID, cfg.AWS_Secret_Access_Key, ""))
+	}
+	if cfg.S3_Endpoint != "" {
+		c.WithEndpoint(cfg.S3_Endpoint)
+		c.WithS3ForcePathStyle(!cfg.S3_VirtualHosted)
+	}
+
+	session := session.New(c)
+
+	return &s3_client{
+		cfg:      cfg,
+		s3:       s3.New(session),
+		uploader: s3manager.NewUploader(session),
+	}
+}
+
+type s3_client struct {
+	cfg      config.ResourceStorageConfig
+	s3       *s3.S3
+	uploader *s3manager.Uploader
+}
+
+func (c *s3_client) PutObject(rdr io.Reader, path, content_type string) error {
+	log.LogF("Putting object to %s", path)
+	acl := "private"
+	if c.cfg.Access == config.AccessPublic {
+		acl = "public-read"
+	}
+	cache_control := CacheControl
+	_, err := c.uploader.Upload(&s3manager.UploadInput{
+		ACL:          &acl,
+		Bucket:       &c.cfg.S3_Bucket,
+		Key:          &path,
+		Body:         rdr,
+		ContentType:  &content_type,
+		CacheControl: &cache_control,
+	})
+	return err
+}
+
+func (c *s3_client) GetFullURL(path string) (string, time.Time, error) {
+	if c.cfg.Access != config.AccessPresigned {
+		return s3_url(c.cfg, path), time.Time{}, nil
+	}
+
+	expiry := c.cfg.GetURLExpiry()
+	expires := time.Now().Add(expiry)
+	req, _ := c.s3.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: &c.cfg.S3_Bucket,
+		Key:    &path,
+	})
+	url, err := req.Presign(expiry)
+	return url, expires, err
+}
+
+func (c *s3_client) GetObject(path string) (io.ReadCloser, string, error) {
+	out, err := c.s3.GetObject(&s3.GetObjectInput{
+		Bucket: &c.cfg.S3_Bucket,
+		Key:    &path,
+	})
+	if failure, ok := err.(awserr.RequestFailure); ok && failure.StatusCode() == http.StatusNotFound {
+		return nil, "", ErrNotFound
+	} else if err != nil {
+		return nil, "", err
+	}
+	return out.Body, aws.StringValue(out.ContentType), nil
+}
+
+// Where an object can be found: under the base URL (e.g. a CDN), or in the
+// bucket on AWS or the S3-compatible endpoint
+func s3_url(cfg config.ResourceStorageConfig, path string) string {
+	switch {
+	case cfg.BaseURL != "":
+		return cfg.BaseURL + "/" + path
+	case cfg.S3_Endpoint != "":
+		endpoint, _ := url.Parse(cfg.S3_Endpoint)
+		if cfg.S3_VirtualHosted {
+			return fmt.Sprintf("%s://%s.%s/%s", endpoint.Scheme, cfg.S3_Bucket, endpoint.Host, path)
+		}
+		return fmt.Sprintf("%s://%s/%s/%s", endpoint.Scheme, endpoint.Host, cfg.S3_Bucket, path)
+	case cfg.S3_VirtualHosted:
+		return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", cfg.S3_Bucket, cfg.S3_Region, path)
+	default:
+		return fmt.Sprintf("https://s3-%s.amazonaws.com/%s/%s", cfg.S3_Region, cfg.S3_Bucket, path)
+	}
+}
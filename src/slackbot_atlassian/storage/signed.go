@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"slackbot_atlassian/config"
+)
+
+// Hands out URLs to the bot's server, signed with the signing key, rather
+// than to where objects are kept, which needn't be public
+type signed struct {
+	Client
+	cfg config.ResourceStorageConfig
+}
+
+func (s signed) GetFullURL(path string) (string, time.Time, error) {
+	url, expires := signed_url(s.cfg, path, time.Now())
+	return url, expires, nil
+}
+
+func signature(key, path string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "%s\n%d", path, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// A URL for a path under the base URL that works for the URL expiry
+func signed_url(cfg config.ResourceStorageConfig, path string, now time.Time) (string, time.Time) {
+	expires := now.Add(cfg.GetURLExpiry()).Unix()
+	query := url.Values{
+		"expires":   {strconv.FormatInt(expires, 10)},
+		"signature": {signature(cfg.SigningKey, path, expires)},
+	}
+	return cfg.BaseURL + "/" + path + "?" + query.Encode(), time.Unix(expires, 0)
+}
+
+// Check a signed URL's query for a path, returning when it expires
+func check_signature(key, path string, query url.Values, now time.Time) (time.Time, bool) {
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || now.Unix() >= expires {
+		return time.Time{}, false
+	}
+	expected := signature(key, path, expires)
+	if !hmac.Equal([]byte(query.Get("signature")), []byte(expected)) {
+		return time.Time{}, false
+	}
+	return time.Unix(expires, 0), true
+}
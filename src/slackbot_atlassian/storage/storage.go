@@ -1,68 +1,52 @@
 package storage
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"time"
 
 	"slackbot_atlassian/config"
-	"slackbot_atlassian/log"
-
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
-type Client interface {
-	PutObject(io.Reader, string) error
-
-	GetFullURL(string) string
-}
-
-func New(cfg config.ResourceStorageConfig) Client {
-	providers := []credentials.Provider{
-		&credentials.StaticProvider{
-			Value: credentials.Value{
-				AccessKeyID:     cfg.AWS_Access_Key_ID,
-				SecretAccessKey: cfg.AWS_Secret_Access_Key,
-			},
-		},
-	}
-
-	c := aws.NewConfig()
+// How long stored objects may be cached for. Objects are stored under a hash
+// of their content, so they never change.
+const CacheControl = "public, max-age=31536000, immutable"
 
-	c.WithRegion(cfg.S3_Region)
-	c.WithCredentialsChainVerboseErrors(true)
-	c.WithCredentials(credentials.NewChainCredentials(providers))
+var ErrNotFound = errors.New("No such object")
 
-	session := session.New(c)
+type Client interface {
+	// Store an object at a path, with its content type
+	PutObject(rdr io.Reader, path, content_type string) error
 
-	return &client{
-		cfg:      cfg,
-		s3:       s3.New(session),
-		uploader: s3manager.NewUploader(session),
-	}
-}
+	// The URL an object can be fetched from, and when that stops working, or
+	// the zero time if it doesn't
+	GetFullURL(path string) (string, time.Time, error)
 
-type client struct {
-	cfg      config.ResourceStorageConfig
-	s3       *s3.S3
-	uploader *s3manager.Uploader
+	// Read an object, returning its content type, or ErrNotFound
+	GetObject(path string) (io.ReadCloser, string, error)
 }
 
-func (c *client) PutObject(rdr io.Reader, path string) error {
-	log.LogF("Putting object to %s", path)
-	acl := "public-read"
-	_, err := c.uploader.Upload(&s3manager.UploadInput{
-		ACL:    &acl,
-		Bucket: &c.cfg.S3_Bucket,
-		Key:    &path,
-		Body:   rdr,
-	})
-	return err
-}
+// A client for the configured driver, or nil for the none driver, where
+// nothing is stored
+func New(cfg config.ResourceStorageConfig) (Client, error) {
+	var c Client
+	switch cfg.Driver {
+	case config.StorageS3:
+		c = new_s3(cfg)
+	case config.StorageLocal:
+		var err error
+		if c, err = new_local(cfg); err != nil {
+			return nil, err
+		}
+	case config.StorageNone:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("Unknown storage driver %q", cfg.Driver)
+	}
 
-func (c *client) GetFullURL(path string) string {
-	return fmt.Sprintf("https://s3-%s.amazonaws.com/%s/%s", c.cfg.S3_Region, c.cfg.S3_Bucket, path)
+	if cfg.Access == config.AccessSigned {
+		c = signed{c, cfg}
+	}
+	return c, nil
 }
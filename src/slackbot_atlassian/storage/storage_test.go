@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"slackbot_atlassian/config"
+)
+
+func TestS3URL(t *testing.T) {
+	cases := []struct {
+		cfg      config.ResourceStorageConfig
+		expected string
+	}{
+		{
+			config.ResourceStorageConfig{S3_Bucket: "images", S3_Region: "eu-west-1"},
+			"https://s3-eu-west-1.amazonaws.com/images/users/images/jane",
+		},
+		{
+			config.ResourceStorageConfig{S3_Bucket: "images", S3_Region: "eu-west-1", S3_VirtualHosted: true},
+			"https://images.s3.eu-west-1.amazonaws.com/users/images/jane",
+		},
+		{
+			config.ResourceStorageConfig{S3_Bucket: "images", S3_Endpoint: "http://minio.local:9000"},
+			"http://minio.local:9000/images/users/images/jane",
+		},
+		{
+			config.ResourceStorageConfig{S3_Bucket: "images", S3_Endpoint: "https://ceph.example.com", S3_VirtualHosted: true},
+			"https://images.ceph.example.com/users/images/jane",
+		},
+		{
+			config.ResourceStorageConfig{S3_Bucket: "images", S3_Region: "eu-west-1", BaseURL: "https://cdn.example.com/bot"},
+			"https://cdn.example.com/bot/users/images/jane",
+		},
+	}
+
+	for _, c := range cases {
+		if url := s3_url(c.cfg, "users/images/jane"); url != c.expected {
+			t.Errorf("%+v: expected %s, got %s", c.cfg, c.expected, url)
+		}
+	}
+}
+
+func TestLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	client, err := New(config.ResourceStorageConfig{Driver: config.StorageLocal, Directory: filepath.Join(dir, "resources"), BaseURL: "https://bot.example.com/resources"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.PutObject(strings.NewReader("image"), "users/images/jane.png", "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.PutObject(strings.NewReader("new image"), "users/images/jane.png", "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "resources", "users", "images", "jane.png"))
+	if err != nil || string(data) != "new image" {
+		t.Errorf("Expected the new image to be stored, got %q (%v)", data, err)
+	}
+	if url, expires, err := client.GetFullURL("users/images/jane.png"); url != "https://bot.example.com/resources/users/images/jane.png" || !expires.IsZero() || err != nil {
+		t.Errorf("Unexpected URL %s (expiring %s, %v)", url, expires, err)
+	}
+
+	if err := client.PutObject(strings.NewReader("image"), "../outside", "image/png"); err == nil {
+		t.Errorf("Expected an error storing outside the directory")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "outside")); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing to be stored outside the directory")
+	}
+}
+
+func TestNone(t *testing.T) {
+	client, err := New(config.ResourceStorageConfig{Driver: config.StorageNone})
+	if err != nil || client != nil {
+		t.Errorf("Expected no client, got %v (%v)", client, err)
+	}
+}
+
+func TestPresignedURL(t *testing.T) {
+	cfg, err := config.LoadConfig(strings.NewReader(`{"resource_storage": {
+		"s3_bucket": "images", "s3_region": "us-east-1", "aws_key": "AKID", "aws_secret": "SECRET",
+		"access": "presigned", "url_expiry": "48h"
+	}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := New(cfg.ResourceStorage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	presigned, expires, err := client.GetFullURL("users/images/jane.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(presigned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(u.Path, "/users/images/jane.png") || u.Query().Get("X-Amz-Signature") == "" || u.Query().Get("X-Amz-Expires") != "172800" {
+		t.Errorf("Expected a presigned URL for two days, got %s", presigned)
+	}
+	if d := expires.Sub(time.Now()); d < 47*time.Hour || d > 48*time.Hour {
+		t.Errorf("Expected the URL to expire in two days, got %s", expires)
+	}
+}
+
+func TestSigned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg, err := config.LoadConfig(strings.NewReader(fmt.Sprintf(`{"resource_storage": {
+		"driver": "local", "directory": %q, "base_url": "https://bot.example.com/resources",
+		"access": "signed", "signing_key": "s3cret", "url_expiry": "1h"
+	}}`, dir)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := New(cfg.ResourceStorage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.PutObject(strings.NewReader("image"), "users/images/jane.png", "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	signed, expires, err := client.GetFullURL("users/images/jane.png")
+	if err != nil || !strings.HasPrefix(signed, "https://bot.example.com/resources/users/images/jane.png?") || expires.Before(time.Now().Add(59*time.Minute)) {
+		t.Fatalf("Expected a signed URL for an hour, got %s (expiring %s, %v)", signed, expires, err)
+	}
+
+	h, err := Handler(cfg.ResourceStorage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(u string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", strings.TrimPrefix(u, "https://bot.example.com/resources"), nil)
+		http.StripPrefix("/", h).ServeHTTP(w, r)
+		return w
+	}
+
+	w := get(signed)
+	if w.Code != http.StatusOK || w.Body.String() != "image" {
+		t.Errorf("Expected the image, got %d %q", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Content-Type") != "image/png" || !strings.HasPrefix(w.Header().Get("Cache-Control"), "private, max-age=") {
+		t.Errorf("Unexpected headers %v", w.Header())
+	}
+
+	expired, _ := signed_url(cfg.ResourceStorage, "users/images/jane.png", time.Now().Add(-2*time.Hour))
+	other, _ := signed_url(cfg.ResourceStorage, "users/images/bob.png", time.Now())
+	for _, u := range []string{
+		"https://bot.example.com/resources/users/images/jane.png",
+		strings.Replace(signed, "signature=", "signature=0", 1),
+		expired,
+		strings.Replace(other, "bob", "jane", 1),
+	} {
+		if w := get(u); w.Code != http.StatusForbidden {
+			t.Errorf("%s: expected status 403, got %d", u, w.Code)
+		}
+	}
+	if w := get(other); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for a missing image, got %d", w.Code)
+	}
+}
+
+func TestNoHandler(t *testing.T) {
+	for _, cfg := range []config.ResourceStorageConfig{
+		{Driver: config.StorageNone, Access: config.AccessPublic},
+		{Driver: config.StorageS3, S3_Bucket: "images", Access: config.AccessPublic},
+		{Driver: config.StorageS3, S3_Bucket: "images", Access: config.AccessPresigned},
+	} {
+		if h, err := Handler(cfg); h != nil || err != nil {
+			t.Errorf("%+v: expected nothing to serve, got %v (%v)", cfg, h, err)
+		}
+	}
+}
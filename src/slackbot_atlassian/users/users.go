@@ -0,0 +1,127 @@
+package users
+
+import (
+	"time"
+
+	"slackbot_atlassian/atlassian"
+	"slackbot_atlassian/config"
+	"slackbot_atlassian/log"
+	"slackbot_atlassian/slack"
+	"slackbot_atlassian/state"
+)
+
+// How long to remember the Slack user found (or not found) for a Jira user
+const (
+	found_expiry     = 24 * time.Hour
+	not_found_expiry = time.Hour
+)
+
+// Maps Jira users to Slack users and back
+type Mapper interface {
+	// Find the Slack user ID for a Jira user
+	SlackUserID(atlassian.User) (string, bool, error)
+
+	// Find the Jira username for a Slack user
+	JiraUsername(slack_id string) (string, bool, error)
+}
+
+// Create a mapper that looks users up, in order, in the Slack config, in
+// the state cache, and by email address in Slack (or Jira). Jira users
+// without an email address are looked up in Jira to find it.
+func New(cfg config.SlackConfig, slack_client slack.Slack, state_client state.State, atl atlassian.Atlassian) Mapper {
+	return &mapper{cfg, slack_client, state_client, atl}
+}
+
+type mapper struct {
+	cfg          config.SlackConfig
+	slack_client slack.Slack
+	state_client state.State
+	atl          atlassian.Atlassian
+}
+
+func (m *mapper) SlackUserID(user atlassian.User) (string, bool, error) {
+	if user.Name == "" {
+		return "", false, nil
+	}
+
+	// Explicit config wins
+	if slack_user, ok := m.cfg.Users[user.Name]; ok && slack_user.ID != "" {
+		return slack_user.ID, true, nil
+	}
+
+	id, ok, err := m.state_client.GetSlackUserID(user.Name)
+	if err != nil {
+		log.LogF("Could not retrieve Slack user for %s in Redis: %s", user.Name, err)
+	} else if ok {
+		return id, id != "", nil
+	}
+
+	// People mentioned in comments only come with their name
+	if user.EmailAddress == "" && m.atl != nil {
+		found, ok, err := m.atl.GetUser(user.Name)
+		if err != nil {
+			return "", false, err
+		} else if ok {
+			user.EmailAddress = found.EmailAddress
+		}
+	}
+
+	id, ok = "", false
+	if user.EmailAddress != "" {
+		id, ok, err = m.slack_client.LookupUserByEmail(user.EmailAddress)
+		if err != nil {
+			return "", false, err
+		}
+	}
+
+	expiry := found_expiry
+	if !ok {
+		expiry = not_found_expiry
+	}
+	if err := m.state_client.RecordSlackUserID(user.Name, id, expiry); err != nil {
+		log.LogF("Failed to save Slack user for %s: %s", user.Name, err)
+	}
+
+	return id, ok, nil
+}
+
+func (m *mapper) JiraUsername(slack_id string) (string, bool, error) {
+	if slack_id == "" {
+		return "", false, nil
+	}
+
+	for name, slack_user := range m.cfg.Users {
+		if slack_user.ID == slack_id {
+			return name, true, nil
+		}
+	}
+
+	name, ok, err := m.state_client.GetJiraUsername(slack_id)
+	if err != nil {
+		log.LogF("Could not retrieve Jira user for %s in Redis: %s", slack_id, err)
+	} else if ok {
+		return name, name != "", nil
+	}
+
+	email, ok, err := m.slack_client.GetUserEmail(slack_id)
+	if err != nil {
+		return "", false, err
+	}
+	var user atlassian.User
+	if ok {
+		user, ok, err = m.atl.FindUserByEmail(email)
+		if err != nil {
+			return "", false, err
+		}
+	}
+
+	expiry := found_expiry
+	if !ok {
+		expiry = not_found_expiry
+	}
+	if err := m.state_client.RecordJiraUsername(slack_id, user.Name, expiry); err != nil {
+		log.LogF("Failed to save Jira user for %s: %s", slack_id, err)
+	}
+
+	return user.Name, ok, nil
+}
@@ -0,0 +1,124 @@
+package users
+
+import (
+	"testing"
+	"time"
+
+	"slackbot_atlassian/atlassian"
+	"slackbot_atlassian/config"
+	"slackbot_atlassian/slack"
+	"slackbot_atlassian/state"
+)
+
+// Caches Slack users in memory, remembering how long for
+type fake_state struct {
+	state.State
+	slack_ids map[string]string
+	expiries  map[string]time.Duration
+}
+
+func (f *fake_state) RecordSlackUserID(jira_username, slack_id string, expiry time.Duration) error {
+	f.slack_ids[jira_username] = slack_id
+	f.expiries[jira_username] = expiry
+	return nil
+}
+
+func (f *fake_state) GetSlackUserID(jira_username string) (string, bool, error) {
+	id, ok := f.slack_ids[jira_username]
+	return id, ok, nil
+}
+
+// Finds Slack users by email, counting the lookups
+type fake_slack struct {
+	slack.Slack
+	emails  map[string]string
+	lookups int
+}
+
+func (f *fake_slack) LookupUserByEmail(email string) (string, bool, error) {
+	f.lookups++
+	id, ok := f.emails[email]
+	return id, ok, nil
+}
+
+// Knows the email addresses of Jira users
+type fake_atlassian struct {
+	atlassian.Atlassian
+	emails map[string]string
+}
+
+func (f fake_atlassian) GetUser(username string) (atlassian.User, bool, error) {
+	email, ok := f.emails[username]
+	return atlassian.User{Name: username, EmailAddress: email}, ok, nil
+}
+
+func test_mapper() (Mapper, *fake_state, *fake_slack) {
+	cfg := config.SlackConfig{Users: map[string]config.SlackUser{"bob": {ID: "UBOB"}}}
+	st := &fake_state{slack_ids: make(map[string]string), expiries: make(map[string]time.Duration)}
+	slack_client := &fake_slack{emails: map[string]string{"jane@example.com": "UJANE"}}
+	atl := fake_atlassian{emails: map[string]string{"jane": "jane@example.com"}}
+	return New(cfg, slack_client, st, atl), st, slack_client
+}
+
+func TestSlackUserIDForMentions(t *testing.T) {
+	m, st, _ := test_mapper()
+
+	// Mentions only give the name, so the email comes from Jira
+	if id, ok, err := m.SlackUserID(atlassian.User{Name: "jane"}); err != nil || !ok || id != "UJANE" {
+		t.Errorf("Expected UJANE for a mention of jane, got %q, %v, %v", id, ok, err)
+	}
+	if st.slack_ids["jane"] != "UJANE" || st.expiries["jane"] != found_expiry {
+		t.Errorf("Expected jane to be cached, got %v and %v", st.slack_ids, st.expiries)
+	}
+
+	if _, ok, err := m.SlackUserID(atlassian.User{Name: "nobody"}); err != nil || ok {
+		t.Errorf("Expected nobody not to be found, got %v, %v", ok, err)
+	}
+	if id, ok := st.slack_ids["nobody"]; !ok || id != "" || st.expiries["nobody"] != not_found_expiry {
+		t.Errorf("Expected nobody to be cached as not found, got %v and %v", st.slack_ids, st.expiries)
+	}
+}
+
+func TestSlackUserID(t *testing.T) {
+	m, st, slack_client := test_mapper()
+
+	// Explicit config wins, without looking anywhere else
+	st.slack_ids["bob"] = "UOTHER"
+	if id, ok, err := m.SlackUserID(atlassian.User{Name: "bob", EmailAddress: "bob@example.com"}); err != nil || !ok || id != "UBOB" {
+		t.Errorf("Expected the configured UBOB, got %q, %v, %v", id, ok, err)
+	}
+
+	// Found by email, and then from the cache
+	jane := atlassian.User{Name: "jane", EmailAddress: "jane@example.com"}
+	for i := 0; i < 2; i++ {
+		if id, ok, err := m.SlackUserID(jane); err != nil || !ok || id != "UJANE" {
+			t.Errorf("Expected UJANE, got %q, %v, %v", id, ok, err)
+		}
+	}
+	if slack_client.lookups != 1 || st.expiries["jane"] != found_expiry {
+		t.Errorf("Expected one lookup cached for a day, got %d and %v", slack_client.lookups, st.expiries)
+	}
+
+	// Not found by email, which is cached for less time
+	sam := atlassian.User{Name: "sam", EmailAddress: "sam@example.com"}
+	for i := 0; i < 2; i++ {
+		if _, ok, err := m.SlackUserID(sam); err != nil || ok {
+			t.Errorf("Expected sam not to be found, got %v, %v", ok, err)
+		}
+	}
+	if slack_client.lookups != 2 || st.expiries["sam"] != not_found_expiry {
+		t.Errorf("Expected one lookup cached for an hour, got %d and %v", slack_client.lookups, st.expiries)
+	}
+
+	// Without an email (or a Jira user to find it), Slack isn't asked
+	if _, ok, err := m.SlackUserID(atlassian.User{Name: "ghost"}); err != nil || ok {
+		t.Errorf("Expected ghost not to be found, got %v, %v", ok, err)
+	}
+	if slack_client.lookups != 2 {
+		t.Errorf("Expected no lookup without an email, got %d", slack_client.lookups)
+	}
+
+	if _, ok, _ := m.SlackUserID(atlassian.User{}); ok {
+		t.Errorf("Expected a user without a name not to be found")
+	}
+}